@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/pdftext"
+	"librarymanagementsystem/internal/storage"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// runCommand runs a maintenance subcommand instead of starting the server.
+func runCommand(args []string) {
+	switch args[0] {
+	case "migrate":
+		migrate(args[1:])
+	case "reindex":
+		reindex()
+	case "scrub":
+		scrub()
+	case "rescan":
+		rescan()
+	default:
+		log.Fatalf("Unknown command %q (available: migrate, reindex, scrub, rescan)", args[0])
+	}
+}
+
+// migrate shows or changes the schema version of the database.
+//
+//	migrate status          list migrations and whether they are applied
+//	migrate up [version]    apply pending migrations, up to version if given
+//	migrate down [version]  revert migrations newer than version
+//	                        (default: revert the latest one)
+func migrate(args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		log.Fatal("Usage: migrate status|up [version]|down [version]")
+	}
+
+	database, err := db.OpenDatabase("library.db")
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer database.Close()
+
+	current, err := database.SchemaVersion()
+	if err != nil {
+		log.Fatal("Failed to read schema version:", err)
+	}
+
+	var target int
+	if len(args) == 2 {
+		target, err = strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			log.Fatalf("Invalid version %q", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := database.MigrationStatus()
+		if err != nil {
+			log.Fatal("Failed to read migration status:", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = status.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, applied, status.Description)
+		}
+		w.Flush()
+		fmt.Printf("\nSchema version %d of %d\n", current, db.LatestSchemaVersion())
+		return
+
+	case "up":
+		if len(args) == 1 {
+			target = db.LatestSchemaVersion()
+		}
+		err = database.MigrateUp(target)
+
+	case "down":
+		if len(args) == 1 {
+			target = current - 1
+		}
+		err = database.MigrateDown(target)
+
+	default:
+		log.Fatalf("Unknown migrate command %q", args[0])
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := database.SchemaVersion()
+	if err != nil {
+		log.Fatal("Failed to read schema version:", err)
+	}
+	log.Printf("Schema version %d (was %d)", version, current)
+}
+
+// reindex rebuilds the full-text search index from the PDFs in the blob
+// store, creating the index first if it's missing.
+func reindex() {
+	database, err := db.NewDatabase("library.db")
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer database.Close()
+
+	if err := database.CreateSearchIndex(); err != nil {
+		log.Fatal("Failed to create search index:", err)
+	}
+	if !database.FullTextSearchEnabled() {
+		log.Fatal("Full-text search is disabled: ", database.SearchIndexWarning())
+	}
+
+	if err := database.RebuildSearchIndex(); err != nil {
+		log.Fatal("Failed to rebuild search index:", err)
+	}
+
+	pdfs, err := database.GetAllPDFs()
+	if err != nil {
+		log.Fatal("Failed to fetch PDFs:", err)
+	}
+
+	store := newBlobStore()
+	failed := 0
+	for _, pdf := range pdfs {
+		pages, err := extractStoredPages(store, pdf.StorageKey)
+		if err != nil {
+			log.Printf("Skipping %q: %v", pdf.Title, err)
+			failed++
+			continue
+		}
+
+		if err := database.IndexPDFPages(pdf.ID, pages); err != nil {
+			log.Fatalf("Failed to index %q: %v", pdf.Title, err)
+		}
+		log.Printf("Indexed %q (%d pages)", pdf.Title, len(pages))
+	}
+
+	log.Printf("Reindexed %d of %d PDFs", len(pdfs)-failed, len(pdfs))
+}
+
+// scrub checks every stored file against its checksum now rather than
+// waiting for the server's daily scrub, and exits with status 1 if any file
+// is missing or corrupt.
+func scrub() {
+	database, err := db.NewDatabase("library.db")
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer database.Close()
+
+	libraryHandler := handlers.NewLibraryHandler(database, nil)
+	libraryHandler.SetBlobStore(newBlobStore())
+	damaged, err := libraryHandler.ScrubFiles(context.Background())
+	if err != nil {
+		log.Fatal("Failed to scrub files:", err)
+	}
+
+	if len(damaged) > 0 {
+		log.Fatalf("Files of %d PDFs are missing or corrupt", len(damaged))
+	}
+	log.Println("Every file matches its checksum")
+}
+
+// rescan scans every stored file with the clamd at CLAMD_ADDR, and exits
+// with status 1 if any file is infected.
+func rescan() {
+	config := newUploadConfig()
+	if config.Scanner == nil {
+		log.Fatal("Set CLAMD_ADDR to the address of clamd to rescan files")
+	}
+
+	database, err := db.NewDatabase("library.db")
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer database.Close()
+
+	libraryHandler := handlers.NewLibraryHandler(database, nil)
+	libraryHandler.SetBlobStore(newBlobStore())
+	libraryHandler.SetUploadConfig(config)
+	infected, err := libraryHandler.RescanFiles(context.Background())
+	if err != nil {
+		log.Fatal("Failed to rescan files:", err)
+	}
+
+	if len(infected) > 0 {
+		log.Fatalf("Files of %d PDFs are infected", len(infected))
+	}
+	log.Println("No infected files found")
+}
+
+// extractStoredPages extracts the text of a stored PDF. Blobs that can't be
+// read in place, such as S3 objects, are downloaded to a temporary file first.
+func extractStoredPages(store storage.BlobStore, key string) ([]string, error) {
+	blob, info, err := store.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	if file, ok := blob.(io.ReaderAt); ok {
+		return pdftext.ExtractPagesFrom(file, info.Size)
+	}
+
+	tmp, err := os.CreateTemp("", "reindex-*.pdf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, blob); err != nil {
+		return nil, err
+	}
+	return pdftext.ExtractPagesFrom(tmp, info.Size)
+}
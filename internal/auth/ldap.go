@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapTimeout limits connecting to the directory and each request to it when
+// the context allows longer.
+const ldapTimeout = 10 * time.Second
+
+// ErrInvalidCredentials is returned for a wrong username or password.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// LDAPConfig configures authentication against an LDAP directory.
+type LDAPConfig struct {
+	URL      string // e.g. "ldaps://ldap.example.com" or "ldap://ldap.example.com:389"
+	StartTLS bool   // Upgrade ldap:// connections with StartTLS
+
+	// BindDN and BindPassword are the service account that searches for
+	// users and their groups. Searches are anonymous without them.
+	BindDN       string
+	BindPassword string
+
+	BaseDN         string // Where users are searched for
+	UserFilter     string // Finds a user by username, e.g. "(uid=%s)"
+	EmailAttribute string // "mail" by default
+
+	GroupBaseDN    string // Where groups are searched for, BaseDN by default
+	GroupFilter    string // Finds a user's groups by the user's DN, e.g. "(member=%s)"
+	GroupAttribute string // The attribute that names a group, "cn" by default
+}
+
+// LDAPEntry is a user found in an LDAP directory.
+type LDAPEntry struct {
+	DN       string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// LDAPDirectory authenticates users with a search for their entry followed by
+// a bind as that entry.
+type LDAPDirectory struct {
+	config LDAPConfig
+}
+
+func NewLDAPDirectory(config LDAPConfig) *LDAPDirectory {
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.GroupBaseDN == "" {
+		config.GroupBaseDN = config.BaseDN
+	}
+	if config.GroupFilter == "" {
+		config.GroupFilter = "(member=%s)"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "cn"
+	}
+	return &LDAPDirectory{config: config}
+}
+
+// URL returns the URL of the directory.
+func (d *LDAPDirectory) URL() string {
+	return d.config.URL
+}
+
+// Authenticate checks a username and password against the directory and
+// returns the user's entry and groups. It returns ErrInvalidCredentials if
+// the username doesn't match exactly one entry or the password is wrong. The
+// connection is closed, ending any request in progress, when ctx is done.
+func (d *LDAPDirectory) Authenticate(ctx context.Context, username, password string) (*LDAPEntry, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	entry, err := d.authenticate(conn, username, password)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("LDAP authentication stopped: %w", ctx.Err())
+	}
+	return entry, err
+}
+
+// authenticate looks up a user's entry, binds as it with their password and
+// looks up their groups.
+func (d *LDAPDirectory) authenticate(conn *ldap.Conn, username, password string) (*LDAPEntry, error) {
+	if err := d.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(d.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{d.config.EmailAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for user: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := &LDAPEntry{
+		DN:       result.Entries[0].DN,
+		Username: username,
+		Email:    result.Entries[0].GetAttributeValue(d.config.EmailAttribute),
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind as user: %w", err)
+	}
+
+	// Groups are searched for as the service account, which may see more
+	// of the directory than the user
+	if err := d.bindService(conn); err != nil {
+		return nil, err
+	}
+	result, err = conn.Search(ldap.NewSearchRequest(
+		d.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(d.config.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{d.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for groups: %w", err)
+	}
+	for _, group := range result.Entries {
+		if name := group.GetAttributeValue(d.config.GroupAttribute); name != "" {
+			entry.Groups = append(entry.Groups, name)
+		}
+	}
+
+	return entry, nil
+}
+
+// connect connects to the directory, giving up at ctx's deadline or after
+// ldapTimeout, whichever comes first. Requests on the connection time out
+// after ldapTimeout; Authenticate ends them sooner if ctx is done.
+func (d *LDAPDirectory) connect(ctx context.Context) (*ldap.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP directory: %w", err)
+	}
+	deadline := time.Now().Add(ldapTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	conn, err := ldap.DialURL(d.config.URL, ldap.DialWithDialer(&net.Dialer{Deadline: deadline}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP directory: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if d.config.StartTLS {
+		serverName := ""
+		if u, err := url.Parse(d.config.URL); err == nil {
+			serverName = u.Hostname()
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: serverName}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// bindService binds as the service account, or anonymously without one.
+func (d *LDAPDirectory) bindService(conn *ldap.Conn) error {
+	var err error
+	if d.config.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(d.config.BindDN, d.config.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind as service account: %w", err)
+	}
+	return nil
+}
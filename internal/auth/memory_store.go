@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// MemorySessionStore keeps sessions in memory. Sessions are lost on restart,
+// which makes it mostly useful for tests and development.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]Session),
+	}
+}
+
+func (s *MemorySessionStore) Create(tokenHash string, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[tokenHash] = *session
+	return nil
+}
+
+func (s *MemorySessionStore) Get(tokenHash string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return nil, ErrInvalidToken
+	}
+
+	// Return a copy so callers can't modify the stored session
+	return &session, nil
+}
+
+func (s *MemorySessionStore) Touch(tokenHash string, lastSeenAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return ErrInvalidToken
+	}
+
+	session.LastSeenAt = lastSeenAt
+	s.sessions[tokenHash] = session
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteByUser(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) ListByUser(userID int) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// SecretKeySize is the size of the keys secrets are encrypted with, in
+	// bytes, for AES-256.
+	SecretKeySize = 32
+
+	// sealedPrefix marks encrypted values, so that values stored before
+	// encryption was introduced can be told apart from them.
+	sealedPrefix = "v1:"
+)
+
+// ErrSecretUndecryptable is returned when a sealed value can't be decrypted,
+// because it was sealed with another key or has been tampered with.
+var ErrSecretUndecryptable = errors.New("secret can't be decrypted with this key")
+
+// SecretBox encrypts secrets, such as TOTP secrets, that are stored in the
+// database, so that a copy of the database alone doesn't give them away. It
+// uses AES-256-GCM with a random nonce per value.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox returns a SecretBox that encrypts with key, which must be
+// SecretKeySize bytes long.
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, not %d", SecretKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts a secret for storage.
+func (b *SecretBox) Seal(secret string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret sealed by Seal.
+func (b *SecretBox) Open(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return "", fmt.Errorf("%w: it isn't sealed", ErrSecretUndecryptable)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", ErrSecretUndecryptable
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	secret, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrSecretUndecryptable
+	}
+	return string(secret), nil
+}
+
+// IsSealed reports whether a stored value was sealed by a SecretBox, as
+// opposed to stored in plaintext.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// ParseSecretKey decodes a base64-encoded encryption key.
+func ParseSecretKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key isn't valid base64: %w", err)
+	}
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, not %d", SecretKeySize, len(key))
+	}
+	return key, nil
+}
+
+// LoadOrCreateSecretKey reads the base64-encoded encryption key in the file
+// at path, first creating the file with a new random key, readable only by
+// its owner, if it doesn't exist.
+func LoadOrCreateSecretKey(path string) ([]byte, error) {
+	encoded, err := os.ReadFile(path)
+	if err == nil {
+		return ParseSecretKey(string(encoded))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := make([]byte, SecretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -2,8 +2,11 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -15,60 +18,110 @@ var (
 	ErrInvalidToken    = errors.New("invalid token")
 )
 
+const (
+	sessionDuration = 24 * time.Hour
+
+	// APITokenPrefix marks personal API tokens, so they can be told apart
+	// from session tokens in an Authorization header.
+	APITokenPrefix = "lms_"
+
+	// lastSeenInterval limits how often LastSeenAt is written back to the
+	// store, so that validating a session is not a write on every request.
+	lastSeenInterval = time.Minute
+)
+
 type Session struct {
-	UserID    int
-	Username  string
-	ExpiresAt time.Time
+	UserID     int
+	Username   string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	IPAddress  string
+	UserAgent  string
+}
+
+// SessionStore persists sessions. Sessions are keyed by the SHA-256 hash of
+// their token so that a leaked store does not leak usable tokens.
+type SessionStore interface {
+	Create(tokenHash string, session *Session) error
+	Get(tokenHash string) (*Session, error)
+	Touch(tokenHash string, lastSeenAt time.Time) error
+	Delete(tokenHash string) error
+	DeleteExpired(now time.Time) error
+	DeleteByUser(userID int) error
+	ListByUser(userID int) ([]Session, error)
 }
 
 type SessionManager struct {
-	sessions map[string]*Session
+	store SessionStore
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(store SessionStore) *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		store: store,
 	}
 }
 
-func (sm *SessionManager) CreateSession(userID int, username string) (string, error) {
+func (sm *SessionManager) CreateSession(userID int, username, ipAddress, userAgent string) (string, error) {
 	token := generateToken()
-	expiresAt := time.Now().Add(24 * time.Hour)
-
-	sm.sessions[token] = &Session{
-		UserID:    userID,
-		Username:  username,
-		ExpiresAt: expiresAt,
+	now := time.Now().UTC()
+
+	err := sm.store.Create(HashToken(token), &Session{
+		UserID:     userID,
+		Username:   username,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionDuration),
+		IPAddress:  ipAddress,
+		UserAgent:  userAgent,
+	})
+	if err != nil {
+		return "", err
 	}
 
 	return token, nil
 }
 
 func (sm *SessionManager) ValidateSession(token string) (*Session, error) {
-	session, exists := sm.sessions[token]
-	if !exists {
+	tokenHash := HashToken(token)
+
+	session, err := sm.store.Get(tokenHash)
+	if err != nil {
 		return nil, ErrInvalidToken
 	}
 
-	if time.Now().After(session.ExpiresAt) {
-		delete(sm.sessions, token)
+	now := time.Now().UTC()
+	if now.After(session.ExpiresAt) {
+		sm.store.Delete(tokenHash)
 		return nil, ErrInvalidToken
 	}
 
+	if now.Sub(session.LastSeenAt) > lastSeenInterval {
+		if err := sm.store.Touch(tokenHash, now); err == nil {
+			session.LastSeenAt = now
+		}
+	}
+
 	return session, nil
 }
 
 func (sm *SessionManager) DestroySession(token string) {
-	delete(sm.sessions, token)
+	sm.store.Delete(HashToken(token))
 }
 
-func (sm *SessionManager) CleanupExpiredSessions() {
-	now := time.Now()
-	for token, session := range sm.sessions {
-		if now.After(session.ExpiresAt) {
-			delete(sm.sessions, token)
-		}
-	}
+// DestroyUserSessions logs a user out everywhere, for example after their
+// password changes.
+func (sm *SessionManager) DestroyUserSessions(userID int) error {
+	return sm.store.DeleteByUser(userID)
+}
+
+func (sm *SessionManager) CleanupExpiredSessions() error {
+	return sm.store.DeleteExpired(time.Now().UTC())
+}
+
+// UserSessions returns the active sessions of a user, for auditing.
+func (sm *SessionManager) UserSessions(userID int) ([]Session, error) {
+	return sm.store.ListByUser(userID)
 }
 
 func generateToken() string {
@@ -77,6 +130,38 @@ func generateToken() string {
 	return base64.URLEncoding.EncodeToString(bytes)
 }
 
+// GenerateAPIToken returns a new random personal API token.
+func GenerateAPIToken() string {
+	return APITokenPrefix + generateToken()
+}
+
+// GenerateToken returns a new random token for single-use links, such as
+// password resets.
+func GenerateToken() string {
+	return generateToken()
+}
+
+// IsAPIToken reports whether a token is a personal API token rather than a
+// session token.
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// HashToken returns the hex-encoded SHA-256 hash under which a token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP returns the IP address of the client that sent the request.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func SetSessionCookie(w http.ResponseWriter, token string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_token",
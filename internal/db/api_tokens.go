@@ -0,0 +1,161 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"strings"
+	"time"
+)
+
+// apiTokenTouchInterval limits how often last_used_at is written back, so
+// that authenticating with a token is not a write on every request.
+const apiTokenTouchInterval = time.Minute
+
+var (
+	ErrInvalidScope = errors.New("scope is not a permission the user has")
+	ErrTokenExpired = errors.New("API token has expired")
+)
+
+// CreateAPIToken stores a new API token for a user under the hash of its
+// secret. Every scope must be a permission the user currently has.
+func (d *Database) CreateAPIToken(userID int, name, tokenHash string, scopes []string, expiresAt *time.Time, now time.Time) (*models.APIToken, error) {
+	for _, scope := range scopes {
+		hasPerm, err := d.HasPermission(userID, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !hasPerm {
+			return nil, ErrInvalidScope
+		}
+	}
+
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+
+	query := `INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := d.db.Exec(query, userID, name, tokenHash, strings.Join(scopes, " "), now.UTC(), expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := d.queryAPITokens(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &tokens[0], nil
+}
+
+// AuthenticateAPIToken returns the token stored under a hash and records
+// that it was used. Expired tokens are rejected with ErrTokenExpired.
+func (d *Database) AuthenticateAPIToken(tokenHash string, now time.Time) (*models.APIToken, error) {
+	now = now.UTC()
+
+	tokens, err := d.queryAPITokens(`WHERE token_hash = ?`, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	token := &tokens[0]
+
+	if token.IsExpired(now) {
+		return nil, ErrTokenExpired
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > apiTokenTouchInterval {
+		if _, err := d.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, token.ID); err == nil {
+			token.LastUsedAt = &now
+		}
+	}
+
+	return token, nil
+}
+
+// GetUserAPITokens returns a user's API tokens, newest first.
+func (d *Database) GetUserAPITokens(userID int) ([]models.APIToken, error) {
+	return d.queryAPITokens(`WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+}
+
+// DeleteAPIToken revokes one of a user's API tokens.
+func (d *Database) DeleteAPIToken(id, userID int) error {
+	result, err := d.db.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetUserPermissions returns the permissions a user has through their roles.
+func (d *Database) GetUserPermissions(userID int) ([]models.Permission, error) {
+	query := `
+		SELECT DISTINCT p.id, p.name, p.resource, p.action, p.description, p.created_at
+		FROM permissions p
+		INNER JOIN role_permissions rp ON rp.permission_id = p.id
+		INNER JOIN user_roles ur ON ur.role_id = rp.role_id
+		WHERE ur.user_id = ?
+		ORDER BY p.name`
+
+	rows, err := d.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []models.Permission
+	for rows.Next() {
+		var permission models.Permission
+		err := rows.Scan(&permission.ID, &permission.Name, &permission.Resource, &permission.Action, &permission.Description, &permission.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, rows.Err()
+}
+
+// queryAPITokens returns the API tokens selected by where, which may also
+// order and limit the results.
+func (d *Database) queryAPITokens(where string, args ...any) ([]models.APIToken, error) {
+	query := `SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at FROM api_tokens ` + where
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []models.APIToken
+	for rows.Next() {
+		var token models.APIToken
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &expiresAt, &lastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		token.ExpiresAt = nullTimePtr(expiresAt)
+		token.LastUsedAt = nullTimePtr(lastUsedAt)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"librarymanagementsystem/internal/models"
+	"strings"
+	"time"
+)
+
+// AuditFilter selects audit events. Empty fields match every event.
+type AuditFilter struct {
+	Actor      string // Actor name, compared case-insensitively
+	Action     string
+	TargetType string
+	TargetID   *int
+	Since      time.Time // Events at or after this time
+	Until      time.Time // Events before this time
+}
+
+// where returns the SQL condition and arguments that select the events f
+// matches.
+func (f AuditFilter) where() (string, []any) {
+	conditions := []string{"1 = 1"}
+	var args []any
+	if f.Actor != "" {
+		conditions = append(conditions, "actor_name = ? COLLATE NOCASE")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.TargetType != "" {
+		conditions = append(conditions, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if f.TargetID != nil {
+		conditions = append(conditions, "target_id = ?")
+		args = append(args, *f.TargetID)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// RecordAuditEvent appends an event to the audit log. Its CreatedAt is set
+// to now if it's zero.
+func (d *Database) RecordAuditEvent(event models.AuditEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO audit_events (actor_id, actor_name, action, target_type, target_id, before_json, after_json, ip_address, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := d.db.Exec(query, event.ActorID, event.ActorName, event.Action, event.TargetType, event.TargetID,
+		nullJSON(event.Before), nullJSON(event.After), event.IPAddress, event.CreatedAt.UTC())
+	return err
+}
+
+// GetAuditEvents returns a page of the events f matches, newest first,
+// along with their total number. A negative limit returns every match.
+func (d *Database) GetAuditEvents(f AuditFilter, limit, offset int) ([]models.AuditEvent, int, error) {
+	where, args := f.where()
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, actor_id, actor_name, action, target_type, target_id, before_json, after_json, ip_address, created_at
+		FROM audit_events
+		WHERE ` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`
+	rows, err := d.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var event models.AuditEvent
+		var actorID, targetID sql.NullInt64
+		var before, after sql.NullString
+		err := rows.Scan(&event.ID, &actorID, &event.ActorName, &event.Action, &event.TargetType, &targetID, &before, &after, &event.IPAddress, &event.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		event.ActorID = nullIntPtr(actorID)
+		event.TargetID = nullIntPtr(targetID)
+		if before.Valid {
+			event.Before = []byte(before.String)
+		}
+		if after.Valid {
+			event.After = []byte(after.String)
+		}
+		events = append(events, event)
+	}
+
+	return events, total, rows.Err()
+}
+
+// nullJSON stores an empty JSON snapshot as NULL.
+func nullJSON(data []byte) sql.NullString {
+	return sql.NullString{String: string(data), Valid: len(data) > 0}
+}
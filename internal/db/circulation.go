@@ -0,0 +1,429 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrDuplicateBarcode    = errors.New("barcode is already in use")
+	ErrCopyUnavailable     = errors.New("copy is already checked out")
+	ErrNotCheckedOut       = errors.New("copy is not checked out")
+	ErrLoanLimitReached    = errors.New("loan limit reached")
+	ErrRenewalLimitReached = errors.New("renewal limit reached")
+	ErrCopyOnHold          = errors.New("copy is set aside for another patron's hold")
+	ErrHoldsWaiting        = errors.New("other patrons are waiting for this item")
+)
+
+// LoanPolicy is the lending policy that applies to a user. A user with
+// several roles gets the most generous value of each setting.
+type LoanPolicy struct {
+	Limit       int // Maximum number of items on loan at once
+	PeriodDays  int // Length of a loan and of each renewal
+	MaxRenewals int
+}
+
+func (d *Database) GetLoanPolicy(userID int) (LoanPolicy, error) {
+	query := `
+		SELECT COALESCE(MAX(r.loan_limit), 0), COALESCE(MAX(r.loan_period_days), 0), COALESCE(MAX(r.max_renewals), 0)
+		FROM roles r
+		INNER JOIN user_roles ur ON r.id = ur.role_id
+		WHERE ur.user_id = ?`
+
+	var policy LoanPolicy
+	err := d.db.QueryRow(query, userID).Scan(&policy.Limit, &policy.PeriodDays, &policy.MaxRenewals)
+	return policy, err
+}
+
+func (d *Database) CreateItem(title, author, isbn, description string) (int, error) {
+	query := `INSERT INTO items (title, author, isbn, description) VALUES (?, ?, ?, ?)`
+	result, err := d.db.Exec(query, title, author, isbn, description)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetAllItems returns every item with its copy counts, but without the
+// copies themselves.
+func (d *Database) GetAllItems() ([]models.Item, error) {
+	query := `
+		SELECT i.id, i.title, i.author, i.isbn, i.description, i.created_at,
+			COUNT(c.id), COUNT(c.id) - COUNT(l.id) - COUNT(h.id)
+		FROM items i
+		LEFT JOIN copies c ON c.item_id = i.id
+		LEFT JOIN loans l ON l.copy_id = c.id AND l.returned_at IS NULL
+		LEFT JOIN holds h ON h.copy_id = c.id AND h.status = 'ready'
+		GROUP BY i.id
+		ORDER BY i.title`
+
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []models.Item
+	for rows.Next() {
+		var item models.Item
+		err := rows.Scan(&item.ID, &item.Title, &item.Author, &item.ISBN, &item.Description, &item.CreatedAt,
+			&item.TotalCopies, &item.AvailableCopies)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// GetItemByID returns an item with all of its copies, their active loans
+// and holds, and the number of patrons waiting for it.
+func (d *Database) GetItemByID(id int) (*models.Item, error) {
+	query := `SELECT id, title, author, isbn, description, created_at FROM items WHERE id = ?`
+
+	var item models.Item
+	err := d.db.QueryRow(query, id).Scan(&item.ID, &item.Title, &item.Author, &item.ISBN, &item.Description, &item.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query(`SELECT id, item_id, barcode, shelf_location, created_at FROM copies WHERE item_id = ? ORDER BY barcode`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemCopy models.Copy
+		if err := rows.Scan(&itemCopy.ID, &itemCopy.ItemID, &itemCopy.Barcode, &itemCopy.ShelfLocation, &itemCopy.CreatedAt); err != nil {
+			return nil, err
+		}
+		item.Copies = append(item.Copies, itemCopy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	loans, err := d.queryLoans(`WHERE c.item_id = ? AND l.returned_at IS NULL`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	holds, err := d.queryHolds(`WHERE h.item_id = ? AND h.status = ?`, id, models.HoldReady)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range item.Copies {
+		for j := range loans {
+			if loans[j].CopyID == item.Copies[i].ID {
+				item.Copies[i].Loan = &loans[j]
+			}
+		}
+		for j := range holds {
+			if holds[j].CopyID != nil && *holds[j].CopyID == item.Copies[i].ID {
+				item.Copies[i].Hold = &holds[j]
+			}
+		}
+	}
+
+	query = `SELECT COUNT(*) FROM holds WHERE item_id = ? AND status = ?`
+	if err := d.db.QueryRow(query, id, models.HoldWaiting).Scan(&item.WaitingHolds); err != nil {
+		return nil, err
+	}
+
+	item.TotalCopies = len(item.Copies)
+	item.AvailableCopies = len(item.Copies) - len(loans) - len(holds)
+	return &item, nil
+}
+
+func (d *Database) AddCopy(itemID int, barcode, shelfLocation string) (int, error) {
+	query := `INSERT INTO copies (item_id, barcode, shelf_location) VALUES (?, ?, ?)`
+	result, err := d.db.Exec(query, itemID, barcode, shelfLocation)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicateBarcode
+		}
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// CheckOut lends the copy with the given barcode to a user, due after the
+// user's loan period. checkedOutBy is the librarian recording the loan.
+func (d *Database) CheckOut(barcode string, userID, checkedOutBy int, now time.Time) (*models.Loan, error) {
+	policy, err := d.GetLoanPolicy(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	finePolicy, err := d.GetFinePolicy()
+	if err != nil {
+		return nil, err
+	}
+	balance, err := d.GetBalance(userID)
+	if err != nil {
+		return nil, err
+	}
+	if balance > finePolicy.BlockThresholdCents {
+		return nil, ErrFinesOwed
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var copyID, itemID int
+	if err := tx.QueryRow(`SELECT id, item_id FROM copies WHERE barcode = ?`, barcode).Scan(&copyID, &itemID); err != nil {
+		return nil, err
+	}
+
+	// A copy set aside for a hold can only go to the patron who placed it
+	var heldFor int
+	err = tx.QueryRow(`SELECT user_id FROM holds WHERE copy_id = ? AND status = ?`, copyID, models.HoldReady).Scan(&heldFor)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err == nil && heldFor != userID {
+		return nil, ErrCopyOnHold
+	}
+
+	var active int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM loans WHERE user_id = ? AND returned_at IS NULL`, userID).Scan(&active); err != nil {
+		return nil, err
+	}
+	if active >= policy.Limit {
+		return nil, ErrLoanLimitReached
+	}
+
+	now = now.UTC()
+	dueAt := now.AddDate(0, 0, policy.PeriodDays)
+	query := `INSERT INTO loans (copy_id, user_id, checked_out_by, checked_out_at, due_at) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, copyID, userID, checkedOutBy, now, dueAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrCopyUnavailable
+		}
+		return nil, err
+	}
+
+	loanID, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Borrowing the item satisfies the patron's hold on it. If their hold had
+	// a different copy set aside, that copy goes to the next patron in line.
+	var heldCopyID sql.NullInt64
+	query = `SELECT copy_id FROM holds WHERE user_id = ? AND item_id = ? AND status = ?`
+	err = tx.QueryRow(query, userID, itemID, models.HoldReady).Scan(&heldCopyID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	query = `UPDATE holds SET status = ?, closed_at = ? WHERE user_id = ? AND item_id = ? AND status IN (?, ?)`
+	if _, err := tx.Exec(query, models.HoldFulfilled, now, userID, itemID, models.HoldWaiting, models.HoldReady); err != nil {
+		return nil, err
+	}
+
+	if heldCopyID.Valid && int(heldCopyID.Int64) != copyID {
+		if _, err := assignCopyToNextHold(tx, int(heldCopyID.Int64), itemID, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return d.GetLoanByID(int(loanID))
+}
+
+// CheckIn records the return of the copy with the given barcode and returns
+// the loan it closed. If patrons are waiting for the item, the copy is set
+// aside for the first of them and their hold is returned as well.
+func (d *Database) CheckIn(barcode string, now time.Time) (*models.Loan, *models.Hold, error) {
+	loans, err := d.queryLoans(`WHERE c.barcode = ? AND l.returned_at IS NULL`, barcode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(loans) == 0 {
+		var exists int
+		if err := d.db.QueryRow(`SELECT COUNT(*) FROM copies WHERE barcode = ?`, barcode).Scan(&exists); err != nil {
+			return nil, nil, err
+		}
+		if exists == 0 {
+			return nil, nil, sql.ErrNoRows
+		}
+		return nil, nil, ErrNotCheckedOut
+	}
+	loan := loans[0]
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// The returned_at check makes a concurrent check-in of the same loan a no-op
+	result, err := tx.Exec(`UPDATE loans SET returned_at = ? WHERE id = ? AND returned_at IS NULL`, now.UTC(), loan.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return nil, nil, err
+	} else if rows == 0 {
+		return nil, nil, ErrNotCheckedOut
+	}
+
+	holdID, err := assignCopyToNextHold(tx, loan.CopyID, loan.ItemID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	returned, err := d.GetLoanByID(loan.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if holdID == 0 {
+		return returned, nil, nil
+	}
+
+	hold, err := d.GetHoldByID(holdID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return returned, hold, nil
+}
+
+// RenewLoan extends an active loan by the borrower's loan period, counted
+// from now.
+func (d *Database) RenewLoan(loanID int, now time.Time) (*models.Loan, error) {
+	loan, err := d.GetLoanByID(loanID)
+	if err != nil {
+		return nil, err
+	}
+	if loan.ReturnedAt != nil {
+		return nil, ErrNotCheckedOut
+	}
+
+	policy, err := d.GetLoanPolicy(loan.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if loan.Renewals >= policy.MaxRenewals {
+		return nil, ErrRenewalLimitReached
+	}
+
+	// Patrons waiting for the item get it back on time
+	var waiting int
+	query := `SELECT COUNT(*) FROM holds WHERE item_id = ? AND status = ?`
+	if err := d.db.QueryRow(query, loan.ItemID, models.HoldWaiting).Scan(&waiting); err != nil {
+		return nil, err
+	}
+	if waiting > 0 {
+		return nil, ErrHoldsWaiting
+	}
+
+	// Matching on renewals makes concurrent renewals count only once
+	dueAt := now.UTC().AddDate(0, 0, policy.PeriodDays)
+	query = `UPDATE loans SET due_at = ?, renewals = renewals + 1 WHERE id = ? AND renewals = ? AND returned_at IS NULL`
+	result, err := d.db.Exec(query, dueAt, loanID, loan.Renewals)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if rows == 0 {
+		return nil, ErrConflict
+	}
+
+	return d.GetLoanByID(loanID)
+}
+
+func (d *Database) GetLoanByID(id int) (*models.Loan, error) {
+	loans, err := d.queryLoans(`WHERE l.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(loans) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &loans[0], nil
+}
+
+// GetActiveLoans returns every loan that hasn't been returned, soonest due
+// first.
+func (d *Database) GetActiveLoans() ([]models.Loan, error) {
+	return d.queryLoans(`WHERE l.returned_at IS NULL ORDER BY l.due_at`)
+}
+
+// GetUserLoans returns a user's active loans, soonest due first, followed
+// by their most recent returns.
+func (d *Database) GetUserLoans(userID int) ([]models.Loan, error) {
+	return d.queryLoans(`WHERE l.user_id = ?
+	ORDER BY l.returned_at IS NOT NULL, CASE WHEN l.returned_at IS NULL THEN l.due_at END, l.returned_at DESC
+	LIMIT 50`, userID)
+}
+
+// queryLoans returns the loans selected by where, which may also order and
+// limit the results.
+func (d *Database) queryLoans(where string, args ...any) ([]models.Loan, error) {
+	query := `
+		SELECT l.id, l.copy_id, l.user_id, l.checked_out_by, l.checked_out_at, l.due_at, l.returned_at, l.renewals,
+			c.item_id, i.title, c.barcode, u.username
+		FROM loans l
+		INNER JOIN copies c ON c.id = l.copy_id
+		INNER JOIN items i ON i.id = c.item_id
+		INNER JOIN users u ON u.id = l.user_id
+		` + where
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []models.Loan
+	for rows.Next() {
+		var loan models.Loan
+		var returnedAt sql.NullTime
+		err := rows.Scan(&loan.ID, &loan.CopyID, &loan.UserID, &loan.CheckedOutBy, &loan.CheckedOutAt, &loan.DueAt, &returnedAt,
+			&loan.Renewals, &loan.ItemID, &loan.ItemTitle, &loan.Barcode, &loan.Username)
+		if err != nil {
+			return nil, err
+		}
+		loan.ReturnedAt = nullTimePtr(returnedAt)
+		loans = append(loans, loan)
+	}
+
+	return loans, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
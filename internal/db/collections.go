@@ -0,0 +1,222 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+// ErrCollectionExists is returned when a collection is given a name another
+// collection already has.
+var ErrCollectionExists = errors.New("a collection with that name already exists")
+
+// CreateCollection adds an empty collection with no access list.
+func (d *Database) CreateCollection(name string, createdBy int, now time.Time) (int, error) {
+	result, err := d.db.Exec(`INSERT INTO collections (name, created_by, created_at) VALUES (?, ?, ?)`, name, createdBy, now.UTC())
+	if isUniqueViolation(err) {
+		return 0, ErrCollectionExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// GetCollectionByID returns a collection without its PDFs or access list.
+func (d *Database) GetCollectionByID(id int) (*models.Collection, error) {
+	var collection models.Collection
+	err := d.db.QueryRow(`SELECT id, name, created_by, created_at FROM collections WHERE id = ?`, id).
+		Scan(&collection.ID, &collection.Name, &collection.CreatedBy, &collection.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// GetAllCollections returns every collection by name, without their PDFs or
+// access lists.
+func (d *Database) GetAllCollections() ([]models.Collection, error) {
+	return d.queryCollections(`SELECT id, name, created_by, created_at FROM collections ORDER BY name`)
+}
+
+// GetPDFCollections returns the collections a PDF is in, by name.
+func (d *Database) GetPDFCollections(pdfID int) ([]models.Collection, error) {
+	query := `
+		SELECT c.id, c.name, c.created_by, c.created_at
+		FROM collections c
+		JOIN collection_pdfs cp ON cp.collection_id = c.id
+		WHERE cp.pdf_id = ?
+		ORDER BY c.name`
+	return d.queryCollections(query, pdfID)
+}
+
+func (d *Database) queryCollections(query string, args ...any) ([]models.Collection, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []models.Collection
+	for rows.Next() {
+		var collection models.Collection
+		if err := rows.Scan(&collection.ID, &collection.Name, &collection.CreatedBy, &collection.CreatedAt); err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+
+	return collections, rows.Err()
+}
+
+// GetCollectionPDFs returns the PDFs in a collection by title.
+func (d *Database) GetCollectionPDFs(collectionID int) ([]models.PDF, error) {
+	query := `SELECT ` + pdfColumns + ` FROM pdfs WHERE id IN (SELECT pdf_id FROM collection_pdfs WHERE collection_id = ?) ORDER BY title, id`
+	return d.queryPDFs(query, collectionID)
+}
+
+// DeleteCollection deletes a collection along with its access list. Its
+// PDFs are left in the library.
+func (d *Database) DeleteCollection(id int) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		for _, query := range []string{
+			`DELETE FROM collection_acl_entries WHERE collection_id = ?`,
+			`DELETE FROM collection_pdfs WHERE collection_id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.Exec(`DELETE FROM collections WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// AddPDFToCollection puts a PDF in a collection. Adding a PDF that's
+// already in the collection does nothing.
+func (d *Database) AddPDFToCollection(collectionID, pdfID int) error {
+	query := `
+		INSERT OR IGNORE INTO collection_pdfs (collection_id, pdf_id)
+		SELECT c.id, p.id FROM collections c, pdfs p WHERE c.id = ? AND p.id = ?`
+	result, err := d.db.Exec(query, collectionID, pdfID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		// Either the collection or the PDF doesn't exist, or the PDF is
+		// already in the collection
+		var exists bool
+		query := `SELECT EXISTS (SELECT 1 FROM collection_pdfs WHERE collection_id = ? AND pdf_id = ?)`
+		if err := d.db.QueryRow(query, collectionID, pdfID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+	}
+	return nil
+}
+
+// RemovePDFFromCollection takes a PDF out of a collection.
+func (d *Database) RemovePDFFromCollection(collectionID, pdfID int) error {
+	result, err := d.db.Exec(`DELETE FROM collection_pdfs WHERE collection_id = ? AND pdf_id = ?`, collectionID, pdfID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetCollectionACL returns the access list of a collection, user entries
+// first.
+func (d *Database) GetCollectionACL(collectionID int) ([]models.CollectionACLEntry, error) {
+	query := `
+		SELECT a.id, a.collection_id, a.user_id, COALESCE(u.username, ''), a.role_id, COALESCE(r.name, ''), a.access, a.created_by, a.created_at
+		FROM collection_acl_entries a
+		LEFT JOIN users u ON a.user_id = u.id
+		LEFT JOIN roles r ON a.role_id = r.id
+		WHERE a.collection_id = ?
+		ORDER BY a.user_id IS NULL, u.username, r.name`
+
+	rows, err := d.db.Query(query, collectionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.CollectionACLEntry
+	for rows.Next() {
+		var entry models.CollectionACLEntry
+		var userID, roleID sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.CollectionID, &userID, &entry.Username, &roleID, &entry.RoleName, &entry.Access, &entry.CreatedBy, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.UserID = nullIntPtr(userID)
+		entry.RoleID = nullIntPtr(roleID)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// SetCollectionACLEntry grants a user or a role, whichever is non-nil,
+// access to every PDF in a collection, replacing the access level of an
+// existing entry for them.
+func (d *Database) SetCollectionACLEntry(collectionID int, userID, roleID *int, access string, createdBy int, now time.Time) error {
+	if (userID == nil) == (roleID == nil) || !models.PDFAccessIncludes(access, models.PDFAccessRead) {
+		return ErrInvalidACLEntry
+	}
+
+	return d.inTransaction(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM collections WHERE id = ?)`, collectionID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		query := `DELETE FROM collection_acl_entries WHERE collection_id = ? AND (user_id = ? OR role_id = ?)`
+		if _, err := tx.Exec(query, collectionID, userID, roleID); err != nil {
+			return err
+		}
+
+		query = `INSERT INTO collection_acl_entries (collection_id, user_id, role_id, access, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+		_, err := tx.Exec(query, collectionID, userID, roleID, access, createdBy, now.UTC())
+		return err
+	})
+}
+
+// DeleteCollectionACLEntry removes an entry from the access list of a
+// collection.
+func (d *Database) DeleteCollectionACLEntry(id, collectionID int) error {
+	result, err := d.db.Exec(`DELETE FROM collection_acl_entries WHERE id = ? AND collection_id = ?`, id, collectionID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -2,205 +2,216 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"librarymanagementsystem/internal/auth"
 	"librarymanagementsystem/internal/models"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrConflict is returned when a record was modified by someone else since
+// it was read.
+var ErrConflict = errors.New("record was modified concurrently")
+
 type Database struct {
-	db *sql.DB
+	db             *sql.DB
+	fullTextSearch bool
+	searchWarning  string
+	// secrets encrypts the secrets stored in the database
+	secrets *auth.SecretBox
 }
 
+// NewDatabase opens the database at dbPath and brings its schema up to
+// date by applying any pending migrations.
 func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	database, err := OpenDatabase(dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+	if err := database.Migrate(); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	database := &Database{db: db}
-	if err := database.createTables(); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+	if err := database.detectSearchIndex(); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to check search index: %w", err)
+	}
+
+	// Assign default roles to existing users
+	if err := database.assignDefaultRoles(); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to assign default roles: %w", err)
 	}
 
 	return database, nil
 }
 
-func (d *Database) createTables() error {
-	userTable := `
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`
-
-	pdfTable := `
-		CREATE TABLE IF NOT EXISTS pdfs (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			title TEXT NOT NULL,
-			author TEXT,
-			description TEXT,
-			filename TEXT NOT NULL,
-			file_path TEXT NOT NULL,
-			uploaded_by INTEGER NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (uploaded_by) REFERENCES users(id)
-		)`
-
-	accessTable := `
-		CREATE TABLE IF NOT EXISTS user_pdf_access (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			pdf_id INTEGER NOT NULL,
-			accessed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (pdf_id) REFERENCES pdfs(id)
-		)`
-
-	rolesTable := `
-		CREATE TABLE IF NOT EXISTS roles (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT UNIQUE NOT NULL,
-			description TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`
-
-	permissionsTable := `
-		CREATE TABLE IF NOT EXISTS permissions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT UNIQUE NOT NULL,
-			resource TEXT NOT NULL,
-			action TEXT NOT NULL,
-			description TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`
-
-	userRolesTable := `
-		CREATE TABLE IF NOT EXISTS user_roles (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			role_id INTEGER NOT NULL,
-			assigned_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			assigned_by INTEGER,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (role_id) REFERENCES roles(id),
-			FOREIGN KEY (assigned_by) REFERENCES users(id),
-			UNIQUE(user_id, role_id)
-		)`
-
-	rolePermissionsTable := `
-		CREATE TABLE IF NOT EXISTS role_permissions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			role_id INTEGER NOT NULL,
-			permission_id INTEGER NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (role_id) REFERENCES roles(id),
-			FOREIGN KEY (permission_id) REFERENCES permissions(id),
-			UNIQUE(role_id, permission_id)
-		)`
-
-	tables := []string{userTable, pdfTable, accessTable, rolesTable, permissionsTable, userRolesTable, rolePermissionsTable}
-
-	for _, table := range tables {
-		if _, err := d.db.Exec(table); err != nil {
-			return fmt.Errorf("failed to create table: %w", err)
-		}
-	}
-
-	// Initialize default roles and permissions
-	if err := d.initializeRBAC(); err != nil {
-		return fmt.Errorf("failed to initialize RBAC: %w", err)
+// OpenDatabase opens the database at dbPath without touching its schema.
+// It is used by the migrate command; everything else uses NewDatabase.
+func OpenDatabase(dbPath string) (*Database, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Assign default roles to existing users
-	if err := d.assignDefaultRoles(); err != nil {
-		return fmt.Errorf("failed to assign default roles: %w", err)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return nil
+	return &Database{db: db}, nil
 }
 
 func (d *Database) Close() error {
 	return d.db.Close()
 }
 
+// CreateUser creates an active user with a verified email address and the
+// default "user" role.
 func (d *Database) CreateUser(username, email, passwordHash string) error {
-	// Start transaction
-	tx, err := d.db.Begin()
-	if err != nil {
-		return err
+	_, err := d.RegisterUser(username, email, passwordHash, true, models.UserActive, time.Now())
+	return err
+}
+
+// RegisterUser creates a user with the default "user" role and returns their
+// ID. Users who haven't verified their email address or whose account isn't
+// active yet can log in but not use the library.
+func (d *Database) RegisterUser(username, email, passwordHash string, emailVerified bool, status string, now time.Time) (int, error) {
+	var verifiedAt *time.Time
+	if emailVerified {
+		utc := now.UTC()
+		verifiedAt = &utc
 	}
-	defer tx.Rollback()
 
-	// Insert user
-	query := `INSERT INTO users (username, email, password_hash) VALUES (?, ?, ?)`
-	result, err := tx.Exec(query, username, email, passwordHash)
+	userRoleID, err := d.getRoleIDByName("user")
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to get user role ID: %w", err)
 	}
 
-	// Get user ID
-	userID, err := result.LastInsertId()
-	if err != nil {
+	var userID int
+	err = d.inTransaction(func(tx *sql.Tx) error {
+		userID, err = insertUser(tx, username, email, passwordHash, verifiedAt, status, userRoleID)
 		return err
-	}
+	})
+	return userID, err
+}
 
-	// Assign default user role
-	userRoleID, err := d.getRoleIDByName("user")
+func insertUser(tx *sql.Tx, username, email, passwordHash string, verifiedAt *time.Time, status string, roleID int) (int, error) {
+	query := `INSERT INTO users (username, email, password_hash, email_verified_at, status) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, username, email, passwordHash, verifiedAt, status)
 	if err != nil {
-		return fmt.Errorf("failed to get user role ID: %w", err)
+		return 0, err
 	}
 
-	_, err = tx.Exec(`INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)`, userID, userRoleID)
+	userID, err := result.LastInsertId()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// Commit transaction
-	return tx.Commit()
+	// Assign default user role
+	_, err = tx.Exec(`INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)`, userID, roleID)
+	return int(userID), err
 }
 
-func (d *Database) GetUserByUsername(username string) (*models.User, error) {
-	query := `SELECT id, username, email, password_hash, created_at FROM users WHERE username = ?`
-	row := d.db.QueryRow(query, username)
+// userColumns lists the users columns in the order scanUser expects them.
+const userColumns = `id, username, email, password_hash, created_at, email_verified_at, status, totp_enabled_at`
 
+func scanUser(row rowScanner) (*models.User, error) {
 	var user models.User
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.CreatedAt)
+	var verifiedAt, totpEnabledAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.CreatedAt, &verifiedAt, &user.Status, &totpEnabledAt)
 	if err != nil {
 		return nil, err
 	}
-
+	user.EmailVerifiedAt = nullTimePtr(verifiedAt)
+	user.TOTPEnabledAt = nullTimePtr(totpEnabledAt)
 	return &user, nil
 }
 
+func (d *Database) GetUserByUsername(username string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = ?`
+	row := d.db.QueryRow(query, username)
+
+	return scanUser(row)
+}
+
+// GetUserByEmail looks a user up by email address, ignoring case.
+func (d *Database) GetUserByEmail(email string) (*models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = ? COLLATE NOCASE`
+	row := d.db.QueryRow(query, email)
+
+	return scanUser(row)
+}
+
 func (d *Database) GetUserByID(id int) (*models.User, error) {
-	query := `SELECT id, username, email, password_hash, created_at FROM users WHERE id = ?`
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
 	row := d.db.QueryRow(query, id)
 
-	var user models.User
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.CreatedAt)
+	return scanUser(row)
+}
+
+// pdfColumns lists the pdfs columns in the order scanPDF expects them.
+const pdfColumns = `id, title, author, description, filename, storage_key, checksum, size_bytes, uploaded_by, created_at, updated_at, version, max_concurrent_loans, restricted, scrub_status, scrubbed_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPDF(row rowScanner) (*models.PDF, error) {
+	var pdf models.PDF
+	var scrubbedAt sql.NullTime
+	err := row.Scan(&pdf.ID, &pdf.Title, &pdf.Author, &pdf.Description, &pdf.Filename, &pdf.StorageKey, &pdf.Checksum, &pdf.SizeBytes,
+		&pdf.UploadedBy, &pdf.CreatedAt, &pdf.UpdatedAt, &pdf.Version, &pdf.MaxConcurrentLoans, &pdf.Restricted, &pdf.ScrubStatus, &scrubbedAt)
 	if err != nil {
 		return nil, err
 	}
+	pdf.ScrubbedAt = nullTimePtr(scrubbedAt)
+	return &pdf, nil
+}
 
-	return &user, nil
+// CreatePDF adds a PDF whose file is stored in the blob store under
+// storageKey.
+func (d *Database) CreatePDF(title, author, description, filename, storageKey string, uploadedBy int) (int, error) {
+	return d.CreateUploadedPDF(models.PDF{
+		Title:       title,
+		Author:      author,
+		Description: description,
+		Filename:    filename,
+		StorageKey:  storageKey,
+		UploadedBy:  uploadedBy,
+	})
 }
 
-func (d *Database) CreatePDF(title, author, description, filename, filePath string, uploadedBy int) error {
-	query := `INSERT INTO pdfs (title, author, description, filename, file_path, uploaded_by) VALUES (?, ?, ?, ?, ?, ?)`
-	_, err := d.db.Exec(query, title, author, description, filename, filePath, uploadedBy)
-	return err
+// CreateUploadedPDF adds a PDF along with the checksum and size of its file.
+func (d *Database) CreateUploadedPDF(pdf models.PDF) (int, error) {
+	query := `INSERT INTO pdfs (title, author, description, filename, storage_key, checksum, size_bytes, uploaded_by, updated_at) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	result, err := d.db.Exec(query, pdf.Title, pdf.Author, pdf.Description, pdf.Filename, pdf.StorageKey, pdf.Checksum, pdf.SizeBytes, pdf.UploadedBy)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
 }
 
 func (d *Database) GetAllPDFs() ([]models.PDF, error) {
-	query := `SELECT id, title, author, description, filename, file_path, uploaded_by, created_at FROM pdfs ORDER BY created_at DESC`
-	rows, err := d.db.Query(query)
+	return d.GetVisiblePDFs(PDFVisibility{All: true})
+}
+
+// GetVisiblePDFs returns the PDFs v allows, newest first.
+func (d *Database) GetVisiblePDFs(v PDFVisibility) ([]models.PDF, error) {
+	visible, args := v.where()
+	query := `SELECT ` + pdfColumns + ` FROM pdfs p WHERE ` + visible + ` ORDER BY created_at DESC`
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -208,52 +219,55 @@ func (d *Database) GetAllPDFs() ([]models.PDF, error) {
 
 	var pdfs []models.PDF
 	for rows.Next() {
-		var pdf models.PDF
-		err := rows.Scan(&pdf.ID, &pdf.Title, &pdf.Author, &pdf.Description, &pdf.Filename, &pdf.FilePath, &pdf.UploadedBy, &pdf.CreatedAt)
+		pdf, err := scanPDF(rows)
 		if err != nil {
 			return nil, err
 		}
-		pdfs = append(pdfs, pdf)
+		pdfs = append(pdfs, *pdf)
 	}
 
 	return pdfs, nil
 }
 
 func (d *Database) GetPDFByID(id int) (*models.PDF, error) {
-	query := `SELECT id, title, author, description, filename, file_path, uploaded_by, created_at FROM pdfs WHERE id = ?`
-	row := d.db.QueryRow(query, id)
-
-	var pdf models.PDF
-	err := row.Scan(&pdf.ID, &pdf.Title, &pdf.Author, &pdf.Description, &pdf.Filename, &pdf.FilePath, &pdf.UploadedBy, &pdf.CreatedAt)
-	if err != nil {
-		return nil, err
-	}
-
-	return &pdf, nil
+	query := `SELECT ` + pdfColumns + ` FROM pdfs WHERE id = ?`
+	return scanPDF(d.db.QueryRow(query, id))
 }
 
-func (d *Database) SearchPDFs(query string) ([]models.PDF, error) {
-	searchQuery := `SELECT id, title, author, description, filename, file_path, uploaded_by, created_at FROM pdfs 
-	WHERE title LIKE ? OR author LIKE ? OR description LIKE ? ORDER BY created_at DESC`
+// UpdatePDF saves the metadata and file of a PDF and increments its version.
+// expectedVersion is the Version the caller based its changes on; if the
+// record has been updated since, ErrConflict is returned and nothing is
+// written.
+func (d *Database) UpdatePDF(pdf *models.PDF, expectedVersion int) error {
+	now := time.Now().UTC()
 
-	searchPattern := "%" + query + "%"
-	rows, err := d.db.Query(searchQuery, searchPattern, searchPattern, searchPattern)
+	query := `UPDATE pdfs SET title = ?, author = ?, description = ?, filename = ?, storage_key = ?, checksum = ?, size_bytes = ?, max_concurrent_loans = ?, updated_at = ?, version = version + 1
+	WHERE id = ? AND version = ?`
+	result, err := d.db.Exec(query, pdf.Title, pdf.Author, pdf.Description, pdf.Filename, pdf.StorageKey, pdf.Checksum, pdf.SizeBytes, pdf.MaxConcurrentLoans, now, pdf.ID, expectedVersion)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	var pdfs []models.PDF
-	for rows.Next() {
-		var pdf models.PDF
-		err := rows.Scan(&pdf.ID, &pdf.Title, &pdf.Author, &pdf.Description, &pdf.Filename, &pdf.FilePath, &pdf.UploadedBy, &pdf.CreatedAt)
-		if err != nil {
-			return nil, err
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		if _, err := d.GetPDFByID(pdf.ID); err != nil {
+			return err
 		}
-		pdfs = append(pdfs, pdf)
+		return ErrConflict
 	}
 
-	return pdfs, nil
+	pdf.UpdatedAt = now
+	pdf.Version = expectedVersion + 1
+	return nil
+}
+
+func (d *Database) UpdatePDFStorageKey(id int, storageKey string) error {
+	query := `UPDATE pdfs SET storage_key = ? WHERE id = ?`
+	_, err := d.db.Exec(query, storageKey, id)
+	return err
 }
 
 func (d *Database) RecordPDFAccess(userID, pdfID int) error {
@@ -283,73 +297,6 @@ func (d *Database) GetUserAccessHistory(userID int) ([]models.UserPDFAccess, err
 	return access, nil
 }
 
-func (d *Database) initializeRBAC() error {
-	// Create default roles
-	roles := []struct {
-		name        string
-		description string
-	}{
-		{"admin", "System administrator with full access"},
-		{"user", "Regular user with catalog access"},
-	}
-
-	for _, role := range roles {
-		query := `INSERT OR IGNORE INTO roles (name, description) VALUES (?, ?)`
-		if _, err := d.db.Exec(query, role.name, role.description); err != nil {
-			return fmt.Errorf("failed to create role %s: %w", role.name, err)
-		}
-	}
-
-	// Create default permissions
-	permissions := []struct {
-		name        string
-		resource    string
-		action      string
-		description string
-	}{
-		{"upload_pdf", "pdf", "create", "Upload PDF files"},
-		{"view_pdf", "pdf", "read", "View PDF files"},
-		{"edit_pdf", "pdf", "update", "Edit PDF metadata"},
-		{"delete_pdf", "pdf", "delete", "Delete PDF files"},
-		{"manage_users", "user", "manage", "Manage user accounts"},
-		{"manage_roles", "role", "manage", "Manage user roles"},
-	}
-
-	for _, perm := range permissions {
-		query := `INSERT OR IGNORE INTO permissions (name, resource, action, description) VALUES (?, ?, ?, ?)`
-		if _, err := d.db.Exec(query, perm.name, perm.resource, perm.action, perm.description); err != nil {
-			return fmt.Errorf("failed to create permission %s: %w", perm.name, err)
-		}
-	}
-
-	// Assign permissions to roles
-	rolePermissions := map[string][]string{
-		"admin": {"upload_pdf", "view_pdf", "edit_pdf", "delete_pdf", "manage_users", "manage_roles"},
-		"user":  {"view_pdf"},
-	}
-
-	for roleName, permNames := range rolePermissions {
-		roleID, err := d.getRoleIDByName(roleName)
-		if err != nil {
-			return fmt.Errorf("failed to get role ID for %s: %w", roleName, err)
-		}
-
-		for _, permName := range permNames {
-			permID, err := d.getPermissionIDByName(permName)
-			if err != nil {
-				return fmt.Errorf("failed to get permission ID for %s: %w", permName, err)
-			}
-
-			query := `INSERT OR IGNORE INTO role_permissions (role_id, permission_id) VALUES (?, ?)`
-			if _, err := d.db.Exec(query, roleID, permID); err != nil {
-				return fmt.Errorf("failed to assign permission %s to role %s: %w", permName, roleName, err)
-			}
-		}
-	}
-
-	return nil
-}
-
 func (d *Database) getRoleIDByName(name string) (int, error) {
 	query := `SELECT id FROM roles WHERE name = ?`
 	var id int
@@ -360,20 +307,10 @@ func (d *Database) getRoleIDByName(name string) (int, error) {
 	return id, nil
 }
 
-func (d *Database) getPermissionIDByName(name string) (int, error) {
-	query := `SELECT id FROM permissions WHERE name = ?`
-	var id int
-	err := d.db.QueryRow(query, name).Scan(&id)
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
 // RBAC query methods
 func (d *Database) GetUserRoles(userID int) ([]models.Role, error) {
 	query := `
-		SELECT r.id, r.name, r.description, r.created_at 
+		SELECT r.id, r.name, r.description, r.require_2fa, r.built_in, r.created_at 
 		FROM roles r 
 		INNER JOIN user_roles ur ON r.id = ur.role_id 
 		WHERE ur.user_id = ?`
@@ -387,7 +324,7 @@ func (d *Database) GetUserRoles(userID int) ([]models.Role, error) {
 	var roles []models.Role
 	for rows.Next() {
 		var role models.Role
-		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.Require2FA, &role.BuiltIn, &role.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -435,14 +372,20 @@ func (d *Database) AssignRole(userID, roleID int, assignedBy *int) error {
 	return err
 }
 
+// RemoveRole takes a role away from a user. It returns ErrLastRoleManager
+// instead if that would leave no one able to manage roles.
 func (d *Database) RemoveRole(userID, roleID int) error {
-	query := `DELETE FROM user_roles WHERE user_id = ? AND role_id = ?`
-	_, err := d.db.Exec(query, userID, roleID)
-	return err
+	return d.inTransaction(func(tx *sql.Tx) error {
+		return keepRoleManager(tx, func() error {
+			query := `DELETE FROM user_roles WHERE user_id = ? AND role_id = ?`
+			_, err := tx.Exec(query, userID, roleID)
+			return err
+		})
+	})
 }
 
 func (d *Database) GetAllRoles() ([]models.Role, error) {
-	query := `SELECT id, name, description, created_at FROM roles ORDER BY name`
+	query := `SELECT id, name, description, require_2fa, built_in, created_at FROM roles ORDER BY name`
 	rows, err := d.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -452,7 +395,7 @@ func (d *Database) GetAllRoles() ([]models.Role, error) {
 	var roles []models.Role
 	for rows.Next() {
 		var role models.Role
-		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.Require2FA, &role.BuiltIn, &role.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -489,7 +432,7 @@ func (d *Database) GetRolePermissions(roleID int) ([]models.Permission, error) {
 }
 
 func (d *Database) GetAllUsersWithRoles() ([]models.User, error) {
-	query := `SELECT id, username, email, password_hash, created_at FROM users ORDER BY username`
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY username`
 	rows, err := d.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -498,8 +441,7 @@ func (d *Database) GetAllUsersWithRoles() ([]models.User, error) {
 
 	var users []models.User
 	for rows.Next() {
-		var user models.User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.CreatedAt)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -511,16 +453,134 @@ func (d *Database) GetAllUsersWithRoles() ([]models.User, error) {
 		}
 		user.Roles = roles
 
-		users = append(users, user)
+		users = append(users, *user)
 	}
 
 	return users, nil
 }
 
+// GetUsersWithRolesPage returns a page of users ordered by username, along
+// with the total number of users.
+func (d *Database) GetUsersWithRolesPage(limit, offset int) ([]models.User, int, error) {
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY username LIMIT ? OFFSET ?`
+	rows, err := d.db.Query(query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for i := range users {
+		roles, err := d.GetUserRoles(users[i].ID)
+		if err != nil {
+			return nil, 0, err
+		}
+		users[i].Roles = roles
+	}
+
+	return users, total, nil
+}
+
+// GetPDFsPage returns a page of the PDFs v allows, newest first, along with
+// their total number.
+func (d *Database) GetPDFsPage(v PDFVisibility, limit, offset int) ([]models.PDF, int, error) {
+	visible, args := v.where()
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM pdfs p WHERE `+visible, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + pdfColumns + ` FROM pdfs p WHERE ` + visible + ` ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`
+	rows, err := d.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var pdfs []models.PDF
+	for rows.Next() {
+		pdf, err := scanPDF(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		pdfs = append(pdfs, *pdf)
+	}
+
+	return pdfs, total, rows.Err()
+}
+
+// GetRoleByID returns a role with its permissions.
+func (d *Database) GetRoleByID(id int) (*models.Role, error) {
+	var role models.Role
+	query := `SELECT id, name, description, require_2fa, built_in, created_at FROM roles WHERE id = ?`
+	if err := d.db.QueryRow(query, id).Scan(&role.ID, &role.Name, &role.Description, &role.Require2FA, &role.BuiltIn, &role.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	permissions, err := d.GetRolePermissions(id)
+	if err != nil {
+		return nil, err
+	}
+	role.Permissions = permissions
+
+	return &role, nil
+}
+
+func (d *Database) GetAllPermissions() ([]models.Permission, error) {
+	query := `SELECT id, name, resource, action, description, created_at FROM permissions ORDER BY name`
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []models.Permission
+	for rows.Next() {
+		var perm models.Permission
+		err := rows.Scan(&perm.ID, &perm.Name, &perm.Resource, &perm.Action, &perm.Description, &perm.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, perm)
+	}
+
+	return permissions, rows.Err()
+}
+
+// DeletePDF deletes a PDF along with its digital loans, holds, access list
+// and collection memberships.
 func (d *Database) DeletePDF(id int) error {
-	query := `DELETE FROM pdfs WHERE id = ?`
-	_, err := d.db.Exec(query, id)
-	return err
+	return d.inTransaction(func(tx *sql.Tx) error {
+		for _, query := range []string{
+			`DELETE FROM pdf_acl_entries WHERE pdf_id = ?`,
+			`DELETE FROM collection_pdfs WHERE pdf_id = ?`,
+			`DELETE FROM holds WHERE pdf_id = ?`,
+			`DELETE FROM digital_loans WHERE pdf_id = ?`,
+			`DELETE FROM pdfs WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (d *Database) assignDefaultRoles() error {
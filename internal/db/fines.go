@@ -0,0 +1,311 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+var (
+	ErrFinesOwed      = errors.New("patron owes fines above the checkout threshold")
+	ErrExceedsBalance = errors.New("amount exceeds the outstanding balance")
+	ErrInvalidAmount  = errors.New("amount must be positive")
+	ErrInvalidPolicy  = errors.New("fine policy values can't be negative")
+)
+
+// GetFinePolicy returns the library-wide fine policy.
+func (d *Database) GetFinePolicy() (models.FinePolicy, error) {
+	query := `SELECT per_day_cents, grace_days, max_cents, block_threshold_cents FROM fine_policy WHERE id = 1`
+
+	var policy models.FinePolicy
+	err := d.db.QueryRow(query).Scan(&policy.PerDayCents, &policy.GraceDays, &policy.MaxCents, &policy.BlockThresholdCents)
+	return policy, err
+}
+
+func (d *Database) UpdateFinePolicy(policy models.FinePolicy) error {
+	if policy.PerDayCents < 0 || policy.GraceDays < 0 || policy.MaxCents < 0 || policy.BlockThresholdCents < 0 {
+		return ErrInvalidPolicy
+	}
+
+	query := `UPDATE fine_policy SET per_day_cents = ?, grace_days = ?, max_cents = ?, block_threshold_cents = ? WHERE id = 1`
+	_, err := d.db.Exec(query, policy.PerDayCents, policy.GraceDays, policy.MaxCents, policy.BlockThresholdCents)
+	return err
+}
+
+// GetFineOverrides returns the fine policy overrides of every role, including
+// roles without any.
+func (d *Database) GetFineOverrides() ([]models.FineOverride, error) {
+	query := `SELECT id, name, fine_per_day_cents, fine_grace_days, fine_max_cents FROM roles ORDER BY name`
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []models.FineOverride
+	for rows.Next() {
+		var override models.FineOverride
+		var perDay, grace, maxCents sql.NullInt64
+		if err := rows.Scan(&override.RoleID, &override.RoleName, &perDay, &grace, &maxCents); err != nil {
+			return nil, err
+		}
+		override.PerDayCents = nullIntPtr(perDay)
+		override.GraceDays = nullIntPtr(grace)
+		override.MaxCents = nullIntPtr(maxCents)
+		overrides = append(overrides, override)
+	}
+
+	return overrides, rows.Err()
+}
+
+// SetFineOverride sets a role's fine policy overrides. Nil values make the
+// role use the library-wide value.
+func (d *Database) SetFineOverride(override models.FineOverride) error {
+	for _, value := range []*int{override.PerDayCents, override.GraceDays, override.MaxCents} {
+		if value != nil && *value < 0 {
+			return ErrInvalidPolicy
+		}
+	}
+
+	query := `UPDATE roles SET fine_per_day_cents = ?, fine_grace_days = ?, fine_max_cents = ? WHERE id = ?`
+	result, err := d.db.Exec(query, override.PerDayCents, override.GraceDays, override.MaxCents, override.RoleID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetUserFinePolicy returns the fine policy that applies to a user: the
+// library-wide policy with the most generous value across their roles
+// applied to each setting. Roles without an override count with the
+// library-wide value, and a cap is more generous than no cap.
+func (d *Database) GetUserFinePolicy(userID int) (models.FinePolicy, error) {
+	policy, err := d.GetFinePolicy()
+	if err != nil {
+		return policy, err
+	}
+
+	query := `
+		SELECT COUNT(*),
+			MIN(COALESCE(r.fine_per_day_cents, ?)),
+			MAX(COALESCE(r.fine_grace_days, ?)),
+			MIN(NULLIF(COALESCE(r.fine_max_cents, ?), 0))
+		FROM roles r
+		INNER JOIN user_roles ur ON r.id = ur.role_id
+		WHERE ur.user_id = ?`
+
+	var roles int
+	var perDay, grace, maxCents sql.NullInt64
+	err = d.db.QueryRow(query, policy.PerDayCents, policy.GraceDays, policy.MaxCents, userID).Scan(&roles, &perDay, &grace, &maxCents)
+	if err != nil || roles == 0 {
+		return policy, err
+	}
+	policy.PerDayCents = int(perDay.Int64)
+	policy.GraceDays = int(grace.Int64)
+	// NULL means none of the roles has a cap
+	policy.MaxCents = int(maxCents.Int64)
+
+	return policy, nil
+}
+
+// AssessFines charges fines for overdue loans. Each run charges only the
+// difference between a loan's fine so far and what was already charged for
+// it, so the ledger is never rewritten. Returned loans are settled after
+// their final assessment and not looked at again. It returns the number of
+// charges recorded.
+func (d *Database) AssessFines(now time.Time) (int, error) {
+	now = now.UTC()
+	loans, err := d.queryLoans(`WHERE l.fine_settled = 0 AND l.due_at < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	policies := make(map[int]models.FinePolicy)
+	charges := 0
+	for _, loan := range loans {
+		policy, ok := policies[loan.UserID]
+		if !ok {
+			policy, err = d.GetUserFinePolicy(loan.UserID)
+			if err != nil {
+				return charges, err
+			}
+			policies[loan.UserID] = policy
+		}
+
+		end := now
+		if loan.ReturnedAt != nil {
+			end = *loan.ReturnedAt
+		}
+
+		charged, err := d.assessLoan(loan, policy.FineFor(loan.DueAt, end), loan.ReturnedAt != nil, now)
+		if err != nil {
+			return charges, fmt.Errorf("failed to assess loan %d: %w", loan.ID, err)
+		}
+		if charged {
+			charges++
+		}
+	}
+
+	return charges, nil
+}
+
+func (d *Database) assessLoan(loan models.Loan, fine int, final bool, now time.Time) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var assessed int
+	query := `SELECT COALESCE(SUM(amount_cents), 0) FROM ledger_entries WHERE loan_id = ? AND kind = ?`
+	if err := tx.QueryRow(query, loan.ID, models.LedgerCharge).Scan(&assessed); err != nil {
+		return false, err
+	}
+
+	charged := false
+	if fine > assessed {
+		query = `INSERT INTO ledger_entries (user_id, loan_id, kind, amount_cents, description, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+		description := fmt.Sprintf("Overdue fine: %s (%s)", loan.ItemTitle, loan.Barcode)
+		if _, err := tx.Exec(query, loan.UserID, loan.ID, models.LedgerCharge, fine-assessed, description, now); err != nil {
+			return false, err
+		}
+		charged = true
+	}
+
+	if final {
+		if _, err := tx.Exec(`UPDATE loans SET fine_settled = 1 WHERE id = ?`, loan.ID); err != nil {
+			return false, err
+		}
+	}
+
+	return charged, tx.Commit()
+}
+
+// GetBalance returns the fines a user owes, in cents.
+func (d *Database) GetBalance(userID int) (int, error) {
+	query := `
+		SELECT COALESCE(SUM(CASE WHEN kind = ? THEN amount_cents ELSE -amount_cents END), 0)
+		FROM ledger_entries WHERE user_id = ?`
+
+	var balance int
+	err := d.db.QueryRow(query, models.LedgerCharge, userID).Scan(&balance)
+	return balance, err
+}
+
+// GetOutstandingBalances returns every user who owes fines, largest balance
+// first.
+func (d *Database) GetOutstandingBalances() ([]models.UserBalance, error) {
+	query := `
+		SELECT u.id, u.username, SUM(CASE WHEN e.kind = ? THEN e.amount_cents ELSE -e.amount_cents END) AS balance
+		FROM ledger_entries e
+		INNER JOIN users u ON u.id = e.user_id
+		GROUP BY u.id
+		HAVING balance > 0
+		ORDER BY balance DESC`
+
+	rows, err := d.db.Query(query, models.LedgerCharge)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []models.UserBalance
+	for rows.Next() {
+		var balance models.UserBalance
+		if err := rows.Scan(&balance.UserID, &balance.Username, &balance.BalanceCents); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, rows.Err()
+}
+
+// GetLedger returns a user's ledger entries, newest first.
+func (d *Database) GetLedger(userID int) ([]models.LedgerEntry, error) {
+	query := `
+		SELECT e.id, e.user_id, e.loan_id, e.kind, e.amount_cents, e.description, e.recorded_by, COALESCE(s.username, ''), e.created_at
+		FROM ledger_entries e
+		LEFT JOIN users s ON s.id = e.recorded_by
+		WHERE e.user_id = ?
+		ORDER BY e.created_at DESC, e.id DESC`
+
+	rows, err := d.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.LedgerEntry
+	for rows.Next() {
+		var entry models.LedgerEntry
+		var loanID, recordedBy sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.UserID, &loanID, &entry.Kind, &entry.AmountCents, &entry.Description,
+			&recordedBy, &entry.RecordedByName, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.LoanID = nullIntPtr(loanID)
+		entry.RecordedBy = nullIntPtr(recordedBy)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// RecordPayment records a payment towards a user's fines, taken by the staff
+// member recordedBy.
+func (d *Database) RecordPayment(userID, amountCents int, note string, recordedBy int, now time.Time) error {
+	return d.reduceBalance(userID, models.LedgerPayment, amountCents, note, recordedBy, now)
+}
+
+// WaiveFines forgives part or all of a user's fines on behalf of the staff
+// member recordedBy.
+func (d *Database) WaiveFines(userID, amountCents int, note string, recordedBy int, now time.Time) error {
+	return d.reduceBalance(userID, models.LedgerWaiver, amountCents, note, recordedBy, now)
+}
+
+func (d *Database) reduceBalance(userID int, kind string, amountCents int, note string, recordedBy int, now time.Time) error {
+	if amountCents <= 0 {
+		return ErrInvalidAmount
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	query := `
+		SELECT COALESCE(SUM(CASE WHEN kind = ? THEN amount_cents ELSE -amount_cents END), 0)
+		FROM ledger_entries WHERE user_id = ?`
+	if err := tx.QueryRow(query, models.LedgerCharge, userID).Scan(&balance); err != nil {
+		return err
+	}
+	if amountCents > balance {
+		return ErrExceedsBalance
+	}
+
+	query = `INSERT INTO ledger_entries (user_id, kind, amount_cents, description, recorded_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, userID, kind, amountCents, note, recordedBy, now.UTC()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
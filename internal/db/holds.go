@@ -0,0 +1,272 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+// holdPickupPeriod is how long a returned copy stays set aside for the
+// patron whose hold it filled.
+const holdPickupPeriod = 7 * 24 * time.Hour
+
+var (
+	ErrHoldExists      = errors.New("patron already has a hold on this item")
+	ErrHoldNotActive   = errors.New("hold is no longer active")
+	ErrCopiesAvailable = errors.New("a copy of this item is available")
+	ErrAlreadyBorrowed = errors.New("patron already has this item on loan")
+)
+
+// PlaceHold adds a user to the end of an item's hold queue. Holds can only be
+// placed while every copy is checked out or set aside for other holds.
+func (d *Database) PlaceHold(userID, itemID int, now time.Time) (*models.Hold, error) {
+	item, err := d.GetItemByID(itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, itemCopy := range item.Copies {
+		if itemCopy.Loan != nil && itemCopy.Loan.UserID == userID {
+			return nil, ErrAlreadyBorrowed
+		}
+	}
+	if item.AvailableCopies > 0 {
+		return nil, ErrCopiesAvailable
+	}
+
+	query := `INSERT INTO holds (user_id, item_id, status, created_at) VALUES (?, ?, ?, ?)`
+	result, err := d.db.Exec(query, userID, itemID, models.HoldWaiting, now.UTC())
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrHoldExists
+		}
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.GetHoldByID(int(id))
+}
+
+// PlacePDFHold adds a user to the end of a lending-controlled PDF's hold
+// queue. Holds can only be placed while every loan of the PDF is in use or
+// set aside for other holds.
+func (d *Database) PlacePDFHold(userID, pdfID int, now time.Time) (*models.Hold, error) {
+	now = now.UTC()
+
+	var holdID int64
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		if err := refreshPDFLending(tx, pdfID, now); err != nil {
+			return err
+		}
+
+		active, err := hasActiveDigitalLoan(tx, userID, pdfID, now)
+		if err != nil {
+			return err
+		}
+		if active {
+			return ErrAlreadyBorrowed
+		}
+
+		free, _, err := pdfLoanCounts(tx, pdfID, now)
+		if err != nil {
+			return err
+		}
+		if free > 0 {
+			return ErrCopiesAvailable
+		}
+
+		query := `INSERT INTO holds (user_id, pdf_id, status, created_at) VALUES (?, ?, ?, ?)`
+		result, err := tx.Exec(query, userID, pdfID, models.HoldWaiting, now)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return ErrHoldExists
+			}
+			return err
+		}
+		holdID, err = result.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d.GetHoldByID(int(holdID))
+}
+
+// CancelHold cancels one of a user's active holds. A copy or loan that was
+// set aside for the hold passes to the next patron in the queue.
+func (d *Database) CancelHold(holdID, userID int, now time.Time) error {
+	return d.closeHold(holdID, userID, models.HoldCancelled, now)
+}
+
+// ExpireHolds expires ready holds whose pickup deadline has passed and
+// passes their copies on to the next patrons in line. It returns the number
+// of holds expired.
+func (d *Database) ExpireHolds(now time.Time) (int, error) {
+	holds, err := d.queryHolds(`WHERE h.status = ? AND h.expires_at < ?`, models.HoldReady, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, hold := range holds {
+		err := d.closeHold(hold.ID, hold.UserID, models.HoldExpired, now)
+		if errors.Is(err, ErrHoldNotActive) {
+			// Picked up or cancelled in the meantime
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	return expired, nil
+}
+
+func (d *Database) closeHold(holdID, userID int, status string, now time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var itemID, pdfID, copyID sql.NullInt64
+	var current string
+	query := `SELECT item_id, pdf_id, copy_id, status FROM holds WHERE id = ? AND user_id = ?`
+	if err := tx.QueryRow(query, holdID, userID).Scan(&itemID, &pdfID, &copyID, &current); err != nil {
+		return err
+	}
+	if current != models.HoldWaiting && current != models.HoldReady {
+		return ErrHoldNotActive
+	}
+
+	query = `UPDATE holds SET status = ?, closed_at = ? WHERE id = ? AND status = ?`
+	result, err := tx.Exec(query, status, now.UTC(), holdID, current)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrHoldNotActive
+	}
+
+	if current == models.HoldReady {
+		if copyID.Valid {
+			if _, err := assignCopyToNextHold(tx, int(copyID.Int64), int(itemID.Int64), now); err != nil {
+				return err
+			}
+		} else if pdfID.Valid {
+			if err := fillPDFHolds(tx, int(pdfID.Int64), now.UTC()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// assignCopyToNextHold sets a copy aside for the oldest waiting hold on its
+// item, starting that hold's pickup period. It returns the ID of the hold,
+// or 0 if nobody is waiting.
+func assignCopyToNextHold(tx *sql.Tx, copyID, itemID int, now time.Time) (int, error) {
+	var holdID int
+	query := `SELECT id FROM holds WHERE item_id = ? AND status = ? ORDER BY id LIMIT 1`
+	err := tx.QueryRow(query, itemID, models.HoldWaiting).Scan(&holdID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now = now.UTC()
+	query = `UPDATE holds SET status = ?, copy_id = ?, ready_at = ?, expires_at = ? WHERE id = ?`
+	if _, err := tx.Exec(query, models.HoldReady, copyID, now, now.Add(holdPickupPeriod), holdID); err != nil {
+		return 0, err
+	}
+
+	return holdID, nil
+}
+
+func (d *Database) GetHoldByID(id int) (*models.Hold, error) {
+	holds, err := d.queryHolds(`WHERE h.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(holds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &holds[0], nil
+}
+
+// GetUserHolds returns a user's active holds, oldest first, followed by
+// their most recently closed ones.
+func (d *Database) GetUserHolds(userID int) ([]models.Hold, error) {
+	return d.queryHolds(`WHERE h.user_id = ?
+	ORDER BY h.closed_at IS NOT NULL, CASE WHEN h.closed_at IS NULL THEN h.id END, h.closed_at DESC
+	LIMIT 50`, userID)
+}
+
+// GetReadyHolds returns every physical item hold awaiting pickup, soonest
+// deadline first.
+func (d *Database) GetReadyHolds() ([]models.Hold, error) {
+	return d.queryHolds(`WHERE h.status = ? AND h.item_id IS NOT NULL ORDER BY h.expires_at`, models.HoldReady)
+}
+
+// queryHolds returns the holds selected by where, which may also order and
+// limit the results.
+func (d *Database) queryHolds(where string, args ...any) ([]models.Hold, error) {
+	query := `
+		SELECT h.id, h.user_id, h.item_id, h.pdf_id, h.copy_id, h.status, h.created_at, h.ready_at, h.expires_at, h.closed_at,
+			CASE WHEN h.status = 'waiting' THEN
+				(SELECT COUNT(*) FROM holds w WHERE (w.item_id = h.item_id OR w.pdf_id = h.pdf_id) AND w.status = 'waiting' AND w.id <= h.id)
+			ELSE 0 END,
+			COALESCE(i.title, p.title, ''), COALESCE(c.barcode, ''), u.username
+		FROM holds h
+		LEFT JOIN items i ON i.id = h.item_id
+		LEFT JOIN pdfs p ON p.id = h.pdf_id
+		INNER JOIN users u ON u.id = h.user_id
+		LEFT JOIN copies c ON c.id = h.copy_id
+		` + where
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []models.Hold
+	for rows.Next() {
+		var hold models.Hold
+		var itemID, pdfID, copyID sql.NullInt64
+		var readyAt, expiresAt, closedAt sql.NullTime
+		err := rows.Scan(&hold.ID, &hold.UserID, &itemID, &pdfID, &copyID, &hold.Status, &hold.CreatedAt, &readyAt, &expiresAt, &closedAt,
+			&hold.Position, &hold.ItemTitle, &hold.Barcode, &hold.Username)
+		if err != nil {
+			return nil, err
+		}
+		hold.ItemID = nullIntPtr(itemID)
+		hold.PDFID = nullIntPtr(pdfID)
+		hold.CopyID = nullIntPtr(copyID)
+		hold.ReadyAt = nullTimePtr(readyAt)
+		hold.ExpiresAt = nullTimePtr(expiresAt)
+		hold.ClosedAt = nullTimePtr(closedAt)
+		holds = append(holds, hold)
+	}
+
+	return holds, rows.Err()
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
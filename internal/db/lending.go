@@ -0,0 +1,320 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+// digitalLoanPeriod is how long a digital loan grants access to a PDF.
+const digitalLoanPeriod = 14 * 24 * time.Hour
+
+// digitalHoldPickupPeriod is how long a freed-up loan stays reserved for the
+// patron whose hold it filled.
+const digitalHoldPickupPeriod = 2 * 24 * time.Hour
+
+var (
+	ErrNotLendable      = errors.New("PDF can be read without a loan")
+	ErrNoLoansAvailable = errors.New("every loan of this PDF is in use")
+	ErrNoDigitalLoan    = errors.New("patron has no active loan of this PDF")
+)
+
+// BorrowPDF starts a digital loan of a lending-controlled PDF. A patron
+// whose hold is ready gets the loan reserved for them; anyone else can only
+// borrow while a loan is free and nobody is waiting for it.
+func (d *Database) BorrowPDF(userID, pdfID int, now time.Time) (*models.DigitalLoan, error) {
+	now = now.UTC()
+
+	var loanID int64
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		if err := refreshPDFLending(tx, pdfID, now); err != nil {
+			return err
+		}
+
+		active, err := hasActiveDigitalLoan(tx, userID, pdfID, now)
+		if err != nil {
+			return err
+		}
+		if active {
+			return ErrAlreadyBorrowed
+		}
+
+		// A ready hold already has a loan set aside
+		query := `UPDATE holds SET status = ?, closed_at = ? WHERE user_id = ? AND pdf_id = ? AND status = ?`
+		result, err := tx.Exec(query, models.HoldFulfilled, now, userID, pdfID, models.HoldReady)
+		if err != nil {
+			return err
+		}
+		fulfilled, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if fulfilled == 0 {
+			free, _, err := pdfLoanCounts(tx, pdfID, now)
+			if err != nil {
+				return err
+			}
+			if free <= 0 {
+				return ErrNoLoansAvailable
+			}
+		}
+
+		query = `INSERT INTO digital_loans (user_id, pdf_id, checked_out_at, due_at) VALUES (?, ?, ?, ?)`
+		result, err = tx.Exec(query, userID, pdfID, now, now.Add(digitalLoanPeriod))
+		if err != nil {
+			if isUniqueViolation(err) {
+				return ErrAlreadyBorrowed
+			}
+			return err
+		}
+		loanID, err = result.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d.GetDigitalLoanByID(int(loanID))
+}
+
+// ReturnPDF ends a patron's loan of a PDF early, passing it on to the next
+// patron in the hold queue.
+func (d *Database) ReturnPDF(userID, pdfID int, now time.Time) error {
+	now = now.UTC()
+
+	return d.inTransaction(func(tx *sql.Tx) error {
+		query := `UPDATE digital_loans SET returned_at = ? WHERE user_id = ? AND pdf_id = ? AND returned_at IS NULL AND due_at > ?`
+		result, err := tx.Exec(query, now, userID, pdfID, now)
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrNoDigitalLoan
+		}
+
+		return fillPDFHolds(tx, pdfID, now)
+	})
+}
+
+// ExpireDigitalLoans ends digital loans whose due time has passed and hands
+// the freed loans to waiting holds. It returns the number of loans expired.
+func (d *Database) ExpireDigitalLoans(now time.Time) (int, error) {
+	now = now.UTC()
+
+	query := `
+		SELECT pdf_id FROM digital_loans WHERE returned_at IS NULL AND due_at <= ?
+		UNION
+		SELECT pdf_id FROM holds WHERE pdf_id IS NOT NULL AND status = ?`
+	rows, err := d.db.Query(query, now, models.HoldWaiting)
+	if err != nil {
+		return 0, err
+	}
+	var pdfIDs []int
+	for rows.Next() {
+		var pdfID int
+		if err := rows.Scan(&pdfID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pdfIDs = append(pdfIDs, pdfID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, pdfID := range pdfIDs {
+		err := d.inTransaction(func(tx *sql.Tx) error {
+			n, err := expireDigitalLoans(tx, pdfID, now)
+			if err != nil {
+				return err
+			}
+			expired += n
+			return fillPDFHolds(tx, pdfID, now)
+		})
+		if err != nil {
+			return expired, err
+		}
+	}
+
+	return expired, nil
+}
+
+// refreshPDFLending ends a PDF's overdue loans and hands free loans to
+// waiting holds, so lending decisions don't depend on when the background
+// job last ran.
+func refreshPDFLending(tx *sql.Tx, pdfID int, now time.Time) error {
+	var maxLoans int
+	if err := tx.QueryRow(`SELECT max_concurrent_loans FROM pdfs WHERE id = ?`, pdfID).Scan(&maxLoans); err != nil {
+		return err
+	}
+	if maxLoans == 0 {
+		return ErrNotLendable
+	}
+
+	if _, err := expireDigitalLoans(tx, pdfID, now); err != nil {
+		return err
+	}
+	return fillPDFHolds(tx, pdfID, now)
+}
+
+func expireDigitalLoans(tx *sql.Tx, pdfID int, now time.Time) (int, error) {
+	query := `UPDATE digital_loans SET returned_at = due_at WHERE pdf_id = ? AND returned_at IS NULL AND due_at <= ?`
+	result, err := tx.Exec(query, pdfID, now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// fillPDFHolds sets free loans of a PDF aside for the oldest waiting holds,
+// starting their pickup periods. Holds on a PDF that no longer needs a loan
+// are fulfilled, since the patrons can simply read it.
+func fillPDFHolds(tx *sql.Tx, pdfID int, now time.Time) error {
+	var maxLoans int
+	if err := tx.QueryRow(`SELECT max_concurrent_loans FROM pdfs WHERE id = ?`, pdfID).Scan(&maxLoans); err != nil {
+		return err
+	}
+	if maxLoans == 0 {
+		query := `UPDATE holds SET status = ?, closed_at = ? WHERE pdf_id = ? AND status IN (?, ?)`
+		_, err := tx.Exec(query, models.HoldFulfilled, now, pdfID, models.HoldWaiting, models.HoldReady)
+		return err
+	}
+
+	free, _, err := pdfLoanCounts(tx, pdfID, now)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE holds SET status = ?, ready_at = ?, expires_at = ?
+		WHERE id IN (SELECT id FROM holds WHERE pdf_id = ? AND status = ? ORDER BY id LIMIT ?)`
+	_, err = tx.Exec(query, models.HoldReady, now, now.Add(digitalHoldPickupPeriod), pdfID, models.HoldWaiting, max(free, 0))
+	return err
+}
+
+// pdfLoanCounts returns how many loans of a PDF are neither in use nor set
+// aside for a ready hold, and how many holds are waiting for one.
+func pdfLoanCounts(tx *sql.Tx, pdfID int, now time.Time) (free, waiting int, err error) {
+	query := `
+		SELECT p.max_concurrent_loans
+			- (SELECT COUNT(*) FROM digital_loans l WHERE l.pdf_id = p.id AND l.returned_at IS NULL AND l.due_at > ?)
+			- (SELECT COUNT(*) FROM holds h WHERE h.pdf_id = p.id AND h.status = ?),
+			(SELECT COUNT(*) FROM holds h WHERE h.pdf_id = p.id AND h.status = ?)
+		FROM pdfs p WHERE p.id = ?`
+	err = tx.QueryRow(query, now, models.HoldReady, models.HoldWaiting, pdfID).Scan(&free, &waiting)
+	return free, waiting, err
+}
+
+// HasActiveDigitalLoan reports whether a user currently has a PDF on loan.
+func (d *Database) HasActiveDigitalLoan(userID, pdfID int, now time.Time) (bool, error) {
+	return hasActiveDigitalLoan(d.db, userID, pdfID, now)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func hasActiveDigitalLoan(q rowQuerier, userID, pdfID int, now time.Time) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM digital_loans WHERE user_id = ? AND pdf_id = ? AND returned_at IS NULL AND due_at > ?)`
+	err := q.QueryRow(query, userID, pdfID, now.UTC()).Scan(&exists)
+	return exists, err
+}
+
+// GetPDFLending returns the lending state of a lending-controlled PDF for a
+// user.
+func (d *Database) GetPDFLending(pdfID, userID int, now time.Time) (models.PDFLending, error) {
+	now = now.UTC()
+	var lending models.PDFLending
+
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		if err := refreshPDFLending(tx, pdfID, now); err != nil {
+			return err
+		}
+
+		free, waiting, err := pdfLoanCounts(tx, pdfID, now)
+		if err != nil {
+			return err
+		}
+		lending.Available = max(free, 0)
+		lending.Waiting = waiting
+		return nil
+	})
+	if err != nil {
+		return lending, err
+	}
+
+	loans, err := d.queryDigitalLoans(`WHERE l.user_id = ? AND l.pdf_id = ? AND l.returned_at IS NULL AND l.due_at > ?`, userID, pdfID, now)
+	if err != nil {
+		return lending, err
+	}
+	if len(loans) > 0 {
+		lending.Loan = &loans[0]
+	}
+
+	holds, err := d.queryHolds(`WHERE h.user_id = ? AND h.pdf_id = ? AND h.status IN (?, ?)`, userID, pdfID, models.HoldWaiting, models.HoldReady)
+	if err != nil {
+		return lending, err
+	}
+	if len(holds) > 0 {
+		lending.Hold = &holds[0]
+	}
+
+	return lending, nil
+}
+
+func (d *Database) GetDigitalLoanByID(id int) (*models.DigitalLoan, error) {
+	loans, err := d.queryDigitalLoans(`WHERE l.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(loans) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &loans[0], nil
+}
+
+// GetUserDigitalLoans returns a user's active digital loans, soonest due
+// first.
+func (d *Database) GetUserDigitalLoans(userID int, now time.Time) ([]models.DigitalLoan, error) {
+	return d.queryDigitalLoans(`WHERE l.user_id = ? AND l.returned_at IS NULL AND l.due_at > ? ORDER BY l.due_at`, userID, now.UTC())
+}
+
+// queryDigitalLoans returns the digital loans selected by where, which may
+// also order and limit the results.
+func (d *Database) queryDigitalLoans(where string, args ...any) ([]models.DigitalLoan, error) {
+	query := `
+		SELECT l.id, l.user_id, l.pdf_id, l.checked_out_at, l.due_at, l.returned_at, p.title, u.username
+		FROM digital_loans l
+		INNER JOIN pdfs p ON p.id = l.pdf_id
+		INNER JOIN users u ON u.id = l.user_id
+		` + where
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []models.DigitalLoan
+	for rows.Next() {
+		var loan models.DigitalLoan
+		var returnedAt sql.NullTime
+		err := rows.Scan(&loan.ID, &loan.UserID, &loan.PDFID, &loan.CheckedOutAt, &loan.DueAt, &returnedAt, &loan.PDFTitle, &loan.Username)
+		if err != nil {
+			return nil, err
+		}
+		loan.ReturnedAt = nullTimePtr(returnedAt)
+		loans = append(loans, loan)
+	}
+
+	return loans, rows.Err()
+}
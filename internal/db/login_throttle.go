@@ -0,0 +1,244 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"strings"
+	"time"
+)
+
+// loginThrottle sets how failed logins counted under one kind of subject are
+// slowed down and locked out.
+type loginThrottle struct {
+	freeFailures int // Failures allowed before backoff starts
+	lockoutAfter int // Failures that lock the subject out
+}
+
+// loginThrottles allow more failures per IP address than per username, since
+// many users can share an address.
+var loginThrottles = map[string]loginThrottle{
+	models.LockoutUsername: {freeFailures: 3, lockoutAfter: 10},
+	models.LockoutIP:       {freeFailures: 10, lockoutAfter: 50},
+}
+
+const (
+	loginBackoffBase   = time.Second
+	loginBackoffMax    = 5 * time.Minute
+	lockoutPeriod      = 30 * time.Minute
+	loginFailureWindow = time.Hour // A counter restarts after this long without failures
+)
+
+// loginBackoff returns how long logins are blocked after a number of
+// failures: nothing for the free failures, then doubling from
+// loginBackoffBase up to loginBackoffMax.
+func loginBackoff(throttle loginThrottle, failures int) time.Duration {
+	if failures <= throttle.freeFailures {
+		return 0
+	}
+	delay := loginBackoffBase
+	for i := throttle.freeFailures + 1; i < failures && delay < loginBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, loginBackoffMax)
+}
+
+// loginSubjects returns the counters a login attempt is counted under.
+// Usernames are compared case-insensitively, so that changing the case
+// doesn't reset the count.
+func loginSubjects(username, ip string) [][2]string {
+	return [][2]string{
+		{models.LockoutUsername, strings.ToLower(strings.TrimSpace(username))},
+		{models.LockoutIP, ip},
+	}
+}
+
+// LoginBlockedUntil returns when logins for a username from an IP address
+// are allowed again, or the zero time if they are allowed now.
+func (d *Database) LoginBlockedUntil(username, ip string, now time.Time) (time.Time, error) {
+	now = now.UTC()
+
+	var blockedUntil time.Time
+	for _, subject := range loginSubjects(username, ip) {
+		var until sql.NullTime
+		query := `SELECT blocked_until FROM login_failures WHERE kind = ? AND subject = ?`
+		err := d.db.QueryRow(query, subject[0], subject[1]).Scan(&until)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if until.Valid && until.Time.After(now) && until.Time.After(blockedUntil) {
+			blockedUntil = until.Time
+		}
+	}
+
+	return blockedUntil, nil
+}
+
+// RecordLoginFailure counts a failed login for a username from an IP
+// address, blocking further attempts for a backoff period. Subjects that
+// reach their lockout threshold are locked out for lockoutPeriod, and the
+// lockouts are returned. Counters keep counting through a lockout, so the
+// next failure after it ends locks the subject out again.
+func (d *Database) RecordLoginFailure(username, ip string, now time.Time) ([]models.Lockout, error) {
+	now = now.UTC()
+
+	var lockoutIDs []int64
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		for _, subject := range loginSubjects(username, ip) {
+			kind, name := subject[0], subject[1]
+			throttle := loginThrottles[kind]
+
+			var failures int
+			var lastFailure time.Time
+			query := `SELECT failures, last_failure_at FROM login_failures WHERE kind = ? AND subject = ?`
+			err := tx.QueryRow(query, kind, name).Scan(&failures, &lastFailure)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if now.Sub(lastFailure) > loginFailureWindow {
+				failures = 0
+			}
+			failures++
+
+			var blockedUntil *time.Time
+			if delay := loginBackoff(throttle, failures); delay > 0 {
+				until := now.Add(delay)
+				blockedUntil = &until
+			}
+
+			if failures >= throttle.lockoutAfter {
+				until := now.Add(lockoutPeriod)
+				blockedUntil = &until
+
+				query := `INSERT INTO lockouts (kind, subject, ip_address, failures, locked_at, locked_until) VALUES (?, ?, ?, ?, ?, ?)`
+				result, err := tx.Exec(query, kind, name, ip, failures, now, until)
+				if err != nil {
+					return err
+				}
+				id, err := result.LastInsertId()
+				if err != nil {
+					return err
+				}
+				lockoutIDs = append(lockoutIDs, id)
+			}
+
+			query = `
+				INSERT INTO login_failures (kind, subject, failures, last_failure_at, blocked_until) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (kind, subject) DO UPDATE SET failures = excluded.failures, last_failure_at = excluded.last_failure_at, blocked_until = excluded.blocked_until`
+			if _, err := tx.Exec(query, kind, name, failures, now, blockedUntil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var lockouts []models.Lockout
+	for _, id := range lockoutIDs {
+		started, err := d.queryLockouts(`WHERE l.id = ?`, id)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, started...)
+	}
+	return lockouts, nil
+}
+
+// ClearLoginFailures resets the failure counter of a username after a
+// successful login. IP address counters are left alone, so that logging in
+// to one account doesn't clear the way for guessing the passwords of others.
+func (d *Database) ClearLoginFailures(username string) error {
+	subject := loginSubjects(username, "")[0]
+	_, err := d.db.Exec(`DELETE FROM login_failures WHERE kind = ? AND subject = ?`, subject[0], subject[1])
+	return err
+}
+
+// PruneLoginFailures deletes counters that have restarted and no longer
+// block logins.
+func (d *Database) PruneLoginFailures(now time.Time) (int, error) {
+	now = now.UTC()
+
+	query := `DELETE FROM login_failures WHERE last_failure_at < ? AND (blocked_until IS NULL OR blocked_until < ?)`
+	result, err := d.db.Exec(query, now.Add(-loginFailureWindow), now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// GetActiveLockouts returns the lockouts that still block logins, newest
+// first.
+func (d *Database) GetActiveLockouts(now time.Time) ([]models.Lockout, error) {
+	return d.queryLockouts(`WHERE l.unlocked_at IS NULL AND l.locked_until > ? ORDER BY l.locked_at DESC, l.id DESC`, now.UTC())
+}
+
+// Unlock ends an active lockout early and resets the failure counter of its
+// subject. It returns sql.ErrNoRows if the lockout isn't active.
+func (d *Database) Unlock(lockoutID, unlockedBy int, now time.Time) (*models.Lockout, error) {
+	now = now.UTC()
+
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		var kind, subject string
+		query := `SELECT kind, subject FROM lockouts WHERE id = ? AND unlocked_at IS NULL AND locked_until > ?`
+		if err := tx.QueryRow(query, lockoutID, now).Scan(&kind, &subject); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`UPDATE lockouts SET unlocked_at = ?, unlocked_by = ? WHERE id = ?`, now, unlockedBy, lockoutID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`DELETE FROM login_failures WHERE kind = ? AND subject = ?`, kind, subject)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lockouts, err := d.queryLockouts(`WHERE l.id = ?`, lockoutID)
+	if err != nil {
+		return nil, err
+	}
+	if len(lockouts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &lockouts[0], nil
+}
+
+// queryLockouts returns the lockouts selected by where, which may also order
+// and limit the results.
+func (d *Database) queryLockouts(where string, args ...any) ([]models.Lockout, error) {
+	query := `
+		SELECT l.id, l.kind, l.subject, l.ip_address, l.failures, l.locked_at, l.locked_until, l.unlocked_at, l.unlocked_by, COALESCE(u.username, '')
+		FROM lockouts l
+		LEFT JOIN users u ON u.id = l.unlocked_by
+		` + where
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []models.Lockout
+	for rows.Next() {
+		var lockout models.Lockout
+		var unlockedAt sql.NullTime
+		var unlockedBy sql.NullInt64
+		err := rows.Scan(&lockout.ID, &lockout.Kind, &lockout.Subject, &lockout.IPAddress, &lockout.Failures, &lockout.LockedAt, &lockout.LockedUntil, &unlockedAt, &unlockedBy, &lockout.UnlockedByName)
+		if err != nil {
+			return nil, err
+		}
+		lockout.UnlockedAt = nullTimePtr(unlockedAt)
+		lockout.UnlockedBy = nullIntPtr(unlockedBy)
+		lockouts = append(lockouts, lockout)
+	}
+
+	return lockouts, rows.Err()
+}
@@ -0,0 +1,1092 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a numbered, reversible schema change. Migrations are applied
+// in version order, each in its own transaction together with its
+// schema_migrations record, so a failed migration leaves no trace.
+//
+// Never edit a migration that has been released; add a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+	down        func(tx *sql.Tx) error
+}
+
+// MigrationStatus describes a known migration and whether it has been
+// applied to the database.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// Databases created before migrations existed already contain some of the
+// tables and columns below, so the early migrations use IF NOT EXISTS and
+// addColumnIfMissing to be recorded on them without errors.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create users, pdfs and access history tables",
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT UNIQUE NOT NULL,
+				email TEXT UNIQUE NOT NULL,
+				password_hash TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS pdfs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				title TEXT NOT NULL,
+				author TEXT,
+				description TEXT,
+				filename TEXT NOT NULL,
+				file_path TEXT NOT NULL,
+				uploaded_by INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (uploaded_by) REFERENCES users(id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_pdf_access (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				pdf_id INTEGER NOT NULL,
+				accessed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (pdf_id) REFERENCES pdfs(id)
+			)`,
+		),
+		down: execAll(
+			`DROP TABLE IF EXISTS user_pdf_access`,
+			`DROP TABLE IF EXISTS pdfs`,
+			`DROP TABLE IF EXISTS users`,
+		),
+	},
+	{
+		version:     2,
+		description: "create RBAC tables",
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS roles (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL,
+				description TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS permissions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL,
+				resource TEXT NOT NULL,
+				action TEXT NOT NULL,
+				description TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_roles (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				role_id INTEGER NOT NULL,
+				assigned_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				assigned_by INTEGER,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (role_id) REFERENCES roles(id),
+				FOREIGN KEY (assigned_by) REFERENCES users(id),
+				UNIQUE(user_id, role_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS role_permissions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				role_id INTEGER NOT NULL,
+				permission_id INTEGER NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (role_id) REFERENCES roles(id),
+				FOREIGN KEY (permission_id) REFERENCES permissions(id),
+				UNIQUE(role_id, permission_id)
+			)`,
+		),
+		down: execAll(
+			`DROP TABLE IF EXISTS role_permissions`,
+			`DROP TABLE IF EXISTS user_roles`,
+			`DROP TABLE IF EXISTS permissions`,
+			`DROP TABLE IF EXISTS roles`,
+		),
+	},
+	{
+		version:     3,
+		description: "seed default roles and permissions",
+		up: seedRBAC(
+			[]seedRole{
+				{"admin", "System administrator with full access"},
+				{"user", "Regular user with catalog access"},
+			},
+			[]seedPermission{
+				{"upload_pdf", "pdf", "create", "Upload PDF files"},
+				{"view_pdf", "pdf", "read", "View PDF files"},
+				{"edit_pdf", "pdf", "update", "Edit PDF metadata"},
+				{"delete_pdf", "pdf", "delete", "Delete PDF files"},
+				{"manage_users", "user", "manage", "Manage user accounts"},
+				{"manage_roles", "role", "manage", "Manage user roles"},
+			},
+			map[string][]string{
+				"admin": {"upload_pdf", "view_pdf", "edit_pdf", "delete_pdf", "manage_users", "manage_roles"},
+				"user":  {"view_pdf"},
+			},
+		),
+		down: unseedRBAC(
+			[]string{"admin", "user"},
+			[]string{"upload_pdf", "view_pdf", "edit_pdf", "delete_pdf", "manage_users", "manage_roles"},
+		),
+	},
+	{
+		version:     4,
+		description: "create sessions table",
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS sessions (
+				token_hash TEXT PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				username TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				last_seen_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				ip_address TEXT NOT NULL DEFAULT '',
+				user_agent TEXT NOT NULL DEFAULT '',
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+		),
+		down: execAll(
+			`DROP TABLE IF EXISTS sessions`,
+		),
+	},
+	{
+		version:     5,
+		description: "add pdfs.updated_at",
+		up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "pdfs", "updated_at", "DATETIME"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`UPDATE pdfs SET updated_at = created_at WHERE updated_at IS NULL`)
+			return err
+		},
+		down: execAll(
+			`ALTER TABLE pdfs DROP COLUMN updated_at`,
+		),
+	},
+	{
+		version:     6,
+		description: "add physical items, copies, loans and per-role loan policies",
+		up: inOrder(
+			execAll(
+				`CREATE TABLE items (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					title TEXT NOT NULL,
+					author TEXT NOT NULL DEFAULT '',
+					isbn TEXT NOT NULL DEFAULT '',
+					description TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`,
+				`CREATE TABLE copies (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					item_id INTEGER NOT NULL,
+					barcode TEXT UNIQUE NOT NULL,
+					shelf_location TEXT NOT NULL DEFAULT '',
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (item_id) REFERENCES items(id)
+				)`,
+				`CREATE INDEX idx_copies_item_id ON copies(item_id)`,
+				`CREATE TABLE loans (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					copy_id INTEGER NOT NULL,
+					user_id INTEGER NOT NULL,
+					checked_out_by INTEGER NOT NULL,
+					checked_out_at DATETIME NOT NULL,
+					due_at DATETIME NOT NULL,
+					returned_at DATETIME,
+					renewals INTEGER NOT NULL DEFAULT 0,
+					FOREIGN KEY (copy_id) REFERENCES copies(id),
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (checked_out_by) REFERENCES users(id)
+				)`,
+				// A copy can only be on one active loan at a time
+				`CREATE UNIQUE INDEX idx_loans_active_copy ON loans(copy_id) WHERE returned_at IS NULL`,
+				`CREATE INDEX idx_loans_user_id ON loans(user_id)`,
+				`ALTER TABLE roles ADD COLUMN loan_limit INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE roles ADD COLUMN loan_period_days INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE roles ADD COLUMN max_renewals INTEGER NOT NULL DEFAULT 0`,
+			),
+			seedRBAC(
+				[]seedRole{
+					{"librarian", "Library staff who manage items and circulation"},
+				},
+				[]seedPermission{
+					{"borrow_items", "loan", "create", "Borrow physical items"},
+					{"manage_circulation", "loan", "manage", "Check out, check in and renew loans"},
+					{"manage_items", "item", "manage", "Add physical items and copies"},
+				},
+				map[string][]string{
+					"admin":     {"borrow_items", "manage_circulation", "manage_items"},
+					"librarian": {"view_pdf", "borrow_items", "manage_circulation", "manage_items"},
+					"user":      {"borrow_items"},
+				},
+			),
+			execAll(
+				`UPDATE roles SET loan_limit = 5, loan_period_days = 21, max_renewals = 2 WHERE name = 'user'`,
+				`UPDATE roles SET loan_limit = 20, loan_period_days = 28, max_renewals = 3 WHERE name IN ('admin', 'librarian')`,
+			),
+		),
+		down: inOrder(
+			unseedRBAC(
+				[]string{"librarian"},
+				[]string{"borrow_items", "manage_circulation", "manage_items"},
+			),
+			execAll(
+				`ALTER TABLE roles DROP COLUMN max_renewals`,
+				`ALTER TABLE roles DROP COLUMN loan_period_days`,
+				`ALTER TABLE roles DROP COLUMN loan_limit`,
+				`DROP TABLE loans`,
+				`DROP TABLE copies`,
+				`DROP TABLE items`,
+			),
+		),
+	},
+	{
+		version:     7,
+		description: "add holds",
+		up: execAll(
+			`CREATE TABLE holds (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				item_id INTEGER NOT NULL,
+				copy_id INTEGER,
+				status TEXT NOT NULL DEFAULT 'waiting',
+				created_at DATETIME NOT NULL,
+				ready_at DATETIME,
+				expires_at DATETIME,
+				closed_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (item_id) REFERENCES items(id),
+				FOREIGN KEY (copy_id) REFERENCES copies(id)
+			)`,
+			`CREATE INDEX idx_holds_item_status ON holds(item_id, status)`,
+			// A patron holds an item at most once, and a copy is set aside
+			// for at most one hold
+			`CREATE UNIQUE INDEX idx_holds_active_user_item ON holds(user_id, item_id) WHERE status IN ('waiting', 'ready')`,
+			`CREATE UNIQUE INDEX idx_holds_ready_copy ON holds(copy_id) WHERE status = 'ready'`,
+		),
+		down: execAll(
+			`DROP TABLE holds`,
+		),
+	},
+	{
+		version:     8,
+		description: "add fine policy and fines ledger",
+		up: inOrder(
+			execAll(
+				`CREATE TABLE fine_policy (
+					id INTEGER PRIMARY KEY CHECK (id = 1),
+					per_day_cents INTEGER NOT NULL,
+					grace_days INTEGER NOT NULL,
+					max_cents INTEGER NOT NULL,
+					block_threshold_cents INTEGER NOT NULL
+				)`,
+				`INSERT INTO fine_policy (id, per_day_cents, grace_days, max_cents, block_threshold_cents) VALUES (1, 25, 1, 1000, 500)`,
+				// NULL means the role uses the library-wide policy
+				`ALTER TABLE roles ADD COLUMN fine_per_day_cents INTEGER`,
+				`ALTER TABLE roles ADD COLUMN fine_grace_days INTEGER`,
+				`ALTER TABLE roles ADD COLUMN fine_max_cents INTEGER`,
+				`CREATE TABLE ledger_entries (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					loan_id INTEGER,
+					kind TEXT NOT NULL,
+					amount_cents INTEGER NOT NULL CHECK (amount_cents > 0),
+					description TEXT NOT NULL DEFAULT '',
+					recorded_by INTEGER,
+					created_at DATETIME NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (loan_id) REFERENCES loans(id),
+					FOREIGN KEY (recorded_by) REFERENCES users(id)
+				)`,
+				`CREATE INDEX idx_ledger_entries_user_id ON ledger_entries(user_id)`,
+				`CREATE INDEX idx_ledger_entries_loan_id ON ledger_entries(loan_id)`,
+				// Set once a returned loan's fine has been fully charged
+				`ALTER TABLE loans ADD COLUMN fine_settled INTEGER NOT NULL DEFAULT 0`,
+			),
+			seedRBAC(
+				nil,
+				[]seedPermission{
+					{"manage_fines", "fine", "manage", "Record payments, waive fines and set the fine policy"},
+				},
+				map[string][]string{
+					"admin":     {"manage_fines"},
+					"librarian": {"manage_fines"},
+				},
+			),
+		),
+		down: inOrder(
+			unseedRBAC(nil, []string{"manage_fines"}),
+			execAll(
+				`ALTER TABLE loans DROP COLUMN fine_settled`,
+				`DROP TABLE ledger_entries`,
+				`ALTER TABLE roles DROP COLUMN fine_max_cents`,
+				`ALTER TABLE roles DROP COLUMN fine_grace_days`,
+				`ALTER TABLE roles DROP COLUMN fine_per_day_cents`,
+				`DROP TABLE fine_policy`,
+			),
+		),
+	},
+	{
+		version:     9,
+		description: "add controlled digital lending of PDFs",
+		up: execAll(
+			// 0 means the PDF can be read by any number of users without a loan
+			`ALTER TABLE pdfs ADD COLUMN max_concurrent_loans INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE digital_loans (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				pdf_id INTEGER NOT NULL,
+				checked_out_at DATETIME NOT NULL,
+				due_at DATETIME NOT NULL,
+				returned_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (pdf_id) REFERENCES pdfs(id)
+			)`,
+			`CREATE INDEX idx_digital_loans_pdf_id ON digital_loans(pdf_id)`,
+			`CREATE UNIQUE INDEX idx_digital_loans_active_user_pdf ON digital_loans(user_id, pdf_id) WHERE returned_at IS NULL`,
+			// Holds are now either on a physical item or on a PDF. SQLite
+			// can't drop NOT NULL from item_id, so the table is rebuilt.
+			`CREATE TABLE holds_new (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				item_id INTEGER,
+				pdf_id INTEGER,
+				copy_id INTEGER,
+				status TEXT NOT NULL DEFAULT 'waiting',
+				created_at DATETIME NOT NULL,
+				ready_at DATETIME,
+				expires_at DATETIME,
+				closed_at DATETIME,
+				CHECK ((item_id IS NULL) != (pdf_id IS NULL)),
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (item_id) REFERENCES items(id),
+				FOREIGN KEY (pdf_id) REFERENCES pdfs(id),
+				FOREIGN KEY (copy_id) REFERENCES copies(id)
+			)`,
+			`INSERT INTO holds_new (id, user_id, item_id, copy_id, status, created_at, ready_at, expires_at, closed_at)
+				SELECT id, user_id, item_id, copy_id, status, created_at, ready_at, expires_at, closed_at FROM holds`,
+			`DROP TABLE holds`,
+			`ALTER TABLE holds_new RENAME TO holds`,
+			`CREATE INDEX idx_holds_item_status ON holds(item_id, status)`,
+			`CREATE INDEX idx_holds_pdf_status ON holds(pdf_id, status)`,
+			`CREATE UNIQUE INDEX idx_holds_active_user_item ON holds(user_id, item_id) WHERE status IN ('waiting', 'ready')`,
+			`CREATE UNIQUE INDEX idx_holds_active_user_pdf ON holds(user_id, pdf_id) WHERE status IN ('waiting', 'ready')`,
+			`CREATE UNIQUE INDEX idx_holds_ready_copy ON holds(copy_id) WHERE status = 'ready'`,
+		),
+		down: execAll(
+			`CREATE TABLE holds_old (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				item_id INTEGER NOT NULL,
+				copy_id INTEGER,
+				status TEXT NOT NULL DEFAULT 'waiting',
+				created_at DATETIME NOT NULL,
+				ready_at DATETIME,
+				expires_at DATETIME,
+				closed_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (item_id) REFERENCES items(id),
+				FOREIGN KEY (copy_id) REFERENCES copies(id)
+			)`,
+			`INSERT INTO holds_old (id, user_id, item_id, copy_id, status, created_at, ready_at, expires_at, closed_at)
+				SELECT id, user_id, item_id, copy_id, status, created_at, ready_at, expires_at, closed_at FROM holds WHERE item_id IS NOT NULL`,
+			`DROP TABLE holds`,
+			`ALTER TABLE holds_old RENAME TO holds`,
+			`CREATE INDEX idx_holds_item_status ON holds(item_id, status)`,
+			`CREATE UNIQUE INDEX idx_holds_active_user_item ON holds(user_id, item_id) WHERE status IN ('waiting', 'ready')`,
+			`CREATE UNIQUE INDEX idx_holds_ready_copy ON holds(copy_id) WHERE status = 'ready'`,
+			`DROP TABLE digital_loans`,
+			`ALTER TABLE pdfs DROP COLUMN max_concurrent_loans`,
+		),
+	},
+	{
+		version:     10,
+		description: "create api_tokens table",
+		up: execAll(
+			`CREATE TABLE api_tokens (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				token_hash TEXT UNIQUE NOT NULL,
+				scopes TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME,
+				last_used_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_api_tokens_user_id ON api_tokens(user_id)`,
+		),
+		down: execAll(`DROP TABLE api_tokens`),
+	},
+	{
+		version:     11,
+		description: "create password_resets table",
+		up: execAll(
+			`CREATE TABLE password_resets (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				token_hash TEXT UNIQUE NOT NULL,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				used_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_password_resets_user_id ON password_resets(user_id)`,
+		),
+		down: execAll(`DROP TABLE password_resets`),
+	},
+	{
+		version:     12,
+		description: "add email verification, account status and invitations",
+		up: execAll(
+			`ALTER TABLE users ADD COLUMN email_verified_at DATETIME`,
+			`ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active'`,
+			// Existing accounts predate verification and keep working
+			`UPDATE users SET email_verified_at = COALESCE(created_at, CURRENT_TIMESTAMP)`,
+			`CREATE TABLE email_verifications (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				token_hash TEXT UNIQUE NOT NULL,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				used_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_email_verifications_user_id ON email_verifications(user_id)`,
+			`CREATE TABLE invitations (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				email TEXT NOT NULL,
+				token_hash TEXT UNIQUE NOT NULL,
+				invited_by INTEGER NOT NULL,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				used_at DATETIME,
+				used_by INTEGER,
+				FOREIGN KEY (invited_by) REFERENCES users(id),
+				FOREIGN KEY (used_by) REFERENCES users(id)
+			)`,
+		),
+		down: execAll(
+			`DROP TABLE invitations`,
+			`DROP TABLE email_verifications`,
+			`ALTER TABLE users DROP COLUMN status`,
+			`ALTER TABLE users DROP COLUMN email_verified_at`,
+		),
+	},
+	{
+		version:     13,
+		description: "add login failure counters and lockouts",
+		up: execAll(
+			`CREATE TABLE login_failures (
+				kind TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				failures INTEGER NOT NULL,
+				last_failure_at DATETIME NOT NULL,
+				blocked_until DATETIME,
+				PRIMARY KEY (kind, subject)
+			)`,
+			`CREATE TABLE lockouts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				kind TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				ip_address TEXT NOT NULL,
+				failures INTEGER NOT NULL,
+				locked_at DATETIME NOT NULL,
+				locked_until DATETIME NOT NULL,
+				unlocked_at DATETIME,
+				unlocked_by INTEGER,
+				FOREIGN KEY (unlocked_by) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_lockouts_locked_until ON lockouts(locked_until)`,
+		),
+		down: execAll(
+			`DROP TABLE lockouts`,
+			`DROP TABLE login_failures`,
+		),
+	},
+	{
+		version:     14,
+		description: "add TOTP two-factor authentication",
+		up: execAll(
+			`ALTER TABLE users ADD COLUMN totp_secret TEXT`,
+			`ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME`,
+			`ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE roles ADD COLUMN require_2fa BOOLEAN NOT NULL DEFAULT 0`,
+			`CREATE TABLE recovery_codes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				code_hash TEXT NOT NULL,
+				used_at DATETIME,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_recovery_codes_user_id ON recovery_codes(user_id)`,
+			`CREATE TABLE login_challenges (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				token_hash TEXT UNIQUE NOT NULL,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+		),
+		down: execAll(
+			`DROP TABLE login_challenges`,
+			`DROP TABLE recovery_codes`,
+			`ALTER TABLE roles DROP COLUMN require_2fa`,
+			`ALTER TABLE users DROP COLUMN totp_last_step`,
+			`ALTER TABLE users DROP COLUMN totp_enabled_at`,
+			`ALTER TABLE users DROP COLUMN totp_secret`,
+		),
+	},
+	{
+		version:     15,
+		description: "add OpenID Connect identities",
+		up: execAll(
+			`CREATE TABLE user_identities (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				issuer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				email TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NOT NULL,
+				last_login_at DATETIME,
+				UNIQUE (issuer, subject),
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+			`CREATE INDEX idx_user_identities_user_id ON user_identities(user_id)`,
+			`CREATE TABLE oidc_states (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				state_hash TEXT UNIQUE NOT NULL,
+				nonce TEXT NOT NULL,
+				code_verifier TEXT NOT NULL,
+				link_user_id INTEGER,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL,
+				FOREIGN KEY (link_user_id) REFERENCES users(id)
+			)`,
+		),
+		down: execAll(
+			`DROP TABLE oidc_states`,
+			`DROP TABLE user_identities`,
+		),
+	},
+	{
+		version:     16,
+		description: "mark built-in roles",
+		up: execAll(
+			`ALTER TABLE roles ADD COLUMN built_in BOOLEAN NOT NULL DEFAULT 0`,
+			`UPDATE roles SET built_in = 1 WHERE name IN ('admin', 'user', 'librarian')`,
+		),
+		down: execAll(
+			`ALTER TABLE roles DROP COLUMN built_in`,
+		),
+	},
+	{
+		version:     17,
+		description: "add PDF access control lists",
+		up: inOrder(
+			execAll(
+				`ALTER TABLE pdfs ADD COLUMN restricted BOOLEAN NOT NULL DEFAULT 0`,
+				`CREATE TABLE pdf_acl_entries (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					pdf_id INTEGER NOT NULL,
+					user_id INTEGER,
+					role_id INTEGER,
+					access TEXT NOT NULL CHECK (access IN ('read', 'edit', 'delete')),
+					created_by INTEGER NOT NULL,
+					created_at DATETIME NOT NULL,
+					CHECK ((user_id IS NULL) != (role_id IS NULL)),
+					FOREIGN KEY (pdf_id) REFERENCES pdfs(id),
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (role_id) REFERENCES roles(id),
+					FOREIGN KEY (created_by) REFERENCES users(id)
+				)`,
+				// One entry per user or role and PDF
+				`CREATE UNIQUE INDEX idx_pdf_acl_entries_user ON pdf_acl_entries(pdf_id, user_id) WHERE user_id IS NOT NULL`,
+				`CREATE UNIQUE INDEX idx_pdf_acl_entries_role ON pdf_acl_entries(pdf_id, role_id) WHERE role_id IS NOT NULL`,
+			),
+			seedRBAC(
+				nil,
+				[]seedPermission{
+					{"manage_pdf_access", "pdf", "manage", "Read, edit and delete every PDF and manage access lists"},
+				},
+				map[string][]string{
+					"admin": {"manage_pdf_access"},
+				},
+			),
+		),
+		down: inOrder(
+			unseedRBAC(nil, []string{"manage_pdf_access"}),
+			execAll(
+				`DROP TABLE pdf_acl_entries`,
+				`ALTER TABLE pdfs DROP COLUMN restricted`,
+			),
+		),
+	},
+	{
+		version:     18,
+		description: "add audit log",
+		up: inOrder(
+			execAll(
+				`CREATE TABLE audit_events (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					actor_id INTEGER,
+					actor_name TEXT NOT NULL DEFAULT '',
+					action TEXT NOT NULL,
+					target_type TEXT NOT NULL DEFAULT '',
+					target_id INTEGER,
+					before_json TEXT,
+					after_json TEXT,
+					ip_address TEXT NOT NULL DEFAULT '',
+					created_at DATETIME NOT NULL,
+					FOREIGN KEY (actor_id) REFERENCES users(id)
+				)`,
+				`CREATE INDEX idx_audit_events_created_at ON audit_events(created_at)`,
+				`CREATE INDEX idx_audit_events_actor_name ON audit_events(actor_name COLLATE NOCASE)`,
+				`CREATE INDEX idx_audit_events_target ON audit_events(target_type, target_id)`,
+				// The log is append-only
+				`CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+				BEGIN
+					SELECT RAISE(ABORT, 'audit events are append-only');
+				END`,
+				`CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+				BEGIN
+					SELECT RAISE(ABORT, 'audit events are append-only');
+				END`,
+			),
+			seedRBAC(
+				nil,
+				[]seedPermission{
+					{"view_audit_log", "audit", "read", "View and export the audit log"},
+				},
+				map[string][]string{
+					"admin": {"view_audit_log"},
+				},
+			),
+		),
+		down: inOrder(
+			unseedRBAC(nil, []string{"view_audit_log"}),
+			execAll(
+				`DROP TABLE audit_events`,
+			),
+		),
+	},
+	{
+		version:     19,
+		description: "store blob storage keys instead of file paths",
+		// Keys are relative to the uploads directory. Files still in the
+		// legacy static tree keep their paths until RelocateLegacyUploads
+		// moves them into the blob store.
+		up: execAll(
+			`ALTER TABLE pdfs RENAME COLUMN file_path TO storage_key`,
+			`UPDATE pdfs SET storage_key = substr(storage_key, length('uploads/') + 1) WHERE storage_key LIKE 'uploads/%'`,
+		),
+		down: execAll(
+			`UPDATE pdfs SET storage_key = 'uploads/' || storage_key WHERE storage_key NOT LIKE 'static/uploads/%'`,
+			`ALTER TABLE pdfs RENAME COLUMN storage_key TO file_path`,
+		),
+	},
+	{
+		version:     20,
+		description: "add file checksums and scrub results",
+		// PDFs uploaded earlier get their checksum from the first scrub
+		up: execAll(
+			`ALTER TABLE pdfs ADD COLUMN checksum TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE pdfs ADD COLUMN size_bytes INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE pdfs ADD COLUMN scrub_status TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE pdfs ADD COLUMN scrubbed_at DATETIME`,
+			`CREATE INDEX idx_pdfs_checksum ON pdfs(checksum)`,
+			`CREATE INDEX idx_pdfs_storage_key ON pdfs(storage_key)`,
+		),
+		down: execAll(
+			`DROP INDEX idx_pdfs_storage_key`,
+			`DROP INDEX idx_pdfs_checksum`,
+			`ALTER TABLE pdfs DROP COLUMN scrubbed_at`,
+			`ALTER TABLE pdfs DROP COLUMN scrub_status`,
+			`ALTER TABLE pdfs DROP COLUMN size_bytes`,
+			`ALTER TABLE pdfs DROP COLUMN checksum`,
+		),
+	},
+	{
+		version:     21,
+		description: "add pdf record versions",
+		up: execAll(
+			`ALTER TABLE pdfs ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		),
+		down: execAll(
+			`ALTER TABLE pdfs DROP COLUMN version`,
+		),
+	},
+	{
+		version:     22,
+		description: "add full-text search index",
+		// The index needs SQLite built with FTS5; without it the migration
+		// creates nothing and search falls back to LIKE queries
+		up:   createSearchIndex,
+		down: dropSearchIndex,
+	},
+	{
+		version:     23,
+		description: "add released blobs",
+		// Files no PDF uses any more wait here for the scrub job to delete
+		// them, so that deleting can't race with uploads of the same file
+		up: execAll(
+			`CREATE TABLE released_blobs (
+				storage_key TEXT PRIMARY KEY,
+				released_at DATETIME NOT NULL
+			)`,
+		),
+		down: execAll(
+			`DROP TABLE released_blobs`,
+		),
+	},
+	{
+		version:     24,
+		description: "add collections",
+		up: execAll(
+			`CREATE TABLE collections (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+				created_by INTEGER NOT NULL,
+				created_at DATETIME NOT NULL,
+				FOREIGN KEY (created_by) REFERENCES users(id)
+			)`,
+			`CREATE TABLE collection_pdfs (
+				collection_id INTEGER NOT NULL,
+				pdf_id INTEGER NOT NULL,
+				PRIMARY KEY (collection_id, pdf_id),
+				FOREIGN KEY (collection_id) REFERENCES collections(id),
+				FOREIGN KEY (pdf_id) REFERENCES pdfs(id)
+			)`,
+			`CREATE INDEX idx_collection_pdfs_pdf ON collection_pdfs(pdf_id)`,
+			`CREATE TABLE collection_acl_entries (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				collection_id INTEGER NOT NULL,
+				user_id INTEGER,
+				role_id INTEGER,
+				access TEXT NOT NULL CHECK (access IN ('read', 'edit', 'delete')),
+				created_by INTEGER NOT NULL,
+				created_at DATETIME NOT NULL,
+				CHECK ((user_id IS NULL) != (role_id IS NULL)),
+				FOREIGN KEY (collection_id) REFERENCES collections(id),
+				FOREIGN KEY (user_id) REFERENCES users(id),
+				FOREIGN KEY (role_id) REFERENCES roles(id),
+				FOREIGN KEY (created_by) REFERENCES users(id)
+			)`,
+			// One entry per user or role and collection
+			`CREATE UNIQUE INDEX idx_collection_acl_entries_user ON collection_acl_entries(collection_id, user_id) WHERE user_id IS NOT NULL`,
+			`CREATE UNIQUE INDEX idx_collection_acl_entries_role ON collection_acl_entries(collection_id, role_id) WHERE role_id IS NOT NULL`,
+		),
+		down: execAll(
+			`DROP TABLE collection_acl_entries`,
+			`DROP TABLE collection_pdfs`,
+			`DROP TABLE collections`,
+		),
+	},
+}
+
+// LatestSchemaVersion is the version the database is at once every known
+// migration has been applied.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate applies all pending migrations.
+func (d *Database) Migrate() error {
+	return d.MigrateUp(LatestSchemaVersion())
+}
+
+// MigrateUp applies pending migrations up to and including version target.
+func (d *Database) MigrateUp(target int) error {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for version := range applied {
+		if version > LatestSchemaVersion() {
+			return fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, LatestSchemaVersion())
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		err := d.inTransaction(func(tx *sql.Tx) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.description, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts applied migrations, newest first, until the schema is
+// at version target. A target of 0 reverts every migration.
+func (d *Database) MigrateDown(target int) error {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= target {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+
+		err := d.inTransaction(func(tx *sql.Tx) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the version of the newest applied migration, or 0
+// if none have been applied.
+func (d *Database) SchemaVersion() (int, error) {
+	if err := d.createMigrationsTable(); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := d.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// MigrationStatus lists every known migration in version order.
+func (d *Database) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.version]
+		statuses = append(statuses, MigrationStatus{
+			Version:     m.version,
+			Description: m.description,
+			Applied:     ok,
+			AppliedAt:   appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+func (d *Database) createMigrationsTable() error {
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
+		)`
+	_, err := d.db.Exec(query)
+	return err
+}
+
+// appliedMigrations returns the application time of every applied
+// migration, keyed by version.
+func (d *Database) appliedMigrations() (map[int]time.Time, error) {
+	if err := d.createMigrationsTable(); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	rows, err := d.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+func (d *Database) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// execAll returns a migration step that runs each statement in order.
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// inOrder returns a migration step that runs each step in order.
+func inOrder(steps ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, step := range steps {
+			if err := step(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type seedRole struct {
+	name        string
+	description string
+}
+
+type seedPermission struct {
+	name        string
+	resource    string
+	action      string
+	description string
+}
+
+// seedRBAC returns a migration step that creates roles and permissions and
+// grants permissions to roles. Existing rows are left untouched.
+func seedRBAC(roles []seedRole, permissions []seedPermission, grants map[string][]string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, role := range roles {
+			query := `INSERT OR IGNORE INTO roles (name, description) VALUES (?, ?)`
+			if _, err := tx.Exec(query, role.name, role.description); err != nil {
+				return fmt.Errorf("failed to create role %s: %w", role.name, err)
+			}
+		}
+
+		for _, perm := range permissions {
+			query := `INSERT OR IGNORE INTO permissions (name, resource, action, description) VALUES (?, ?, ?, ?)`
+			if _, err := tx.Exec(query, perm.name, perm.resource, perm.action, perm.description); err != nil {
+				return fmt.Errorf("failed to create permission %s: %w", perm.name, err)
+			}
+		}
+
+		for roleName, permNames := range grants {
+			for _, permName := range permNames {
+				query := `
+					INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+					SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = ? AND p.name = ?`
+				if _, err := tx.Exec(query, roleName, permName); err != nil {
+					return fmt.Errorf("failed to assign permission %s to role %s: %w", permName, roleName, err)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// unseedRBAC returns a migration step that deletes roles and permissions
+// along with their grants and assignments.
+func unseedRBAC(roles []string, permissions []string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, name := range permissions {
+			if _, err := tx.Exec(`DELETE FROM role_permissions WHERE permission_id IN (SELECT id FROM permissions WHERE name = ?)`, name); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM permissions WHERE name = ?`, name); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range roles {
+			if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role_id IN (SELECT id FROM roles WHERE name = ?)`, name); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM user_roles WHERE role_id IN (SELECT id FROM roles WHERE name = ?)`, name); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM roles WHERE name = ?`, name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+// oidcStatePeriod is how long a user has to log in at the identity provider.
+const oidcStatePeriod = 10 * time.Minute
+
+var (
+	ErrInvalidOIDCState = errors.New("login state is invalid or expired")
+	ErrIdentityLinked   = errors.New("identity is already linked to a user")
+	ErrEmailInUse       = errors.New("email address belongs to another user")
+)
+
+// CreateOIDCState stores the state of a login sent to the identity provider
+// under the hash of its state parameter.
+func (d *Database) CreateOIDCState(stateHash string, state models.OIDCState, now time.Time) error {
+	now = now.UTC()
+
+	query := `INSERT INTO oidc_states (state_hash, nonce, code_verifier, link_user_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := d.db.Exec(query, stateHash, state.Nonce, state.CodeVerifier, state.LinkUserID, now, now.Add(oidcStatePeriod))
+	return err
+}
+
+// TakeOIDCState returns and deletes the state of a login returning from the
+// identity provider, so that it can't be replayed. Expired states of every
+// login are deleted along with it.
+func (d *Database) TakeOIDCState(stateHash string, now time.Time) (*models.OIDCState, error) {
+	now = now.UTC()
+
+	var state models.OIDCState
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		var linkUserID sql.NullInt64
+		query := `SELECT nonce, code_verifier, link_user_id FROM oidc_states WHERE state_hash = ? AND expires_at > ?`
+		err := tx.QueryRow(query, stateHash, now).Scan(&state.Nonce, &state.CodeVerifier, &linkUserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidOIDCState
+		}
+		if err != nil {
+			return err
+		}
+		state.LinkUserID = nullIntPtr(linkUserID)
+
+		_, err = tx.Exec(`DELETE FROM oidc_states WHERE state_hash = ? OR expires_at <= ?`, stateHash, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// GetUserByIdentity returns the user an identity is linked to, recording
+// the login and the email address the provider gave for it.
+func (d *Database) GetUserByIdentity(issuer, subject, email string, now time.Time) (*models.User, error) {
+	query := `UPDATE user_identities SET email = ?, last_login_at = ? WHERE issuer = ? AND subject = ? RETURNING user_id`
+
+	var userID int
+	if err := d.db.QueryRow(query, email, now.UTC(), issuer, subject).Scan(&userID); err != nil {
+		return nil, err
+	}
+	return d.GetUserByID(userID)
+}
+
+// LinkIdentity links an identity to an existing user. Each identity can only
+// be linked to one user.
+func (d *Database) LinkIdentity(userID int, issuer, subject, email string, now time.Time) error {
+	query := `INSERT INTO user_identities (user_id, issuer, subject, email, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := d.db.Exec(query, userID, issuer, subject, email, now.UTC(), now.UTC())
+	if isUniqueViolation(err) {
+		return ErrIdentityLinked
+	}
+	return err
+}
+
+// ProvisionIdentityUser creates a user with the given status, a verified
+// email address and no password for a new identity, and links the identity
+// to them. The username is the preferred one, or the preferred one with a
+// number added if it's taken.
+func (d *Database) ProvisionIdentityUser(preferredUsername, email, issuer, subject, status string, now time.Time) (int, error) {
+	now = now.UTC()
+
+	userRoleID, err := d.getRoleIDByName("user")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user role ID: %w", err)
+	}
+
+	var userID int
+	err = d.inTransaction(func(tx *sql.Tx) error {
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE)`, email).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return ErrEmailInUse
+		}
+
+		username := preferredUsername
+		for n := 2; ; n++ {
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)`, username).Scan(&taken); err != nil {
+				return err
+			}
+			if !taken {
+				break
+			}
+			username = fmt.Sprintf("%s%d", preferredUsername, n)
+		}
+
+		userID, err = insertUser(tx, username, email, "", &now, status, userRoleID)
+		if err != nil {
+			return err
+		}
+
+		query := `INSERT INTO user_identities (user_id, issuer, subject, email, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?)`
+		_, err = tx.Exec(query, userID, issuer, subject, email, now, now)
+		if isUniqueViolation(err) {
+			return ErrIdentityLinked
+		}
+		return err
+	})
+	return userID, err
+}
+
+// GetUserIdentities returns the identities linked to a user.
+func (d *Database) GetUserIdentities(userID int) ([]models.UserIdentity, error) {
+	query := `
+		SELECT id, user_id, issuer, subject, email, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = ?
+		ORDER BY created_at, id`
+
+	rows, err := d.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []models.UserIdentity
+	for rows.Next() {
+		var identity models.UserIdentity
+		var lastLoginAt sql.NullTime
+		err := rows.Scan(&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject, &identity.Email, &identity.CreatedAt, &lastLoginAt)
+		if err != nil {
+			return nil, err
+		}
+		identity.LastLoginAt = nullTimePtr(lastLoginAt)
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes one of a user's identities at an issuer.
+func (d *Database) UnlinkIdentity(id, userID int, issuer string) error {
+	result, err := d.db.Exec(`DELETE FROM user_identities WHERE id = ? AND user_id = ? AND issuer = ?`, id, userID, issuer)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// passwordResetPeriod is how long a password reset link stays valid.
+const passwordResetPeriod = time.Hour
+
+var ErrInvalidResetToken = errors.New("password reset link is invalid, used or expired")
+
+// CreatePasswordReset stores a reset token for a user under the hash of its
+// secret. Earlier unused tokens of the user stop working, so only the most
+// recently emailed link can be used.
+func (d *Database) CreatePasswordReset(userID int, tokenHash string, now time.Time) error {
+	now = now.UTC()
+
+	return d.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL`, userID); err != nil {
+			return err
+		}
+
+		query := `INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)`
+		_, err := tx.Exec(query, userID, tokenHash, now, now.Add(passwordResetPeriod))
+		return err
+	})
+}
+
+// CheckPasswordReset returns ErrInvalidResetToken unless a reset token can
+// still be used.
+func (d *Database) CheckPasswordReset(tokenHash string, now time.Time) error {
+	_, err := passwordResetUser(d.db, tokenHash, now)
+	return err
+}
+
+// ResetPassword uses up a reset token and sets its user's password. It
+// returns the ID of the user whose password changed.
+func (d *Database) ResetPassword(tokenHash, passwordHash string, now time.Time) (int, error) {
+	now = now.UTC()
+
+	var userID int
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		var err error
+		userID, err = passwordResetUser(tx, tokenHash, now)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL`, now, tokenHash)
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrInvalidResetToken
+		}
+
+		return setPassword(tx, userID, passwordHash)
+	})
+	return userID, err
+}
+
+// SetPassword replaces a user's password, for example when an administrator
+// sets a temporary one.
+func (d *Database) SetPassword(userID int, passwordHash string) error {
+	return setPassword(d.db, userID, passwordHash)
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func setPassword(e execer, userID int, passwordHash string) error {
+	result, err := e.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func passwordResetUser(q rowQuerier, tokenHash string, now time.Time) (int, error) {
+	var userID int
+	query := `SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`
+	err := q.QueryRow(query, tokenHash, now.UTC()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, err
+}
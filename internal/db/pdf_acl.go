@@ -0,0 +1,156 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+// ErrInvalidACLEntry is returned for access list entries that don't name
+// exactly one user or role, or have an unknown access level.
+var ErrInvalidACLEntry = errors.New("access list entries need a user or a role and a valid access level")
+
+// PDFVisibility limits PDF listings and searches to what a user may see.
+// Restricted PDFs are left out unless the user uploaded them or has an
+// access list entry for them or for a collection they're in, directly or
+// through a role, or All is set.
+type PDFVisibility struct {
+	UserID int
+	All    bool
+}
+
+// where returns a condition on the pdfs table, aliased p, that holds for the
+// PDFs v allows, along with its arguments.
+func (v PDFVisibility) where() (string, []any) {
+	if v.All {
+		return `1`, nil
+	}
+	return `(p.restricted = 0 OR p.uploaded_by = ? OR EXISTS (
+		SELECT 1 FROM pdf_acl_entries a
+		WHERE a.pdf_id = p.id AND (a.user_id = ? OR a.role_id IN (SELECT role_id FROM user_roles WHERE user_id = ?))
+	) OR EXISTS (
+		SELECT 1 FROM collection_pdfs cp
+		JOIN collection_acl_entries ca ON ca.collection_id = cp.collection_id
+		WHERE cp.pdf_id = p.id AND (ca.user_id = ? OR ca.role_id IN (SELECT role_id FROM user_roles WHERE user_id = ?))))`,
+		[]any{v.UserID, v.UserID, v.UserID, v.UserID, v.UserID}
+}
+
+// GetPDFAccess returns the highest access level a user's access list entries
+// for a PDF, or for the collections it's in, grant them, directly or through
+// their roles, or "" if they have none.
+func (d *Database) GetPDFAccess(pdfID, userID int) (string, error) {
+	query := `
+		SELECT access FROM pdf_acl_entries
+		WHERE pdf_id = ? AND (user_id = ? OR role_id IN (SELECT role_id FROM user_roles WHERE user_id = ?))
+		UNION ALL
+		SELECT ca.access FROM collection_acl_entries ca
+		JOIN collection_pdfs cp ON cp.collection_id = ca.collection_id
+		WHERE cp.pdf_id = ? AND (ca.user_id = ? OR ca.role_id IN (SELECT role_id FROM user_roles WHERE user_id = ?))`
+
+	rows, err := d.db.Query(query, pdfID, userID, userID, pdfID, userID, userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	granted := ""
+	for rows.Next() {
+		var access string
+		if err := rows.Scan(&access); err != nil {
+			return "", err
+		}
+		if !models.PDFAccessIncludes(granted, access) {
+			granted = access
+		}
+	}
+	return granted, rows.Err()
+}
+
+// GetPDFACL returns the access list of a PDF, user entries first.
+func (d *Database) GetPDFACL(pdfID int) ([]models.PDFACLEntry, error) {
+	query := `
+		SELECT a.id, a.pdf_id, a.user_id, COALESCE(u.username, ''), a.role_id, COALESCE(r.name, ''), a.access, a.created_by, a.created_at
+		FROM pdf_acl_entries a
+		LEFT JOIN users u ON a.user_id = u.id
+		LEFT JOIN roles r ON a.role_id = r.id
+		WHERE a.pdf_id = ?
+		ORDER BY a.user_id IS NULL, u.username, r.name`
+
+	rows, err := d.db.Query(query, pdfID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.PDFACLEntry
+	for rows.Next() {
+		var entry models.PDFACLEntry
+		var userID, roleID sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.PDFID, &userID, &entry.Username, &roleID, &entry.RoleName, &entry.Access, &entry.CreatedBy, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.UserID = nullIntPtr(userID)
+		entry.RoleID = nullIntPtr(roleID)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// SetPDFACLEntry grants a user or a role, whichever is non-nil, access to a
+// PDF, replacing the access level of an existing entry for them.
+func (d *Database) SetPDFACLEntry(pdfID int, userID, roleID *int, access string, createdBy int, now time.Time) error {
+	if (userID == nil) == (roleID == nil) || !models.PDFAccessIncludes(access, models.PDFAccessRead) {
+		return ErrInvalidACLEntry
+	}
+
+	return d.inTransaction(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pdfs WHERE id = ?)`, pdfID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		query := `DELETE FROM pdf_acl_entries WHERE pdf_id = ? AND (user_id = ? OR role_id = ?)`
+		if _, err := tx.Exec(query, pdfID, userID, roleID); err != nil {
+			return err
+		}
+
+		query = `INSERT INTO pdf_acl_entries (pdf_id, user_id, role_id, access, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+		_, err := tx.Exec(query, pdfID, userID, roleID, access, createdBy, now.UTC())
+		return err
+	})
+}
+
+// DeletePDFACLEntry removes an entry from the access list of a PDF.
+func (d *Database) DeletePDFACLEntry(id, pdfID int) error {
+	result, err := d.db.Exec(`DELETE FROM pdf_acl_entries WHERE id = ? AND pdf_id = ?`, id, pdfID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetPDFRestricted sets whether a PDF can only be read through its access
+// list.
+func (d *Database) SetPDFRestricted(pdfID int, restricted bool) error {
+	result, err := d.db.Exec(`UPDATE pdfs SET restricted = ? WHERE id = ?`, restricted, pdfID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"database/sql"
+	"librarymanagementsystem/internal/models"
+	"time"
+)
+
+// GetPDFsByChecksum returns the PDFs v allows whose file has the given
+// checksum, oldest first.
+func (d *Database) GetPDFsByChecksum(v PDFVisibility, checksum string) ([]models.PDF, error) {
+	visible, args := v.where()
+	query := `SELECT ` + pdfColumns + ` FROM pdfs p WHERE checksum = ? AND ` + visible + ` ORDER BY created_at, id`
+	return d.queryPDFs(query, append([]any{checksum}, args...)...)
+}
+
+// ReleaseBlob marks the file stored under key for deletion if no PDF uses
+// it. CollectReleasedBlobs deletes marked files later.
+func (d *Database) ReleaseBlob(key string, now time.Time) error {
+	query := `INSERT INTO released_blobs (storage_key, released_at)
+		SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM pdfs WHERE storage_key = ?)
+		ON CONFLICT (storage_key) DO UPDATE SET released_at = excluded.released_at`
+	_, err := d.db.Exec(query, key, now.UTC(), key)
+	return err
+}
+
+// CollectReleasedBlobs calls deleteBlob for each file marked by ReleaseBlob
+// that still isn't used by any PDF, forgets the marks of files used again,
+// and returns how many files were deleted. Each file is deleted inside the
+// transaction that checks it's unused, while holding SQLite's write lock, so
+// a PDF created meanwhile only commits after the file is gone and its
+// uploader can store the file again.
+func (d *Database) CollectReleasedBlobs(deleteBlob func(key string) error) (int, error) {
+	rows, err := d.db.Query(`SELECT storage_key FROM released_blobs ORDER BY released_at`)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		var unused bool
+		err := d.inTransaction(func(tx *sql.Tx) error {
+			// Writing first takes the write lock before the check
+			if _, err := tx.Exec(`DELETE FROM released_blobs WHERE storage_key = ?`, key); err != nil {
+				return err
+			}
+			err := tx.QueryRow(`SELECT NOT EXISTS (SELECT 1 FROM pdfs WHERE storage_key = ?)`, key).Scan(&unused)
+			if err != nil || !unused {
+				return err
+			}
+			return deleteBlob(key)
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if unused {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// SetPDFChecksum records the checksum and size of a PDF's file, for PDFs
+// uploaded before checksums were recorded.
+func (d *Database) SetPDFChecksum(id int, checksum string, size int64) error {
+	_, err := d.db.Exec(`UPDATE pdfs SET checksum = ?, size_bytes = ? WHERE id = ?`, checksum, size, id)
+	return err
+}
+
+// RecordPDFScrub records the result of checking a PDF's file against its
+// checksum.
+func (d *Database) RecordPDFScrub(id int, status string, at time.Time) error {
+	_, err := d.db.Exec(`UPDATE pdfs SET scrub_status = ?, scrubbed_at = ? WHERE id = ?`, status, at.UTC(), id)
+	return err
+}
+
+// GetDamagedPDFs returns the PDFs whose file was missing or corrupt when it
+// was last checked.
+func (d *Database) GetDamagedPDFs() ([]models.PDF, error) {
+	query := `SELECT ` + pdfColumns + ` FROM pdfs WHERE scrub_status IN (?, ?) ORDER BY title, id`
+	return d.queryPDFs(query, models.ScrubMissing, models.ScrubCorrupt)
+}
+
+func (d *Database) queryPDFs(query string, args ...any) ([]models.PDF, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pdfs []models.PDF
+	for rows.Next() {
+		pdf, err := scanPDF(rows)
+		if err != nil {
+			return nil, err
+		}
+		pdfs = append(pdfs, *pdf)
+	}
+
+	return pdfs, rows.Err()
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/models"
+	"slices"
+)
+
+var (
+	ErrRoleExists      = errors.New("a role with that name already exists")
+	ErrBuiltInRole     = errors.New("built-in roles can't be renamed or deleted")
+	ErrLastRoleManager = errors.New("no one else can manage roles")
+)
+
+// CreateRole creates a role without permissions or members. Its loan and
+// fine settings are left at their defaults, so its members can't borrow
+// unless another role lets them.
+func (d *Database) CreateRole(name, description string) (int, error) {
+	result, err := d.db.Exec(`INSERT INTO roles (name, description) VALUES (?, ?)`, name, description)
+	if isUniqueViolation(err) {
+		return 0, ErrRoleExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// UpdateRole changes the name and description of a role. Built-in roles
+// keep their names, since the application looks them up by name.
+func (d *Database) UpdateRole(id int, name, description string) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		var current string
+		var builtIn bool
+		if err := tx.QueryRow(`SELECT name, built_in FROM roles WHERE id = ?`, id).Scan(&current, &builtIn); err != nil {
+			return err
+		}
+		if builtIn && name != current {
+			return ErrBuiltInRole
+		}
+
+		_, err := tx.Exec(`UPDATE roles SET name = ?, description = ? WHERE id = ?`, name, description, id)
+		if isUniqueViolation(err) {
+			return ErrRoleExists
+		}
+		return err
+	})
+}
+
+// DeleteRole deletes a role along with its permissions, assignments and
+// access list entries. It
+// returns ErrBuiltInRole for built-in roles, and ErrLastRoleManager if the
+// role's members are the only ones who can manage roles.
+func (d *Database) DeleteRole(id int) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		var builtIn bool
+		if err := tx.QueryRow(`SELECT built_in FROM roles WHERE id = ?`, id).Scan(&builtIn); err != nil {
+			return err
+		}
+		if builtIn {
+			return ErrBuiltInRole
+		}
+
+		return keepRoleManager(tx, func() error {
+			for _, query := range []string{
+				`DELETE FROM pdf_acl_entries WHERE role_id = ?`,
+				`DELETE FROM collection_acl_entries WHERE role_id = ?`,
+				`DELETE FROM role_permissions WHERE role_id = ?`,
+				`DELETE FROM user_roles WHERE role_id = ?`,
+				`DELETE FROM roles WHERE id = ?`,
+			} {
+				if _, err := tx.Exec(query, id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// SetRolePermissions replaces the permissions of each role in grants, which
+// maps role IDs to permission IDs, in one transaction. Roles that aren't in
+// grants keep theirs. It returns sql.ErrNoRows if a role or permission
+// doesn't exist, and ErrLastRoleManager if the change would leave no one
+// able to manage roles.
+func (d *Database) SetRolePermissions(grants map[int][]int) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		return keepRoleManager(tx, func() error {
+			for roleID, permissionIDs := range grants {
+				var exists bool
+				if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM roles WHERE id = ?)`, roleID).Scan(&exists); err != nil {
+					return err
+				}
+				if !exists {
+					return sql.ErrNoRows
+				}
+
+				if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role_id = ?`, roleID); err != nil {
+					return err
+				}
+				for i, permissionID := range permissionIDs {
+					query := `INSERT OR IGNORE INTO role_permissions (role_id, permission_id) SELECT ?, id FROM permissions WHERE id = ?`
+					result, err := tx.Exec(query, roleID, permissionID)
+					if err != nil {
+						return err
+					}
+					if rows, err := result.RowsAffected(); err != nil {
+						return err
+					} else if rows == 0 && !slices.Contains(permissionIDs[:i], permissionID) {
+						return sql.ErrNoRows
+					}
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// keepRoleManager makes change and returns ErrLastRoleManager if it leaves
+// no active user with the manage_roles permission where there was one
+// before, so that the caller's transaction is rolled back.
+func keepRoleManager(tx *sql.Tx, change func() error) error {
+	before, err := countRoleManagers(tx)
+	if err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	after, err := countRoleManagers(tx)
+	if err != nil {
+		return err
+	}
+	if before > 0 && after == 0 {
+		return ErrLastRoleManager
+	}
+	return nil
+}
+
+func countRoleManagers(tx *sql.Tx) (int, error) {
+	query := `
+		SELECT COUNT(DISTINCT u.id)
+		FROM users u
+		INNER JOIN user_roles ur ON u.id = ur.user_id
+		INNER JOIN role_permissions rp ON ur.role_id = rp.role_id
+		INNER JOIN permissions p ON rp.permission_id = p.id
+		WHERE p.name = 'manage_roles' AND u.status = ? AND u.email_verified_at IS NOT NULL`
+
+	var count int
+	err := tx.QueryRow(query, models.UserActive).Scan(&count)
+	return count, err
+}
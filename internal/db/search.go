@@ -0,0 +1,344 @@
+package db
+
+import (
+	"database/sql"
+	"librarymanagementsystem/internal/models"
+	"strings"
+)
+
+const (
+	// Markers wrapped around matched terms by snippet(). They are control
+	// characters so they can't collide with document text.
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+
+	maxMatchesPerPDF = 3
+)
+
+// fts5Query asks SQLite whether it was built with FTS5 (the sqlite_fts5
+// build tag).
+const fts5Query = `SELECT sqlite_compileoption_used('ENABLE_FTS5')`
+
+// fts5Available scans the result of fts5Query.
+func fts5Available(row *sql.Row) (bool, error) {
+	var used bool
+	err := row.Scan(&used)
+	return used, err
+}
+
+// createSearchIndex sets up the pdf_search FTS5 table and the triggers that
+// keep its metadata rows (page 0) in sync with pdfs, and indexes the
+// metadata of existing PDFs. Page text rows are written by IndexPDFPages. If
+// SQLite was built without FTS5, nothing is created and search falls back
+// to LIKE queries.
+func createSearchIndex(tx *sql.Tx) error {
+	available, err := fts5Available(tx.QueryRow(fts5Query))
+	if err != nil || !available {
+		return err
+	}
+
+	return execAll(
+		`CREATE VIRTUAL TABLE IF NOT EXISTS pdf_search USING fts5(
+			title, author, description, body,
+			pdf_id UNINDEXED, page UNINDEXED,
+			tokenize = 'porter unicode61'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS pdfs_search_insert AFTER INSERT ON pdfs BEGIN
+			INSERT INTO pdf_search (title, author, description, body, pdf_id, page)
+			VALUES (new.title, COALESCE(new.author, ''), COALESCE(new.description, ''), '', new.id, 0);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS pdfs_search_update AFTER UPDATE OF title, author, description ON pdfs BEGIN
+			DELETE FROM pdf_search WHERE pdf_id = old.id AND page = 0;
+			INSERT INTO pdf_search (title, author, description, body, pdf_id, page)
+			VALUES (new.title, COALESCE(new.author, ''), COALESCE(new.description, ''), '', new.id, 0);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS pdfs_search_delete AFTER DELETE ON pdfs BEGIN
+			DELETE FROM pdf_search WHERE pdf_id = old.id;
+		END`,
+		// Index metadata of PDFs that existed before the search index
+		`INSERT INTO pdf_search (title, author, description, body, pdf_id, page)
+		SELECT title, COALESCE(author, ''), COALESCE(description, ''), '', id, 0 FROM pdfs
+		WHERE id NOT IN (SELECT pdf_id FROM pdf_search WHERE page = 0)`,
+	)(tx)
+}
+
+// dropSearchIndex removes what createSearchIndex created, if anything.
+var dropSearchIndex = execAll(
+	`DROP TRIGGER IF EXISTS pdfs_search_delete`,
+	`DROP TRIGGER IF EXISTS pdfs_search_update`,
+	`DROP TRIGGER IF EXISTS pdfs_search_insert`,
+	`DROP TABLE IF EXISTS pdf_search`,
+)
+
+// detectSearchIndex turns on full-text search if the search index exists and
+// SQLite was built with FTS5, and otherwise records why it's off.
+func (d *Database) detectSearchIndex() error {
+	available, err := fts5Available(d.db.QueryRow(fts5Query))
+	if err != nil {
+		return err
+	}
+	if !available {
+		d.searchWarning = "SQLite was built without FTS5; build with -tags sqlite_fts5 (as make build does) to enable it"
+		return nil
+	}
+
+	var tables int
+	err = d.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'pdf_search'`).Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables == 0 {
+		d.searchWarning = "the search index is missing because the database was migrated by a build without FTS5; run reindex with a build with FTS5 to create it"
+		return nil
+	}
+	d.fullTextSearch = true
+	return nil
+}
+
+// FullTextSearchEnabled reports whether the FTS5 search index is available.
+func (d *Database) FullTextSearchEnabled() bool {
+	return d.fullTextSearch
+}
+
+// SearchIndexWarning explains why full-text search is disabled and how to
+// enable it, or returns "" if it's enabled.
+func (d *Database) SearchIndexWarning() string {
+	return d.searchWarning
+}
+
+// CreateSearchIndex creates the search index if SQLite has FTS5 but the index
+// is missing, because the database was migrated by a build without FTS5, and
+// turns on full-text search.
+func (d *Database) CreateSearchIndex() error {
+	if d.fullTextSearch {
+		return nil
+	}
+	if err := d.inTransaction(createSearchIndex); err != nil {
+		return err
+	}
+	d.searchWarning = ""
+	return d.detectSearchIndex()
+}
+
+// IndexPDFPages replaces the indexed page text of a PDF. pages[0] is page 1.
+func (d *Database) IndexPDFPages(pdfID int, pages []string) error {
+	if !d.fullTextSearch {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM pdf_search WHERE pdf_id = ? AND page > 0`, pdfID); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO pdf_search (title, author, description, body, pdf_id, page) VALUES ('', '', '', ?, ?, ?)`
+	for i, text := range pages {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if _, err := tx.Exec(query, text, pdfID, i+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RebuildSearchIndex drops all indexed metadata and page text and re-indexes
+// the metadata of every PDF. Page text has to be indexed again with
+// IndexPDFPages.
+func (d *Database) RebuildSearchIndex() error {
+	if !d.fullTextSearch {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM pdf_search`); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO pdf_search (title, author, description, body, pdf_id, page)
+		SELECT title, COALESCE(author, ''), COALESCE(description, ''), '', id, 0 FROM pdfs`
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SearchPDFs returns the PDFs v allows that match query, best match first,
+// along with highlighted snippets of the pages that matched, keyed by PDF
+// ID.
+func (d *Database) SearchPDFs(v PDFVisibility, query string) ([]models.PDF, map[int][]models.PageMatch, error) {
+	if !d.fullTextSearch {
+		pdfs, err := d.searchPDFsLike(v, query)
+		return pdfs, nil, err
+	}
+
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil, nil
+	}
+
+	// Metadata columns weigh more than page text. PDFs are ranked by their
+	// best match, and only the PDFs v allows count towards the limit. Each
+	// PDF brings its metadata row and best pages along.
+	visible, args := v.where()
+	searchQuery := `
+		WITH matches AS MATERIALIZED (
+			SELECT pdf_id, page, snippet(pdf_search, 3, char(2), char(3), '…', 16) AS snippet,
+				bm25(pdf_search, 10.0, 5.0, 2.0, 1.0) AS rank
+			FROM pdf_search
+			WHERE pdf_search MATCH ?
+		),
+		numbered AS (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY pdf_id ORDER BY rank) AS nth FROM matches
+		),
+		best AS (
+			SELECT m.pdf_id, MIN(m.rank) AS rank
+			FROM matches m
+			JOIN pdfs p ON p.id = m.pdf_id
+			WHERE ` + visible + `
+			GROUP BY m.pdf_id
+			ORDER BY MIN(m.rank), m.pdf_id
+			LIMIT 500
+		)
+		SELECT ` + pdfColumns + `, m.page, m.snippet
+		FROM best b
+		JOIN pdfs p ON p.id = b.pdf_id
+		JOIN numbered m ON m.pdf_id = b.pdf_id
+		WHERE m.nth <= ?
+		ORDER BY b.rank, b.pdf_id, m.rank`
+
+	queryArgs := append(append([]any{match}, args...), maxMatchesPerPDF+1)
+	rows, err := d.db.Query(searchQuery, queryArgs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var pdfs []models.PDF
+	matches := make(map[int][]models.PageMatch)
+	seen := make(map[int]bool)
+	for rows.Next() {
+		var page int
+		var snippet string
+		pdf, err := scanPDF(extraColumns{rows, []any{&page, &snippet}})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Rows come best first, so the first row of a PDF determines its rank
+		if !seen[pdf.ID] {
+			seen[pdf.ID] = true
+			pdfs = append(pdfs, *pdf)
+		}
+
+		if page > 0 && len(matches[pdf.ID]) < maxMatchesPerPDF {
+			matches[pdf.ID] = append(matches[pdf.ID], models.PageMatch{
+				Page:    page,
+				Snippet: parseSnippet(snippet),
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return pdfs, matches, nil
+}
+
+// extraColumns scans a row with more columns than scanPDF expects, the rest
+// going into extra.
+type extraColumns struct {
+	row   rowScanner
+	extra []any
+}
+
+func (e extraColumns) Scan(dest ...any) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+func (d *Database) searchPDFsLike(v PDFVisibility, query string) ([]models.PDF, error) {
+	visible, args := v.where()
+	searchQuery := `SELECT ` + pdfColumns + ` FROM pdfs p
+	WHERE (title LIKE ? OR author LIKE ? OR description LIKE ?) AND ` + visible + ` ORDER BY created_at DESC`
+
+	searchPattern := "%" + query + "%"
+	rows, err := d.db.Query(searchQuery, append([]any{searchPattern, searchPattern, searchPattern}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pdfs []models.PDF
+	for rows.Next() {
+		pdf, err := scanPDF(rows)
+		if err != nil {
+			return nil, err
+		}
+		pdfs = append(pdfs, *pdf)
+	}
+
+	return pdfs, rows.Err()
+}
+
+// ftsQuery turns free text typed by a user into an FTS5 query. Every term is
+// quoted so that FTS5 syntax in the input can't cause errors, and the last
+// term is a prefix match to support search-as-you-type.
+func ftsQuery(query string) string {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		term = strings.ReplaceAll(term, `"`, "")
+		if term == "" {
+			continue
+		}
+		terms = append(terms, `"`+term+`"`)
+	}
+
+	if len(terms) == 0 {
+		return ""
+	}
+
+	terms[len(terms)-1] += "*"
+	return strings.Join(terms, " ")
+}
+
+// parseSnippet splits a snippet produced with the highlight markers into
+// plain and highlighted parts.
+func parseSnippet(snippet string) []models.SnippetPart {
+	var parts []models.SnippetPart
+	for {
+		start := strings.Index(snippet, highlightStart)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(snippet[start:], highlightEnd)
+		if end < 0 {
+			break
+		}
+		end += start
+
+		if start > 0 {
+			parts = append(parts, models.SnippetPart{Text: snippet[:start]})
+		}
+		parts = append(parts, models.SnippetPart{Text: snippet[start+len(highlightStart) : end], Highlight: true})
+		snippet = snippet[end+len(highlightEnd):]
+	}
+
+	if snippet != "" {
+		parts = append(parts, models.SnippetPart{Text: snippet})
+	}
+	return parts
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"librarymanagementsystem/internal/auth"
+	"time"
+)
+
+// SessionStore is an auth.SessionStore backed by the sessions table, so
+// sessions survive restarts and can be audited.
+type SessionStore struct {
+	db *Database
+}
+
+func NewSessionStore(database *Database) *SessionStore {
+	return &SessionStore{db: database}
+}
+
+func (s *SessionStore) Create(tokenHash string, session *auth.Session) error {
+	query := `INSERT INTO sessions (token_hash, user_id, username, created_at, last_seen_at, expires_at, ip_address, user_agent) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.db.Exec(query, tokenHash, session.UserID, session.Username, session.CreatedAt.UTC(),
+		session.LastSeenAt.UTC(), session.ExpiresAt.UTC(), session.IPAddress, session.UserAgent)
+	return err
+}
+
+func (s *SessionStore) Get(tokenHash string) (*auth.Session, error) {
+	query := `SELECT user_id, username, created_at, last_seen_at, expires_at, ip_address, user_agent FROM sessions WHERE token_hash = ?`
+	row := s.db.db.QueryRow(query, tokenHash)
+
+	var session auth.Session
+	err := row.Scan(&session.UserID, &session.Username, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.IPAddress, &session.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (s *SessionStore) Touch(tokenHash string, lastSeenAt time.Time) error {
+	query := `UPDATE sessions SET last_seen_at = ? WHERE token_hash = ?`
+	_, err := s.db.db.Exec(query, lastSeenAt.UTC(), tokenHash)
+	return err
+}
+
+func (s *SessionStore) Delete(tokenHash string) error {
+	query := `DELETE FROM sessions WHERE token_hash = ?`
+	_, err := s.db.db.Exec(query, tokenHash)
+	return err
+}
+
+func (s *SessionStore) DeleteExpired(now time.Time) error {
+	query := `DELETE FROM sessions WHERE expires_at < ?`
+	_, err := s.db.db.Exec(query, now.UTC())
+	return err
+}
+
+func (s *SessionStore) DeleteByUser(userID int) error {
+	query := `DELETE FROM sessions WHERE user_id = ?`
+	_, err := s.db.db.Exec(query, userID)
+	return err
+}
+
+func (s *SessionStore) ListByUser(userID int) ([]auth.Session, error) {
+	query := `SELECT user_id, username, created_at, last_seen_at, expires_at, ip_address, user_agent FROM sessions 
+	WHERE user_id = ? ORDER BY last_seen_at DESC`
+	rows, err := s.db.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []auth.Session
+	for rows.Next() {
+		var session auth.Session
+		err := rows.Scan(&session.UserID, &session.Username, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.IPAddress, &session.UserAgent)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"time"
+)
+
+const (
+	loginChallengePeriod      = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var (
+	ErrTwoFactorEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled   = errors.New("two-factor authentication is not enabled")
+	ErrTOTPCodeUsed          = errors.New("TOTP code has already been used")
+	ErrInvalidRecoveryCode   = errors.New("recovery code is invalid or used")
+	ErrInvalidLoginChallenge = errors.New("login challenge is invalid or expired")
+	ErrNoEncryptionKey       = errors.New("no encryption key is set")
+)
+
+// SetSecretBox sets the SecretBox that TOTP secrets are encrypted with.
+// Two-factor authentication can't be set up or used without one.
+func (d *Database) SetSecretBox(box *auth.SecretBox) {
+	d.secrets = box
+}
+
+// SetPendingTOTPSecret stores a TOTP secret a user is setting up. It doesn't
+// take effect until EnableTOTP confirms that the user's authenticator app
+// produces codes for it. The secret is encrypted before it's stored.
+func (d *Database) SetPendingTOTPSecret(userID int, secret string) error {
+	if d.secrets == nil {
+		return ErrNoEncryptionKey
+	}
+	sealed, err := d.secrets.Seal(secret)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(`UPDATE users SET totp_secret = ? WHERE id = ? AND totp_enabled_at IS NULL`, sealed, userID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// GetTOTPSecret returns a user's TOTP secret, which is empty if they haven't
+// started setting up two-factor authentication.
+func (d *Database) GetTOTPSecret(userID int) (string, error) {
+	var secret sql.NullString
+	if err := d.db.QueryRow(`SELECT totp_secret FROM users WHERE id = ?`, userID).Scan(&secret); err != nil {
+		return "", err
+	}
+	if !secret.Valid {
+		return "", nil
+	}
+	if d.secrets == nil {
+		return "", ErrNoEncryptionKey
+	}
+	return d.secrets.Open(secret.String)
+}
+
+// EncryptTOTPSecrets encrypts the TOTP secrets stored in plaintext before
+// secrets were encrypted, returning how many it encrypted.
+func (d *Database) EncryptTOTPSecrets() (int, error) {
+	if d.secrets == nil {
+		return 0, ErrNoEncryptionKey
+	}
+
+	encrypted := 0
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL`)
+		if err != nil {
+			return err
+		}
+		plaintext := make(map[int]string)
+		for rows.Next() {
+			var id int
+			var secret string
+			if err := rows.Scan(&id, &secret); err != nil {
+				rows.Close()
+				return err
+			}
+			if !auth.IsSealed(secret) {
+				plaintext[id] = secret
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, secret := range plaintext {
+			sealed, err := d.secrets.Seal(secret)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, sealed, id); err != nil {
+				return fmt.Errorf("failed to encrypt the TOTP secret of user %d: %w", id, err)
+			}
+		}
+		encrypted = len(plaintext)
+		return nil
+	})
+	return encrypted, err
+}
+
+// EnableTOTP turns on two-factor authentication with the user's pending
+// secret, using up the time step of the code that confirmed it, and
+// replaces the user's recovery codes.
+func (d *Database) EnableTOTP(userID int, step int64, recoveryCodeHashes []string, now time.Time) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		query := `UPDATE users SET totp_enabled_at = ?, totp_last_step = ? WHERE id = ? AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL`
+		result, err := tx.Exec(query, now.UTC(), step, userID)
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrTwoFactorEnabled
+		}
+
+		return replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and deletes the user's
+// secret and recovery codes.
+func (d *Database) DisableTOTP(userID int) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		query := `UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?`
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+		return err
+	})
+}
+
+// UseTOTPStep records that a user logged in with the code of a time step.
+// Codes can't be used twice, so it returns ErrTOTPCodeUsed for a step at or
+// before the last one used.
+func (d *Database) UseTOTPStep(userID int, step int64) error {
+	query := `UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_enabled_at IS NOT NULL AND totp_last_step < ?`
+	result, err := d.db.Exec(query, step, userID, step)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces a user's recovery codes with new ones.
+func (d *Database) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	return d.inTransaction(func(tx *sql.Tx) error {
+		var enabled bool
+		if err := tx.QueryRow(`SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID).Scan(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrTwoFactorNotEnabled
+		}
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	})
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up one of a user's recovery codes.
+func (d *Database) UseRecoveryCode(userID int, codeHash string, now time.Time) error {
+	query := `UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`
+	result, err := d.db.Exec(query, now.UTC(), userID, codeHash)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrInvalidRecoveryCode
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left.
+func (d *Database) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
+
+// CreateLoginChallenge stores a login that passed the password check and
+// waits for a second factor, under the hash of a token kept by the browser.
+func (d *Database) CreateLoginChallenge(userID int, tokenHash string, now time.Time) error {
+	now = now.UTC()
+
+	query := `INSERT INTO login_challenges (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)`
+	_, err := d.db.Exec(query, userID, tokenHash, now, now.Add(loginChallengePeriod))
+	return err
+}
+
+// GetLoginChallenge returns the ID of the user a pending login challenge
+// belongs to.
+func (d *Database) GetLoginChallenge(tokenHash string, now time.Time) (int, error) {
+	var userID int
+	query := `SELECT user_id FROM login_challenges WHERE token_hash = ? AND expires_at > ? AND attempts < ?`
+	err := d.db.QueryRow(query, tokenHash, now.UTC(), loginChallengeMaxAttempts).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidLoginChallenge
+	}
+	return userID, err
+}
+
+// FailLoginChallenge counts a wrong second factor against a login challenge,
+// which stops working after loginChallengeMaxAttempts.
+func (d *Database) FailLoginChallenge(tokenHash string) error {
+	_, err := d.db.Exec(`UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+// DeleteLoginChallenge ends a login challenge once the login is complete.
+// Expired challenges of every user are deleted along with it.
+func (d *Database) DeleteLoginChallenge(tokenHash string, now time.Time) error {
+	_, err := d.db.Exec(`DELETE FROM login_challenges WHERE token_hash = ? OR expires_at <= ?`, tokenHash, now.UTC())
+	return err
+}
+
+// SetRoleRequire2FA sets whether members of a role must use two-factor
+// authentication.
+func (d *Database) SetRoleRequire2FA(roleID int, required bool) error {
+	result, err := d.db.Exec(`UPDATE roles SET require_2fa = ? WHERE id = ?`, required, roleID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
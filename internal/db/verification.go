@@ -0,0 +1,174 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/models"
+	"strings"
+	"time"
+)
+
+// emailVerificationPeriod is how long an email verification link stays
+// valid.
+const emailVerificationPeriod = 48 * time.Hour
+
+// invitationPeriod is how long an invitation to register stays valid.
+const invitationPeriod = 7 * 24 * time.Hour
+
+var (
+	ErrInvalidVerificationToken = errors.New("verification link is invalid, used or expired")
+	ErrInvalidInvitation        = errors.New("invitation is invalid, used or expired")
+)
+
+// CreateEmailVerification stores an email verification token for a user
+// under the hash of its secret. Earlier unused tokens of the user stop
+// working.
+func (d *Database) CreateEmailVerification(userID int, tokenHash string, now time.Time) error {
+	now = now.UTC()
+
+	return d.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ? AND used_at IS NULL`, userID); err != nil {
+			return err
+		}
+
+		query := `INSERT INTO email_verifications (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)`
+		_, err := tx.Exec(query, userID, tokenHash, now, now.Add(emailVerificationPeriod))
+		return err
+	})
+}
+
+// VerifyEmail uses up a verification token and marks its user's email
+// address as verified. It returns the ID of the user.
+func (d *Database) VerifyEmail(tokenHash string, now time.Time) (int, error) {
+	now = now.UTC()
+
+	var userID int
+	err := d.inTransaction(func(tx *sql.Tx) error {
+		query := `SELECT user_id FROM email_verifications WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`
+		err := tx.QueryRow(query, tokenHash, now).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidVerificationToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`UPDATE email_verifications SET used_at = ? WHERE token_hash = ?`, now, tokenHash); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL`, now, userID)
+		return err
+	})
+	return userID, err
+}
+
+// ApproveUser activates an account that registered while registration
+// required approval.
+func (d *Database) ApproveUser(userID int) error {
+	result, err := d.db.Exec(`UPDATE users SET status = ? WHERE id = ?`, models.UserActive, userID)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateInvitation stores an invitation for an email address under the hash
+// of its secret.
+func (d *Database) CreateInvitation(email, tokenHash string, invitedBy int, now time.Time) error {
+	now = now.UTC()
+
+	query := `INSERT INTO invitations (email, token_hash, invited_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := d.db.Exec(query, email, tokenHash, invitedBy, now, now.Add(invitationPeriod))
+	return err
+}
+
+// GetInvitation returns the invitation stored under a hash if it can still
+// be used.
+func (d *Database) GetInvitation(tokenHash string, now time.Time) (*models.Invitation, error) {
+	invitations, err := d.queryInvitations(`WHERE i.token_hash = ? AND i.used_at IS NULL AND i.expires_at > ?`, tokenHash, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	if len(invitations) == 0 {
+		return nil, ErrInvalidInvitation
+	}
+	return &invitations[0], nil
+}
+
+// GetOpenInvitations returns the invitations that haven't been used or
+// expired, newest first.
+func (d *Database) GetOpenInvitations(now time.Time) ([]models.Invitation, error) {
+	return d.queryInvitations(`WHERE i.used_at IS NULL AND i.expires_at > ? ORDER BY i.created_at DESC, i.id DESC`, now.UTC())
+}
+
+// RegisterInvitedUser uses up an invitation to create an active user. The
+// email address must be the one the invitation was sent to, so it counts as
+// verified.
+func (d *Database) RegisterInvitedUser(tokenHash, username, email, passwordHash string, now time.Time) (int, error) {
+	now = now.UTC()
+
+	userRoleID, err := d.getRoleIDByName("user")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user role ID: %w", err)
+	}
+
+	var userID int
+	err = d.inTransaction(func(tx *sql.Tx) error {
+		var invitationID int
+		var invitedEmail string
+		query := `SELECT id, email FROM invitations WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`
+		err := tx.QueryRow(query, tokenHash, now).Scan(&invitationID, &invitedEmail)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && !strings.EqualFold(invitedEmail, email) {
+			return ErrInvalidInvitation
+		}
+		if err != nil {
+			return err
+		}
+
+		userID, err = insertUser(tx, username, email, passwordHash, &now, models.UserActive, userRoleID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE invitations SET used_at = ?, used_by = ? WHERE id = ?`, now, userID, invitationID)
+		return err
+	})
+	return userID, err
+}
+
+// queryInvitations returns the invitations selected by where, which may also
+// order and limit the results.
+func (d *Database) queryInvitations(where string, args ...any) ([]models.Invitation, error) {
+	query := `
+		SELECT i.id, i.email, i.invited_by, u.username, i.created_at, i.expires_at, i.used_at
+		FROM invitations i
+		INNER JOIN users u ON u.id = i.invited_by
+		` + where
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []models.Invitation
+	for rows.Next() {
+		var invitation models.Invitation
+		var usedAt sql.NullTime
+		err := rows.Scan(&invitation.ID, &invitation.Email, &invitation.InvitedBy, &invitation.InviterName, &invitation.CreatedAt, &invitation.ExpiresAt, &usedAt)
+		if err != nil {
+			return nil, err
+		}
+		invitation.UsedAt = nullTimePtr(usedAt)
+		invitations = append(invitations, invitation)
+	}
+
+	return invitations, rows.Err()
+}
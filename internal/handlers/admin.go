@@ -2,14 +2,28 @@ package handlers
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"librarymanagementsystem/internal/auth"
 	"librarymanagementsystem/internal/db"
 	"librarymanagementsystem/internal/models"
 	"librarymanagementsystem/templates"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
+// adminNotices are the messages shown on the admin page after an action
+// redirects back to it with ?notice=.
+var adminNotices = map[string]string{
+	"invited":  "Invitation sent",
+	"approved": "User approved",
+	"unlocked": "Lockout removed",
+	"role2fa":  "Role two-factor policy updated",
+}
+
 type AdminHandler struct {
 	db             *db.Database
 	sessionManager *auth.SessionManager
@@ -48,7 +62,25 @@ func (h *AdminHandler) Index(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	templates.AdminIndex(users, roles, user).Render(r.Context(), w)
+	invitations, err := h.db.GetOpenInvitations(time.Now())
+	if err != nil {
+		http.Error(w, "Failed to fetch invitations", http.StatusInternalServerError)
+		return
+	}
+
+	lockouts, err := h.db.GetActiveLockouts(time.Now())
+	if err != nil {
+		http.Error(w, "Failed to fetch lockouts", http.StatusInternalServerError)
+		return
+	}
+
+	damaged, err := h.db.GetDamagedPDFs()
+	if err != nil {
+		http.Error(w, "Failed to fetch file checks", http.StatusInternalServerError)
+		return
+	}
+
+	templates.AdminIndex(users, roles, invitations, lockouts, damaged, user, adminNotices[r.URL.Query().Get("notice")]).Render(r.Context(), w)
 }
 
 func (h *AdminHandler) AssignRole(w http.ResponseWriter, r *http.Request) {
@@ -95,6 +127,7 @@ func (h *AdminHandler) AssignRole(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to assign role", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(h.db, r, user, models.AuditRoleAssigned, models.AuditTargetUser, userID, nil, map[string]int{"role_id": roleID})
 
 	// Redirect back to admin page
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
@@ -140,10 +173,197 @@ func (h *AdminHandler) RemoveRole(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = h.db.RemoveRole(userID, roleID)
+	if errors.Is(err, db.ErrLastRoleManager) {
+		http.Error(w, "That would leave no one able to manage roles", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to remove role", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(h.db, r, user, models.AuditRoleRemoved, models.AuditTargetUser, userID, map[string]int{"role_id": roleID}, nil)
+
+	// Redirect back to admin page
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// Approve activates an account that registered while registration required
+// admin approval.
+func (h *AdminHandler) Approve(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_users")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid User ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.ApproveUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to approve user", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditUserApproved, models.AuditTargetUser, userID, nil, nil)
+
+	http.Redirect(w, r, "/admin?notice=approved", http.StatusSeeOther)
+}
+
+// Unlock ends a login lockout early, so the locked out username or IP
+// address can log in again right away.
+func (h *AdminHandler) Unlock(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_users")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lockoutID, err := strconv.Atoi(r.FormValue("lockout_id"))
+	if err != nil {
+		http.Error(w, "Invalid lockout ID", http.StatusBadRequest)
+		return
+	}
+
+	lockout, err := h.db.Unlock(lockoutID, user.ID, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Lockout not found or already ended", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove lockout", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s removed the lockout of %s %q", user.Username, lockout.Kind, lockout.Subject)
+	recordAudit(h.db, r, user, models.AuditUnlock, models.AuditTargetLockout, lockout.ID, nil, lockout)
+
+	http.Redirect(w, r, "/admin?notice=unlocked", http.StatusSeeOther)
+}
+
+// SetRoleTwoFactor sets whether members of a role must use two-factor
+// authentication. Members who haven't set it up are sent to set it up the
+// next time they open a page.
+func (h *AdminHandler) SetRoleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_roles")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roleID, err := strconv.Atoi(r.FormValue("role_id"))
+	if err != nil {
+		http.Error(w, "Invalid Role ID", http.StatusBadRequest)
+		return
+	}
+
+	require2FA := r.FormValue("require_2fa") == "true"
+	err = h.db.SetRoleRequire2FA(roleID, require2FA)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditRoleTwoFactor, models.AuditTargetRole, roleID, nil, map[string]bool{"require_2fa": require2FA})
+
+	http.Redirect(w, r, "/admin?notice=role2fa", http.StatusSeeOther)
+}
+
+// SetPassword sets a temporary password for a user who can't reset their
+// own, logging them out of every session.
+func (h *AdminHandler) SetPassword(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_users")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid User ID", http.StatusBadRequest)
+		return
+	}
+
+	password := r.FormValue("password")
+	if len(password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.db.SetPassword(userID, passwordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to set password", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(h.db, r, user, models.AuditPasswordSet, models.AuditTargetUser, userID, nil, nil)
+
+	if err := h.sessionManager.DestroyUserSessions(userID); err != nil {
+		http.Error(w, "Failed to end sessions", http.StatusInternalServerError)
+		return
+	}
 
 	// Redirect back to admin page
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
@@ -157,35 +377,9 @@ func (h *AdminHandler) getUserFromContext(ctx context.Context) *models.User {
 }
 
 func (h *AdminHandler) hasPermission(user *models.User, permissionName string) (bool, error) {
-	if user == nil {
-		return false, nil
-	}
-	return h.db.HasPermission(user.ID, permissionName)
+	return checkPermission(h.db, user, permissionName)
 }
 
 func (h *AdminHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		sessionToken, err := auth.GetSessionToken(r)
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		session, err := h.sessionManager.ValidateSession(sessionToken)
-		if err != nil {
-			auth.ClearSessionCookie(w)
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		// Add user with roles to context
-		user, err := h.db.GetUserWithRoles(session.UserID)
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		ctx := context.WithValue(r.Context(), "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	}
+	return authMiddleware(h.db, h.sessionManager, next, redirectToLogin)
 }
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/storage"
+	"log"
+	"net/http"
+)
+
+// checkUpload checks that a quarantined file is a readable, unencrypted PDF
+// and, if a scanner is configured, that it's free of malware. Infected files
+// are logged and recorded in the audit log. Files that can't be scanned are
+// rejected too, so nothing leaves quarantine unscanned.
+func (h *LibraryHandler) checkUpload(r *http.Request, user *models.User, u *upload) error {
+	if err := u.check(); err != nil {
+		return err
+	}
+	if h.uploads.Scanner == nil {
+		return nil
+	}
+
+	threat, err := h.uploads.Scanner.Scan(r.Context(), u.file)
+	if _, seekErr := u.file.Seek(0, io.SeekStart); err == nil && seekErr != nil {
+		err = seekErr
+	}
+	if err != nil {
+		log.Printf("Failed to scan upload %q from %s: %v", u.filename, user.Username, err)
+		return &uploadError{http.StatusServiceUnavailable, "The file couldn't be scanned for viruses; try again later"}
+	}
+
+	if threat != "" {
+		log.Printf("Rejected upload %q from %s: infected with %s", u.filename, user.Username, threat)
+		recordAudit(h.db, r, user, models.AuditUploadInfected, "", 0, nil, map[string]any{
+			"filename": u.filename,
+			"size":     u.size,
+			"threat":   threat,
+		})
+		return &uploadError{http.StatusUnprocessableEntity, fmt.Sprintf("The file was rejected because it contains malware (%s)", threat)}
+	}
+	return nil
+}
+
+// InfectedPDF is a PDF whose file the scanner found malware in.
+type InfectedPDF struct {
+	PDF    models.PDF
+	Threat string
+}
+
+// RescanFiles scans the file of every PDF in the catalog for malware, for
+// files uploaded before scanning was set up or before the scanner knew of
+// the malware in them. Infected PDFs are logged, recorded in the audit log
+// and returned; they're left in place for an administrator to review. Files
+// shared by several PDFs are scanned once, and missing files are left to
+// ScrubFiles.
+func (h *LibraryHandler) RescanFiles(ctx context.Context) ([]InfectedPDF, error) {
+	if h.uploads.Scanner == nil {
+		return nil, errors.New("no virus scanner is configured")
+	}
+
+	pdfs, err := h.db.GetAllPDFs()
+	if err != nil {
+		return nil, err
+	}
+
+	threats := make(map[string]string)
+	var infected []InfectedPDF
+	for _, pdf := range pdfs {
+		threat, ok := threats[pdf.StorageKey]
+		if !ok {
+			threat, err = h.scanBlob(ctx, pdf.StorageKey)
+			if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+				log.Printf("Skipping PDF %d (%q): its file is missing", pdf.ID, pdf.Title)
+				continue
+			}
+			if err != nil {
+				return infected, fmt.Errorf("failed to scan the file of PDF %d: %w", pdf.ID, err)
+			}
+			threats[pdf.StorageKey] = threat
+		}
+
+		if threat != "" {
+			log.Printf("The file of PDF %d (%q) is infected with %s: %s", pdf.ID, pdf.Title, threat, pdf.StorageKey)
+			recordAudit(h.db, nil, nil, models.AuditPDFInfected, models.AuditTargetPDF, pdf.ID, nil, map[string]string{
+				"storage_key": pdf.StorageKey,
+				"threat":      threat,
+			})
+			infected = append(infected, InfectedPDF{PDF: pdf, Threat: threat})
+		}
+	}
+
+	return infected, nil
+}
+
+// scanBlob scans a stored file for malware.
+func (h *LibraryHandler) scanBlob(ctx context.Context, key string) (string, error) {
+	blob, _, err := h.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	return h.uploads.Scanner.Scan(ctx, blob)
+}
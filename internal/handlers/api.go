@@ -0,0 +1,941 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix = "/api/v1"
+
+	defaultPerPage = 20
+	maxPerPage     = 100
+
+	// maxJSONBody limits the size of JSON request bodies.
+	maxJSONBody = 1 << 20
+)
+
+// APIHandler serves the versioned JSON API under /api/v1. It applies the same
+// permission checks as the HTML handlers, and authenticates requests with the
+// session cookie or an "Authorization: Bearer" header holding a session token
+// or a personal API token.
+type APIHandler struct {
+	db             *db.Database
+	sessionManager *auth.SessionManager
+	library        *LibraryHandler
+	authenticator  Authenticator
+	now            func() time.Time
+}
+
+func NewAPIHandler(database *db.Database, sessionManager *auth.SessionManager) *APIHandler {
+	return &APIHandler{
+		db:             database,
+		sessionManager: sessionManager,
+		library:        NewLibraryHandler(database, sessionManager),
+		authenticator:  NewPasswordAuthenticator(database),
+		now:            time.Now,
+	}
+}
+
+// SetAuthenticator changes how passwords are checked at login, which is
+// PasswordAuthenticator by default.
+func (h *APIHandler) SetAuthenticator(authenticator Authenticator) {
+	h.authenticator = authenticator
+}
+
+// SetClock changes where the handler gets the current time from at login,
+// as AuthHandler.SetClock does.
+func (h *APIHandler) SetClock(now func() time.Time) {
+	h.now = now
+}
+
+// SetBlobStore changes where uploaded files are stored, as
+// LibraryHandler.SetBlobStore does.
+func (h *APIHandler) SetBlobStore(store storage.BlobStore) {
+	h.library.SetBlobStore(store)
+}
+
+// SetUploadConfig changes how uploaded files are received, as
+// LibraryHandler.SetUploadConfig does.
+func (h *APIHandler) SetUploadConfig(config UploadConfig) {
+	h.library.SetUploadConfig(config)
+}
+
+// apiResponse is the envelope of every successful response that has a body.
+type apiResponse struct {
+	Data       any            `json:"data"`
+	Pagination *apiPagination `json:"pagination,omitempty"`
+	Warnings   []apiWarning   `json:"warnings,omitempty"`
+}
+
+// apiWarning describes something about a successful request the client
+// may want to act on, such as an upload duplicating an existing PDF.
+type apiWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	PDFID   int    `json:"pdf_id,omitempty"` // The PDF the warning refers to
+}
+
+type apiPagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// apiErrorResponse is the envelope of every error response.
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiErrorCodes maps HTTP statuses to the machine-readable error codes
+// clients can switch on.
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+}
+
+// apiSearchResult is a PDF matching a search along with the pages that
+// matched its text.
+type apiSearchResult struct {
+	models.PDF
+	Matches []models.PageMatch `json:"matches"`
+}
+
+// Login exchanges a username and password for a session token to send as
+// "Authorization: Bearer <token>".
+func (h *APIHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Code     string `json:"code"` // TOTP or recovery code, for users with two-factor authentication
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Username == "" || body.Password == "" {
+		writeAPIError(w, http.StatusBadRequest, "Username and password are required")
+		return
+	}
+
+	now := h.now()
+	user, err := checkLogin(h.db, h.authenticator, r, body.Username, body.Password, now)
+	var throttled *loginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		throttled.setRetryAfter(w, now)
+		writeAPIError(w, http.StatusTooManyRequests, throttled.message(now))
+		return
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		writeAPIError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "Failed to check login")
+		return
+	}
+
+	if user.HasTwoFactor() {
+		if body.Code == "" {
+			writeAPIError(w, http.StatusUnauthorized, "A two-factor code is required")
+			return
+		}
+		err := checkSecondFactor(h.db, user, body.Code, now)
+		if errors.Is(err, errInvalidSecondFactor) {
+			if err := recordLoginFailure(h.db, r, user.Username, now); err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "Failed to check login")
+				return
+			}
+			writeAPIError(w, http.StatusUnauthorized, "Invalid two-factor code")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to check two-factor code")
+			return
+		}
+	}
+
+	token, err := h.sessionManager.CreateSession(user.ID, user.Username, auth.ClientIP(r), r.UserAgent())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditLogin, models.AuditTargetUser, user.ID, nil, nil)
+
+	user, err = h.db.GetUserWithRoles(user.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to fetch user")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiResponse{Data: map[string]any{
+		"token": token,
+		"user":  user,
+	}})
+}
+
+// Logout ends the session the request was authenticated with.
+func (h *APIHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w, "POST")
+		return
+	}
+
+	token, err := auth.GetSessionToken(r)
+	if err == nil {
+		h.sessionManager.DestroySession(token)
+	}
+	user := h.getUserFromContext(r.Context())
+	recordAudit(h.db, r, user, models.AuditLogout, models.AuditTargetUser, user.ID, nil, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PDFs lists PDFs (GET) or uploads a new one from a multipart form with the
+// same fields as the upload page (POST).
+func (h *APIHandler) PDFs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		user := h.getUserFromContext(r.Context())
+		if !h.requirePermission(w, user, "view_pdf") {
+			return
+		}
+
+		page, perPage, ok := parsePagination(w, r)
+		if !ok {
+			return
+		}
+
+		visibility, err := pdfVisibility(h.db, user)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to check permissions")
+			return
+		}
+
+		pdfs, total, err := h.db.GetPDFsPage(visibility, perPage, (page-1)*perPage)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to fetch PDFs")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{Data: nonNil(pdfs), Pagination: newPagination(page, perPage, total)})
+	case "POST":
+		h.createPDF(w, r)
+	default:
+		writeMethodNotAllowed(w, "GET, POST")
+	}
+}
+
+func (h *APIHandler) createPDF(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+	if !h.requirePermission(w, user, "upload_pdf") {
+		return
+	}
+
+	upload, err := h.library.receiveUpload(w, r)
+	if err != nil {
+		status, message := uploadErrorResponse(err)
+		writeAPIError(w, status, message)
+		return
+	}
+	defer upload.Close()
+
+	title := strings.TrimSpace(upload.form.Get("title"))
+	if title == "" {
+		writeAPIError(w, http.StatusBadRequest, "Title is required")
+		return
+	}
+
+	if upload.file == nil {
+		writeAPIError(w, http.StatusBadRequest, "File is required")
+		return
+	}
+
+	if err := h.library.checkUpload(r, user, upload); err != nil {
+		status, message := uploadErrorResponse(err)
+		writeAPIError(w, status, message)
+		return
+	}
+
+	stored, err := h.library.storeUpload(r.Context(), upload.file)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	pdf := models.PDF{
+		Title:       title,
+		Author:      upload.form.Get("author"),
+		Description: upload.form.Get("description"),
+		Filename:    fmt.Sprintf("%d_%s", user.ID, upload.filename),
+		UploadedBy:  user.ID,
+	}
+	stored.apply(&pdf)
+	pdfID, err := h.db.CreateUploadedPDF(pdf)
+	if err != nil {
+		h.library.releaseBlob(stored.key)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to create PDF record")
+		return
+	}
+
+	h.library.confirmStored(r.Context(), upload.file, stored)
+	h.library.indexPDFText(pdfID, upload.file, stored.size)
+
+	created, err := h.db.GetPDFByID(pdfID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to fetch PDF")
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditPDFUploaded, models.AuditTargetPDF, created.ID, nil, created)
+
+	duplicates, err := duplicatePDFs(h.db, user, created)
+	if err != nil {
+		log.Printf("Failed to check PDF %d for duplicates: %v", created.ID, err)
+	}
+	var warnings []apiWarning
+	for _, duplicate := range duplicates {
+		warnings = append(warnings, apiWarning{
+			Code:    "duplicate",
+			Message: fmt.Sprintf("The file is identical to the one of %q", duplicate.Title),
+			PDFID:   duplicate.ID,
+		})
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/pdfs/%d", apiPrefix, created.ID))
+	writeJSON(w, http.StatusCreated, apiResponse{Data: created, Warnings: warnings})
+}
+
+// SearchPDFs searches PDF metadata and contents for the q parameter.
+func (h *APIHandler) SearchPDFs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	user := h.getUserFromContext(r.Context())
+	if !h.requirePermission(w, user, "view_pdf") {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeAPIError(w, http.StatusBadRequest, "The q parameter is required")
+		return
+	}
+
+	page, perPage, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	visibility, err := pdfVisibility(h.db, user)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return
+	}
+
+	pdfs, matches, err := h.db.SearchPDFs(visibility, query)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to search PDFs")
+		return
+	}
+
+	results := make([]apiSearchResult, 0, perPage)
+	for _, pdf := range pageOf(pdfs, page, perPage) {
+		results = append(results, apiSearchResult{PDF: pdf, Matches: nonNil(matches[pdf.ID])})
+	}
+
+	writeJSON(w, http.StatusOK, apiResponse{Data: results, Pagination: newPagination(page, perPage, len(pdfs))})
+}
+
+// PDF gets (GET), updates (PUT or PATCH) or deletes (DELETE) the PDF at
+// /api/v1/pdfs/{id}.
+func (h *APIHandler) PDF(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, apiPrefix+"/pdfs/"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		pdf, err := h.db.GetPDFByID(id)
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "PDF not found")
+			return
+		}
+		if !h.requirePDFAccess(w, r, pdf, models.PDFAccessRead) {
+			return
+		}
+		writeJSON(w, http.StatusOK, apiResponse{Data: pdf})
+	case "PUT", "PATCH":
+		h.updatePDF(w, r, id)
+	case "DELETE":
+		h.deletePDF(w, r, id)
+	default:
+		writeMethodNotAllowed(w, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+// updatePDF changes the metadata of a PDF. Fields left out of the body keep
+// their values. Like the edit page, the body must carry the version the
+// changes are based on, and stale updates are rejected with 409 Conflict.
+func (h *APIHandler) updatePDF(w http.ResponseWriter, r *http.Request, id int) {
+	var body struct {
+		Title              *string `json:"title"`
+		Author             *string `json:"author"`
+		Description        *string `json:"description"`
+		MaxConcurrentLoans *int    `json:"max_concurrent_loans"`
+		Version            *int    `json:"version"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Version == nil {
+		writeAPIError(w, http.StatusBadRequest, "version is required")
+		return
+	}
+
+	pdf, err := h.db.GetPDFByID(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "PDF not found")
+		return
+	}
+	if !h.requirePDFAccess(w, r, pdf, models.PDFAccessEdit) {
+		return
+	}
+	before := *pdf
+
+	if body.Title != nil {
+		pdf.Title = strings.TrimSpace(*body.Title)
+		if pdf.Title == "" {
+			writeAPIError(w, http.StatusBadRequest, "Title can't be empty")
+			return
+		}
+	}
+	if body.Author != nil {
+		pdf.Author = *body.Author
+	}
+	if body.Description != nil {
+		pdf.Description = *body.Description
+	}
+	if body.MaxConcurrentLoans != nil {
+		if *body.MaxConcurrentLoans < 0 {
+			writeAPIError(w, http.StatusBadRequest, "max_concurrent_loans can't be negative")
+			return
+		}
+		pdf.MaxConcurrentLoans = *body.MaxConcurrentLoans
+	}
+
+	err = h.db.UpdatePDF(pdf, *body.Version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeAPIError(w, http.StatusNotFound, "PDF not found")
+	case errors.Is(err, db.ErrConflict):
+		writeAPIError(w, http.StatusConflict, "The PDF was changed since this version; fetch it again and retry")
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "Failed to update PDF")
+	default:
+		recordAudit(h.db, r, h.getUserFromContext(r.Context()), models.AuditPDFUpdated, models.AuditTargetPDF, pdf.ID, before, pdf)
+		writeJSON(w, http.StatusOK, apiResponse{Data: pdf})
+	}
+}
+
+func (h *APIHandler) deletePDF(w http.ResponseWriter, r *http.Request, id int) {
+	pdf, err := h.db.GetPDFByID(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "PDF not found")
+		return
+	}
+	if !h.requirePDFAccess(w, r, pdf, models.PDFAccessDelete) {
+		return
+	}
+
+	if err := h.db.DeletePDF(id); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to delete PDF")
+		return
+	}
+	recordAudit(h.db, r, h.getUserFromContext(r.Context()), models.AuditPDFDeleted, models.AuditTargetPDF, id, pdf, nil)
+
+	h.library.releaseBlob(pdf.StorageKey)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me returns the current user with their roles.
+func (h *APIHandler) Me(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiResponse{Data: h.getUserFromContext(r.Context())})
+}
+
+// Users lists users with their roles.
+func (h *APIHandler) Users(w http.ResponseWriter, r *http.Request) {
+	if !h.requirePermission(w, h.getUserFromContext(r.Context()), "manage_roles") {
+		return
+	}
+
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	page, perPage, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	users, total, err := h.db.GetUsersWithRolesPage(perPage, (page-1)*perPage)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to fetch users")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiResponse{Data: nonNil(users), Pagination: newPagination(page, perPage, total)})
+}
+
+// User serves /api/v1/users/{id} (GET), assigns a role with
+// POST /api/v1/users/{id}/roles and removes one with
+// DELETE /api/v1/users/{id}/roles/{roleID}.
+func (h *APIHandler) User(w http.ResponseWriter, r *http.Request) {
+	current := h.getUserFromContext(r.Context())
+	if !h.requirePermission(w, current, "manage_roles") {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix+"/users/"), "/")
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 3 || len(parts) > 1 && parts[1] != "roles" {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if _, err := h.db.GetUserByID(userID); err != nil {
+		writeAPIError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+	case len(parts) == 1:
+		writeMethodNotAllowed(w, "GET")
+		return
+	case len(parts) == 2 && r.Method == "POST":
+		var body struct {
+			RoleID int `json:"role_id"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		if _, err := h.db.GetRoleByID(body.RoleID); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Unknown role_id")
+			return
+		}
+		if err := h.db.AssignRole(userID, body.RoleID, &current.ID); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to assign role")
+			return
+		}
+		recordAudit(h.db, r, current, models.AuditRoleAssigned, models.AuditTargetUser, userID, nil, map[string]int{"role_id": body.RoleID})
+	case len(parts) == 2:
+		writeMethodNotAllowed(w, "POST")
+		return
+	case r.Method == "DELETE":
+		roleID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		err = h.db.RemoveRole(userID, roleID)
+		if errors.Is(err, db.ErrLastRoleManager) {
+			writeAPIError(w, http.StatusConflict, "That would leave no one able to manage roles")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to remove role")
+			return
+		}
+		recordAudit(h.db, r, current, models.AuditRoleRemoved, models.AuditTargetUser, userID, map[string]int{"role_id": roleID}, nil)
+	default:
+		writeMethodNotAllowed(w, "DELETE")
+		return
+	}
+
+	user, err := h.db.GetUserWithRoles(userID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to fetch user")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiResponse{Data: user})
+}
+
+// Roles lists the roles with their permissions (GET) or creates a role
+// (POST).
+func (h *APIHandler) Roles(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+	if !h.requirePermission(w, user, "manage_roles") {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		roles, err := h.db.GetAllRoles()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Failed to fetch roles")
+			return
+		}
+		for i := range roles {
+			permissions, err := h.db.GetRolePermissions(roles[i].ID)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "Failed to fetch role permissions")
+				return
+			}
+			roles[i].Permissions = nonNil(permissions)
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{Data: nonNil(roles)})
+	case "POST":
+		var body struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		name := strings.TrimSpace(body.Name)
+		if err := validateRoleName(name); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		id, err := h.db.CreateRole(name, strings.TrimSpace(body.Description))
+		if err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		recordRoleChange(h.db, r, user, models.AuditRoleCreated, id, nil)
+		w.Header().Set("Location", fmt.Sprintf("%s/roles/%d", apiPrefix, id))
+		h.writeRole(w, http.StatusCreated, id)
+	default:
+		writeMethodNotAllowed(w, "GET, POST")
+	}
+}
+
+// Role gets (GET), updates (PUT or PATCH) or deletes (DELETE) the role at
+// /api/v1/roles/{id}, and replaces its permissions with
+// PUT /api/v1/roles/{id}/permissions.
+func (h *APIHandler) Role(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+	if !h.requirePermission(w, user, "manage_roles") {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiPrefix+"/roles/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 || len(parts) == 2 && parts[1] != "permissions" {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	role, err := h.db.GetRoleByID(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Role not found")
+		return
+	}
+	before := *role
+
+	switch {
+	case len(parts) == 2 && r.Method == "PUT":
+		var body struct {
+			PermissionIDs []int `json:"permission_ids"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		if body.PermissionIDs == nil {
+			writeAPIError(w, http.StatusBadRequest, "permission_ids is required")
+			return
+		}
+		err = setRolePermissions(h.db, r, user, map[int][]int{id: body.PermissionIDs})
+		if errors.Is(err, sql.ErrNoRows) {
+			writeAPIError(w, http.StatusBadRequest, "Unknown permission ID")
+			return
+		}
+	case len(parts) == 2:
+		writeMethodNotAllowed(w, "PUT")
+		return
+	case r.Method == "GET":
+	case r.Method == "PUT" || r.Method == "PATCH":
+		var body struct {
+			Name        *string `json:"name"`
+			Description *string `json:"description"`
+		}
+		if !decodeJSON(w, r, &body) {
+			return
+		}
+		if body.Name != nil {
+			role.Name = strings.TrimSpace(*body.Name)
+			if err := validateRoleName(role.Name); err != nil {
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if body.Description != nil {
+			role.Description = strings.TrimSpace(*body.Description)
+		}
+		if err = h.db.UpdateRole(id, role.Name, role.Description); err == nil {
+			recordRoleChange(h.db, r, user, models.AuditRoleUpdated, id, &before)
+		}
+	case r.Method == "DELETE":
+		if err := h.db.DeleteRole(id); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+		recordRoleChange(h.db, r, user, models.AuditRoleDeleted, id, &before)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeMethodNotAllowed(w, "GET, PUT, PATCH, DELETE")
+		return
+	}
+
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	h.writeRole(w, http.StatusOK, id)
+}
+
+// writeRole writes the role with its permissions.
+func (h *APIHandler) writeRole(w http.ResponseWriter, status, id int) {
+	role, err := h.db.GetRoleByID(id)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to fetch role")
+		return
+	}
+	role.Permissions = nonNil(role.Permissions)
+
+	writeJSON(w, status, apiResponse{Data: role})
+}
+
+// writeRoleError writes the API error for an error from the role management
+// methods of db.Database.
+func writeRoleError(w http.ResponseWriter, err error) {
+	status, message := roleErrorMessage(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Failed to update roles: %v", err)
+	}
+	writeAPIError(w, status, message)
+}
+
+// Permissions lists every permission.
+func (h *APIHandler) Permissions(w http.ResponseWriter, r *http.Request) {
+	if !h.requirePermission(w, h.getUserFromContext(r.Context()), "manage_roles") {
+		return
+	}
+
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	permissions, err := h.db.GetAllPermissions()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to fetch permissions")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiResponse{Data: nonNil(permissions)})
+}
+
+// NotFound answers requests for unknown API paths.
+func (h *APIHandler) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "Not found")
+}
+
+// requirePDFAccess writes a 403 error and returns false unless the current
+// user may access the PDF at level.
+func (h *APIHandler) requirePDFAccess(w http.ResponseWriter, r *http.Request, pdf *models.PDF, level string) bool {
+	allowed, err := canAccessPDF(h.db, h.getUserFromContext(r.Context()), pdf, level)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return false
+	}
+	if !allowed {
+		writeAPIError(w, http.StatusForbidden, "Access denied")
+		return false
+	}
+	return true
+}
+
+// requirePermission writes a 403 error and returns false unless the user has
+// the permission.
+func (h *APIHandler) requirePermission(w http.ResponseWriter, user *models.User, permissionName string) bool {
+	hasPerm, err := h.hasPermission(user, permissionName)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Failed to check permissions")
+		return false
+	}
+	if !hasPerm {
+		writeAPIError(w, http.StatusForbidden, "Access denied")
+		return false
+	}
+	return true
+}
+
+func (h *APIHandler) getUserFromContext(ctx context.Context) *models.User {
+	if user, ok := ctx.Value("user").(*models.User); ok {
+		return user
+	}
+	return nil
+}
+
+func (h *APIHandler) hasPermission(user *models.User, permissionName string) (bool, error) {
+	return checkPermission(h.db, user, permissionName)
+}
+
+// AuthMiddleware authenticates API requests. Unlike the HTML handlers'
+// middleware it answers with a 401 error instead of redirecting to the login
+// page.
+func (h *APIHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(h.db, h.sessionManager, next, h.unauthorized)
+}
+
+func (h *APIHandler) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errAccountInactive) {
+		writeAPIError(w, http.StatusForbidden, "Account email is not verified or account is awaiting approval")
+		return
+	}
+	if errors.Is(err, errTwoFactorSetupRequired) {
+		writeAPIError(w, http.StatusForbidden, "Your role requires two-factor authentication; set it up at /account/2fa")
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "Invalid or expired token")
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeAPIError(w, http.StatusUnauthorized, "Authentication required")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Failed to write JSON response: %v\n", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	code, ok := apiErrorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	writeJSON(w, status, apiErrorResponse{Error: apiError{Code: code, Message: message}})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// decodeJSON decodes a JSON request body into v, rejecting unknown fields. It
+// writes an error and returns false if the body can't be decoded.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "Request body is too large")
+			return false
+		}
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// parsePagination reads the page and per_page query parameters. It writes an
+// error and returns false if either is invalid.
+func parsePagination(w http.ResponseWriter, r *http.Request) (page, perPage int, ok bool) {
+	page, perPage = 1, defaultPerPage
+
+	if value := r.URL.Query().Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeAPIError(w, http.StatusBadRequest, "page must be a positive number")
+			return 0, 0, false
+		}
+		page = n
+	}
+
+	if value := r.URL.Query().Get("per_page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPerPage {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("per_page must be between 1 and %d", maxPerPage))
+			return 0, 0, false
+		}
+		perPage = n
+	}
+
+	return page, perPage, true
+}
+
+func newPagination(page, perPage, total int) *apiPagination {
+	return &apiPagination{
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: (total + perPage - 1) / perPage,
+	}
+}
+
+// pageOf returns the items on a page of a fully loaded list.
+func pageOf[T any](items []T, page, perPage int) []T {
+	start := (page - 1) * perPage
+	if start >= len(items) {
+		return nil
+	}
+	return items[start:min(start+perPage, len(items))]
+}
+
+// nonNil makes empty lists encode as [] rather than null.
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
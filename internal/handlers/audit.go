@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditPageSize is the number of events on each page of the audit log.
+const auditPageSize = 50
+
+// recordAudit appends an event caused by a request to the audit log. actor
+// is nil for events no user caused, such as lockouts, and has no ID for
+// failed logins, where only the attempted username is known. targetID is 0
+// for events without a target. before and after are snapshots of what the
+// event changed, stored as JSON, and may be nil. r is nil for events found
+// outside a request, such as by maintenance commands. Failures are logged
+// rather than failing the request.
+func recordAudit(database *db.Database, r *http.Request, actor *models.User, action, targetType string, targetID int, before, after any) {
+	event := models.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		Before:     auditSnapshot(before),
+		After:      auditSnapshot(after),
+	}
+	if r != nil {
+		event.IPAddress = auth.ClientIP(r)
+	}
+	if actor != nil {
+		event.ActorName = actor.Username
+		if actor.ID != 0 {
+			event.ActorID = &actor.ID
+		}
+	}
+	if targetID != 0 {
+		event.TargetID = &targetID
+	}
+
+	if err := database.RecordAuditEvent(event); err != nil {
+		log.Printf("Failed to record audit event %s: %v", action, err)
+	}
+}
+
+// auditSnapshot returns v as JSON, or nil if v is nil.
+func auditSnapshot(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode audit snapshot: %v", err)
+		return nil
+	}
+	return data
+}
+
+// parseAuditFilter reads the audit log filters from a query string. since
+// and until are dates, and until includes the whole day.
+func parseAuditFilter(query url.Values) (db.AuditFilter, error) {
+	filter := db.AuditFilter{
+		Actor:      strings.TrimSpace(query.Get("actor")),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+	}
+	if filter.Action != "" && !slices.Contains(models.AuditActions, filter.Action) {
+		return filter, errors.New("Unknown action")
+	}
+
+	if s := strings.TrimSpace(query.Get("target_id")); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return filter, errors.New("Invalid target ID")
+		}
+		filter.TargetID = &id
+	}
+
+	var err error
+	if s := query.Get("since"); s != "" {
+		if filter.Since, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return filter, errors.New("Invalid start date")
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if filter.Until, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return filter, errors.New("Invalid end date")
+		}
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	return filter, nil
+}
+
+// Audit shows the audit log, filtered by the query string and newest first.
+// With ?format=csv or ?format=json it downloads every matching event instead.
+func (h *AdminHandler) Audit(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "view_audit_log")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := parseAuditFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format := query.Get("format"); format {
+	case "":
+		page, _ := strconv.Atoi(query.Get("page"))
+		page = max(page, 1)
+		events, total, err := h.db.GetAuditEvents(filter, auditPageSize, (page-1)*auditPageSize)
+		if err != nil {
+			http.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+			return
+		}
+		totalPages := max(1, (total+auditPageSize-1)/auditPageSize)
+		templates.AdminAudit(events, query, page, totalPages, total, user).Render(r.Context(), w)
+
+	case "csv", "json":
+		events, _, err := h.db.GetAuditEvents(filter, -1, 0)
+		if err != nil {
+			http.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-events.`+format+`"`)
+		if format == "json" {
+			writeJSON(w, http.StatusOK, nonNil(events))
+			return
+		}
+		writeAuditCSV(w, events)
+
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+	}
+}
+
+// writeAuditCSV writes audit events as CSV, with a header row.
+func writeAuditCSV(w http.ResponseWriter, events []models.AuditEvent) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "created_at", "actor_id", "actor_name", "action", "target_type", "target_id", "before", "after", "ip_address"})
+	optional := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+	for _, event := range events {
+		out.Write([]string{
+			strconv.Itoa(event.ID),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			optional(event.ActorID),
+			csvText(event.ActorName),
+			csvText(event.Action),
+			csvText(event.TargetType),
+			optional(event.TargetID),
+			csvText(string(event.Before)),
+			csvText(string(event.After)),
+			csvText(event.IPAddress),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Failed to write audit export: %v", err)
+	}
+}
+
+// csvText neutralises text that spreadsheets would run as a formula, such as
+// a failed login's attempted username, by prefixing it with an apostrophe.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
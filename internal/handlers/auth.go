@@ -2,29 +2,57 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"librarymanagementsystem/internal/auth"
 	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
 	"librarymanagementsystem/templates"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// minPasswordLength is the shortest password users can choose.
+const minPasswordLength = 6
+
 type AuthHandler struct {
 	db             *db.Database
 	sessionManager *auth.SessionManager
+	mailer         mail.Mailer
+	config         AuthConfig
+	now            func() time.Time
 }
 
-func NewAuthHandler(database *db.Database, sessionManager *auth.SessionManager) *AuthHandler {
+func NewAuthHandler(database *db.Database, sessionManager *auth.SessionManager, mailer mail.Mailer, config AuthConfig) *AuthHandler {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if config.Authenticator == nil {
+		config.Authenticator = NewPasswordAuthenticator(database)
+	}
+	if config.OIDC.ProviderName == "" {
+		config.OIDC.ProviderName = "Single Sign-On"
+	}
 	return &AuthHandler{
 		db:             database,
 		sessionManager: sessionManager,
+		mailer:         mailer,
+		config:         config,
+		now:            time.Now,
 	}
 }
 
+// SetClock changes where the handler gets the current time from, which is
+// time.Now by default. Tests use it to control how long failed logins block
+// further attempts.
+func (h *AuthHandler) SetClock(now func() time.Time) {
+	h.now = now
+}
+
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		templates.Login().Render(r.Context(), w)
+		templates.Login(h.ssoName()).Render(r.Context(), w)
 		return
 	}
 
@@ -41,22 +69,48 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.db.GetUserByUsername(username)
-	if err != nil {
+	now := h.now()
+	user, err := checkLogin(h.db, h.config.Authenticator, r, username, password, now)
+	var throttled *loginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		throttled.setRetryAfter(w, now)
+		h.renderAuthErrorStatus(w, http.StatusTooManyRequests, throttled.message(now))
+		return
+	case errors.Is(err, auth.ErrInvalidCredentials):
 		h.renderAuthError(w, "Invalid username or password")
 		return
+	case err != nil:
+		log.Printf("Failed to check login of %q: %v", username, err)
+		http.Error(w, "Failed to check login", http.StatusInternalServerError)
+		return
 	}
 
-	if !auth.CheckPassword(password, user.PasswordHash) {
-		h.renderAuthError(w, "Invalid username or password")
+	if user.HasTwoFactor() {
+		h.startLoginChallenge(w, r, user)
 		return
 	}
 
-	sessionToken, err := h.sessionManager.CreateSession(user.ID, user.Username)
+	h.completeLogin(w, r, user)
+}
+
+// ssoName returns the name of the single sign-on provider, or "" if single
+// sign-on is off.
+func (h *AuthHandler) ssoName() string {
+	if !h.config.OIDC.Enabled() {
+		return ""
+	}
+	return h.config.OIDC.ProviderName
+}
+
+// completeLogin starts a session for a user who passed every login check.
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	sessionToken, err := h.sessionManager.CreateSession(user.ID, user.Username, auth.ClientIP(r), r.UserAgent())
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(h.db, r, user, models.AuditLogin, models.AuditTargetUser, user.ID, nil, nil)
 
 	auth.SetSessionCookie(w, sessionToken)
 
@@ -68,9 +122,15 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Register shows the registration form (GET) or creates an account (POST).
+// Who may register depends on the registration mode. New accounts must
+// verify their email address, and in approval mode be approved, before they
+// can use the library; accounts created from an invitation are ready at once.
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	invite := r.FormValue("invite")
+
 	if r.Method == "GET" {
-		templates.Register().Render(r.Context(), w)
+		templates.Register(invite, h.config.RegistrationMode == RegistrationInvite && invite == "").Render(r.Context(), w)
 		return
 	}
 
@@ -80,7 +140,7 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	username := r.FormValue("username")
-	email := r.FormValue("email")
+	email := strings.TrimSpace(r.FormValue("email"))
 	password := r.FormValue("password")
 	confirmPassword := r.FormValue("confirm-password")
 
@@ -94,11 +154,24 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(password) < 6 {
-		h.renderAuthError(w, "Password must be at least 6 characters")
+	if len(password) < minPasswordLength {
+		h.renderAuthError(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength))
 		return
 	}
 
+	if invite == "" {
+		switch h.config.RegistrationMode {
+		case RegistrationInvite:
+			h.renderAuthError(w, "Registration is by invitation only")
+			return
+		case RegistrationDomain:
+			if !h.config.allowsDomain(email) {
+				h.renderAuthError(w, "Registration is limited to addresses at "+strings.Join(h.config.AllowedDomains, ", "))
+				return
+			}
+		}
+	}
+
 	// Check if user already exists
 	_, err := h.db.GetUserByUsername(username)
 	if err == nil {
@@ -114,9 +187,20 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create user
-	err = h.db.CreateUser(username, email, passwordHash)
+	var userID int
+	if invite != "" {
+		userID, err = h.db.RegisterInvitedUser(auth.HashToken(invite), username, email, passwordHash, time.Now())
+	} else {
+		status := models.UserActive
+		if h.config.RegistrationMode == RegistrationApproval {
+			status = models.UserPending
+		}
+		userID, err = h.db.RegisterUser(username, email, passwordHash, false, status, time.Now())
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		if errors.Is(err, db.ErrInvalidInvitation) {
+			h.renderAuthError(w, "This invitation is invalid, has been used or has expired, or was sent to a different email address")
+		} else if strings.Contains(err.Error(), "UNIQUE constraint failed") {
 			h.renderAuthError(w, "Username or email already exists")
 		} else {
 			http.Error(w, "Failed to create user", http.StatusInternalServerError)
@@ -124,14 +208,21 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Auto-login after registration
-	user, err := h.db.GetUserByUsername(username)
+	user, err := h.db.GetUserByID(userID)
 	if err != nil {
 		http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
 		return
 	}
 
-	sessionToken, err := h.sessionManager.CreateSession(user.ID, user.Username)
+	if !user.IsEmailVerified() {
+		if err := h.sendEmailVerification(user); err != nil {
+			// The user can ask for another email from the pending page
+			log.Printf("Failed to send email verification to user %d: %v", user.ID, err)
+		}
+	}
+
+	// Auto-login after registration
+	sessionToken, err := h.sessionManager.CreateSession(user.ID, user.Username, auth.ClientIP(r), r.UserAgent())
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
@@ -139,17 +230,26 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 	auth.SetSessionCookie(w, sessionToken)
 
+	target := "/library"
+	if !user.CanUseLibrary() {
+		target = "/account/pending"
+	}
+
 	if r.Header.Get("HX-Request") == "true" {
-		w.Header().Set("HX-Redirect", "/library")
+		w.Header().Set("HX-Redirect", target)
 		w.WriteHeader(http.StatusOK)
 	} else {
-		http.Redirect(w, r, "/library", http.StatusSeeOther)
+		http.Redirect(w, r, target, http.StatusSeeOther)
 	}
 }
 
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	sessionToken, err := auth.GetSessionToken(r)
 	if err == nil {
+		if session, err := h.sessionManager.ValidateSession(sessionToken); err == nil {
+			actor := &models.User{ID: session.UserID, Username: session.Username}
+			recordAudit(h.db, r, actor, models.AuditLogout, models.AuditTargetUser, session.UserID, nil, nil)
+		}
 		h.sessionManager.DestroySession(sessionToken)
 	}
 
@@ -159,36 +259,28 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *AuthHandler) renderAuthError(w http.ResponseWriter, message string) {
+	h.renderAuthErrorStatus(w, http.StatusBadRequest, message)
+}
+
+func (h *AuthHandler) renderAuthErrorStatus(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 
 	errorHTML := fmt.Sprintf(`<div class="error-message">%s</div>`, message)
 	w.Write([]byte(errorHTML))
 }
 
 func (h *AuthHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		sessionToken, err := auth.GetSessionToken(r)
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		session, err := h.sessionManager.ValidateSession(sessionToken)
-		if err != nil {
-			auth.ClearSessionCookie(w)
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		// Add user with roles to context
-		user, err := h.db.GetUserWithRoles(session.UserID)
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
+	return authMiddleware(h.db, h.sessionManager, next, redirectToLogin)
+}
 
-		ctx := context.WithValue(r.Context(), "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
+func (h *AuthHandler) getUserFromContext(ctx context.Context) *models.User {
+	if user, ok := ctx.Value("user").(*models.User); ok {
+		return user
 	}
+	return nil
+}
+
+func (h *AuthHandler) hasPermission(user *models.User, permissionName string) (bool, error) {
+	return checkPermission(h.db, user, permissionName)
 }
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Authenticator checks the username and password of a login. Login
+// throttling happens before an Authenticator is asked, so implementations
+// only check the credentials.
+type Authenticator interface {
+	// Authenticate returns the user the credentials belong to, or
+	// auth.ErrInvalidCredentials if they're wrong.
+	Authenticate(ctx context.Context, username, password string) (*models.User, error)
+}
+
+// PasswordAuthenticator checks passwords against the bcrypt hashes stored
+// with users.
+type PasswordAuthenticator struct {
+	db *db.Database
+}
+
+func NewPasswordAuthenticator(database *db.Database) *PasswordAuthenticator {
+	return &PasswordAuthenticator{db: database}
+}
+
+func (a *PasswordAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	user, err := a.db.GetUserByUsername(username)
+	if err != nil || !auth.CheckPassword(password, user.PasswordHash) {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// LDAPAuthenticator checks passwords against an LDAP directory. Directory
+// users are linked to local users by their DN, and get a local user without
+// a password at their first login if the registration mode allows it. At
+// every login the roles named in the role mapping are updated to match the
+// user's directory groups.
+type LDAPAuthenticator struct {
+	db          *db.Database
+	directory   *auth.LDAPDirectory
+	roleMapping map[string][]string
+	config      AuthConfig
+}
+
+// NewLDAPAuthenticator returns an LDAPAuthenticator for a directory.
+// roleMapping maps directory groups to local roles, as ParseRoleMapping
+// returns it. config's registration mode and allowed domains decide which
+// directory users get a local user, as they do for registration.
+func NewLDAPAuthenticator(database *db.Database, directory *auth.LDAPDirectory, roleMapping map[string][]string, config AuthConfig) *LDAPAuthenticator {
+	return &LDAPAuthenticator{db: database, directory: directory, roleMapping: roleMapping, config: config}
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	entry, err := a.directory.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user, err := a.db.GetUserByIdentity(a.directory.URL(), entry.DN, entry.Email, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		if entry.Email == "" {
+			return nil, fmt.Errorf("directory entry %s has no email address", entry.DN)
+		}
+		status, refused := a.config.provisionStatus(entry.Email)
+		if refused != nil {
+			log.Printf("Not creating a user for %s: %v", entry.DN, refused)
+			return nil, auth.ErrInvalidCredentials
+		}
+		var userID int
+		userID, err = a.db.ProvisionIdentityUser(entry.Username, entry.Email, a.directory.URL(), entry.DN, status, now)
+		if errors.Is(err, db.ErrEmailInUse) {
+			// Linking by email address would let whoever controls the
+			// directory entry's address take over the local account
+			log.Printf("Not creating a user for %s: its email address belongs to an existing user", entry.DN)
+			return nil, auth.ErrInvalidCredentials
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Created user %d for directory entry %s", userID, entry.DN)
+		user, err = a.db.GetUserByID(userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a.roleMapping) > 0 {
+		if err := syncManagedRoles(a.db, nil, user.ID, managedRoles(a.roleMapping), rolesFor(a.roleMapping, entry.Groups), a.directory.URL()); err != nil {
+			return nil, fmt.Errorf("failed to update roles: %w", err)
+		}
+	}
+
+	return user, nil
+}
+
+// Authenticators asks each Authenticator in turn and returns the first user
+// one of them accepts. If none does, it returns the first error other than
+// auth.ErrInvalidCredentials, so that an unreachable directory isn't mistaken
+// for a wrong password.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	var firstErr error
+	for _, authenticator := range a {
+		user, err := authenticator.Authenticate(ctx, username, password)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, auth.ErrInvalidCredentials) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, auth.ErrInvalidCredentials
+}
+
+// ParseRoleMapping parses a comma-separated list of group=role pairs. A group
+// may be mapped to several roles.
+func ParseRoleMapping(s string) (map[string][]string, error) {
+	mapping := make(map[string][]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("invalid group mapping %q, expected group=role", pair)
+		}
+		mapping[group] = append(mapping[group], role)
+	}
+	return mapping, nil
+}
+
+// managedRoles returns the roles a group to role mapping manages.
+func managedRoles(roleMapping map[string][]string) []string {
+	var roles []string
+	for _, mapped := range roleMapping {
+		for _, role := range mapped {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// rolesFor returns the roles a group to role mapping gives to members of
+// groups.
+func rolesFor(roleMapping map[string][]string, groups []string) []string {
+	var roles []string
+	for _, group := range groups {
+		roles = append(roles, roleMapping[group]...)
+	}
+	return roles
+}
+
+// syncManagedRoles makes a user's membership of the managed roles match
+// wanted with Database.AssignRole and RemoveRole, leaving their other roles
+// alone. Roles that don't exist are ignored, and so is a removal that would
+// leave no one able to manage roles. Changes are recorded in the audit log
+// with no actor and the directory or identity provider they came from as
+// source. r is nil if the request isn't known.
+func syncManagedRoles(database *db.Database, r *http.Request, userID int, managed, wanted []string, source string) error {
+	roles, err := database.GetAllRoles()
+	if err != nil {
+		return err
+	}
+	user, err := database.GetUserWithRoles(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if !slices.Contains(managed, role.Name) {
+			continue
+		}
+		has := slices.ContainsFunc(user.Roles, func(r models.Role) bool { return r.ID == role.ID })
+		snapshot := map[string]any{"role_id": role.ID, "role": role.Name, "source": source}
+		switch want := slices.Contains(wanted, role.Name); {
+		case want && !has:
+			if err := database.AssignRole(userID, role.ID, nil); err != nil {
+				return err
+			}
+			recordAudit(database, r, nil, models.AuditRoleAssigned, models.AuditTargetUser, userID, nil, snapshot)
+		case !want && has:
+			err := database.RemoveRole(userID, role.ID)
+			if errors.Is(err, db.ErrLastRoleManager) {
+				log.Printf("Not removing role %s from user %d: no one else could manage roles", role.Name, userID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			recordAudit(database, r, nil, models.AuditRoleRemoved, models.AuditTargetUser, userID, snapshot, nil)
+		}
+	}
+	return nil
+}
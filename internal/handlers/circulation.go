@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CirculationHandler serves the physical item catalog, the circulation desk
+// where librarians check items out, check them in and renew loans, and
+// patrons' loans and holds.
+type CirculationHandler struct {
+	db             *db.Database
+	sessionManager *auth.SessionManager
+}
+
+func NewCirculationHandler(database *db.Database, sessionManager *auth.SessionManager) *CirculationHandler {
+	return &CirculationHandler{
+		db:             database,
+		sessionManager: sessionManager,
+	}
+}
+
+// Items lists the physical items (GET) or adds a new item with its first
+// copy (POST).
+func (h *CirculationHandler) Items(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	if r.Method == "POST" {
+		hasPerm, err := h.hasPermission(user, "manage_items")
+		if err != nil {
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !hasPerm {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		title := strings.TrimSpace(r.FormValue("title"))
+		barcode := strings.TrimSpace(r.FormValue("barcode"))
+		if title == "" || barcode == "" {
+			http.Error(w, "Title and barcode are required", http.StatusBadRequest)
+			return
+		}
+
+		itemID, err := h.db.CreateItem(title, r.FormValue("author"), r.FormValue("isbn"), r.FormValue("description"))
+		if err != nil {
+			http.Error(w, "Failed to create item", http.StatusInternalServerError)
+			return
+		}
+
+		// The item is kept even if its copy is rejected, so the copy can be
+		// added again from the item page
+		if _, err := h.db.AddCopy(itemID, barcode, r.FormValue("shelf_location")); err != nil {
+			h.renderItem(w, r, itemID, http.StatusConflict, copyErrorMessage(err))
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/items/%d", itemID), http.StatusSeeOther)
+		return
+	}
+
+	items, err := h.db.GetAllItems()
+	if err != nil {
+		http.Error(w, "Failed to fetch items", http.StatusInternalServerError)
+		return
+	}
+
+	templates.ItemsIndex(items, user).Render(r.Context(), w)
+}
+
+// Item shows a physical item with its copies (GET) or adds a copy (POST).
+func (h *CirculationHandler) Item(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/items/"))
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		hasPerm, err := h.hasPermission(user, "manage_items")
+		if err != nil {
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !hasPerm {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		if _, err := h.db.GetItemByID(id); err != nil {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+
+		barcode := strings.TrimSpace(r.FormValue("barcode"))
+		if barcode == "" {
+			h.renderItem(w, r, id, http.StatusBadRequest, "Barcode is required")
+			return
+		}
+
+		if _, err := h.db.AddCopy(id, barcode, r.FormValue("shelf_location")); err != nil {
+			h.renderItem(w, r, id, http.StatusConflict, copyErrorMessage(err))
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/items/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	h.renderItem(w, r, id, http.StatusOK, "")
+}
+
+func (h *CirculationHandler) renderItem(w http.ResponseWriter, r *http.Request, id, status int, message string) {
+	item, err := h.db.GetItemByID(id)
+	if err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.ItemDetail(*item, h.getUserFromContext(r.Context()), message, time.Now()).Render(r.Context(), w)
+}
+
+func copyErrorMessage(err error) string {
+	if errors.Is(err, db.ErrDuplicateBarcode) {
+		return "A copy with that barcode already exists"
+	}
+	return "Failed to add copy"
+}
+
+// Desk shows the circulation desk with every active loan.
+func (h *CirculationHandler) Desk(w http.ResponseWriter, r *http.Request) {
+	if !h.requireCirculation(w, r) {
+		return
+	}
+	h.renderDesk(w, r, http.StatusOK, "", false)
+}
+
+// CheckOut lends a copy, identified by barcode, to a patron.
+func (h *CirculationHandler) CheckOut(w http.ResponseWriter, r *http.Request) {
+	if !h.requireCirculation(w, r) {
+		return
+	}
+	user := h.getUserFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	barcode := strings.TrimSpace(r.FormValue("barcode"))
+	if username == "" || barcode == "" {
+		h.renderDesk(w, r, http.StatusBadRequest, "Patron and barcode are required", true)
+		return
+	}
+
+	patron, err := h.db.GetUserByUsername(username)
+	if err != nil {
+		h.renderDesk(w, r, http.StatusNotFound, fmt.Sprintf("No patron named %q", username), true)
+		return
+	}
+
+	canBorrow, err := h.hasPermission(patron, "borrow_items")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !canBorrow {
+		h.renderDesk(w, r, http.StatusForbidden, fmt.Sprintf("%s is not allowed to borrow items", patron.Username), true)
+		return
+	}
+
+	loan, err := h.db.CheckOut(barcode, patron.ID, user.ID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.renderDesk(w, r, http.StatusNotFound, fmt.Sprintf("No copy with barcode %q", barcode), true)
+	case errors.Is(err, db.ErrCopyUnavailable):
+		h.renderDesk(w, r, http.StatusConflict, fmt.Sprintf("Copy %s is already checked out", barcode), true)
+	case errors.Is(err, db.ErrCopyOnHold):
+		h.renderDesk(w, r, http.StatusConflict, fmt.Sprintf("Copy %s is set aside for another patron's hold", barcode), true)
+	case errors.Is(err, db.ErrLoanLimitReached):
+		h.renderDesk(w, r, http.StatusConflict, fmt.Sprintf("%s has reached their loan limit", patron.Username), true)
+	case errors.Is(err, db.ErrFinesOwed):
+		h.renderDesk(w, r, http.StatusConflict, fmt.Sprintf("%s owes too much in fines to borrow; record a payment first", patron.Username), true)
+	case err != nil:
+		http.Error(w, "Failed to check out copy", http.StatusInternalServerError)
+	default:
+		h.renderDesk(w, r, http.StatusOK, fmt.Sprintf("Checked out %q to %s, due %s", loan.ItemTitle, loan.Username, loan.DueAt.Local().Format("Jan 2, 2006")), false)
+	}
+}
+
+// CheckIn records the return of a copy, identified by barcode.
+func (h *CirculationHandler) CheckIn(w http.ResponseWriter, r *http.Request) {
+	if !h.requireCirculation(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	barcode := strings.TrimSpace(r.FormValue("barcode"))
+	if barcode == "" {
+		h.renderDesk(w, r, http.StatusBadRequest, "Barcode is required", true)
+		return
+	}
+
+	now := time.Now()
+	loan, hold, err := h.db.CheckIn(barcode, now)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		h.renderDesk(w, r, http.StatusNotFound, fmt.Sprintf("No copy with barcode %q", barcode), true)
+	case errors.Is(err, db.ErrNotCheckedOut):
+		h.renderDesk(w, r, http.StatusConflict, fmt.Sprintf("Copy %s is not checked out", barcode), true)
+	case err != nil:
+		http.Error(w, "Failed to check in copy", http.StatusInternalServerError)
+	default:
+		message := fmt.Sprintf("Checked in %q from %s", loan.ItemTitle, loan.Username)
+		if loan.DueAt.Before(now) {
+			message += " (returned late)"
+		}
+		if hold != nil {
+			message += fmt.Sprintf(". Set it aside for %s's hold.", hold.Username)
+		}
+		h.renderDesk(w, r, http.StatusOK, message, false)
+	}
+}
+
+// Renew extends an active loan.
+func (h *CirculationHandler) Renew(w http.ResponseWriter, r *http.Request) {
+	if !h.requireCirculation(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loanID, err := strconv.Atoi(r.FormValue("loan_id"))
+	if err != nil {
+		http.Error(w, "Invalid loan ID", http.StatusBadRequest)
+		return
+	}
+
+	loan, err := h.db.RenewLoan(loanID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Loan not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrNotCheckedOut):
+		h.renderDesk(w, r, http.StatusConflict, "That loan has already been returned", true)
+	case errors.Is(err, db.ErrRenewalLimitReached):
+		h.renderDesk(w, r, http.StatusConflict, "That loan has no renewals left", true)
+	case errors.Is(err, db.ErrHoldsWaiting):
+		h.renderDesk(w, r, http.StatusConflict, "That loan can't be renewed because other patrons are waiting for the item", true)
+	case errors.Is(err, db.ErrConflict):
+		h.renderDesk(w, r, http.StatusConflict, "That loan was renewed by someone else; check the new due date", true)
+	case err != nil:
+		http.Error(w, "Failed to renew loan", http.StatusInternalServerError)
+	default:
+		h.renderDesk(w, r, http.StatusOK, fmt.Sprintf("Renewed %q for %s, now due %s", loan.ItemTitle, loan.Username, loan.DueAt.Local().Format("Jan 2, 2006")), false)
+	}
+}
+
+func (h *CirculationHandler) renderDesk(w http.ResponseWriter, r *http.Request, status int, message string, isError bool) {
+	loans, err := h.db.GetActiveLoans()
+	if err != nil {
+		http.Error(w, "Failed to fetch loans", http.StatusInternalServerError)
+		return
+	}
+
+	holds, err := h.db.GetReadyHolds()
+	if err != nil {
+		http.Error(w, "Failed to fetch holds", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.CirculationDesk(loans, holds, h.getUserFromContext(r.Context()), message, isError, time.Now()).Render(r.Context(), w)
+}
+
+// Holds shows the current user's holds.
+func (h *CirculationHandler) Holds(w http.ResponseWriter, r *http.Request) {
+	h.renderHolds(w, r, http.StatusOK, "")
+}
+
+func (h *CirculationHandler) renderHolds(w http.ResponseWriter, r *http.Request, status int, message string) {
+	user := h.getUserFromContext(r.Context())
+
+	holds, err := h.db.GetUserHolds(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch holds", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.MyHolds(holds, user, message).Render(r.Context(), w)
+}
+
+// PlaceHold puts the current user in the queue for an item.
+func (h *CirculationHandler) PlaceHold(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hasPerm, err := h.hasPermission(user, "borrow_items")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	itemID, err := strconv.Atoi(r.FormValue("item_id"))
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.db.PlaceHold(user.ID, itemID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Item not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrHoldExists):
+		h.renderHolds(w, r, http.StatusConflict, "You already have a hold on that item")
+	case errors.Is(err, db.ErrAlreadyBorrowed):
+		h.renderItem(w, r, itemID, http.StatusConflict, "You already have this item on loan")
+	case errors.Is(err, db.ErrCopiesAvailable):
+		h.renderItem(w, r, itemID, http.StatusConflict, "A copy is available; borrow it at the circulation desk")
+	case err != nil:
+		http.Error(w, "Failed to place hold", http.StatusInternalServerError)
+	default:
+		http.Redirect(w, r, "/holds", http.StatusSeeOther)
+	}
+}
+
+// CancelHold cancels one of the current user's holds.
+func (h *CirculationHandler) CancelHold(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	holdID, err := strconv.Atoi(r.FormValue("hold_id"))
+	if err != nil {
+		http.Error(w, "Invalid hold ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.CancelHold(holdID, user.ID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Hold not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrHoldNotActive):
+		h.renderHolds(w, r, http.StatusConflict, "That hold is no longer active")
+	case err != nil:
+		http.Error(w, "Failed to cancel hold", http.StatusInternalServerError)
+	default:
+		http.Redirect(w, r, "/holds", http.StatusSeeOther)
+	}
+}
+
+// MyLoans shows the current user's loans.
+func (h *CirculationHandler) MyLoans(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	loans, err := h.db.GetUserLoans(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch loans", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	digitalLoans, err := h.db.GetUserDigitalLoans(user.ID, now)
+	if err != nil {
+		http.Error(w, "Failed to fetch digital loans", http.StatusInternalServerError)
+		return
+	}
+
+	policy, err := h.db.GetLoanPolicy(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch loan policy", http.StatusInternalServerError)
+		return
+	}
+
+	templates.MyLoans(loans, digitalLoans, policy.Limit, user, now).Render(r.Context(), w)
+}
+
+// requireCirculation writes an error and returns false unless the current
+// user may run the circulation desk.
+func (h *CirculationHandler) requireCirculation(w http.ResponseWriter, r *http.Request) bool {
+	hasPerm, err := h.hasPermission(h.getUserFromContext(r.Context()), "manage_circulation")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *CirculationHandler) getUserFromContext(ctx context.Context) *models.User {
+	if user, ok := ctx.Value("user").(*models.User); ok {
+		return user
+	}
+	return nil
+}
+
+func (h *CirculationHandler) hasPermission(user *models.User, permissionName string) (bool, error) {
+	return checkPermission(h.db, user, permissionName)
+}
+
+func (h *CirculationHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(h.db, h.sessionManager, next, redirectToLogin)
+}
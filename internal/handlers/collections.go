@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCollectionNameLength is the longest name a collection can have.
+const maxCollectionNameLength = 100
+
+// Collections lists collections with their PDFs and access lists, and
+// manages them for users with manage_pdf_access. The action field selects
+// what to do: "create" adds a collection named name, "delete" removes
+// collection_id, "grant" gives a user (by username) or a role (by role_id)
+// an access level to every PDF in collection_id, replacing any entry they
+// already have, and "revoke" removes entry_id from its access list. PDFs
+// are put in collections from the viewer.
+func (h *LibraryHandler) Collections(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_pdf_access")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		h.renderCollections(w, r, http.StatusOK, "", false)
+		return
+	}
+
+	action := r.FormValue("action")
+	var collectionID int
+	var before *models.Collection
+	if action != "create" {
+		var convErr error
+		if collectionID, convErr = strconv.Atoi(r.FormValue("collection_id")); convErr != nil {
+			http.Error(w, "Invalid collection ID", http.StatusBadRequest)
+			return
+		}
+		var getErr error
+		if before, getErr = h.db.GetCollectionByID(collectionID); getErr != nil {
+			h.renderCollections(w, r, http.StatusNotFound, "Collection not found", true)
+			return
+		}
+	}
+
+	var message, event string
+	var beforeSnapshot, afterSnapshot any
+	switch action {
+	case "create":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" || len(name) > maxCollectionNameLength {
+			h.renderCollections(w, r, http.StatusBadRequest, fmt.Sprintf("Collection names must be 1 to %d characters long", maxCollectionNameLength), true)
+			return
+		}
+		collectionID, err = h.db.CreateCollection(name, user.ID, time.Now())
+		message, event = fmt.Sprintf("Created collection %s", name), models.AuditCollectionCreated
+		afterSnapshot = map[string]string{"name": name}
+
+	case "delete":
+		beforeSnapshot = before
+		if before.Entries, err = h.db.GetCollectionACL(collectionID); err == nil {
+			err = h.db.DeleteCollection(collectionID)
+		}
+		message, event = fmt.Sprintf("Deleted collection %s", before.Name), models.AuditCollectionDeleted
+
+	case "grant":
+		var userID, roleID *int
+		if username := strings.TrimSpace(r.FormValue("username")); username != "" {
+			grantee, err := h.db.GetUserByUsername(username)
+			if err != nil {
+				h.renderCollections(w, r, http.StatusBadRequest, fmt.Sprintf("There is no user named %s", username), true)
+				return
+			}
+			userID = &grantee.ID
+		} else if id, err := strconv.Atoi(r.FormValue("role_id")); err == nil {
+			if _, err := h.db.GetRoleByID(id); err != nil {
+				http.Error(w, "Role not found", http.StatusBadRequest)
+				return
+			}
+			roleID = &id
+		}
+		access := r.FormValue("access")
+		err = h.db.SetCollectionACLEntry(collectionID, userID, roleID, access, user.ID, time.Now())
+		message, event = fmt.Sprintf("Updated the access list of %s", before.Name), models.AuditCollectionAccess
+		afterSnapshot = map[string]any{"user_id": userID, "role_id": roleID, "access": access}
+
+	case "revoke":
+		entryID, convErr := strconv.Atoi(r.FormValue("entry_id"))
+		if convErr != nil {
+			http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+			return
+		}
+		entries, aclErr := h.db.GetCollectionACL(collectionID)
+		if aclErr != nil {
+			http.Error(w, "Failed to fetch access list", http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			if entry.ID == entryID {
+				beforeSnapshot = entry
+			}
+		}
+		err = h.db.DeleteCollectionACLEntry(entryID, collectionID)
+		message, event = fmt.Sprintf("Updated the access list of %s", before.Name), models.AuditCollectionAccess
+
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case errors.Is(err, db.ErrCollectionExists):
+		h.renderCollections(w, r, http.StatusConflict, "A collection with that name already exists", true)
+		return
+	case errors.Is(err, db.ErrInvalidACLEntry):
+		h.renderCollections(w, r, http.StatusBadRequest, "Choose a user or a role and an access level", true)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		h.renderCollections(w, r, http.StatusNotFound, "Not found", true)
+		return
+	case err != nil:
+		log.Printf("Failed to update collections: %v", err)
+		h.renderCollections(w, r, http.StatusInternalServerError, "Failed to update collections", true)
+		return
+	}
+	recordAudit(h.db, r, user, event, models.AuditTargetCollection, collectionID, beforeSnapshot, afterSnapshot)
+
+	h.renderCollections(w, r, http.StatusOK, message, false)
+}
+
+// renderCollections shows the collections page with a message.
+func (h *LibraryHandler) renderCollections(w http.ResponseWriter, r *http.Request, status int, message string, isError bool) {
+	collections, err := h.db.GetAllCollections()
+	if err != nil {
+		http.Error(w, "Failed to fetch collections", http.StatusInternalServerError)
+		return
+	}
+	for i := range collections {
+		if collections[i].PDFs, err = h.db.GetCollectionPDFs(collections[i].ID); err != nil {
+			http.Error(w, "Failed to fetch collection PDFs", http.StatusInternalServerError)
+			return
+		}
+		if collections[i].Entries, err = h.db.GetCollectionACL(collections[i].ID); err != nil {
+			http.Error(w, "Failed to fetch access list", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	roles, err := h.db.GetAllRoles()
+	if err != nil {
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.Collections(collections, roles, h.getUserFromContext(r.Context()), message, isError).Render(r.Context(), w)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/templates"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// csrfCookie holds the secret that CSRF tokens are derived from for visitors
+// without a session.
+const csrfCookie = "csrf_secret"
+
+// CSRFMiddleware rejects requests that change state unless they carry the
+// CSRF token of the browser's session, in the X-CSRF-Token header or the
+// csrf_token form field, which must come first in multipart forms so that
+// uploads aren't read before the handler streams them. Visitors who haven't
+// logged in get a token too, so that the login and registration forms can't
+// be forged either. The token is put in the request context, where the
+// templates add it to every form and htmx request.
+//
+// API requests without a session cookie are let through, since they're
+// authenticated with an Authorization header that other sites can't make a
+// browser send.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := ""
+		_, sessionErr := r.Cookie("session_token")
+		if sessionErr == nil {
+			secret, _ = auth.GetSessionToken(r)
+		} else if cookie, err := r.Cookie(csrfCookie); err == nil {
+			secret = cookie.Value
+		}
+
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			if secret == "" {
+				secret = auth.GenerateToken()
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookie,
+					Value:    secret,
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+		default:
+			headerAuthenticated := sessionErr != nil && (strings.HasPrefix(r.URL.Path, apiPrefix+"/") || r.Header.Get("Authorization") != "")
+			if !headerAuthenticated && !auth.CheckCSRFToken(secret, csrfToken(r)) {
+				log.Printf("Rejected %s %s from %s without a valid CSRF token", r.Method, r.URL.Path, auth.ClientIP(r))
+				if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+					writeAPIError(w, http.StatusForbidden, "Missing or invalid CSRF token")
+					return
+				}
+				w.WriteHeader(http.StatusForbidden)
+				templates.CSRFError().Render(r.Context(), w)
+				return
+			}
+		}
+
+		if secret != "" {
+			r = r.WithContext(auth.WithCSRFToken(r.Context(), auth.CSRFToken(secret)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxCSRFTokenSize limits how much of a form field is read as a CSRF token.
+const maxCSRFTokenSize = 256
+
+// csrfToken returns the CSRF token a request carries.
+func csrfToken(r *http.Request) string {
+	if token := r.Header.Get(auth.CSRFHeader); token != "" {
+		return token
+	}
+	if mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == "multipart/form-data" {
+		return multipartCSRFToken(r, params["boundary"])
+	}
+	return r.PostFormValue(auth.CSRFField)
+}
+
+// multipartCSRFToken returns the CSRF token in the first field of a multipart
+// form, which is where the templates put it. Parsing the whole form would
+// buffer uploads before the handlers can check and stream them, so only the
+// first field is read, and the bytes read are put back in front of the body.
+func multipartCSRFToken(r *http.Request, boundary string) string {
+	var consumed bytes.Buffer
+	body := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&consumed, body), body}
+	}()
+
+	part, err := multipart.NewReader(io.TeeReader(body, &consumed), boundary).NextPart()
+	if err != nil || part.FormName() != auth.CSRFField {
+		return ""
+	}
+	token, err := io.ReadAll(io.LimitReader(part, maxCSRFTokenSize))
+	if err != nil {
+		return ""
+	}
+	return string(token)
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MyFines shows the current user's fines balance and ledger.
+func (h *CirculationHandler) MyFines(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	balance, err := h.db.GetBalance(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance", http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := h.db.GetLedger(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch ledger", http.StatusInternalServerError)
+		return
+	}
+
+	policy, err := h.db.GetUserFinePolicy(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch fine policy", http.StatusInternalServerError)
+		return
+	}
+
+	templates.MyFines(entries, balance, policy, user).Render(r.Context(), w)
+}
+
+// Fines lists the patrons who owe fines (GET) or updates the library-wide
+// fine policy or a role's overrides of it (POST with role_id).
+func (h *CirculationHandler) Fines(w http.ResponseWriter, r *http.Request) {
+	if !h.requireFines(w, r) {
+		return
+	}
+
+	if r.Method == "POST" {
+		if r.FormValue("role_id") != "" {
+			h.updateFineOverride(w, r)
+		} else {
+			h.updateFinePolicy(w, r)
+		}
+		return
+	}
+
+	h.renderFines(w, r, http.StatusOK, "", false)
+}
+
+func (h *CirculationHandler) updateFinePolicy(w http.ResponseWriter, r *http.Request) {
+	perDay, perDayErr := parseCents(r.FormValue("per_day"))
+	grace, graceErr := strconv.Atoi(strings.TrimSpace(r.FormValue("grace_days")))
+	maxCents, maxErr := parseCents(r.FormValue("max"))
+	threshold, thresholdErr := parseCents(r.FormValue("block_threshold"))
+	if errors.Join(perDayErr, graceErr, maxErr, thresholdErr) != nil {
+		h.renderFines(w, r, http.StatusBadRequest, "Enter amounts in dollars and the grace period in whole days", true)
+		return
+	}
+
+	before, err := h.db.GetFinePolicy()
+	if err != nil {
+		http.Error(w, "Failed to fetch fine policy", http.StatusInternalServerError)
+		return
+	}
+
+	policy := models.FinePolicy{PerDayCents: perDay, GraceDays: grace, MaxCents: maxCents, BlockThresholdCents: threshold}
+	if err := h.db.UpdateFinePolicy(policy); err != nil {
+		if errors.Is(err, db.ErrInvalidPolicy) {
+			h.renderFines(w, r, http.StatusBadRequest, "Fine policy values can't be negative", true)
+			return
+		}
+		http.Error(w, "Failed to update fine policy", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(h.db, r, h.getUserFromContext(r.Context()), models.AuditFinePolicy, "", 0, before, policy)
+
+	h.renderFines(w, r, http.StatusOK, "Fine policy updated", false)
+}
+
+func (h *CirculationHandler) updateFineOverride(w http.ResponseWriter, r *http.Request) {
+	roleID, err := strconv.Atoi(r.FormValue("role_id"))
+	if err != nil {
+		http.Error(w, "Invalid role ID", http.StatusBadRequest)
+		return
+	}
+
+	perDay, perDayErr := parseOptional(r.FormValue("per_day"), parseCents)
+	grace, graceErr := parseOptional(r.FormValue("grace_days"), strconv.Atoi)
+	maxCents, maxErr := parseOptional(r.FormValue("max"), parseCents)
+	if errors.Join(perDayErr, graceErr, maxErr) != nil {
+		h.renderFines(w, r, http.StatusBadRequest, "Enter amounts in dollars and the grace period in whole days, or leave them blank", true)
+		return
+	}
+
+	overrides, err := h.db.GetFineOverrides()
+	if err != nil {
+		http.Error(w, "Failed to fetch role fine policies", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(overrides, func(o models.FineOverride) bool { return o.RoleID == roleID })
+	if i < 0 {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	before := overrides[i]
+
+	override := models.FineOverride{RoleID: roleID, RoleName: before.RoleName, PerDayCents: perDay, GraceDays: grace, MaxCents: maxCents}
+	err = h.db.SetFineOverride(override)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Role not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrInvalidPolicy):
+		h.renderFines(w, r, http.StatusBadRequest, "Fine policy values can't be negative", true)
+	case err != nil:
+		http.Error(w, "Failed to update role fine policy", http.StatusInternalServerError)
+	default:
+		recordAudit(h.db, r, h.getUserFromContext(r.Context()), models.AuditFineOverride, models.AuditTargetRole, roleID, before, override)
+		h.renderFines(w, r, http.StatusOK, "Role fine policy updated", false)
+	}
+}
+
+func (h *CirculationHandler) renderFines(w http.ResponseWriter, r *http.Request, status int, message string, isError bool) {
+	balances, err := h.db.GetOutstandingBalances()
+	if err != nil {
+		http.Error(w, "Failed to fetch balances", http.StatusInternalServerError)
+		return
+	}
+
+	policy, err := h.db.GetFinePolicy()
+	if err != nil {
+		http.Error(w, "Failed to fetch fine policy", http.StatusInternalServerError)
+		return
+	}
+
+	overrides, err := h.db.GetFineOverrides()
+	if err != nil {
+		http.Error(w, "Failed to fetch role fine policies", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.FinesDesk(balances, policy, overrides, h.getUserFromContext(r.Context()), message, isError).Render(r.Context(), w)
+}
+
+// PatronFines shows a patron's ledger (GET) or records a payment or waiver
+// against their balance (POST).
+func (h *CirculationHandler) PatronFines(w http.ResponseWriter, r *http.Request) {
+	if !h.requireFines(w, r) {
+		return
+	}
+	user := h.getUserFromContext(r.Context())
+
+	patronID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/circulation/fines/"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		amount, err := parseCents(r.FormValue("amount"))
+		if err != nil {
+			h.renderPatronFines(w, r, patronID, http.StatusBadRequest, "Enter the amount in dollars, like 2.50", true)
+			return
+		}
+		note := strings.TrimSpace(r.FormValue("note"))
+
+		kind := r.FormValue("kind")
+		var action string
+		switch kind {
+		case models.LedgerPayment:
+			action = models.AuditFinePayment
+			err = h.db.RecordPayment(patronID, amount, note, user.ID, time.Now())
+		case models.LedgerWaiver:
+			action = models.AuditFineWaiver
+			err = h.db.WaiveFines(patronID, amount, note, user.ID, time.Now())
+		default:
+			http.Error(w, "Invalid entry kind", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case errors.Is(err, db.ErrInvalidAmount):
+			h.renderPatronFines(w, r, patronID, http.StatusBadRequest, "The amount must be more than zero", true)
+		case errors.Is(err, db.ErrExceedsBalance):
+			h.renderPatronFines(w, r, patronID, http.StatusConflict, "The amount is more than the patron owes", true)
+		case err != nil:
+			http.Error(w, "Failed to record "+kind, http.StatusInternalServerError)
+		default:
+			h.auditBalanceChange(r, user, action, patronID, amount, note)
+			h.renderPatronFines(w, r, patronID, http.StatusOK, fmt.Sprintf("Recorded %s of $%.2f", kind, float64(amount)/100), false)
+		}
+		return
+	}
+
+	h.renderPatronFines(w, r, patronID, http.StatusOK, "", false)
+}
+
+// auditBalanceChange records a payment or waiver that reduced a patron's
+// balance by amount in the audit log, with the balance before and after it.
+func (h *CirculationHandler) auditBalanceChange(r *http.Request, user *models.User, action string, patronID, amount int, note string) {
+	after := map[string]any{"amount_cents": amount, "note": note}
+	var before any
+	if balance, err := h.db.GetBalance(patronID); err != nil {
+		log.Printf("Failed to fetch the balance of user %d for the audit log: %v", patronID, err)
+	} else {
+		before = map[string]int{"balance_cents": balance + amount}
+		after["balance_cents"] = balance
+	}
+	recordAudit(h.db, r, user, action, models.AuditTargetUser, patronID, before, after)
+}
+
+func (h *CirculationHandler) renderPatronFines(w http.ResponseWriter, r *http.Request, patronID, status int, message string, isError bool) {
+	patron, err := h.db.GetUserByID(patronID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	balance, err := h.db.GetBalance(patronID)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance", http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := h.db.GetLedger(patronID)
+	if err != nil {
+		http.Error(w, "Failed to fetch ledger", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.PatronFines(*patron, entries, balance, h.getUserFromContext(r.Context()), message, isError).Render(r.Context(), w)
+}
+
+// requireFines writes an error and returns false unless the current user may
+// manage fines.
+func (h *CirculationHandler) requireFines(w http.ResponseWriter, r *http.Request) bool {
+	hasPerm, err := h.hasPermission(h.getUserFromContext(r.Context()), "manage_fines")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// parseCents parses a dollar amount such as "2", "2.5" or "$2.50" into cents.
+func parseCents(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "$")
+	dollars, cents, _ := strings.Cut(s, ".")
+	if dollars == "" && cents == "" || len(cents) > 2 || strings.Trim(dollars+cents, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	amount := 0
+	if dollars != "" {
+		d, err := strconv.Atoi(dollars)
+		if err != nil {
+			return 0, err
+		}
+		amount = d * 100
+	}
+	if cents != "" {
+		c, err := strconv.Atoi(cents)
+		if err != nil {
+			return 0, err
+		}
+		if len(cents) == 1 {
+			c *= 10
+		}
+		amount += c
+	}
+	return amount, nil
+}
+
+// parseOptional parses s with parse, returning nil for a blank value.
+func parseOptional(s string, parse func(string) (int, error)) (*int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	v, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -2,35 +2,75 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"librarymanagementsystem/internal/auth"
 	"librarymanagementsystem/internal/db"
 	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/pdftext"
+	"librarymanagementsystem/internal/storage"
 	"librarymanagementsystem/templates"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// uploadsDir holds uploaded PDFs unless another blob store is configured. It
+// lives outside the static tree so files are only reachable through
+// ServeFile, which enforces authentication and permissions.
+const uploadsDir = "uploads"
+
+// legacyUploadsDir is where uploads used to be stored, under the public
+// static file server.
+const legacyUploadsDir = "static/uploads"
+
 type LibraryHandler struct {
 	db             *db.Database
 	sessionManager *auth.SessionManager
+	store          storage.BlobStore
+	uploads        UploadConfig
 }
 
 func NewLibraryHandler(database *db.Database, sessionManager *auth.SessionManager) *LibraryHandler {
 	return &LibraryHandler{
 		db:             database,
 		sessionManager: sessionManager,
+		store:          storage.NewLocalStore(uploadsDir),
+		uploads:        UploadConfig{MaxSize: DefaultMaxUploadSize},
 	}
 }
 
+// SetBlobStore changes where uploaded files are stored, which is uploadsDir
+// on the local filesystem by default.
+func (h *LibraryHandler) SetBlobStore(store storage.BlobStore) {
+	h.store = store
+}
+
+// SetUploadConfig changes how uploaded files are received. By default files
+// up to DefaultMaxUploadSize are accepted, quarantined in the system's
+// temporary directory and not scanned for malware.
+func (h *LibraryHandler) SetUploadConfig(config UploadConfig) {
+	h.uploads = config
+}
+
 func (h *LibraryHandler) Index(w http.ResponseWriter, r *http.Request) {
 	user := h.getUserFromContext(r.Context())
 
-	pdfs, err := h.db.GetAllPDFs()
+	visibility, err := pdfVisibility(h.db, user)
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+
+	pdfs, err := h.db.GetVisiblePDFs(visibility)
 	if err != nil {
 		http.Error(w, "Failed to fetch PDFs", http.StatusInternalServerError)
 		return
@@ -47,13 +87,19 @@ func (h *LibraryHandler) Search(w http.ResponseWriter, r *http.Request) {
 		query = r.FormValue("search")
 	}
 
+	visibility, err := pdfVisibility(h.db, user)
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+
 	var pdfs []models.PDF
-	var err error
+	var matches map[int][]models.PageMatch
 
 	if query == "" {
-		pdfs, err = h.db.GetAllPDFs()
+		pdfs, err = h.db.GetVisiblePDFs(visibility)
 	} else {
-		pdfs, err = h.db.SearchPDFs(query)
+		pdfs, matches, err = h.db.SearchPDFs(visibility, query)
 	}
 
 	if err != nil {
@@ -61,12 +107,10 @@ func (h *LibraryHandler) Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	templates.PDFList(pdfs, user).Render(r.Context(), w)
+	templates.PDFList(pdfs, matches, user).Render(r.Context(), w)
 }
 
 func (h *LibraryHandler) ViewPDF(w http.ResponseWriter, r *http.Request) {
-	user := h.getUserFromContext(r.Context())
-
 	idStr := strings.TrimPrefix(r.URL.Path, "/library/view/")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -74,20 +118,236 @@ func (h *LibraryHandler) ViewPDF(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.renderViewer(w, r, id, http.StatusOK, "")
+}
+
+// renderViewer shows a PDF, or for a lending-controlled PDF the user hasn't
+// borrowed, its lending status with the option to borrow it or place a hold.
+// Users who may manage the PDF's access also get its access list editor.
+func (h *LibraryHandler) renderViewer(w http.ResponseWriter, r *http.Request, id, status int, message string) {
+	user := h.getUserFromContext(r.Context())
+
+	pdf, ok := h.accessiblePDF(w, user, id, models.PDFAccessRead)
+	if !ok {
+		return
+	}
+
+	control, err := h.pdfAccessControl(user, pdf)
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+
+	var lending models.PDFLending
+	if pdf.IsLendingControlled() {
+		lending, err = h.db.GetPDFLending(pdf.ID, user.ID, time.Now())
+		if err != nil {
+			http.Error(w, "Failed to fetch lending status", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !pdf.IsLendingControlled() || lending.Loan != nil {
+		// Record access
+		err = h.db.RecordPDFAccess(user.ID, pdf.ID)
+		if err != nil {
+			// Log error but don't fail the request
+			fmt.Printf("Failed to record PDF access: %v\n", err)
+		}
+	}
+
+	// Open the viewer at a specific page, e.g. when coming from a search result
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
+	// Warn about an upload that duplicates a file already in the library
+	var duplicates []models.PDF
+	if r.URL.Query().Get("duplicate") == "1" {
+		duplicates, err = duplicatePDFs(h.db, user, pdf)
+		if err != nil {
+			http.Error(w, "Failed to check for duplicates", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(status)
+	templates.PDFViewer(*pdf, page, lending, control, duplicates, user, message).Render(r.Context(), w)
+}
+
+// BorrowPDF starts a digital loan of a lending-controlled PDF for the
+// current user.
+func (h *LibraryHandler) BorrowPDF(w http.ResponseWriter, r *http.Request) {
+	pdfID, ok := h.lendingRequest(w, r)
+	if !ok {
+		return
+	}
+	user := h.getUserFromContext(r.Context())
+
+	_, err := h.db.BorrowPDF(user.ID, pdfID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "PDF not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrNotLendable), errors.Is(err, db.ErrAlreadyBorrowed):
+		http.Redirect(w, r, fmt.Sprintf("/library/view/%d", pdfID), http.StatusSeeOther)
+	case errors.Is(err, db.ErrNoLoansAvailable):
+		h.renderViewer(w, r, pdfID, http.StatusConflict, "Someone else just borrowed the last available loan")
+	case err != nil:
+		http.Error(w, "Failed to borrow PDF", http.StatusInternalServerError)
+	default:
+		http.Redirect(w, r, fmt.Sprintf("/library/view/%d", pdfID), http.StatusSeeOther)
+	}
+}
+
+// ReturnPDF ends the current user's loan of a PDF before it's due.
+func (h *LibraryHandler) ReturnPDF(w http.ResponseWriter, r *http.Request) {
+	pdfID, ok := h.lendingRequest(w, r)
+	if !ok {
+		return
+	}
+	user := h.getUserFromContext(r.Context())
+
+	err := h.db.ReturnPDF(user.ID, pdfID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "PDF not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrNoDigitalLoan):
+		h.renderViewer(w, r, pdfID, http.StatusConflict, "You don't have this PDF on loan")
+	case err != nil:
+		http.Error(w, "Failed to return PDF", http.StatusInternalServerError)
+	default:
+		http.Redirect(w, r, "/loans", http.StatusSeeOther)
+	}
+}
+
+// PlacePDFHold puts the current user in the queue for a lending-controlled
+// PDF.
+func (h *LibraryHandler) PlacePDFHold(w http.ResponseWriter, r *http.Request) {
+	pdfID, ok := h.lendingRequest(w, r)
+	if !ok {
+		return
+	}
+	user := h.getUserFromContext(r.Context())
+
+	_, err := h.db.PlacePDFHold(user.ID, pdfID, time.Now())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "PDF not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrNotLendable), errors.Is(err, db.ErrAlreadyBorrowed):
+		http.Redirect(w, r, fmt.Sprintf("/library/view/%d", pdfID), http.StatusSeeOther)
+	case errors.Is(err, db.ErrHoldExists):
+		h.renderViewer(w, r, pdfID, http.StatusConflict, "You already have a hold on this PDF")
+	case errors.Is(err, db.ErrCopiesAvailable):
+		h.renderViewer(w, r, pdfID, http.StatusConflict, "A loan is available; borrow the PDF instead")
+	case err != nil:
+		http.Error(w, "Failed to place hold", http.StatusInternalServerError)
+	default:
+		http.Redirect(w, r, "/holds", http.StatusSeeOther)
+	}
+}
+
+// lendingRequest checks that a borrow, return or hold request is a POST
+// from a user who may read the PDF and returns the PDF ID it is for. It
+// writes an error and returns false otherwise.
+func (h *LibraryHandler) lendingRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+
+	pdfID, err := strconv.Atoi(r.FormValue("pdf_id"))
+	if err != nil {
+		http.Error(w, "Invalid PDF ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	if _, ok := h.accessiblePDF(w, h.getUserFromContext(r.Context()), pdfID, models.PDFAccessRead); !ok {
+		return 0, false
+	}
+	return pdfID, true
+}
+
+// accessiblePDF returns the PDF with the given ID if the user may access it
+// at level. It writes an error and returns false otherwise.
+func (h *LibraryHandler) accessiblePDF(w http.ResponseWriter, user *models.User, id int, level string) (*models.PDF, bool) {
 	pdf, err := h.db.GetPDFByID(id)
 	if err != nil {
 		http.Error(w, "PDF not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	allowed, err := canAccessPDF(h.db, user, pdf, level)
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !allowed {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return nil, false
+	}
+	return pdf, true
+}
+
+// ServeFile streams the PDF file itself. It supports Range requests and
+// conditional requests via ETag/If-None-Match, and serves the file inline
+// unless ?download=1 is given.
+func (h *LibraryHandler) ServeFile(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/library/file/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid PDF ID", http.StatusBadRequest)
 		return
 	}
 
-	// Record access
-	err = h.db.RecordPDFAccess(user.ID, pdf.ID)
+	pdf, ok := h.accessiblePDF(w, user, id, models.PDFAccessRead)
+	if !ok {
+		return
+	}
+
+	// Lending-controlled PDFs are only served to users who have them on loan
+	if pdf.IsLendingControlled() {
+		onLoan, err := h.db.HasActiveDigitalLoan(user.ID, pdf.ID, time.Now())
+		if err != nil {
+			http.Error(w, "Failed to check loan", http.StatusInternalServerError)
+			return
+		}
+		if !onLoan {
+			http.Error(w, "Borrow this PDF to read it", http.StatusForbidden)
+			return
+		}
+	}
+
+	file, info, err := h.store.Get(r.Context(), pdf.StorageKey)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		http.Error(w, "PDF file not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		// Log error but don't fail the request
-		fmt.Printf("Failed to record PDF access: %v\n", err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" {
+		disposition = "attachment"
 	}
 
-	templates.PDFViewer(*pdf, user).Render(r.Context(), w)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": pdf.Filename}))
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%x-%x"`, pdf.ID, info.ModTime.UnixNano(), info.Size))
+	// Responses must not be shared between users, and clients have to
+	// revalidate so that revoked permissions take effect.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since.
+	http.ServeContent(w, r, pdf.Filename, info.ModTime, file)
 }
 
 func (h *LibraryHandler) UploadForm(w http.ResponseWriter, r *http.Request) {
@@ -126,105 +386,381 @@ func (h *LibraryHandler) UploadPDF(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form (max 32MB)
-	err = r.ParseMultipartForm(32 << 20)
+	// Receive the file into quarantine
+	upload, err := h.receiveUpload(w, r)
 	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		status, message := uploadErrorResponse(err)
+		http.Error(w, message, status)
 		return
 	}
+	defer upload.Close()
 
-	title := r.FormValue("title")
-	author := r.FormValue("author")
-	description := r.FormValue("description")
+	title := upload.form.Get("title")
+	author := upload.form.Get("author")
+	description := upload.form.Get("description")
 
 	if title == "" {
 		http.Error(w, "Title is required", http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	if upload.file == nil {
 		http.Error(w, "File is required", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	// Check if file is PDF
-	if !strings.HasSuffix(strings.ToLower(header.Filename), ".pdf") {
-		http.Error(w, "Only PDF files are allowed", http.StatusBadRequest)
+	// Only release the file from quarantine once it's known to be a clean PDF
+	if err := h.checkUpload(r, user, upload); err != nil {
+		status, message := uploadErrorResponse(err)
+		http.Error(w, message, status)
 		return
 	}
 
-	// Generate unique filename
-	filename := fmt.Sprintf("%d_%s", user.ID, header.Filename)
-	filePath := fmt.Sprintf("static/uploads/%s", filename)
-
 	// Save file
-	err = h.saveUploadedFile(file, filePath)
+	stored, err := h.storeUpload(r.Context(), upload.file)
 	if err != nil {
 		http.Error(w, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
 
 	// Create PDF record in database
-	err = h.db.CreatePDF(title, author, description, filename, filePath, user.ID)
+	pdf := models.PDF{
+		Title:       title,
+		Author:      author,
+		Description: description,
+		Filename:    fmt.Sprintf("%d_%s", user.ID, upload.filename),
+		UploadedBy:  user.ID,
+	}
+	stored.apply(&pdf)
+	pdfID, err := h.db.CreateUploadedPDF(pdf)
 	if err != nil {
+		h.releaseBlob(stored.key)
 		http.Error(w, "Failed to create PDF record", http.StatusInternalServerError)
 		return
 	}
+	recordPDFUpload(h.db, r, user, pdfID)
+
+	h.confirmStored(r.Context(), upload.file, stored)
+	h.indexPDFText(pdfID, upload.file, stored.size)
+
+	// Show the new PDF along with the ones it duplicates
+	pdf.ID = pdfID
+	duplicates, err := duplicatePDFs(h.db, user, &pdf)
+	if err != nil {
+		fmt.Printf("Failed to check PDF %d for duplicates: %v\n", pdfID, err)
+	}
+	if len(duplicates) > 0 {
+		http.Redirect(w, r, fmt.Sprintf("/library/view/%d?duplicate=1", pdfID), http.StatusSeeOther)
+		return
+	}
 
 	// Redirect to library
 	http.Redirect(w, r, "/library", http.StatusSeeOther)
 }
 
-func (h *LibraryHandler) saveUploadedFile(file multipart.File, filePath string) error {
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "static/uploads"
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		return fmt.Errorf("failed to create uploads directory: %w", err)
+// EditPDF shows and processes the form for editing a PDF's metadata and
+// replacing its file. The form carries the record's version so that an edit
+// based on stale data is rejected instead of overwriting someone else's
+// changes.
+func (h *LibraryHandler) EditPDF(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/library/edit/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid PDF ID", http.StatusBadRequest)
+		return
 	}
 
-	// Create the file
-	dst, err := os.Create(filePath)
+	pdf, ok := h.accessiblePDF(w, user, id, models.PDFAccessEdit)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		templates.EditPDF(*pdf, user, "").Render(r.Context(), w)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Receive the form, and any replacement file into quarantine
+	upload, err := h.receiveUpload(w, r)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		status, message := uploadErrorResponse(err)
+		http.Error(w, message, status)
+		return
 	}
-	defer dst.Close()
+	defer upload.Close()
+	form := upload.form
 
-	// Copy the uploaded file to the destination
-	_, err = io.Copy(dst, file)
+	expectedVersion, err := strconv.Atoi(form.Get("version"))
 	if err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+		http.Error(w, "Invalid form version", http.StatusBadRequest)
+		return
 	}
 
-	return nil
-}
+	title := form.Get("title")
+	if title == "" {
+		http.Error(w, "Title is required", http.StatusBadRequest)
+		return
+	}
 
-func (h *LibraryHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		sessionToken, err := auth.GetSessionToken(r)
-		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+	maxLoans := 0
+	if value := strings.TrimSpace(form.Get("max_concurrent_loans")); value != "" {
+		maxLoans, err = strconv.Atoi(value)
+		if err != nil || maxLoans < 0 {
+			http.Error(w, "Concurrent loans must be a whole number of at least 0", http.StatusBadRequest)
+			return
+		}
+	}
+
+	before := *pdf
+	oldKey := pdf.StorageKey
+	pdf.Title = title
+	pdf.MaxConcurrentLoans = maxLoans
+	pdf.Author = form.Get("author")
+	pdf.Description = form.Get("description")
+
+	// Replace the file if a new one was uploaded
+	newFile := upload.file != nil
+	var stored storedFile
+	if newFile {
+		if err := h.checkUpload(r, user, upload); err != nil {
+			status, message := uploadErrorResponse(err)
+			http.Error(w, message, status)
 			return
 		}
 
-		session, err := h.sessionManager.ValidateSession(sessionToken)
+		// Files are stored by checksum, so the current file isn't
+		// overwritten before the update is known to succeed
+		stored, err = h.storeUpload(r.Context(), upload.file)
 		if err != nil {
-			auth.ClearSessionCookie(w)
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+		pdf.Filename = fmt.Sprintf("%d_%s", user.ID, upload.filename)
+		stored.apply(pdf)
+	}
+
+	err = h.db.UpdatePDF(pdf, expectedVersion)
+	if err != nil {
+		if newFile {
+			h.releaseBlob(pdf.StorageKey)
+		}
+
+		if errors.Is(err, db.ErrConflict) {
+			// Show the current values so the user can redo their changes
+			current, err := h.db.GetPDFByID(id)
+			if err != nil {
+				http.Error(w, "PDF not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusConflict)
+			templates.EditPDF(*current, user, "This PDF was changed by someone else while you were editing it. Review the current values below and save again.").Render(r.Context(), w)
 			return
 		}
 
-		// Add user with roles to context
-		user, err := h.db.GetUserWithRoles(session.UserID)
+		http.Error(w, "Failed to update PDF", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(h.db, r, user, models.AuditPDFUpdated, models.AuditTargetPDF, pdf.ID, before, pdf)
+
+	// Release the replaced file
+	if newFile {
+		h.releaseBlob(oldKey)
+		h.confirmStored(r.Context(), upload.file, stored)
+		h.indexPDFText(pdf.ID, upload.file, pdf.SizeBytes)
+
+		duplicates, err := duplicatePDFs(h.db, user, pdf)
 		if err != nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			fmt.Printf("Failed to check PDF %d for duplicates: %v\n", pdf.ID, err)
+		}
+		if len(duplicates) > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/library/view/%d?duplicate=1", pdf.ID), http.StatusSeeOther)
 			return
 		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/library/view/%d", pdf.ID), http.StatusSeeOther)
+}
+
+// recordPDFUpload records the upload of a new PDF in the audit log.
+func recordPDFUpload(database *db.Database, r *http.Request, user *models.User, pdfID int) {
+	var after any
+	if pdf, err := database.GetPDFByID(pdfID); err == nil {
+		after = pdf
+	}
+	recordAudit(database, r, user, models.AuditPDFUploaded, models.AuditTargetPDF, pdfID, nil, after)
+}
+
+// indexPDFText extracts the text of each page of an uploaded PDF and adds it
+// to the full-text search index. Failures are logged rather than returned,
+// since the PDF is still usable without its text being searchable.
+func (h *LibraryHandler) indexPDFText(pdfID int, file io.ReaderAt, size int64) {
+	pages, err := pdftext.ExtractPagesFrom(file, size)
+	if err != nil {
+		fmt.Printf("Failed to extract text from PDF %d: %v\n", pdfID, err)
+		return
+	}
+
+	if err := h.db.IndexPDFPages(pdfID, pages); err != nil {
+		fmt.Printf("Failed to index text of PDF %d: %v\n", pdfID, err)
+	}
+}
+
+// storedFile is an uploaded file saved in the blob store.
+type storedFile struct {
+	key      string
+	checksum string
+	size     int64
+}
+
+// apply makes pdf refer to the stored file.
+func (f storedFile) apply(pdf *models.PDF) {
+	pdf.StorageKey = f.key
+	pdf.Checksum = f.checksum
+	pdf.SizeBytes = f.size
+}
+
+// storeUpload saves an uploaded file in the blob store under its SHA-256
+// checksum, so that a file uploaded several times is only stored once.
+func (h *LibraryHandler) storeUpload(ctx context.Context, file io.ReadSeeker) (storedFile, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return storedFile{}, fmt.Errorf("failed to hash file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return storedFile{}, fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	stored := storedFile{key: checksumKey(checksum), checksum: checksum, size: size}
+
+	if info, err := h.store.Stat(ctx, stored.key); err == nil && info.Size == size {
+		return stored, nil
+	}
+	return stored, h.store.Put(ctx, stored.key, file, size)
+}
+
+// checksumKey returns the storage key of a file with the given SHA-256
+// checksum. Keys are spread over subdirectories so none gets too big.
+func checksumKey(checksum string) string {
+	return "sha256/" + checksum[:2] + "/" + checksum
+}
+
+// releaseBlob marks a file for deletion if no PDF uses it; ScrubFiles
+// deletes it later. Failures are logged rather than returned, since they only
+// leave an unused file behind.
+func (h *LibraryHandler) releaseBlob(key string) {
+	if err := h.db.ReleaseBlob(key, time.Now()); err != nil {
+		fmt.Printf("Failed to release file %s: %v\n", key, err)
+	}
+}
+
+// confirmStored stores an uploaded file again if it was deleted as released
+// between storeUpload and the commit of the record that uses it. Once that
+// record is committed, the file can't be deleted any more.
+func (h *LibraryHandler) confirmStored(ctx context.Context, file io.ReadSeeker, stored storedFile) {
+	_, err := h.store.Stat(ctx, stored.key)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err == nil {
+		err = h.store.Put(ctx, stored.key, file, stored.size)
+	}
+	if err != nil {
+		fmt.Printf("Failed to store file %s again: %v\n", stored.key, err)
+	}
+}
+
+// duplicatePDFs returns the other PDFs the user can see whose file is
+// identical to pdf's.
+func duplicatePDFs(database *db.Database, user *models.User, pdf *models.PDF) ([]models.PDF, error) {
+	if pdf.Checksum == "" {
+		return nil, nil
+	}
+
+	visibility, err := pdfVisibility(database, user)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := database.GetPDFsByChecksum(visibility, pdf.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicates []models.PDF
+	for _, match := range matches {
+		if match.ID != pdf.ID {
+			duplicates = append(duplicates, match)
+		}
+	}
+	return duplicates, nil
+}
+
+// RelocateLegacyUploads moves files uploaded before uploads were taken out of
+// the static tree into the blob store and updates their database records.
+func (h *LibraryHandler) RelocateLegacyUploads() error {
+	pdfs, err := h.db.GetAllPDFs()
+	if err != nil {
+		return fmt.Errorf("failed to fetch PDFs: %w", err)
+	}
+
+	for _, pdf := range pdfs {
+		path := pdf.StorageKey
+		if filepath.Dir(filepath.Clean(path)) != filepath.Clean(legacyUploadsDir) {
+			continue
+		}
+
+		key := filepath.Base(path)
+		if err := h.moveToStore(path, key); err != nil {
+			return fmt.Errorf("failed to move %s: %w", path, err)
+		}
 
-		ctx := context.WithValue(r.Context(), "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		if err := h.db.UpdatePDFStorageKey(pdf.ID, key); err != nil {
+			return fmt.Errorf("failed to update storage key for PDF %d: %w", pdf.ID, err)
+		}
 	}
+
+	// Remove the legacy directory if nothing is left in it
+	os.Remove(legacyUploadsDir)
+
+	return nil
+}
+
+// moveToStore stores the file at path under key and removes it. A missing
+// file is skipped.
+func (h *LibraryHandler) moveToStore(path, key string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := h.store.Put(context.Background(), key, file, info.Size()); err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Remove(path)
+}
+
+func (h *LibraryHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(h.db, h.sessionManager, next, redirectToLogin)
 }
 
 func (h *LibraryHandler) getUserFromContext(ctx context.Context) *models.User {
@@ -235,10 +771,7 @@ func (h *LibraryHandler) getUserFromContext(ctx context.Context) *models.User {
 }
 
 func (h *LibraryHandler) hasPermission(user *models.User, permissionName string) (bool, error) {
-	if user == nil {
-		return false, nil
-	}
-	return h.db.HasPermission(user.ID, permissionName)
+	return checkPermission(h.db, user, permissionName)
 }
 
 func (h *LibraryHandler) requirePermission(permissionName string, next http.HandlerFunc) http.HandlerFunc {
@@ -267,17 +800,6 @@ func (h *LibraryHandler) requirePermission(permissionName string, next http.Hand
 func (h *LibraryHandler) DeletePDF(w http.ResponseWriter, r *http.Request) {
 	user := h.getUserFromContext(r.Context())
 
-	// Check delete permission
-	hasPerm, err := h.hasPermission(user, "delete_pdf")
-	if err != nil {
-		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
-		return
-	}
-	if !hasPerm {
-		http.Error(w, "Access denied", http.StatusForbidden)
-		return
-	}
-
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -291,9 +813,8 @@ func (h *LibraryHandler) DeletePDF(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get PDF info for file deletion
-	pdf, err := h.db.GetPDFByID(id)
-	if err != nil {
-		http.Error(w, "PDF not found", http.StatusNotFound)
+	pdf, ok := h.accessiblePDF(w, user, id, models.PDFAccessDelete)
+	if !ok {
 		return
 	}
 
@@ -303,12 +824,10 @@ func (h *LibraryHandler) DeletePDF(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to delete PDF", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(h.db, r, user, models.AuditPDFDeleted, models.AuditTargetPDF, id, pdf, nil)
 
-	// Delete file from filesystem
-	if err := os.Remove(pdf.FilePath); err != nil {
-		// Log error but don't fail the request
-		fmt.Printf("Failed to delete file %s: %v\n", pdf.FilePath, err)
-	}
+	// Release the file for deletion unless another PDF shares it
+	h.releaseBlob(pdf.StorageKey)
 
 	// Redirect back to library
 	http.Redirect(w, r, "/library", http.StatusSeeOther)
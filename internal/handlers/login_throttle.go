@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// loginThrottledError is returned by checkLogin while earlier failures block
+// logins for the username or the client's IP address.
+type loginThrottledError struct {
+	until time.Time
+}
+
+func (e *loginThrottledError) Error() string {
+	return "too many failed login attempts"
+}
+
+// retryAfter returns the whole seconds until logins are allowed again.
+func (e *loginThrottledError) retryAfter(now time.Time) int {
+	return max(1, int(math.Ceil(e.until.Sub(now).Seconds())))
+}
+
+// message describes when logins are allowed again.
+func (e *loginThrottledError) message(now time.Time) string {
+	seconds := e.retryAfter(now)
+	wait := fmt.Sprintf("%d seconds", seconds)
+	if seconds > 90 {
+		wait = fmt.Sprintf("%d minutes", (seconds+59)/60)
+	}
+	return "Too many failed login attempts. Try again in " + wait + "."
+}
+
+// setRetryAfter sets the Retry-After header of a throttled login response.
+func (e *loginThrottledError) setRetryAfter(w http.ResponseWriter, now time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(e.retryAfter(now)))
+}
+
+// checkLogin returns the user a username and password belong to, as the
+// authenticator finds them. Failures are counted against the username and the
+// client's IP address, and while they block logins checkLogin returns a
+// *loginThrottledError without checking the password.
+func checkLogin(database *db.Database, authenticator Authenticator, r *http.Request, username, password string, now time.Time) (*models.User, error) {
+	ip := auth.ClientIP(r)
+
+	blockedUntil, err := database.LoginBlockedUntil(username, ip, now)
+	if err != nil {
+		return nil, err
+	}
+	if !blockedUntil.IsZero() {
+		return nil, &loginThrottledError{until: blockedUntil}
+	}
+
+	user, err := authenticator.Authenticate(r.Context(), username, password)
+	if err == nil {
+		if err := database.ClearLoginFailures(username); err != nil {
+			log.Printf("Failed to clear login failures of %q: %v", username, err)
+		}
+		return user, nil
+	}
+	if !errors.Is(err, auth.ErrInvalidCredentials) {
+		return nil, err
+	}
+
+	if err := recordLoginFailure(database, r, username, now); err != nil {
+		return nil, err
+	}
+	return nil, auth.ErrInvalidCredentials
+}
+
+// recordLoginFailure counts a failed login and records it and the lockouts
+// it causes in the audit log.
+func recordLoginFailure(database *db.Database, r *http.Request, username string, now time.Time) error {
+	lockouts, err := database.RecordLoginFailure(username, auth.ClientIP(r), now)
+	if err != nil {
+		return err
+	}
+	recordAudit(database, r, &models.User{Username: username}, models.AuditLoginFailed, "", 0, nil, nil)
+	for _, lockout := range lockouts {
+		log.Printf("Locked out %s %q until %s after %d failed logins, the last from %s",
+			lockout.Kind, lockout.Subject, lockout.LockedUntil.Format(time.RFC3339), lockout.Failures, lockout.IPAddress)
+		recordAudit(database, r, nil, models.AuditLockout, models.AuditTargetLockout, lockout.ID, nil, lockout)
+	}
+	return nil
+}
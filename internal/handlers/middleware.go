@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// authenticate returns the user who made a request, along with their roles.
+// Requests are authenticated with the session cookie or an
+// "Authorization: Bearer" header holding either a session token or a
+// personal API token. Users authenticated with an API token carry its scopes
+// in TokenScopes.
+func authenticate(database *db.Database, sessionManager *auth.SessionManager, r *http.Request) (*models.User, error) {
+	token, err := auth.GetSessionToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.IsAPIToken(token) {
+		apiToken, err := database.AuthenticateAPIToken(auth.HashToken(token), time.Now())
+		if err != nil {
+			return nil, auth.ErrInvalidToken
+		}
+
+		user, err := database.GetUserWithRoles(apiToken.UserID)
+		if err != nil {
+			return nil, auth.ErrInvalidToken
+		}
+		user.TokenScopes = apiToken.Scopes
+		if user.TokenScopes == nil {
+			user.TokenScopes = []string{}
+		}
+		return user, nil
+	}
+
+	session, err := sessionManager.ValidateSession(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := database.GetUserWithRoles(session.UserID)
+	if err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	return user, nil
+}
+
+// authMiddleware puts the authenticated user in the request context under
+// "user", or calls unauthorized if the request isn't authenticated, the user
+// can't use the library yet, or their role requires two-factor
+// authentication they haven't set up.
+func authMiddleware(database *db.Database, sessionManager *auth.SessionManager, next http.HandlerFunc, unauthorized func(http.ResponseWriter, *http.Request, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(database, sessionManager, r)
+		if err != nil {
+			unauthorized(w, r, err)
+			return
+		}
+		if !user.CanUseLibrary() {
+			unauthorized(w, r, errAccountInactive)
+			return
+		}
+		if user.NeedsTwoFactorSetup() {
+			unauthorized(w, r, errTwoFactorSetupRequired)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user", user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// redirectToLogin sends unauthenticated page requests to the login page, and
+// users who can't use the library yet to the page explaining why or where
+// they set up two-factor authentication.
+func redirectToLogin(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errAccountInactive) {
+		http.Redirect(w, r, "/account/pending", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, errTwoFactorSetupRequired) {
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, auth.ErrInvalidToken) {
+		auth.ClearSessionCookie(w)
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// checkPermission reports whether a user has a permission through their
+// roles and, for requests made with an API token, the token's scopes.
+func checkPermission(database *db.Database, user *models.User, permissionName string) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if user.TokenScopes != nil && !slices.Contains(user.TokenScopes, permissionName) {
+		return false, nil
+	}
+	return database.HasPermission(user.ID, permissionName)
+}
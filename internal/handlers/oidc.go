@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcStateCookie holds the state parameter of a login sent to the identity
+// provider, tying the callback to the browser that started the login.
+const oidcStateCookie = "oidc_state"
+
+// OIDCConfig configures logging in through an OpenID Connect identity
+// provider. It is off unless IssuerURL is set.
+type OIDCConfig struct {
+	ProviderName string // Shown on the login button, e.g. "Okta"
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // Defaults to BaseURL + "/auth/oidc/callback"
+	GroupsClaim  string // ID token claim listing the user's groups, "groups" by default
+
+	// RoleMapping maps provider groups to local roles. Roles that appear in
+	// it are managed by the provider: every login adds users to or removes
+	// them from these roles to match their groups.
+	RoleMapping map[string][]string
+}
+
+// Enabled reports whether logging in through the identity provider is on.
+func (c OIDCConfig) Enabled() bool {
+	return c.IssuerURL != ""
+}
+
+// OIDCHandler logs users in through an OpenID Connect identity provider with
+// the authorization code flow and PKCE. Users logging in for the first time
+// get an account of their own, unless their email address belongs to an
+// existing account; those users log in with their password and link the
+// identity from their security settings instead.
+type OIDCHandler struct {
+	auth     *AuthHandler
+	config   OIDCConfig
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCHandler discovers the identity provider configured in the
+// AuthHandler's config. ctx is used for fetching the provider's keys for as
+// long as the handler is in use.
+func NewOIDCHandler(ctx context.Context, authHandler *AuthHandler) (*OIDCHandler, error) {
+	config := authHandler.config.OIDC
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	redirectURL := config.RedirectURL
+	if redirectURL == "" {
+		redirectURL = authHandler.config.BaseURL + "/auth/oidc/callback"
+	}
+
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover identity provider: %w", err)
+	}
+
+	return &OIDCHandler{
+		auth:   authHandler,
+		config: config,
+		oauth: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+// Login sends the browser to the identity provider to log in.
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	h.startLogin(w, r, nil)
+}
+
+// Link sends a logged-in user to the identity provider to link their
+// identity there to their account.
+func (h *OIDCHandler) Link(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := h.auth.getUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.TokenScopes != nil {
+		http.Error(w, "Identities can only be linked after logging in", http.StatusForbidden)
+		return
+	}
+
+	h.startLogin(w, r, &user.ID)
+}
+
+func (h *OIDCHandler) startLogin(w http.ResponseWriter, r *http.Request, linkUserID *int) {
+	state := auth.GenerateToken()
+	nonce := auth.GenerateToken()
+	verifier := oauth2.GenerateVerifier()
+
+	err := h.auth.db.CreateOIDCState(auth.HashToken(state), models.OIDCState{
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+	}, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, h.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusSeeOther)
+}
+
+// Callback is where the identity provider sends the browser back to. It
+// checks the login, finds, links or creates the user, updates the roles the
+// role mapping manages, and then logs the user in like a password login.
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	if message := r.FormValue("error"); message != "" {
+		if description := r.FormValue("error_description"); description != "" {
+			message = description
+		}
+		h.renderError(w, r, http.StatusBadRequest, h.config.ProviderName+" didn't log you in: "+message)
+		return
+	}
+
+	state := r.FormValue("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		h.renderError(w, r, http.StatusBadRequest, "This login has expired or was started in another browser. Please try again.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		Path:     "/auth/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	loginState, err := h.auth.db.TakeOIDCState(auth.HashToken(state), now)
+	if errors.Is(err, db.ErrInvalidOIDCState) {
+		h.renderError(w, r, http.StatusBadRequest, "This login has expired or was started in another browser. Please try again.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check login", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.oauth.Exchange(r.Context(), r.FormValue("code"), oauth2.VerifierOption(loginState.CodeVerifier))
+	if err != nil {
+		log.Printf("Failed to exchange authorization code: %v", err)
+		h.renderError(w, r, http.StatusBadGateway, "Couldn't complete the login with "+h.config.ProviderName+".")
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("Token response has no ID token")
+		h.renderError(w, r, http.StatusBadGateway, "Couldn't complete the login with "+h.config.ProviderName+".")
+		return
+	}
+	idToken, err := h.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		log.Printf("Failed to verify ID token: %v", err)
+		h.renderError(w, r, http.StatusBadGateway, "Couldn't complete the login with "+h.config.ProviderName+".")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(loginState.Nonce)) != 1 {
+		h.renderError(w, r, http.StatusBadRequest, "This login has expired or was started in another browser. Please try again.")
+		return
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     *bool  `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	var allClaims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Failed to read ID token", http.StatusBadGateway)
+		return
+	}
+	if err := idToken.Claims(&allClaims); err != nil {
+		http.Error(w, "Failed to read ID token", http.StatusBadGateway)
+		return
+	}
+	email := strings.TrimSpace(claims.Email)
+
+	if loginState.LinkUserID != nil {
+		err := h.auth.db.LinkIdentity(*loginState.LinkUserID, idToken.Issuer, idToken.Subject, email, now)
+		if errors.Is(err, db.ErrIdentityLinked) {
+			h.renderError(w, r, http.StatusConflict, "This "+h.config.ProviderName+" account is already linked to a user.")
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to link identity", http.StatusInternalServerError)
+			return
+		}
+		linked, err := h.auth.db.GetUserByID(*loginState.LinkUserID)
+		if err != nil {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(h.auth.db, r, linked, models.AuditIdentityLinked, models.AuditTargetUser, linked.ID, nil, map[string]string{
+			"issuer":  idToken.Issuer,
+			"subject": idToken.Subject,
+			"email":   email,
+		})
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	user, err := h.auth.db.GetUserByIdentity(idToken.Issuer, idToken.Subject, email, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = h.provisionUser(w, r, idToken, email, claims.EmailVerified, claims.PreferredUsername, now)
+		if user == nil && err == nil {
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	if len(h.config.RoleMapping) > 0 {
+		roles := rolesFor(h.config.RoleMapping, claimStrings(allClaims[h.config.GroupsClaim]))
+		if err := syncManagedRoles(h.auth.db, r, user.ID, managedRoles(h.config.RoleMapping), roles, idToken.Issuer); err != nil {
+			http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+			return
+		}
+		if user, err = h.auth.db.GetUserWithRoles(user.ID); err != nil {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if user.HasTwoFactor() {
+		h.auth.startLoginChallenge(w, r, user)
+		return
+	}
+	h.auth.completeLogin(w, r, user)
+}
+
+// provisionUser creates a user for an identity logging in for the first
+// time, if the registration mode lets the identity's email address register.
+// In approval mode the account waits for an admin like any other. It writes
+// the response and returns a nil user if the identity can't have one.
+func (h *OIDCHandler) provisionUser(w http.ResponseWriter, r *http.Request, idToken *oidc.IDToken, email string, emailVerified *bool, preferredUsername string, now time.Time) (*models.User, error) {
+	if email == "" {
+		h.renderError(w, r, http.StatusBadRequest, h.config.ProviderName+" didn't share your email address, which the library needs to create your account.")
+		return nil, nil
+	}
+	if emailVerified != nil && !*emailVerified {
+		h.renderError(w, r, http.StatusBadRequest, "Verify your email address with "+h.config.ProviderName+" first.")
+		return nil, nil
+	}
+
+	status, err := h.auth.config.provisionStatus(email)
+	switch {
+	case errors.Is(err, errInviteOnly):
+		h.renderError(w, r, http.StatusForbidden, "Registration is by invitation only. Register with your invitation first, then link your "+h.config.ProviderName+" account from the Security page.")
+		return nil, nil
+	case errors.Is(err, errDomainNotAllowed):
+		h.renderError(w, r, http.StatusForbidden, "Registration is limited to addresses at "+strings.Join(h.auth.config.AllowedDomains, ", ")+".")
+		return nil, nil
+	}
+
+	userID, err := h.auth.db.ProvisionIdentityUser(identityUsername(preferredUsername, email), email, idToken.Issuer, idToken.Subject, status, now)
+	if errors.Is(err, db.ErrEmailInUse) {
+		h.renderError(w, r, http.StatusConflict, "An account with this email address already exists. Log in with your password and link your "+h.config.ProviderName+" account from the Security page.")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created user %d for %s identity %s", userID, idToken.Issuer, idToken.Subject)
+	return h.auth.db.GetUserByID(userID)
+}
+
+func (h *OIDCHandler) renderError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.WriteHeader(status)
+	templates.SingleSignOnError(message).Render(r.Context(), w)
+}
+
+// UnlinkIdentity removes one of the identity provider's identities linked to
+// the user's account. Users without a password can't remove their last
+// identity, since they couldn't log in anymore.
+func (h *AuthHandler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := h.getUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.TokenScopes != nil {
+		http.Error(w, "Identities can only be unlinked after logging in", http.StatusForbidden)
+		return
+	}
+
+	identityID, err := strconv.Atoi(r.FormValue("identity_id"))
+	if err != nil {
+		http.Error(w, "Invalid identity ID", http.StatusBadRequest)
+		return
+	}
+
+	if user.PasswordHash == "" {
+		identities, err := h.db.GetUserIdentities(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch identities", http.StatusInternalServerError)
+			return
+		}
+		if len(identities) <= 1 {
+			h.renderTwoFactor(w, r, http.StatusBadRequest, user, nil, "Set a password with \"Forgot your password?\" on the login page before unlinking your only way to log in.", true)
+			return
+		}
+	}
+
+	err = h.db.UnlinkIdentity(identityID, user.ID, h.config.OIDC.IssuerURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to unlink identity", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditIdentityUnlinked, models.AuditTargetUser, user.ID, map[string]int{"identity_id": identityID}, nil)
+
+	h.renderTwoFactor(w, r, http.StatusOK, user, nil, "The account was unlinked.", false)
+}
+
+// identityUsername picks the username of a user created for an identity:
+// the provider's preferred username, or else the start of the email address,
+// reduced to characters that are safe in usernames.
+func identityUsername(preferred, email string) string {
+	name := preferred
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return -1
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	if name == "" {
+		name = "user"
+	}
+	return name
+}
+
+// claimStrings reads a claim that holds a string or a list of strings.
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ForgotPassword shows the forgot password form (GET) or emails a password
+// reset link to the account with the given address (POST). The response is
+// the same whether or not an account uses the address, so the form can't be
+// used to find out who has an account.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		templates.ForgotPassword("", false).Render(r.Context(), w)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.ForgotPassword("Email is required", true).Render(r.Context(), w)
+		return
+	}
+
+	if user, err := h.db.GetUserByEmail(email); err == nil {
+		if err := h.sendPasswordReset(user.ID, user.Username, user.Email); err != nil {
+			// Logged rather than shown, so the response doesn't reveal
+			// that the account exists
+			log.Printf("Failed to send password reset to user %d: %v", user.ID, err)
+		}
+	}
+
+	templates.ForgotPassword("If an account uses that email address, we've sent it a link to reset the password.", false).Render(r.Context(), w)
+}
+
+func (h *AuthHandler) sendPasswordReset(userID int, username, email string) error {
+	token := auth.GenerateToken()
+	if err := h.db.CreatePasswordReset(userID, auth.HashToken(token), time.Now()); err != nil {
+		return err
+	}
+
+	link := h.config.BaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	return h.mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Reset your library password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone asked to reset the password of your library account. To choose a new password, open this link within the next hour:\n\n"+
+			"%s\n\n"+
+			"If you didn't ask for this, you can ignore this email and your password won't change.\n", username, link),
+	})
+}
+
+// ResetPassword shows the form for choosing a new password (GET) or sets it
+// (POST). The token from the emailed link can only be used once, and
+// resetting the password logs the user out of every session.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	if r.Method == "GET" {
+		if err := h.db.CheckPasswordReset(auth.HashToken(token), time.Now()); err != nil {
+			h.renderResetPasswordError(w, r, token, err)
+			return
+		}
+		templates.ResetPassword(token, "", false, true).Render(r.Context(), w)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	password := r.FormValue("password")
+	if len(password) < minPasswordLength {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.ResetPassword(token, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), true, true).Render(r.Context(), w)
+		return
+	}
+	if password != r.FormValue("confirm-password") {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.ResetPassword(token, "Passwords do not match", true, true).Render(r.Context(), w)
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := h.db.ResetPassword(auth.HashToken(token), passwordHash, time.Now())
+	if err != nil {
+		h.renderResetPasswordError(w, r, token, err)
+		return
+	}
+	var actor *models.User
+	if resetUser, err := h.db.GetUserByID(userID); err == nil {
+		actor = resetUser
+	}
+	recordAudit(h.db, r, actor, models.AuditPasswordReset, models.AuditTargetUser, userID, nil, nil)
+
+	if err := h.sessionManager.DestroyUserSessions(userID); err != nil {
+		http.Error(w, "Failed to end sessions", http.StatusInternalServerError)
+		return
+	}
+	auth.ClearSessionCookie(w)
+
+	templates.ResetPassword("", "Your password has been changed. You can now log in with it.", false, false).Render(r.Context(), w)
+}
+
+func (h *AuthHandler) renderResetPasswordError(w http.ResponseWriter, r *http.Request, token string, err error) {
+	if !errors.Is(err, db.ErrInvalidResetToken) {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	templates.ResetPassword(token, "This reset link is invalid, has already been used or has expired. Request a new one.", true, false).Render(r.Context(), w)
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pdfAccessPermissions maps access list levels to the role permissions that
+// give the same access to every PDF that isn't restricted.
+var pdfAccessPermissions = map[string]string{
+	models.PDFAccessRead:   "view_pdf",
+	models.PDFAccessEdit:   "edit_pdf",
+	models.PDFAccessDelete: "delete_pdf",
+}
+
+// canAccessPDF reports whether a user may read, edit or delete a PDF, as
+// given by level. Users with manage_pdf_access may do anything, and access
+// list entries, on the PDF or on a collection it's in, grant access on top
+// of the user's roles. The role
+// permissions only count for restricted PDFs if the user uploaded them.
+// Requests made with an API token also need the level's permission in the
+// token's scopes.
+func canAccessPDF(database *db.Database, user *models.User, pdf *models.PDF, level string) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	permission := pdfAccessPermissions[level]
+	if user.TokenScopes != nil && !slices.Contains(user.TokenScopes, permission) {
+		return false, nil
+	}
+
+	if hasPerm, err := checkPermission(database, user, "manage_pdf_access"); err != nil || hasPerm {
+		return hasPerm, err
+	}
+
+	granted, err := database.GetPDFAccess(pdf.ID, user.ID)
+	if err != nil {
+		return false, err
+	}
+	if models.PDFAccessIncludes(granted, level) {
+		return true, nil
+	}
+
+	if pdf.Restricted && pdf.UploadedBy != user.ID {
+		return false, nil
+	}
+	return checkPermission(database, user, permission)
+}
+
+// canManagePDFAccess reports whether a user may change whether a PDF is
+// restricted and edit its access list: users with manage_pdf_access, and
+// the PDF's uploader when they're logged in rather than using an API token.
+func canManagePDFAccess(database *db.Database, user *models.User, pdf *models.PDF) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if user.TokenScopes == nil && pdf.UploadedBy == user.ID {
+		return true, nil
+	}
+	return checkPermission(database, user, "manage_pdf_access")
+}
+
+// pdfVisibility returns which PDFs a user may see in listings and searches.
+func pdfVisibility(database *db.Database, user *models.User) (db.PDFVisibility, error) {
+	if user == nil {
+		return db.PDFVisibility{}, nil
+	}
+	all, err := checkPermission(database, user, "manage_pdf_access")
+	return db.PDFVisibility{UserID: user.ID, All: all}, err
+}
+
+// pdfAccessControl returns what a user may do with a PDF for the viewer,
+// along with its access list and collections if they may manage it.
+func (h *LibraryHandler) pdfAccessControl(user *models.User, pdf *models.PDF) (models.PDFAccessControl, error) {
+	var control models.PDFAccessControl
+	var err error
+
+	if control.CanEdit, err = canAccessPDF(h.db, user, pdf, models.PDFAccessEdit); err != nil {
+		return control, err
+	}
+	if control.CanDelete, err = canAccessPDF(h.db, user, pdf, models.PDFAccessDelete); err != nil {
+		return control, err
+	}
+	if control.CanManage, err = canManagePDFAccess(h.db, user, pdf); err != nil || !control.CanManage {
+		return control, err
+	}
+
+	if control.Entries, err = h.db.GetPDFACL(pdf.ID); err != nil {
+		return control, err
+	}
+	if control.Roles, err = h.db.GetAllRoles(); err != nil {
+		return control, err
+	}
+
+	if control.Collections, err = h.db.GetPDFCollections(pdf.ID); err != nil {
+		return control, err
+	}
+	collections, err := h.db.GetAllCollections()
+	for _, collection := range collections {
+		if !slices.ContainsFunc(control.Collections, func(c models.Collection) bool { return c.ID == collection.ID }) {
+			control.AllCollections = append(control.AllCollections, collection)
+		}
+	}
+	return control, err
+}
+
+// PDFAccess changes who may access a PDF from the viewer. The action field
+// selects what to do: "restrict" sets whether the PDF is restricted to its
+// access list, "grant" gives a user (by username) or a role (by role_id)
+// an access level, replacing any entry they already have, "revoke" removes
+// entry_id, and "add_collection" and "remove_collection" put the PDF in
+// collection_id or take it out.
+func (h *LibraryHandler) PDFAccess(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pdfID, err := strconv.Atoi(r.FormValue("pdf_id"))
+	if err != nil {
+		http.Error(w, "Invalid PDF ID", http.StatusBadRequest)
+		return
+	}
+
+	pdf, err := h.db.GetPDFByID(pdfID)
+	if err != nil {
+		http.Error(w, "PDF not found", http.StatusNotFound)
+		return
+	}
+
+	canManage, err := canManagePDFAccess(h.db, user, pdf)
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	var before, after any
+	switch r.FormValue("action") {
+	case "restrict":
+		restricted := r.FormValue("restricted") == "true"
+		err = h.db.SetPDFRestricted(pdf.ID, restricted)
+		before, after = map[string]bool{"restricted": pdf.Restricted}, map[string]bool{"restricted": restricted}
+
+	case "grant":
+		var userID, roleID *int
+		if username := strings.TrimSpace(r.FormValue("username")); username != "" {
+			grantee, err := h.db.GetUserByUsername(username)
+			if err != nil {
+				h.renderViewer(w, r, pdf.ID, http.StatusBadRequest, fmt.Sprintf("There is no user named %s", username))
+				return
+			}
+			userID = &grantee.ID
+		} else if id, err := strconv.Atoi(r.FormValue("role_id")); err == nil {
+			if _, err := h.db.GetRoleByID(id); err != nil {
+				http.Error(w, "Role not found", http.StatusBadRequest)
+				return
+			}
+			roleID = &id
+		}
+		access := r.FormValue("access")
+		err = h.db.SetPDFACLEntry(pdf.ID, userID, roleID, access, user.ID, time.Now())
+		if errors.Is(err, db.ErrInvalidACLEntry) {
+			h.renderViewer(w, r, pdf.ID, http.StatusBadRequest, "Choose a user or a role and an access level")
+			return
+		}
+		after = map[string]any{"user_id": userID, "role_id": roleID, "access": access}
+
+	case "revoke":
+		entryID, convErr := strconv.Atoi(r.FormValue("entry_id"))
+		if convErr != nil {
+			http.Error(w, "Invalid entry ID", http.StatusBadRequest)
+			return
+		}
+		entries, aclErr := h.db.GetPDFACL(pdf.ID)
+		if aclErr != nil {
+			http.Error(w, "Failed to fetch access list", http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			if entry.ID == entryID {
+				before = entry
+			}
+		}
+		err = h.db.DeletePDFACLEntry(entryID, pdf.ID)
+
+	case "add_collection", "remove_collection":
+		collectionID, convErr := strconv.Atoi(r.FormValue("collection_id"))
+		if convErr != nil {
+			http.Error(w, "Invalid collection ID", http.StatusBadRequest)
+			return
+		}
+		membership := map[string]int{"collection_id": collectionID}
+		if r.FormValue("action") == "add_collection" {
+			err = h.db.AddPDFToCollection(collectionID, pdf.ID)
+			after = membership
+		} else {
+			err = h.db.RemovePDFFromCollection(collectionID, pdf.ID)
+			before = membership
+		}
+
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update access", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditPDFAccessChanged, models.AuditTargetPDF, pdf.ID, before, after)
+
+	http.Redirect(w, r, fmt.Sprintf("/library/view/%d", pdf.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Registration modes.
+const (
+	RegistrationOpen     = "open"     // Anyone can register
+	RegistrationInvite   = "invite"   // Only people with an invitation can register
+	RegistrationDomain   = "domain"   // Only addresses at the allowed domains can register
+	RegistrationApproval = "approval" // Anyone can register, but an admin must approve the account
+)
+
+// AuthConfig configures registration and the links in emails sent by
+// AuthHandler.
+type AuthConfig struct {
+	BaseURL          string // e.g. "https://library.example.com"
+	RegistrationMode string
+	AllowedDomains   []string // Email domains that may register in RegistrationDomain mode
+	OIDC             OIDCConfig
+
+	// Authenticator checks passwords at login, PasswordAuthenticator by
+	// default.
+	Authenticator Authenticator
+}
+
+// Validate checks that the registration mode is known and has what it needs,
+// and that single sign-on has a client ID if it's on.
+func (c AuthConfig) Validate() error {
+	if c.OIDC.Enabled() && c.OIDC.ClientID == "" {
+		return errors.New("single sign-on needs a client ID")
+	}
+
+	switch c.RegistrationMode {
+	case RegistrationOpen, RegistrationInvite, RegistrationApproval:
+		return nil
+	case RegistrationDomain:
+		if len(c.AllowedDomains) == 0 {
+			return errors.New("domain registration needs at least one allowed domain")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown registration mode %q", c.RegistrationMode)
+	}
+}
+
+// allowsDomain reports whether an email address is at one of the allowed
+// domains.
+func (c AuthConfig) allowsDomain(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	return slices.ContainsFunc(c.AllowedDomains, func(allowed string) bool {
+		return strings.EqualFold(allowed, domain)
+	})
+}
+
+// Errors for accounts the registration mode doesn't let a directory or
+// identity provider create at a user's first login.
+var (
+	errInviteOnly       = errors.New("registration is by invitation only")
+	errDomainNotAllowed = errors.New("email domain may not register")
+)
+
+// provisionStatus returns the status of an account created for email at its
+// first login through a directory or identity provider, following the
+// registration mode, or errInviteOnly or errDomainNotAllowed if the mode
+// doesn't allow creating it.
+func (c AuthConfig) provisionStatus(email string) (string, error) {
+	switch c.RegistrationMode {
+	case RegistrationInvite:
+		return "", errInviteOnly
+	case RegistrationDomain:
+		if !c.allowsDomain(email) {
+			return "", errDomainNotAllowed
+		}
+	case RegistrationApproval:
+		return models.UserPending, nil
+	}
+	return models.UserActive, nil
+}
+
+// errAccountInactive is passed to unauthorized handlers for users who are
+// logged in but haven't verified their email address or been approved.
+var errAccountInactive = errors.New("account is not active")
+
+// AccountPending tells users who can't use the library yet what they are
+// waiting for (GET) and sends a new verification email (POST).
+func (h *AuthHandler) AccountPending(w http.ResponseWriter, r *http.Request) {
+	// Authenticated directly, since the middleware turns these users away
+	user, err := authenticate(h.db, h.sessionManager, r)
+	if err != nil {
+		redirectToLogin(w, r, err)
+		return
+	}
+	if user.CanUseLibrary() {
+		http.Redirect(w, r, "/library", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "POST" {
+		if user.IsEmailVerified() {
+			http.Error(w, "Email address is already verified", http.StatusBadRequest)
+			return
+		}
+		if err := h.sendEmailVerification(user); err != nil {
+			log.Printf("Failed to send email verification to user %d: %v", user.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			templates.AccountPending(user, "We couldn't send the email. Try again later.", true).Render(r.Context(), w)
+			return
+		}
+		templates.AccountPending(user, "We've sent a new verification link to "+user.Email+".", false).Render(r.Context(), w)
+		return
+	}
+
+	templates.AccountPending(user, "", false).Render(r.Context(), w)
+}
+
+func (h *AuthHandler) sendEmailVerification(user *models.User) error {
+	token := auth.GenerateToken()
+	if err := h.db.CreateEmailVerification(user.ID, auth.HashToken(token), time.Now()); err != nil {
+		return err
+	}
+
+	link := h.config.BaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return h.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your library email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Please confirm that this is your email address by opening this link within the next 48 hours:\n\n"+
+			"%s\n\n"+
+			"If you didn't create a library account, you can ignore this email.\n", user.Username, link),
+	})
+}
+
+// VerifyEmail marks the email address of the user an emailed verification
+// link was sent to as verified.
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.db.VerifyEmail(auth.HashToken(r.FormValue("token")), time.Now())
+	if errors.Is(err, db.ErrInvalidVerificationToken) {
+		w.WriteHeader(http.StatusBadRequest)
+		templates.VerifyEmail("This verification link is invalid, has already been used or has expired. Log in to request a new one.", true).Render(r.Context(), w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify email address", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Your email address is verified."
+	if user.Status == models.UserPending {
+		message += " An administrator still needs to approve your account before you can use the library."
+	}
+	templates.VerifyEmail(message, false).Render(r.Context(), w)
+}
+
+// Invite emails an invitation to register to an address. Invited users can
+// register in every mode, skip approval, and don't need to verify their
+// email address, since the invitation was sent to it.
+func (h *AuthHandler) Invite(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_users")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" || !strings.Contains(email, "@") {
+		http.Error(w, "A valid email address is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.db.GetUserByEmail(email); err == nil {
+		http.Error(w, "A user with that email address already exists", http.StatusConflict)
+		return
+	}
+
+	token := auth.GenerateToken()
+	if err := h.db.CreateInvitation(email, auth.HashToken(token), user.ID, time.Now()); err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(h.db, r, user, models.AuditInvitationCreated, "", 0, nil, map[string]string{"email": email})
+
+	link := h.config.BaseURL + "/register?invite=" + url.QueryEscape(token)
+	err = h.mailer.Send(mail.Message{
+		To:      email,
+		Subject: "You're invited to the library",
+		Body: fmt.Sprintf("Hello,\n\n"+
+			"%s has invited you to create a library account. Register with this email address using this link within the next 7 days:\n\n"+
+			"%s\n", user.Username, link),
+	})
+	if err != nil {
+		http.Error(w, "Failed to send invitation", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin?notice=invited", http.StatusSeeOther)
+}
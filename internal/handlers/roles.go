@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxRoleNameLength limits role names, which appear in badges and in the
+// group to role mappings of single sign-on and LDAP.
+const maxRoleNameLength = 50
+
+// validateRoleName checks that a role name is short and only uses characters
+// that can't be confused with the separators of a role mapping.
+func validateRoleName(name string) error {
+	if name == "" || len(name) > maxRoleNameLength {
+		return fmt.Errorf("Role names must be 1 to %d characters long", maxRoleNameLength)
+	}
+	if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789_-") != "" {
+		return errors.New("Role names may only contain lowercase letters, digits, hyphens and underscores")
+	}
+	return nil
+}
+
+// roleErrorMessage returns the message to show for an error from the role
+// management methods of db.Database, and the status to answer with.
+func roleErrorMessage(err error) (int, string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, "Role or permission not found"
+	case errors.Is(err, db.ErrRoleExists):
+		return http.StatusConflict, "A role with that name already exists"
+	case errors.Is(err, db.ErrBuiltInRole):
+		return http.StatusConflict, "Built-in roles can't be renamed or deleted"
+	case errors.Is(err, db.ErrLastRoleManager):
+		return http.StatusConflict, "That would leave no one able to manage roles"
+	default:
+		return http.StatusInternalServerError, "Failed to update roles"
+	}
+}
+
+// Roles shows the roles with a permission matrix, and creates (action
+// "create"), updates ("update") and deletes ("delete") roles and saves the
+// matrix ("permissions") on POST.
+func (h *AdminHandler) Roles(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	hasPerm, err := h.hasPermission(user, "manage_roles")
+	if err != nil {
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return
+	}
+	if !hasPerm {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != "POST" {
+		h.renderRoles(w, r, http.StatusOK, "", false)
+		return
+	}
+
+	// The audit event of the change, and the role as it was before
+	var message, event string
+	var roleID int
+	var before *models.Role
+	switch action := r.FormValue("action"); action {
+	case "create":
+		name, description := strings.TrimSpace(r.FormValue("name")), strings.TrimSpace(r.FormValue("description"))
+		if err = validateRoleName(name); err != nil {
+			h.renderRoles(w, r, http.StatusBadRequest, err.Error(), true)
+			return
+		}
+		roleID, err = h.db.CreateRole(name, description)
+		message, event = fmt.Sprintf("Created role %s", name), models.AuditRoleCreated
+
+	case "update":
+		var convErr error
+		if roleID, convErr = strconv.Atoi(r.FormValue("role_id")); convErr != nil {
+			http.Error(w, "Invalid Role ID", http.StatusBadRequest)
+			return
+		}
+		name, description := strings.TrimSpace(r.FormValue("name")), strings.TrimSpace(r.FormValue("description"))
+		if err = validateRoleName(name); err != nil {
+			h.renderRoles(w, r, http.StatusBadRequest, err.Error(), true)
+			return
+		}
+		before, _ = h.db.GetRoleByID(roleID)
+		err = h.db.UpdateRole(roleID, name, description)
+		message, event = fmt.Sprintf("Updated role %s", name), models.AuditRoleUpdated
+
+	case "delete":
+		var convErr error
+		if roleID, convErr = strconv.Atoi(r.FormValue("role_id")); convErr != nil {
+			http.Error(w, "Invalid Role ID", http.StatusBadRequest)
+			return
+		}
+		var getErr error
+		if before, getErr = h.db.GetRoleByID(roleID); getErr != nil {
+			h.renderRoles(w, r, http.StatusNotFound, "Role not found", true)
+			return
+		}
+		err = h.db.DeleteRole(roleID)
+		message, event = fmt.Sprintf("Deleted role %s", before.Name), models.AuditRoleDeleted
+
+	case "permissions":
+		grants, parseErr := parsePermissionMatrix(r)
+		if parseErr != nil {
+			http.Error(w, parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = setRolePermissions(h.db, r, user, grants); err == nil {
+			message = "Permissions saved"
+		}
+
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		status, errMessage := roleErrorMessage(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to update roles: %v", err)
+		}
+		h.renderRoles(w, r, status, errMessage, true)
+		return
+	}
+	if event != "" {
+		recordRoleChange(h.db, r, user, event, roleID, before)
+	}
+	h.renderRoles(w, r, http.StatusOK, message, false)
+}
+
+// recordRoleChange records a change to a role in the audit log, with the
+// role as it was before, if it existed, and as it is after, if it still
+// does.
+func recordRoleChange(database *db.Database, r *http.Request, actor *models.User, event string, roleID int, before *models.Role) {
+	var beforeSnapshot, afterSnapshot any
+	if before != nil {
+		beforeSnapshot = before
+	}
+	if event != models.AuditRoleDeleted {
+		if after, err := database.GetRoleByID(roleID); err == nil {
+			afterSnapshot = after
+		}
+	}
+	recordAudit(database, r, actor, event, models.AuditTargetRole, roleID, beforeSnapshot, afterSnapshot)
+}
+
+// setRolePermissions replaces the permissions of roles, recording the
+// change to each role whose permissions changed in the audit log.
+func setRolePermissions(database *db.Database, r *http.Request, actor *models.User, grants map[int][]int) error {
+	permissionNames := func(roleID int) []string {
+		permissions, err := database.GetRolePermissions(roleID)
+		if err != nil {
+			log.Printf("Failed to fetch the permissions of role %d: %v", roleID, err)
+		}
+		names := []string{}
+		for _, permission := range permissions {
+			names = append(names, permission.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	before := make(map[int][]string, len(grants))
+	for roleID := range grants {
+		before[roleID] = permissionNames(roleID)
+	}
+	if err := database.SetRolePermissions(grants); err != nil {
+		return err
+	}
+	for roleID, names := range before {
+		if after := permissionNames(roleID); !slices.Equal(names, after) {
+			recordAudit(database, r, actor, models.AuditRolePermissions, models.AuditTargetRole, roleID, names, after)
+		}
+	}
+	return nil
+}
+
+// parsePermissionMatrix reads the permission matrix form. Each role_id field
+// names a role in the matrix, and each checked "roleID:permissionID" grant
+// gives that role the permission; roles without checked grants lose all
+// their permissions.
+func parsePermissionMatrix(r *http.Request) (map[int][]int, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	grants := make(map[int][]int)
+	for _, value := range r.PostForm["role_id"] {
+		roleID, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New("Invalid Role ID")
+		}
+		grants[roleID] = []int{}
+	}
+
+	for _, value := range r.PostForm["grant"] {
+		roleStr, permissionStr, _ := strings.Cut(value, ":")
+		roleID, roleErr := strconv.Atoi(roleStr)
+		permissionID, permissionErr := strconv.Atoi(permissionStr)
+		if _, ok := grants[roleID]; roleErr != nil || permissionErr != nil || !ok {
+			return nil, errors.New("Invalid grant")
+		}
+		grants[roleID] = append(grants[roleID], permissionID)
+	}
+
+	return grants, nil
+}
+
+func (h *AdminHandler) renderRoles(w http.ResponseWriter, r *http.Request, status int, message string, isError bool) {
+	roles, err := h.db.GetAllRoles()
+	if err != nil {
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+	for i := range roles {
+		roles[i].Permissions, err = h.db.GetRolePermissions(roles[i].ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch role permissions", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	permissions, err := h.db.GetAllPermissions()
+	if err != nil {
+		http.Error(w, "Failed to fetch permissions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.AdminRoles(roles, permissions, h.getUserFromContext(r.Context()), message, isError).Render(r.Context(), w)
+}
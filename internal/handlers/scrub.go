@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/storage"
+	"log"
+	"time"
+)
+
+// ScrubFiles deletes the files released since the last scrub that no PDF
+// uses, then re-hashes the file of every PDF, records whether it still
+// matches the PDF's checksum and size, and returns the PDFs whose file is
+// missing or corrupt. PDFs uploaded before checksums were recorded take the
+// checksum of their file as it is now. Files shared by several PDFs are read
+// once, and files the blob store fails to read are left for the next scrub.
+func (h *LibraryHandler) ScrubFiles(ctx context.Context) ([]models.PDF, error) {
+	deleted, err := h.db.CollectReleasedBlobs(func(key string) error {
+		return h.store.Delete(ctx, key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete released files: %w", err)
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d files no PDF uses", deleted)
+	}
+
+	pdfs, err := h.db.GetAllPDFs()
+	if err != nil {
+		return nil, err
+	}
+
+	type blobHash struct {
+		checksum string
+		size     int64
+		err      error
+	}
+	hashes := make(map[string]blobHash)
+
+	var damaged []models.PDF
+	for _, pdf := range pdfs {
+		if err := ctx.Err(); err != nil {
+			return damaged, err
+		}
+
+		hash, ok := hashes[pdf.StorageKey]
+		if !ok {
+			hash.checksum, hash.size, hash.err = h.hashBlob(ctx, pdf.StorageKey)
+			hashes[pdf.StorageKey] = hash
+		}
+
+		status := models.ScrubOK
+		switch {
+		case errors.Is(hash.err, storage.ErrNotFound), errors.Is(hash.err, storage.ErrInvalidKey):
+			status = models.ScrubMissing
+		case hash.err != nil:
+			log.Printf("Failed to check the file of PDF %d: %v", pdf.ID, hash.err)
+			continue
+		case pdf.Checksum == "":
+			if err := h.db.SetPDFChecksum(pdf.ID, hash.checksum, hash.size); err != nil {
+				return damaged, err
+			}
+			pdf.Checksum, pdf.SizeBytes = hash.checksum, hash.size
+		case hash.checksum != pdf.Checksum || hash.size != pdf.SizeBytes:
+			status = models.ScrubCorrupt
+		}
+
+		now := time.Now()
+		if err := h.db.RecordPDFScrub(pdf.ID, status, now); err != nil {
+			return damaged, err
+		}
+		pdf.ScrubStatus, pdf.ScrubbedAt = status, &now
+
+		if status != models.ScrubOK {
+			log.Printf("The file of PDF %d (%q) is %s: %s", pdf.ID, pdf.Title, status, pdf.StorageKey)
+			damaged = append(damaged, pdf)
+		}
+	}
+
+	return damaged, nil
+}
+
+// hashBlob returns the SHA-256 checksum and size of a stored file.
+func (h *LibraryHandler) hashBlob(ctx context.Context, key string) (string, int64, error) {
+	blob, _, err := h.store.Get(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer blob.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, blob)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTokenNameLength limits the length of API token names.
+const maxTokenNameLength = 100
+
+// Tokens lists the current user's API tokens (GET) or creates a new one
+// (POST). A new token's secret is only shown in the response that creates
+// it.
+func (h *AuthHandler) Tokens(w http.ResponseWriter, r *http.Request) {
+	if !h.requireSession(w, r) {
+		return
+	}
+
+	if r.Method == "POST" {
+		h.createToken(w, r)
+		return
+	}
+
+	h.renderTokens(w, r, http.StatusOK, "", "", false)
+}
+
+func (h *AuthHandler) createToken(w http.ResponseWriter, r *http.Request) {
+	user := h.getUserFromContext(r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > maxTokenNameLength {
+		h.renderTokens(w, r, http.StatusBadRequest, "", "Give the token a name of up to 100 characters", true)
+		return
+	}
+
+	scopes := r.Form["scope"]
+	if len(scopes) == 0 {
+		h.renderTokens(w, r, http.StatusBadRequest, "", "Choose at least one scope", true)
+		return
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	days, err := strconv.Atoi(r.FormValue("expires_in_days"))
+	if err != nil || days < 0 {
+		h.renderTokens(w, r, http.StatusBadRequest, "", "Invalid expiry", true)
+		return
+	}
+	if days > 0 {
+		expiry := now.AddDate(0, 0, days)
+		expiresAt = &expiry
+	}
+
+	token := auth.GenerateAPIToken()
+	created, err := h.db.CreateAPIToken(user.ID, name, auth.HashToken(token), scopes, expiresAt, now)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidScope) {
+			h.renderTokens(w, r, http.StatusBadRequest, "", "Tokens can only be given permissions you have", true)
+			return
+		}
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(h.db, r, user, models.AuditTokenCreated, models.AuditTargetToken, created.ID, nil,
+		map[string]any{"name": name, "scopes": scopes, "expires_at": expiresAt})
+
+	h.renderTokens(w, r, http.StatusCreated, token, "Token created. Copy it now; it won't be shown again.", false)
+}
+
+// RevokeToken deletes one of the current user's API tokens.
+func (h *AuthHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	if !h.requireSession(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(r.FormValue("token_id"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	user := h.getUserFromContext(r.Context())
+	err = h.db.DeleteAPIToken(tokenID, user.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Token not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+	default:
+		recordAudit(h.db, r, user, models.AuditTokenRevoked, models.AuditTargetToken, tokenID, nil, nil)
+		h.renderTokens(w, r, http.StatusOK, "", "Token revoked", false)
+	}
+}
+
+func (h *AuthHandler) renderTokens(w http.ResponseWriter, r *http.Request, status int, newToken, message string, isError bool) {
+	user := h.getUserFromContext(r.Context())
+
+	tokens, err := h.db.GetUserAPITokens(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tokens", http.StatusInternalServerError)
+		return
+	}
+
+	permissions, err := h.db.GetUserPermissions(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch permissions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	templates.APITokens(tokens, permissions, newToken, user, message, isError, time.Now()).Render(r.Context(), w)
+}
+
+// requireSession writes an error and returns false if the request was
+// authenticated with an API token, so that a token can't be used to mint
+// tokens with other scopes.
+func (h *AuthHandler) requireSession(w http.ResponseWriter, r *http.Request) bool {
+	if h.getUserFromContext(r.Context()).TokenScopes != nil {
+		http.Error(w, "API tokens can only be managed after logging in", http.StatusForbidden)
+		return false
+	}
+	return true
+}
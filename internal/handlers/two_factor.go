@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/templates"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loginChallengeCookie holds the token of a login waiting for its second
+// factor.
+const loginChallengeCookie = "login_challenge"
+
+var (
+	// errTwoFactorSetupRequired is passed to unauthorized handlers for users
+	// whose role requires two-factor authentication they haven't set up.
+	errTwoFactorSetupRequired = errors.New("two-factor authentication must be set up")
+
+	errInvalidSecondFactor = errors.New("invalid two-factor code")
+)
+
+// checkSecondFactor checks a TOTP code or recovery code of a user with
+// two-factor authentication and uses it up, so that it can't be replayed.
+func checkSecondFactor(database *db.Database, user *models.User, code string, now time.Time) error {
+	code = strings.Join(strings.Fields(code), "")
+
+	if _, err := strconv.Atoi(code); err == nil && len(code) == 6 {
+		secret, err := database.GetTOTPSecret(user.ID)
+		if err != nil {
+			return err
+		}
+		step, ok := auth.ValidateTOTP(secret, code, now)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+		err = database.UseTOTPStep(user.ID, step)
+		if errors.Is(err, db.ErrTOTPCodeUsed) {
+			return errInvalidSecondFactor
+		}
+		return err
+	}
+
+	err := database.UseRecoveryCode(user.ID, auth.HashToken(auth.NormalizeRecoveryCode(code)), now)
+	if errors.Is(err, db.ErrInvalidRecoveryCode) {
+		return errInvalidSecondFactor
+	}
+	return err
+}
+
+// startLoginChallenge sends a user who passed the password check on to enter
+// their second factor.
+func (h *AuthHandler) startLoginChallenge(w http.ResponseWriter, r *http.Request, user *models.User) {
+	token := auth.GenerateToken()
+	if err := h.db.CreateLoginChallenge(user.ID, auth.HashToken(token), time.Now()); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/login/2fa",
+		MaxAge:   300,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/login/2fa")
+		w.WriteHeader(http.StatusOK)
+	} else {
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+	}
+}
+
+func clearLoginChallengeCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    "",
+		Path:     "/login/2fa",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// LoginTwoFactor is the second login step for users with two-factor
+// authentication. It shows the code form (GET) and checks a TOTP or
+// recovery code (POST) before starting the session.
+func (h *AuthHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	now := h.now()
+
+	var tokenHash string
+	userID, err := 0, db.ErrInvalidLoginChallenge
+	if cookie, cookieErr := r.Cookie(loginChallengeCookie); cookieErr == nil {
+		tokenHash = auth.HashToken(cookie.Value)
+		userID, err = h.db.GetLoginChallenge(tokenHash, now)
+	}
+	if errors.Is(err, db.ErrInvalidLoginChallenge) {
+		clearLoginChallengeCookie(w)
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Redirect", "/login")
+			w.WriteHeader(http.StatusOK)
+		} else {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		}
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check login", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "GET" {
+		templates.LoginTwoFactor().Render(r.Context(), w)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	ip := auth.ClientIP(r)
+	blockedUntil, err := h.db.LoginBlockedUntil(user.Username, ip, now)
+	if err != nil {
+		http.Error(w, "Failed to check login", http.StatusInternalServerError)
+		return
+	}
+	if !blockedUntil.IsZero() {
+		throttled := &loginThrottledError{until: blockedUntil}
+		throttled.setRetryAfter(w, now)
+		h.renderAuthErrorStatus(w, http.StatusTooManyRequests, throttled.message(now))
+		return
+	}
+
+	err = checkSecondFactor(h.db, user, r.FormValue("code"), now)
+	if errors.Is(err, errInvalidSecondFactor) {
+		if err := h.db.FailLoginChallenge(tokenHash); err != nil {
+			log.Printf("Failed to count a failed login challenge: %v", err)
+		}
+		if err := recordLoginFailure(h.db, r, user.Username, now); err != nil {
+			log.Printf("Failed to record a failed login of %q: %v", user.Username, err)
+		}
+		h.renderAuthError(w, "Invalid code")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check code", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.DeleteLoginChallenge(tokenHash, now); err != nil {
+		log.Printf("Failed to delete login challenge: %v", err)
+	}
+	clearLoginChallengeCookie(w)
+	h.completeLogin(w, r, user)
+}
+
+// TwoFactor is where users set up, use new recovery codes for, and turn off
+// two-factor authentication. Setting up takes two steps: "setup" creates a
+// secret to scan into an authenticator app, and "enable" turns it on once a
+// code from the app confirms it.
+func (h *AuthHandler) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Authenticated directly, since the middleware sends users who must set
+	// up two-factor authentication here
+	user, err := authenticate(h.db, h.sessionManager, r)
+	if err != nil {
+		redirectToLogin(w, r, err)
+		return
+	}
+	if !user.CanUseLibrary() {
+		redirectToLogin(w, r, errAccountInactive)
+		return
+	}
+	if user.TokenScopes != nil {
+		http.Error(w, "Two-factor authentication can only be managed after logging in", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		h.renderTwoFactor(w, r, http.StatusOK, user, nil, "", false)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	switch r.FormValue("action") {
+	case "setup":
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			http.Error(w, "Failed to create secret", http.StatusInternalServerError)
+			return
+		}
+		err = h.db.SetPendingTOTPSecret(user.ID, secret)
+		if errors.Is(err, db.ErrTwoFactorEnabled) {
+			h.renderTwoFactor(w, r, http.StatusConflict, user, nil, "Two-factor authentication is already on", true)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+			return
+		}
+		h.renderTwoFactor(w, r, http.StatusOK, user, nil, "", false)
+
+	case "enable":
+		secret, err := h.db.GetTOTPSecret(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch secret", http.StatusInternalServerError)
+			return
+		}
+		if secret == "" || user.HasTwoFactor() {
+			h.renderTwoFactor(w, r, http.StatusBadRequest, user, nil, "Start setting up two-factor authentication first", true)
+			return
+		}
+		step, ok := auth.ValidateTOTP(secret, r.FormValue("code"), now)
+		if !ok {
+			h.renderTwoFactor(w, r, http.StatusBadRequest, user, nil, "That code doesn't match. Check that your device's clock is right and try again.", true)
+			return
+		}
+
+		codes := auth.GenerateRecoveryCodes()
+		err = h.db.EnableTOTP(user.ID, step, hashRecoveryCodes(codes), now)
+		if errors.Is(err, db.ErrTwoFactorEnabled) {
+			h.renderTwoFactor(w, r, http.StatusConflict, user, nil, "Two-factor authentication is already on", true)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(h.db, r, user, models.AuditTwoFactorEnabled, models.AuditTargetUser, user.ID, nil, nil)
+		h.renderTwoFactor(w, r, http.StatusOK, user, codes, "Two-factor authentication is on.", false)
+
+	case "recovery-codes":
+		if !h.checkSettingsCode(w, r, user, now) {
+			return
+		}
+		codes := auth.GenerateRecoveryCodes()
+		if err := h.db.ReplaceRecoveryCodes(user.ID, hashRecoveryCodes(codes)); err != nil {
+			http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(h.db, r, user, models.AuditRecoveryCodes, models.AuditTargetUser, user.ID, nil, nil)
+		h.renderTwoFactor(w, r, http.StatusOK, user, codes, "Your old recovery codes no longer work.", false)
+
+	case "disable":
+		if user.RequiresTwoFactor() {
+			h.renderTwoFactor(w, r, http.StatusForbidden, user, nil, "Your role requires two-factor authentication", true)
+			return
+		}
+		if !h.checkSettingsCode(w, r, user, now) {
+			return
+		}
+		if err := h.db.DisableTOTP(user.ID); err != nil {
+			http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(h.db, r, user, models.AuditTwoFactorDisabled, models.AuditTargetUser, user.ID, nil, nil)
+		h.renderTwoFactor(w, r, http.StatusOK, user, nil, "Two-factor authentication is off.", false)
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+// checkSettingsCode checks the code that confirms a change to two-factor
+// settings, writing an error and returning false if it's wrong.
+func (h *AuthHandler) checkSettingsCode(w http.ResponseWriter, r *http.Request, user *models.User, now time.Time) bool {
+	if !user.HasTwoFactor() {
+		h.renderTwoFactor(w, r, http.StatusBadRequest, user, nil, "Two-factor authentication is off", true)
+		return false
+	}
+
+	err := checkSecondFactor(h.db, user, r.FormValue("code"), now)
+	if errors.Is(err, errInvalidSecondFactor) {
+		h.renderTwoFactor(w, r, http.StatusBadRequest, user, nil, "Invalid code", true)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to check code", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// TwoFactorQRCode serves the QR code of the secret a user is setting up.
+// Once two-factor authentication is on, the secret is no longer shown.
+func (h *AuthHandler) TwoFactorQRCode(w http.ResponseWriter, r *http.Request) {
+	user, err := authenticate(h.db, h.sessionManager, r)
+	if err != nil || user.TokenScopes != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := h.db.GetTOTPSecret(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch secret", http.StatusInternalServerError)
+		return
+	}
+	if secret == "" || user.HasTwoFactor() {
+		http.NotFound(w, r)
+		return
+	}
+
+	png, err := auth.TOTPQRCode(auth.TOTPURI(secret, user.Username))
+	if err != nil {
+		http.Error(w, "Failed to create QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+func (h *AuthHandler) renderTwoFactor(w http.ResponseWriter, r *http.Request, status int, user *models.User, recoveryCodes []string, message string, isError bool) {
+	// Reload, since the request may have changed the settings
+	user, err := h.db.GetUserWithRoles(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	var setupSecret, setupURI string
+	remaining := 0
+	if user.HasTwoFactor() {
+		remaining, err = h.db.CountRecoveryCodes(user.ID)
+	} else {
+		setupSecret, err = h.db.GetTOTPSecret(user.ID)
+		if setupSecret != "" {
+			setupURI = auth.TOTPURI(setupSecret, user.Username)
+		}
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Failed to fetch two-factor settings", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the identity provider's identities are shown; directory users
+	// are linked through identities too, but can't change them
+	var identities []models.UserIdentity
+	if h.ssoName() != "" {
+		linked, err := h.db.GetUserIdentities(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to fetch identities", http.StatusInternalServerError)
+			return
+		}
+		for _, identity := range linked {
+			if identity.Issuer == h.config.OIDC.IssuerURL {
+				identities = append(identities, identity)
+			}
+		}
+	}
+
+	w.WriteHeader(status)
+	templates.TwoFactorSettings(user, setupSecret, setupURI, recoveryCodes, remaining, identities, h.ssoName(), message, isError).Render(r.Context(), w)
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashToken(code)
+	}
+	return hashes
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"librarymanagementsystem/internal/pdftext"
+	"librarymanagementsystem/internal/scan"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultMaxUploadSize is the largest file that can be uploaded unless
+	// UploadConfig sets another limit.
+	DefaultMaxUploadSize = 32 << 20
+
+	// maxFormFieldSize limits the size of each of an upload form's other
+	// fields, and maxFormOverhead the size of all of them together.
+	maxFormFieldSize = 64 << 10
+	maxFormOverhead  = 1 << 20
+
+	// maxFilenameLength limits the length of sanitized file names.
+	maxFilenameLength = 100
+)
+
+// UploadConfig configures how uploaded files are received.
+type UploadConfig struct {
+	// MaxSize is the size of the largest file that can be uploaded, in
+	// bytes.
+	MaxSize int64
+	// QuarantineDir holds uploaded files until they have been checked and
+	// moved to the blob store. It defaults to the system's temporary
+	// directory.
+	QuarantineDir string
+	// Scanner scans uploaded files for malware before they leave
+	// quarantine. Files aren't scanned if it's nil.
+	Scanner scan.Scanner
+}
+
+// uploadError is an upload rejected for a reason that can be shown to the
+// user.
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// uploadErrorResponse returns the status and message to answer a failed
+// upload with.
+func uploadErrorResponse(err error) (int, string) {
+	var rejected *uploadError
+	if errors.As(err, &rejected) {
+		return rejected.status, rejected.message
+	}
+	return http.StatusInternalServerError, "Failed to receive upload"
+}
+
+// upload is a multipart form with a file. The file is kept in quarantine,
+// outside the blob store, until it has been checked.
+type upload struct {
+	form url.Values
+	// filename is the sanitized name of the file, or "" if the form didn't
+	// include one.
+	filename string
+	file     *os.File
+	size     int64
+}
+
+// receiveUpload reads a multipart form with a file in its "file" field. The
+// form is streamed rather than parsed into memory: the file is written to the
+// quarantine directory as it arrives, and the upload is rejected as soon as
+// it exceeds the size limit. The caller must close the upload to remove the
+// quarantined file.
+func (h *LibraryHandler) receiveUpload(w http.ResponseWriter, r *http.Request) (*upload, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, &uploadError{http.StatusBadRequest, "Expected a multipart form"}
+	}
+
+	limit := h.uploads.MaxSize + maxFormOverhead
+	if r.ContentLength > limit {
+		return nil, tooLargeError(h.uploads.MaxSize)
+	}
+	reader := multipart.NewReader(http.MaxBytesReader(w, r.Body, limit), params["boundary"])
+
+	u := &upload{form: url.Values{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			u.Close()
+			return nil, formError(err, h.uploads.MaxSize)
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			if u.file != nil {
+				u.Close()
+				return nil, &uploadError{http.StatusBadRequest, "Only one file can be uploaded at a time"}
+			}
+			u.filename = sanitizeFilename(part.FileName())
+			if err := u.quarantine(h.uploads, part); err != nil {
+				u.Close()
+				return nil, err
+			}
+			continue
+		}
+
+		// Browsers send an empty file field when no file was chosen
+		if part.FileName() != "" || part.FormName() == "" {
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				u.Close()
+				return nil, formError(err, h.uploads.MaxSize)
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		if err != nil {
+			u.Close()
+			return nil, formError(err, h.uploads.MaxSize)
+		}
+		if len(value) > maxFormFieldSize {
+			u.Close()
+			return nil, &uploadError{http.StatusBadRequest, fmt.Sprintf("The %s field is too long", part.FormName())}
+		}
+		u.form.Add(part.FormName(), string(value))
+	}
+
+	return u, nil
+}
+
+// quarantine writes the file being uploaded to the quarantine directory.
+func (u *upload) quarantine(config UploadConfig, src io.Reader) error {
+	if config.QuarantineDir != "" {
+		if err := os.MkdirAll(config.QuarantineDir, 0700); err != nil {
+			return fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+	}
+
+	file, err := os.CreateTemp(config.QuarantineDir, "upload-*.pdf")
+	if err != nil {
+		return fmt.Errorf("failed to create quarantine file: %w", err)
+	}
+	u.file = file
+
+	// Read one byte more than allowed to tell whether the file is too big
+	body := &bodyReader{r: io.LimitReader(src, config.MaxSize+1)}
+	u.size, err = io.Copy(file, body)
+	if body.err != nil {
+		return formError(body.err, config.MaxSize)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write quarantine file: %w", err)
+	}
+	if u.size > config.MaxSize {
+		return tooLargeError(config.MaxSize)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+// bodyReader records errors reading an upload form, to tell them apart from
+// failures to write the quarantined file.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// formError turns an error reading an upload form into an uploadError.
+func formError(err error, maxSize int64) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return tooLargeError(maxSize)
+	}
+	return &uploadError{http.StatusBadRequest, "Failed to read the upload form"}
+}
+
+// tooLargeError rejects an upload bigger than maxSize.
+func tooLargeError(maxSize int64) error {
+	return &uploadError{
+		http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("The file is larger than the upload limit of %s", formatSize(maxSize)),
+	}
+}
+
+// check validates the uploaded file as a readable, unencrypted PDF.
+func (u *upload) check() error {
+	err := pdftext.Validate(u.file, u.size)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pdftext.ErrNotPDF):
+		return &uploadError{http.StatusUnsupportedMediaType, "Only PDF files are allowed"}
+	case errors.Is(err, pdftext.ErrEncrypted):
+		return &uploadError{http.StatusUnprocessableEntity, "Encrypted or password-protected PDFs can't be uploaded"}
+	default:
+		return &uploadError{http.StatusUnprocessableEntity, fmt.Sprintf("The PDF is damaged and can't be read (%v)", err)}
+	}
+}
+
+// Close removes the quarantined file.
+func (u *upload) Close() error {
+	if u.file == nil {
+		return nil
+	}
+	u.file.Close()
+	return os.Remove(u.file.Name())
+}
+
+// sanitizeFilename reduces the name of an uploaded file to a base name of
+// letters, digits, dots, dashes and underscores ending in .pdf, since it's
+// shown to users and sent back when the file is downloaded.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if strings.HasSuffix(strings.ToLower(name), ".pdf") {
+		name = name[:len(name)-len(".pdf")]
+	}
+
+	var sanitized strings.Builder
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-':
+			sanitized.WriteRune(c)
+		case !strings.HasSuffix(sanitized.String(), "_"):
+			sanitized.WriteByte('_')
+		}
+	}
+
+	name = strings.Trim(sanitized.String(), "._-")
+	if len(name) > maxFilenameLength {
+		name = strings.TrimRight(name[:maxFilenameLength], "._-")
+	}
+	if name == "" {
+		name = "document"
+	}
+	return name + ".pdf"
+}
+
+// formatSize formats a size in bytes for people to read.
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20 && size%(1<<20) == 0:
+		return fmt.Sprintf("%d MB", size>>20)
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%d KB", size>>10)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes each message to its own .eml file in Dir instead of
+// sending it, and logs where it went. It is meant for local development,
+// where the files can be opened to follow links such as password resets.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{
+		Dir:  dir,
+		From: from,
+	}
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	if !validHeader(msg.To) || !validHeader(msg.Subject) {
+		return ErrInvalidHeader
+	}
+
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	path := filepath.Join(m.Dir, fmt.Sprintf("%d.eml", now.UnixNano()))
+	if err := os.WriteFile(path, format(m.From, msg, now), 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Wrote email %q for %s to %s", msg.Subject, msg.To, path)
+	return nil
+}
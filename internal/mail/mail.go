@@ -0,0 +1,40 @@
+// Package mail sends email notifications such as password reset links.
+package mail
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. SMTPMailer sends real email; FileMailer writes
+// messages to disk for local development and tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// format renders a message as a plain-text RFC 5322 email.
+func format(from string, msg Message, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader reports whether a value can go in a header without injecting
+// further headers.
+func validHeader(value string) bool {
+	return !strings.ContainsAny(value, "\r\n")
+}
@@ -1,25 +1,160 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// User statuses. Pending users registered while registration required
+// admin approval and haven't been approved yet.
+const (
+	UserActive  = "active"
+	UserPending = "pending"
+)
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	Roles        []Role    `json:"roles"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID              int        `json:"id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	PasswordHash    string     `json:"-"`
+	Roles           []Role     `json:"roles"`
+	CreatedAt       time.Time  `json:"created_at"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Status          string     `json:"status"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+
+	// TokenScopes limits the user's permissions to the scopes of the API
+	// token the request was authenticated with. It is nil for sessions.
+	TokenScopes []string `json:"-"`
+}
+
+func (u User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// CanUseLibrary reports whether the user has verified their email address
+// and their account is active. Other users can only log in to finish
+// verifying or to wait for approval.
+func (u User) CanUseLibrary() bool {
+	return u.IsEmailVerified() && u.Status == UserActive
+}
+
+// HasTwoFactor reports whether the user logs in with a TOTP code as well as
+// their password.
+func (u User) HasTwoFactor() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// RequiresTwoFactor reports whether one of the user's roles requires
+// two-factor authentication. Roles must be loaded.
+func (u User) RequiresTwoFactor() bool {
+	return slices.ContainsFunc(u.Roles, func(r Role) bool { return r.Require2FA })
+}
+
+// NeedsTwoFactorSetup reports whether the user's roles require two-factor
+// authentication they haven't set up yet.
+func (u User) NeedsTwoFactorSetup() bool {
+	return u.RequiresTwoFactor() && !u.HasTwoFactor()
 }
 
 type PDF struct {
-	ID          int       `json:"id"`
-	Title       string    `json:"title"`
-	Author      string    `json:"author"`
-	Description string    `json:"description"`
-	Filename    string    `json:"filename"`
-	FilePath    string    `json:"file_path"`
-	UploadedBy  int       `json:"uploaded_by"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                 int        `json:"id"`
+	Title              string     `json:"title"`
+	Author             string     `json:"author"`
+	Description        string     `json:"description"`
+	Filename           string     `json:"filename"`
+	StorageKey         string     `json:"storage_key"` // Key of the file in the blob store
+	Checksum           string     `json:"checksum"`    // Hex SHA-256 of the file; empty until first hashed
+	SizeBytes          int64      `json:"size_bytes"`
+	UploadedBy         int        `json:"uploaded_by"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	Version            int        `json:"version"`              // Incremented on every update, for detecting conflicting edits
+	MaxConcurrentLoans int        `json:"max_concurrent_loans"` // 0 means reading doesn't require a loan
+	Restricted         bool       `json:"restricted"`           // Only readable through the access list
+	ScrubStatus        string     `json:"scrub_status"`         // Result of the last integrity check
+	ScrubbedAt         *time.Time `json:"scrubbed_at"`
+}
+
+// Results of checking a PDF's file against its checksum. PDFs that haven't
+// been checked have an empty status.
+const (
+	ScrubOK      = "ok"
+	ScrubMissing = "missing" // The file isn't in the blob store
+	ScrubCorrupt = "corrupt" // The file doesn't match its checksum or size
+)
+
+// IsLendingControlled reports whether the PDF can only be read on loan.
+func (p PDF) IsLendingControlled() bool {
+	return p.MaxConcurrentLoans > 0
+}
+
+// Access list levels. Each level includes the ones before it.
+const (
+	PDFAccessRead   = "read"
+	PDFAccessEdit   = "edit"
+	PDFAccessDelete = "delete"
+)
+
+// PDFAccessLevels lists the access list levels, lowest first.
+var PDFAccessLevels = []string{PDFAccessRead, PDFAccessEdit, PDFAccessDelete}
+
+// PDFAccessIncludes reports whether the access level granted includes
+// wanted. An empty level grants nothing.
+func PDFAccessIncludes(granted, wanted string) bool {
+	return granted != "" && slices.Index(PDFAccessLevels, granted) >= slices.Index(PDFAccessLevels, wanted)
+}
+
+// PDFACLEntry grants a user or a role access to a PDF.
+type PDFACLEntry struct {
+	ID        int       `json:"id"`
+	PDFID     int       `json:"pdf_id"`
+	UserID    *int      `json:"user_id"`
+	Username  string    `json:"username,omitempty"`
+	RoleID    *int      `json:"role_id"`
+	RoleName  string    `json:"role_name,omitempty"`
+	Access    string    `json:"access"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PDFAccessControl is what a user may do with a PDF beyond reading it, and
+// for users who may manage its access list, the list itself.
+type PDFAccessControl struct {
+	CanEdit   bool
+	CanDelete bool
+	CanManage bool
+	Entries   []PDFACLEntry
+	Roles     []Role // Roles entries can be added for
+
+	Collections    []Collection // Collections the PDF is in
+	AllCollections []Collection // Collections the PDF can be added to
+}
+
+// Collection groups PDFs so that access can be granted to all of them with
+// one access list.
+type Collection struct {
+	ID        int                  `json:"id"`
+	Name      string               `json:"name"`
+	PDFs      []PDF                `json:"pdfs,omitempty"`
+	Entries   []CollectionACLEntry `json:"entries,omitempty"`
+	CreatedBy int                  `json:"created_by"`
+	CreatedAt time.Time            `json:"created_at"`
+}
+
+// CollectionACLEntry grants a user or a role access to every PDF in a
+// collection.
+type CollectionACLEntry struct {
+	ID           int       `json:"id"`
+	CollectionID int       `json:"collection_id"`
+	UserID       *int      `json:"user_id"`
+	Username     string    `json:"username,omitempty"`
+	RoleID       *int      `json:"role_id"`
+	RoleName     string    `json:"role_name,omitempty"`
+	Access       string    `json:"access"`
+	CreatedBy    int       `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type UserPDFAccess struct {
@@ -33,6 +168,8 @@ type Role struct {
 	ID          int          `json:"id"`
 	Name        string       `json:"name"`
 	Description string       `json:"description"`
+	Require2FA  bool         `json:"require_2fa"` // Members must use two-factor authentication
+	BuiltIn     bool         `json:"built_in"`    // Seeded role the application relies on; can't be renamed or deleted
 	Permissions []Permission `json:"permissions"`
 	CreatedAt   time.Time    `json:"created_at"`
 }
@@ -53,3 +190,342 @@ type UserRole struct {
 	AssignedAt time.Time `json:"assigned_at"`
 	AssignedBy *int      `json:"assigned_by"`
 }
+
+// PageMatch is a full-text search hit on a single page of a PDF.
+type PageMatch struct {
+	Page    int           `json:"page"`
+	Snippet []SnippetPart `json:"snippet"`
+}
+
+// SnippetPart is a fragment of a search snippet; Highlight marks the
+// fragments that matched the query.
+type SnippetPart struct {
+	Text      string `json:"text"`
+	Highlight bool   `json:"highlight"`
+}
+
+// Item is a physical title held by the library, such as a book. The
+// individual copies on the shelves are Copies.
+type Item struct {
+	ID              int       `json:"id"`
+	Title           string    `json:"title"`
+	Author          string    `json:"author"`
+	ISBN            string    `json:"isbn"`
+	Description     string    `json:"description"`
+	Copies          []Copy    `json:"copies,omitempty"`
+	TotalCopies     int       `json:"total_copies"`
+	AvailableCopies int       `json:"available_copies"`
+	WaitingHolds    int       `json:"waiting_holds"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Copy is a single circulating copy of an Item, identified by its barcode.
+type Copy struct {
+	ID            int       `json:"id"`
+	ItemID        int       `json:"item_id"`
+	Barcode       string    `json:"barcode"`
+	ShelfLocation string    `json:"shelf_location"`
+	Loan          *Loan     `json:"loan,omitempty"` // Active loan, if checked out
+	Hold          *Hold     `json:"hold,omitempty"` // Hold the copy is set aside for, if any
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type Loan struct {
+	ID           int        `json:"id"`
+	CopyID       int        `json:"copy_id"`
+	UserID       int        `json:"user_id"`
+	CheckedOutBy int        `json:"checked_out_by"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	DueAt        time.Time  `json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at"`
+	Renewals     int        `json:"renewals"`
+	ItemID       int        `json:"item_id"`
+	ItemTitle    string     `json:"item_title"`
+	Barcode      string     `json:"barcode"`
+	Username     string     `json:"username"`
+}
+
+// IsOverdue reports whether the loan is still out past its due date.
+func (l Loan) IsOverdue(now time.Time) bool {
+	return l.ReturnedAt == nil && now.After(l.DueAt)
+}
+
+// Hold statuses. A hold waits in its item's queue until a copy is returned,
+// is then ready for pickup until it expires, and is fulfilled when the
+// patron borrows the item.
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+)
+
+type Hold struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	ItemID    *int       `json:"item_id"` // Set for holds on physical items
+	PDFID     *int       `json:"pdf_id"`  // Set for holds on lending-controlled PDFs
+	CopyID    *int       `json:"copy_id"` // Copy set aside once the hold is ready
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadyAt   *time.Time `json:"ready_at"`
+	ExpiresAt *time.Time `json:"expires_at"` // Pickup deadline once the hold is ready
+	ClosedAt  *time.Time `json:"closed_at"`
+	Position  int        `json:"position"`   // Place in the queue while waiting, starting at 1
+	ItemTitle string     `json:"item_title"` // Title of the item or PDF
+	Barcode   string     `json:"barcode"`
+	Username  string     `json:"username"`
+}
+
+// IsActive reports whether the hold is still waiting or ready for pickup.
+func (h Hold) IsActive() bool {
+	return h.Status == HoldWaiting || h.Status == HoldReady
+}
+
+// DigitalLoan is a time-boxed loan of a lending-controlled PDF. The loan
+// ends when it's returned or its due time passes.
+type DigitalLoan struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	PDFID        int        `json:"pdf_id"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	DueAt        time.Time  `json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at"`
+	PDFTitle     string     `json:"pdf_title"`
+	Username     string     `json:"username"`
+}
+
+// IsActive reports whether the loan still grants access at now.
+func (l DigitalLoan) IsActive(now time.Time) bool {
+	return l.ReturnedAt == nil && now.Before(l.DueAt)
+}
+
+// PDFLending is the lending state of a PDF as seen by one user.
+type PDFLending struct {
+	Available int          `json:"available"` // Loans that can be started right now
+	Waiting   int          `json:"waiting"`   // Users waiting in the hold queue
+	Loan      *DigitalLoan `json:"loan"`      // The user's active loan
+	Hold      *Hold        `json:"hold"`      // The user's active hold
+}
+
+// FinePolicy sets how overdue loans are fined. Amounts are in cents.
+type FinePolicy struct {
+	PerDayCents         int `json:"per_day_cents"`
+	GraceDays           int `json:"grace_days"`            // Days late before fines start
+	MaxCents            int `json:"max_cents"`             // Cap per loan; 0 means no cap
+	BlockThresholdCents int `json:"block_threshold_cents"` // Balance above which checkouts are blocked
+}
+
+// FineFor returns the fine for an item due at dueAt and returned (or still
+// out) at end. Only whole days beyond the grace period are charged.
+func (p FinePolicy) FineFor(dueAt, end time.Time) int {
+	daysLate := int(end.Sub(dueAt) / (24 * time.Hour))
+	if daysLate <= p.GraceDays {
+		return 0
+	}
+
+	fine := (daysLate - p.GraceDays) * p.PerDayCents
+	if p.MaxCents > 0 && fine > p.MaxCents {
+		fine = p.MaxCents
+	}
+	return fine
+}
+
+// FineOverride replaces parts of the library-wide fine policy for a role.
+// Nil fields fall back to the library-wide value.
+type FineOverride struct {
+	RoleID      int    `json:"role_id"`
+	RoleName    string `json:"role_name"`
+	PerDayCents *int   `json:"per_day_cents"`
+	GraceDays   *int   `json:"grace_days"`
+	MaxCents    *int   `json:"max_cents"`
+}
+
+// Ledger entry kinds. Charges add to a user's balance; payments and waivers
+// reduce it.
+const (
+	LedgerCharge  = "charge"
+	LedgerPayment = "payment"
+	LedgerWaiver  = "waiver"
+)
+
+type LedgerEntry struct {
+	ID             int       `json:"id"`
+	UserID         int       `json:"user_id"`
+	LoanID         *int      `json:"loan_id"`
+	Kind           string    `json:"kind"`
+	AmountCents    int       `json:"amount_cents"`
+	Description    string    `json:"description"`
+	RecordedBy     *int      `json:"recorded_by"` // Staff member who recorded a payment or waiver
+	RecordedByName string    `json:"recorded_by_name"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// UserBalance is the outstanding fines balance of a user.
+type UserBalance struct {
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	BalanceCents int    `json:"balance_cents"`
+}
+
+// APIToken is a long-lived personal token for scripts and integrations. Its
+// scopes are permission names, and it can only be used for what both the
+// scopes and the owner's current roles allow.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"` // Nil if the token never expires
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func (t APIToken) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// Invitation lets someone register while registration is invite-only. It is
+// bound to the email address it was sent to.
+type Invitation struct {
+	ID          int        `json:"id"`
+	Email       string     `json:"email"`
+	InvitedBy   int        `json:"invited_by"`
+	InviterName string     `json:"inviter_name"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at"`
+}
+
+// Kinds of login failure counters and lockouts.
+const (
+	LockoutUsername = "username"
+	LockoutIP       = "ip"
+)
+
+// Lockout records that logins for a username or from an IP address were
+// blocked after too many failed attempts. Lockouts are kept after they end
+// as a record of attacks.
+type Lockout struct {
+	ID             int        `json:"id"`
+	Kind           string     `json:"kind"`
+	Subject        string     `json:"subject"`
+	IPAddress      string     `json:"ip_address"` // Address of the attempt that caused the lockout
+	Failures       int        `json:"failures"`
+	LockedAt       time.Time  `json:"locked_at"`
+	LockedUntil    time.Time  `json:"locked_until"`
+	UnlockedAt     *time.Time `json:"unlocked_at"`
+	UnlockedBy     *int       `json:"unlocked_by"`
+	UnlockedByName string     `json:"unlocked_by_name"`
+}
+
+// IsActive reports whether the lockout still blocks logins.
+func (l *Lockout) IsActive(now time.Time) bool {
+	return l.UnlockedAt == nil && now.Before(l.LockedUntil)
+}
+
+// UserIdentity links a user to their account at an OpenID Connect identity
+// provider, identified by the provider's issuer URL and the subject it gives
+// the account.
+type UserIdentity struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// OIDCState is what a login through an identity provider needs to remember
+// between sending the browser to the provider and its return.
+type OIDCState struct {
+	Nonce        string
+	CodeVerifier string // PKCE code verifier
+	LinkUserID   *int   // Set when a logged-in user is linking their account
+}
+
+// Audit event actions.
+const (
+	AuditLogin             = "login"
+	AuditLoginFailed       = "login_failed"
+	AuditLogout            = "logout"
+	AuditLockout           = "lockout"
+	AuditUnlock            = "unlock"
+	AuditPasswordReset     = "password_reset"
+	AuditPasswordSet       = "password_set"
+	AuditTwoFactorEnabled  = "2fa_enabled"
+	AuditTwoFactorDisabled = "2fa_disabled"
+	AuditRecoveryCodes     = "recovery_codes_regenerated"
+	AuditTokenCreated      = "token_created"
+	AuditTokenRevoked      = "token_revoked"
+	AuditUserApproved      = "user_approved"
+	AuditRoleAssigned      = "role_assigned"
+	AuditRoleRemoved       = "role_removed"
+	AuditRoleCreated       = "role_created"
+	AuditRoleUpdated       = "role_updated"
+	AuditRoleDeleted       = "role_deleted"
+	AuditRolePermissions   = "role_permissions_changed"
+	AuditRoleTwoFactor     = "role_2fa_changed"
+	AuditPDFUploaded       = "pdf_uploaded"
+	AuditPDFUpdated        = "pdf_updated"
+	AuditPDFDeleted        = "pdf_deleted"
+	AuditPDFAccessChanged  = "pdf_access_changed"
+	AuditUploadInfected    = "upload_infected"
+	AuditPDFInfected       = "pdf_infected"
+	AuditIdentityLinked    = "identity_linked"
+	AuditIdentityUnlinked  = "identity_unlinked"
+	AuditInvitationCreated = "invitation_created"
+	AuditFinePolicy        = "fine_policy_changed"
+	AuditFineOverride      = "fine_override_changed"
+	AuditFinePayment       = "fine_payment"
+	AuditFineWaiver        = "fine_waiver"
+	AuditCollectionCreated = "collection_created"
+	AuditCollectionDeleted = "collection_deleted"
+	AuditCollectionAccess  = "collection_access_changed"
+)
+
+// AuditActions lists every audit event action, for filtering the log.
+var AuditActions = []string{
+	AuditLogin, AuditLoginFailed, AuditLogout, AuditLockout, AuditUnlock,
+	AuditPasswordReset, AuditPasswordSet, AuditTwoFactorEnabled, AuditTwoFactorDisabled, AuditRecoveryCodes,
+	AuditTokenCreated, AuditTokenRevoked, AuditUserApproved,
+	AuditRoleAssigned, AuditRoleRemoved, AuditRoleCreated, AuditRoleUpdated, AuditRoleDeleted,
+	AuditRolePermissions, AuditRoleTwoFactor,
+	AuditPDFUploaded, AuditPDFUpdated, AuditPDFDeleted, AuditPDFAccessChanged,
+	AuditUploadInfected, AuditPDFInfected,
+	AuditIdentityLinked, AuditIdentityUnlinked,
+	AuditInvitationCreated, AuditFinePolicy, AuditFineOverride, AuditFinePayment, AuditFineWaiver,
+	AuditCollectionCreated, AuditCollectionDeleted, AuditCollectionAccess,
+}
+
+// Kinds of things audit events act on.
+const (
+	AuditTargetUser       = "user"
+	AuditTargetRole       = "role"
+	AuditTargetPDF        = "pdf"
+	AuditTargetLockout    = "lockout"
+	AuditTargetToken      = "token"
+	AuditTargetCollection = "collection"
+)
+
+// AuditEvent records an administrative or security event. Before and After
+// hold JSON snapshots of what the event changed, when it changed something.
+// Events are never changed or deleted once recorded.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	ActorID    *int            `json:"actor_id"`
+	ActorName  string          `json:"actor_name"` // The attempted username for failed logins
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   *int            `json:"target_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	IPAddress  string          `json:"ip_address"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
@@ -0,0 +1,65 @@
+package pdftext
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// ExtractPages returns the plain text of every page of the PDF at path, in
+// page order. Pages without extractable text (e.g. scanned images) are
+// returned as empty strings so that indexes still line up with page numbers.
+func ExtractPages(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PDF: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat PDF: %w", err)
+	}
+
+	return ExtractPagesFrom(f, info.Size())
+}
+
+// ExtractPagesFrom is like ExtractPages but reads the size bytes of the PDF
+// from src, such as an uploaded file that hasn't been saved to disk.
+func ExtractPagesFrom(src io.ReaderAt, size int64) (pages []string, err error) {
+	// The PDF reader panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			pages = nil
+			err = fmt.Errorf("failed to parse PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(src, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %w", err)
+	}
+
+	numPages := reader.NumPage()
+	pages = make([]string, 0, numPages)
+	for i := 1; i <= numPages; i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			pages = append(pages, "")
+			continue
+		}
+
+		// Font names are only unique within a page, so let the reader load
+		// each page's fonts itself
+		text, err := page.GetPlainText(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract text from page %d: %w", i, err)
+		}
+		pages = append(pages, strings.TrimSpace(text))
+	}
+
+	return pages, nil
+}
@@ -0,0 +1,77 @@
+package pdftext
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ledongthuc/pdf"
+)
+
+var (
+	// ErrNotPDF is returned by Validate for files that don't start with the
+	// %PDF- header.
+	ErrNotPDF = errors.New("not a PDF file")
+	// ErrEncrypted is returned by Validate for encrypted PDFs, which can't be
+	// indexed or checked.
+	ErrEncrypted = errors.New("PDF is encrypted")
+	// ErrMalformed is returned by Validate, wrapped with the details, for
+	// PDFs whose structure can't be read.
+	ErrMalformed = errors.New("malformed PDF")
+)
+
+// Validate checks that the size bytes in src are a PDF that can be read: it
+// must start with the %PDF- header, have a readable cross-reference table
+// and trailer, not be encrypted, and have at least one page, each of which
+// can be found in the page tree.
+func Validate(src io.ReaderAt, size int64) (err error) {
+	// The PDF reader panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrMalformed, r)
+		}
+	}()
+
+	header := make([]byte, 5)
+	if _, err := src.ReadAt(header, 0); err != nil || !bytes.Equal(header, []byte("%PDF-")) {
+		return ErrNotPDF
+	}
+
+	reader, err := pdf.NewReader(src, size)
+	if err != nil && (errors.Is(err, pdf.ErrInvalidPassword) || hasEncryptKey(src, size)) {
+		return ErrEncrypted
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	// PDFs encrypted with an empty password are opened anyway
+	if !reader.Trailer().Key("Encrypt").IsNull() {
+		return ErrEncrypted
+	}
+
+	numPages := reader.NumPage()
+	if numPages == 0 {
+		return fmt.Errorf("%w: no pages", ErrMalformed)
+	}
+	for i := 1; i <= numPages; i++ {
+		if reader.Page(i).V.IsNull() {
+			return fmt.Errorf("%w: page %d is missing", ErrMalformed, i)
+		}
+	}
+
+	return nil
+}
+
+// trailerSize is how much of the end of a PDF is searched for its trailer.
+const trailerSize = 4096
+
+// hasEncryptKey reports whether the end of a PDF, where its trailer is,
+// mentions an /Encrypt dictionary. It tells PDFs encrypted in ways the reader
+// doesn't support apart from damaged ones.
+func hasEncryptKey(src io.ReaderAt, size int64) bool {
+	offset := max(size-trailerSize, 0)
+	tail := make([]byte, size-offset)
+	n, _ := src.ReadAt(tail, offset)
+	return bytes.Contains(tail[:n], []byte("/Encrypt"))
+}
@@ -0,0 +1,154 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// clamdChunkSize is the size of the chunks files are streamed to clamd
+	// in.
+	clamdChunkSize = 64 << 10
+
+	// clamdTimeout limits how long a scan may take when the context has no
+	// deadline.
+	clamdTimeout = 5 * time.Minute
+)
+
+// errReadFile is returned by sendStream when the file being scanned can't be
+// read, as opposed to failures to send it.
+var errReadFile = errors.New("failed to read file")
+
+// ClamdScanner scans files with a ClamAV daemon, streaming them over its
+// INSTREAM command so that clamd doesn't need access to the files.
+type ClamdScanner struct {
+	network string
+	address string
+}
+
+// NewClamdScanner returns a scanner for the clamd listening at address,
+// either host:port for TCP or the path of a Unix socket, which may be
+// prefixed with unix:.
+func NewClamdScanner(address string) *ClamdScanner {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return &ClamdScanner{network: "unix", address: path}
+	}
+	if strings.HasPrefix(address, "/") {
+		return &ClamdScanner{network: "unix", address: address}
+	}
+	return &ClamdScanner{network: "tcp", address: address}
+}
+
+// Scan sends the contents of r to clamd and returns the name of the
+// signature it matched, if any.
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(clamdTimeout)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := sendStream(conn, r); err != nil {
+		// clamd stops reading and replies with an error when the stream
+		// exceeds its StreamMaxLength
+		if errors.Is(err, errReadFile) {
+			return "", err
+		}
+		if reply, replyErr := readReply(conn); replyErr == nil {
+			return parseReply(reply)
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// sendStream sends the INSTREAM command followed by the contents of r, as
+// chunks prefixed with their length and ended by an empty chunk.
+func sendStream(conn net.Conn, r io.Reader) error {
+	writer := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := writer.WriteString("zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("failed to send clamd command: %w", err)
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := binary.Write(writer, binary.BigEndian, uint32(n)); err != nil {
+				return fmt.Errorf("failed to send file to clamd: %w", err)
+			}
+			if _, err := writer.Write(chunk[:n]); err != nil {
+				return fmt.Errorf("failed to send file to clamd: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errReadFile, err)
+		}
+	}
+
+	if err := binary.Write(writer, binary.BigEndian, uint32(0)); err != nil {
+		return fmt.Errorf("failed to send file to clamd: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to send file to clamd: %w", err)
+	}
+	return nil
+}
+
+// readReply reads clamd's null-terminated reply.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// parseReply interprets clamd's reply to INSTREAM, such as "stream: OK",
+// "stream: Eicar-Test-Signature FOUND" or "INSTREAM size limit exceeded.
+// ERROR".
+func parseReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.HasSuffix(result, " ERROR"):
+		return "", fmt.Errorf("clamd failed to scan the file: %s", strings.TrimSuffix(result, " ERROR"))
+	default:
+		return "", fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
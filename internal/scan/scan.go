@@ -0,0 +1,16 @@
+// Package scan checks uploaded files for malware.
+package scan
+
+import (
+	"context"
+	"io"
+)
+
+// Scanner checks files for malware. ClamdScanner sends them to a ClamAV
+// daemon.
+type Scanner interface {
+	// Scan reads r to the end and returns the name of the malware found in
+	// it, or "" if it's clean. An error means the file couldn't be scanned,
+	// not that it's infected.
+	Scan(ctx context.Context, r io.Reader) (threat string, err error)
+}
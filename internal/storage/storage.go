@@ -0,0 +1,60 @@
+// Package storage keeps uploaded files in a blob store, either a directory on
+// the local filesystem or an S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when no blob is stored under a key.
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned for keys that aren't clean relative paths.
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores blobs under slash-separated keys. Uploaded PDFs are
+// stored by content, under keys such as "sha256/9f/9f86d081...", the file's
+// SHA-256 checksum prefixed with its first two hex digits. LocalStore keeps
+// them in a directory; S3Store keeps them in an S3-compatible bucket.
+type BlobStore interface {
+	// Put stores the size bytes read from r under key, replacing any blob
+	// already there. Readers never see a partly written blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Get opens the blob under key for streaming. The reader is seekable so
+	// that it can serve range requests, and must be closed.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, BlobInfo, error)
+
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+
+	// Delete removes the blob under key. Deleting a missing blob isn't an
+	// error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the blobs whose keys start with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// ValidKey reports whether key is a clean relative path that can't escape
+// the store, such as "a/b.pdf" but not "../b.pdf", "/b.pdf" or "a//b.pdf".
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return false
+	}
+	if path.Clean(key) != key {
+		return false
+	}
+	return key != "." && key != ".." && !strings.HasPrefix(key, "../")
+}
@@ -1,30 +1,92 @@
 package main
 
 import (
+	"context"
 	"librarymanagementsystem/internal/auth"
 	"librarymanagementsystem/internal/db"
 	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/scan"
+	"librarymanagementsystem/internal/storage"
 	"librarymanagementsystem/templates"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	// Initialize database
 	database, err := db.NewDatabase("library.db")
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer database.Close()
+	if warning := database.SearchIndexWarning(); warning != "" {
+		log.Printf("WARNING: Full-text search is disabled: %s. Until then, search only matches titles, authors and descriptions.", warning)
+	}
+
+	// Encrypt TOTP secrets, including any stored before they were encrypted
+	database.SetSecretBox(newSecretBox())
+	if count, err := database.EncryptTOTPSecrets(); err != nil {
+		log.Fatal("Failed to encrypt TOTP secrets:", err)
+	} else if count > 0 {
+		log.Printf("Encrypted %d TOTP secrets stored in plaintext", count)
+	}
 
 	// Initialize session manager
-	sessionManager := auth.NewSessionManager()
+	sessionManager := auth.NewSessionManager(db.NewSessionStore(database))
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(database, sessionManager)
+	authConfig := handlers.AuthConfig{
+		BaseURL:          envOr("BASE_URL", "http://localhost:8009"),
+		RegistrationMode: envOr("REGISTRATION_MODE", handlers.RegistrationOpen),
+		AllowedDomains:   splitList(os.Getenv("REGISTRATION_DOMAINS")),
+		OIDC: handlers.OIDCConfig{
+			ProviderName: os.Getenv("OIDC_PROVIDER_NAME"),
+			IssuerURL:    os.Getenv("OIDC_ISSUER"),
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		},
+	}
+	authConfig.OIDC.RoleMapping, err = handlers.ParseRoleMapping(os.Getenv("OIDC_ROLE_MAPPING"))
+	if err != nil {
+		log.Fatal("Invalid single sign-on configuration:", err)
+	}
+	if err := authConfig.Validate(); err != nil {
+		log.Fatal("Invalid registration configuration:", err)
+	}
+	authenticator := newAuthenticator(database, authConfig)
+	authConfig.Authenticator = authenticator
+	authHandler := handlers.NewAuthHandler(database, sessionManager, newMailer(), authConfig)
 	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
 	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	circulationHandler := handlers.NewCirculationHandler(database, sessionManager)
+	apiHandler := handlers.NewAPIHandler(database, sessionManager)
+	apiHandler.SetAuthenticator(authenticator)
+	blobStore := newBlobStore()
+	libraryHandler.SetBlobStore(blobStore)
+	apiHandler.SetBlobStore(blobStore)
+	uploadConfig := newUploadConfig()
+	if uploadConfig.Scanner == nil {
+		log.Println("CLAMD_ADDR is not set; uploads won't be scanned for viruses")
+	}
+	libraryHandler.SetUploadConfig(uploadConfig)
+	apiHandler.SetUploadConfig(uploadConfig)
+
+	// Move uploads out of the public static tree
+	if err := libraryHandler.RelocateLegacyUploads(); err != nil {
+		log.Fatal("Failed to relocate legacy uploads:", err)
+	}
 
 	// Setup routes
 	mux := http.NewServeMux()
@@ -57,29 +119,269 @@ func main() {
 	mux.HandleFunc("/auth/login", authHandler.Login)
 	mux.HandleFunc("/auth/register", authHandler.Register)
 	mux.HandleFunc("/auth/logout", authHandler.Logout)
+	mux.HandleFunc("/forgot-password", authHandler.ForgotPassword)
+	mux.HandleFunc("/reset-password", authHandler.ResetPassword)
+	mux.HandleFunc("/verify-email", authHandler.VerifyEmail)
+	mux.HandleFunc("/account/pending", authHandler.AccountPending)
+	mux.HandleFunc("/account/2fa", authHandler.TwoFactor)
+	mux.HandleFunc("/account/2fa/qr", authHandler.TwoFactorQRCode)
+	mux.HandleFunc("/login/2fa", authHandler.LoginTwoFactor)
+	mux.HandleFunc("/tokens", authHandler.AuthMiddleware(authHandler.Tokens))
+	mux.HandleFunc("/tokens/revoke", authHandler.AuthMiddleware(authHandler.RevokeToken))
+
+	// Single sign-on routes
+	if authConfig.OIDC.Enabled() {
+		oidcHandler, err := handlers.NewOIDCHandler(context.Background(), authHandler)
+		if err != nil {
+			log.Fatal("Failed to set up single sign-on:", err)
+		}
+		mux.HandleFunc("/auth/oidc/login", oidcHandler.Login)
+		mux.HandleFunc("/auth/oidc/callback", oidcHandler.Callback)
+		mux.HandleFunc("/auth/oidc/link", authHandler.AuthMiddleware(oidcHandler.Link))
+		mux.HandleFunc("/account/sso/unlink", authHandler.AuthMiddleware(authHandler.UnlinkIdentity))
+	}
 
 	// Library routes (protected)
 	mux.HandleFunc("/library", libraryHandler.AuthMiddleware(libraryHandler.Index))
 	mux.HandleFunc("/library/search", libraryHandler.AuthMiddleware(libraryHandler.Search))
 	mux.HandleFunc("/library/view/", libraryHandler.AuthMiddleware(libraryHandler.ViewPDF))
+	mux.HandleFunc("/library/file/", libraryHandler.AuthMiddleware(libraryHandler.ServeFile))
 	mux.HandleFunc("/upload", libraryHandler.AuthMiddleware(libraryHandler.UploadForm))
 	mux.HandleFunc("/library/upload", libraryHandler.AuthMiddleware(libraryHandler.UploadPDF))
+	mux.HandleFunc("/library/edit/", libraryHandler.AuthMiddleware(libraryHandler.EditPDF))
 	mux.HandleFunc("/library/delete", libraryHandler.AuthMiddleware(libraryHandler.DeletePDF))
+	mux.HandleFunc("/library/access", libraryHandler.AuthMiddleware(libraryHandler.PDFAccess))
+	mux.HandleFunc("/library/collections", libraryHandler.AuthMiddleware(libraryHandler.Collections))
+	mux.HandleFunc("/library/borrow", libraryHandler.AuthMiddleware(libraryHandler.BorrowPDF))
+	mux.HandleFunc("/library/return", libraryHandler.AuthMiddleware(libraryHandler.ReturnPDF))
+	mux.HandleFunc("/library/hold", libraryHandler.AuthMiddleware(libraryHandler.PlacePDFHold))
+
+	// Physical item and circulation routes (protected)
+	mux.HandleFunc("/items", circulationHandler.AuthMiddleware(circulationHandler.Items))
+	mux.HandleFunc("/items/", circulationHandler.AuthMiddleware(circulationHandler.Item))
+	mux.HandleFunc("/loans", circulationHandler.AuthMiddleware(circulationHandler.MyLoans))
+	mux.HandleFunc("/holds", circulationHandler.AuthMiddleware(circulationHandler.Holds))
+	mux.HandleFunc("/holds/place", circulationHandler.AuthMiddleware(circulationHandler.PlaceHold))
+	mux.HandleFunc("/holds/cancel", circulationHandler.AuthMiddleware(circulationHandler.CancelHold))
+	mux.HandleFunc("/fines", circulationHandler.AuthMiddleware(circulationHandler.MyFines))
+	mux.HandleFunc("/circulation", circulationHandler.AuthMiddleware(circulationHandler.Desk))
+	mux.HandleFunc("/circulation/checkout", circulationHandler.AuthMiddleware(circulationHandler.CheckOut))
+	mux.HandleFunc("/circulation/checkin", circulationHandler.AuthMiddleware(circulationHandler.CheckIn))
+	mux.HandleFunc("/circulation/renew", circulationHandler.AuthMiddleware(circulationHandler.Renew))
+	mux.HandleFunc("/circulation/fines", circulationHandler.AuthMiddleware(circulationHandler.Fines))
+	mux.HandleFunc("/circulation/fines/", circulationHandler.AuthMiddleware(circulationHandler.PatronFines))
 
 	// Admin routes (protected)
 	mux.HandleFunc("/admin", adminHandler.AuthMiddleware(adminHandler.Index))
 	mux.HandleFunc("/admin/assign-role", adminHandler.AuthMiddleware(adminHandler.AssignRole))
 	mux.HandleFunc("/admin/remove-role", adminHandler.AuthMiddleware(adminHandler.RemoveRole))
+	mux.HandleFunc("/admin/set-password", adminHandler.AuthMiddleware(adminHandler.SetPassword))
+	mux.HandleFunc("/admin/approve", adminHandler.AuthMiddleware(adminHandler.Approve))
+	mux.HandleFunc("/admin/unlock", adminHandler.AuthMiddleware(adminHandler.Unlock))
+	mux.HandleFunc("/admin/roles", adminHandler.AuthMiddleware(adminHandler.Roles))
+	mux.HandleFunc("/admin/roles/2fa", adminHandler.AuthMiddleware(adminHandler.SetRoleTwoFactor))
+	mux.HandleFunc("/admin/audit", adminHandler.AuthMiddleware(adminHandler.Audit))
+	mux.HandleFunc("/admin/invite", authHandler.AuthMiddleware(authHandler.Invite))
+
+	// JSON API
+	mux.HandleFunc("/api/v1/auth/login", apiHandler.Login)
+	mux.HandleFunc("/api/v1/auth/logout", apiHandler.AuthMiddleware(apiHandler.Logout))
+	mux.HandleFunc("/api/v1/pdfs", apiHandler.AuthMiddleware(apiHandler.PDFs))
+	mux.HandleFunc("/api/v1/pdfs/search", apiHandler.AuthMiddleware(apiHandler.SearchPDFs))
+	mux.HandleFunc("/api/v1/pdfs/", apiHandler.AuthMiddleware(apiHandler.PDF))
+	mux.HandleFunc("/api/v1/users", apiHandler.AuthMiddleware(apiHandler.Users))
+	mux.HandleFunc("/api/v1/users/me", apiHandler.AuthMiddleware(apiHandler.Me))
+	mux.HandleFunc("/api/v1/users/", apiHandler.AuthMiddleware(apiHandler.User))
+	mux.HandleFunc("/api/v1/roles", apiHandler.AuthMiddleware(apiHandler.Roles))
+	mux.HandleFunc("/api/v1/roles/", apiHandler.AuthMiddleware(apiHandler.Role))
+	mux.HandleFunc("/api/v1/permissions", apiHandler.AuthMiddleware(apiHandler.Permissions))
+	mux.HandleFunc("/api/v1/", apiHandler.NotFound)
 
 	// Start session cleanup goroutine
 	go func() {
 		for {
 			time.Sleep(1 * time.Hour)
-			sessionManager.CleanupExpiredSessions()
+			if err := sessionManager.CleanupExpiredSessions(); err != nil {
+				log.Println("Failed to clean up expired sessions:", err)
+			}
+		}
+	}()
+
+	// Forget login failure counters that no longer block anything
+	go func() {
+		for {
+			time.Sleep(1 * time.Hour)
+			if _, err := database.PruneLoginFailures(time.Now()); err != nil {
+				log.Println("Failed to prune login failures:", err)
+			}
+		}
+	}()
+
+	// Expire holds that weren't picked up in time
+	go func() {
+		for {
+			time.Sleep(1 * time.Hour)
+			if _, err := database.ExpireHolds(time.Now()); err != nil {
+				log.Println("Failed to expire holds:", err)
+			}
+		}
+	}()
+
+	// End digital loans that are due and pass them on to waiting holds
+	go func() {
+		for {
+			time.Sleep(1 * time.Hour)
+			if _, err := database.ExpireDigitalLoans(time.Now()); err != nil {
+				log.Println("Failed to expire digital loans:", err)
+			}
+		}
+	}()
+
+	// Charge fines for overdue loans
+	go func() {
+		for {
+			time.Sleep(1 * time.Hour)
+			if _, err := database.AssessFines(time.Now()); err != nil {
+				log.Println("Failed to assess fines:", err)
+			}
+		}
+	}()
+
+	// Check stored files against their checksums
+	go func() {
+		for {
+			time.Sleep(24 * time.Hour)
+			if _, err := libraryHandler.ScrubFiles(context.Background()); err != nil {
+				log.Println("Failed to scrub files:", err)
+			}
 		}
 	}()
 
 	// Start server
 	log.Println("Server starting on :8009")
-	log.Fatal(http.ListenAndServe(":8009", mux))
+	log.Fatal(http.ListenAndServe(":8009", handlers.CSRFMiddleware(mux)))
+}
+
+// newMailer sends email through the SMTP server in SMTP_ADDR, or writes it to
+// the mail/ directory when no server is configured.
+func newMailer() mail.Mailer {
+	from := envOr("MAIL_FROM", "library@localhost")
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return mail.NewSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+	log.Println("SMTP_ADDR is not set; writing emails to mail/")
+	return mail.NewFileMailer("mail", from)
+}
+
+// newSecretBox encrypts secrets stored in the database with the
+// base64-encoded 32-byte key in ENCRYPTION_KEY, or the key in
+// ENCRYPTION_KEY_FILE, which is created with a new key if it doesn't exist.
+// The key must be kept, and kept apart from database backups: without it,
+// users can't log in with two-factor authentication.
+func newSecretBox() *auth.SecretBox {
+	var key []byte
+	var err error
+	if encoded := os.Getenv("ENCRYPTION_KEY"); encoded != "" {
+		key, err = auth.ParseSecretKey(encoded)
+	} else {
+		key, err = auth.LoadOrCreateSecretKey(envOr("ENCRYPTION_KEY_FILE", "encryption.key"))
+	}
+	if err != nil {
+		log.Fatal("Invalid encryption key:", err)
+	}
+	box, err := auth.NewSecretBox(key)
+	if err != nil {
+		log.Fatal("Invalid encryption key:", err)
+	}
+	return box
+}
+
+// newBlobStore stores uploaded files in the S3-compatible bucket S3_BUCKET,
+// or in the uploads/ directory when no bucket is configured.
+func newBlobStore() storage.BlobStore {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return storage.NewLocalStore("uploads")
+	}
+
+	region := envOr("S3_REGION", "us-east-1")
+	store, err := storage.NewS3Store(storage.S3Config{
+		Endpoint:        envOr("S3_ENDPOINT", "https://s3."+region+".amazonaws.com"),
+		Bucket:          bucket,
+		Region:          region,
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+	})
+	if err != nil {
+		log.Fatal("Invalid S3 configuration:", err)
+	}
+	return store
+}
+
+// newUploadConfig accepts uploads of up to MAX_UPLOAD_SIZE_MB megabytes, and
+// quarantines them in QUARANTINE_DIR while they're checked and scanned by the
+// clamd at CLAMD_ADDR, if set.
+func newUploadConfig() handlers.UploadConfig {
+	config := handlers.UploadConfig{
+		MaxSize:       handlers.DefaultMaxUploadSize,
+		QuarantineDir: envOr("QUARANTINE_DIR", "quarantine"),
+	}
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		config.Scanner = scan.NewClamdScanner(addr)
+	}
+	if value := os.Getenv("MAX_UPLOAD_SIZE_MB"); value != "" {
+		megabytes, err := strconv.Atoi(value)
+		if err != nil || megabytes < 1 {
+			log.Fatal("Invalid MAX_UPLOAD_SIZE_MB: ", value)
+		}
+		config.MaxSize = int64(megabytes) << 20
+	}
+	return config
+}
+
+// newAuthenticator checks passwords against the LDAP directory in LDAP_URL
+// and then the passwords stored in the database, or only the stored passwords
+// when no directory is configured. Directory users get a local user at their
+// first login as config's registration mode allows.
+func newAuthenticator(database *db.Database, config handlers.AuthConfig) handlers.Authenticator {
+	passwords := handlers.NewPasswordAuthenticator(database)
+	if os.Getenv("LDAP_URL") == "" {
+		return passwords
+	}
+
+	roleMapping, err := handlers.ParseRoleMapping(os.Getenv("LDAP_ROLE_MAPPING"))
+	if err != nil {
+		log.Fatal("Invalid LDAP configuration:", err)
+	}
+	directory := auth.NewLDAPDirectory(auth.LDAPConfig{
+		URL:            os.Getenv("LDAP_URL"),
+		StartTLS:       os.Getenv("LDAP_START_TLS") == "true",
+		BindDN:         os.Getenv("LDAP_BIND_DN"),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         os.Getenv("LDAP_BASE_DN"),
+		UserFilter:     os.Getenv("LDAP_USER_FILTER"),
+		EmailAttribute: os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		GroupBaseDN:    os.Getenv("LDAP_GROUP_BASE_DN"),
+		GroupFilter:    os.Getenv("LDAP_GROUP_FILTER"),
+		GroupAttribute: os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+	})
+	return handlers.Authenticators{handlers.NewLDAPAuthenticator(database, directory, roleMapping, config), passwords}
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated list, dropping blank entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -24,7 +24,7 @@ echo "🔨 Generating templates..."
 templ generate
 
 echo "🏗️  Building application..."
-go build .
+go build -tags sqlite_fts5 .
 
 echo "🎉 Ready to run!"
 echo ""
@@ -32,7 +32,7 @@ echo "To start the server:"
 echo "  ./librarymanagementsystem"
 echo ""
 echo "Or run directly with:"
-echo "  go run ."
+echo "  go run -tags sqlite_fts5 ."
 echo ""
 echo "Then open http://localhost:8080 in your browser"
 echo "=========================================="
\ No newline at end of file
@@ -0,0 +1,307 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/scan"
+	"librarymanagementsystem/internal/storage"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSignature marks test files as infected, like the EICAR test file
+const testSignature = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+
+// fakeClamd is a stand-in for clamd that speaks its INSTREAM protocol and
+// finds testSignature in files
+type fakeClamd struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// scanned holds the files received, in order
+	scanned [][]byte
+	// maxStream makes streams over this size fail, like StreamMaxLength
+	maxStream int
+}
+
+// newFakeClamd starts a fake clamd on a local TCP port
+func newFakeClamd(t *testing.T) *fakeClamd {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	clamd := &fakeClamd{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go clamd.serve(conn)
+		}
+	}()
+	return clamd
+}
+
+func (c *fakeClamd) address() string {
+	return c.listener.Addr().String()
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	command, err := reader.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var file []byte
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return
+		}
+		file = append(file, chunk...)
+
+		c.mu.Lock()
+		tooLarge := c.maxStream > 0 && len(file) > c.maxStream
+		c.mu.Unlock()
+		if tooLarge {
+			// Drain the rest so that closing doesn't reset the connection
+			// before the client reads the reply
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			io.Copy(io.Discard, reader)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	c.scanned = append(c.scanned, file)
+	c.mu.Unlock()
+
+	if bytes.Contains(file, []byte(testSignature)) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+// TestClamdScanner tests scanning files over the clamd INSTREAM protocol
+func TestClamdScanner(t *testing.T) {
+	clamd := newFakeClamd(t)
+	scanner := scan.NewClamdScanner(clamd.address())
+	ctx := context.Background()
+
+	threat, err := scanner.Scan(ctx, strings.NewReader("a clean file"))
+	require.NoError(t, err)
+	assert.Empty(t, threat)
+
+	threat, err = scanner.Scan(ctx, strings.NewReader("infected with "+testSignature))
+	require.NoError(t, err)
+	assert.Equal(t, "Eicar-Test-Signature", threat)
+
+	// Large files are streamed in several chunks
+	large := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	threat, err = scanner.Scan(ctx, bytes.NewReader(large))
+	require.NoError(t, err)
+	assert.Empty(t, threat)
+	clamd.mu.Lock()
+	assert.Equal(t, large, clamd.scanned[len(clamd.scanned)-1])
+	clamd.maxStream = 100 << 10
+	clamd.mu.Unlock()
+
+	_, err = scanner.Scan(ctx, bytes.NewReader(large))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "INSTREAM size limit exceeded")
+
+	t.Run("Unix sockets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "clamd.sock")
+		listener, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				(&fakeClamd{}).serve(conn)
+			}
+		}()
+
+		threat, err := scan.NewClamdScanner("unix:"+path).Scan(ctx, strings.NewReader(testSignature))
+		require.NoError(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", threat)
+	})
+
+	t.Run("Unreachable daemon", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+
+		_, err = scan.NewClamdScanner(address).Scan(ctx, strings.NewReader("a clean file"))
+		assert.Error(t, err)
+	})
+}
+
+// TestUploadVirusScan tests that uploads stay in quarantine until the scanner finds them clean
+func TestUploadVirusScan(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	clamd := newFakeClamd(t)
+	quarantine := filepath.Join(dir, "quarantine")
+	store := storage.NewLocalStore(filepath.Join(dir, "uploads"))
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(store)
+	libraryHandler.SetUploadConfig(handlers.UploadConfig{
+		MaxSize:       handlers.DefaultMaxUploadSize,
+		QuarantineDir: quarantine,
+		Scanner:       scan.NewClamdScanner(clamd.address()),
+	})
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	session, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	clean := testPDF("A clean book")
+	w := uploadPDF(t, libraryHandler, session, "Clean", "clean.pdf", string(clean))
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	clamd.mu.Lock()
+	require.Len(t, clamd.scanned, 1)
+	assert.Equal(t, clean, clamd.scanned[0])
+	clamd.mu.Unlock()
+
+	pdfs, err := database.GetAllPDFs()
+	require.NoError(t, err)
+	require.Len(t, pdfs, 1)
+	stored, err := os.ReadFile(filepath.Join(dir, "uploads", filepath.FromSlash(pdfs[0].StorageKey)))
+	require.NoError(t, err)
+	assert.Equal(t, clean, stored, "scanning doesn't consume the file")
+
+	t.Run("Infected uploads are rejected and audited", func(t *testing.T) {
+		w := uploadPDF(t, libraryHandler, session, "Infected", "infected.pdf", string(testPDF(testSignature)))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "contains malware (Eicar-Test-Signature)")
+
+		pdfs, err := database.GetAllPDFs()
+		require.NoError(t, err)
+		assert.Len(t, pdfs, 1)
+		quarantined, err := os.ReadDir(quarantine)
+		require.NoError(t, err)
+		assert.Empty(t, quarantined)
+
+		events, _, err := database.GetAuditEvents(db.AuditFilter{Action: models.AuditUploadInfected}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "admin", events[0].ActorName)
+		assert.Contains(t, string(events[0].After), `"threat":"Eicar-Test-Signature"`)
+		assert.Contains(t, string(events[0].After), `"filename":"infected.pdf"`)
+	})
+
+	t.Run("Uploads are refused while the scanner is down", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+		libraryHandler.SetUploadConfig(handlers.UploadConfig{
+			MaxSize:       handlers.DefaultMaxUploadSize,
+			QuarantineDir: quarantine,
+			Scanner:       scan.NewClamdScanner(address),
+		})
+
+		w := uploadPDF(t, libraryHandler, session, "Unscanned", "unscanned.pdf", string(testPDF("Unscanned")))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		pdfs, err := database.GetAllPDFs()
+		require.NoError(t, err)
+		assert.Len(t, pdfs, 1)
+	})
+}
+
+// TestRescanFiles tests scanning the files already in the catalog
+func TestRescanFiles(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	ctx := context.Background()
+	clamd := newFakeClamd(t)
+	store := storage.NewLocalStore(filepath.Join(dir, "uploads"))
+	libraryHandler := handlers.NewLibraryHandler(database, nil)
+	libraryHandler.SetBlobStore(store)
+
+	_, err = libraryHandler.RescanFiles(ctx)
+	assert.Error(t, err, "rescanning needs a scanner")
+
+	libraryHandler.SetUploadConfig(handlers.UploadConfig{
+		MaxSize: handlers.DefaultMaxUploadSize,
+		Scanner: scan.NewClamdScanner(clamd.address()),
+	})
+
+	require.NoError(t, database.CreateUser("librarian", "librarian@example.com", "hash"))
+	user, err := database.GetUserByUsername("librarian")
+	require.NoError(t, err)
+
+	// Files uploaded before scanning was set up; two PDFs share the infected one
+	put := func(key, content string) {
+		require.NoError(t, store.Put(ctx, key, strings.NewReader(content), int64(len(content))))
+	}
+	put("clean.pdf", "a clean book")
+	put("infected.pdf", "a book with "+testSignature)
+	cleanID, err := database.CreatePDF("Clean", "", "", "1_clean.pdf", "clean.pdf", user.ID)
+	require.NoError(t, err)
+	infectedID, err := database.CreatePDF("Infected", "", "", "1_infected.pdf", "infected.pdf", user.ID)
+	require.NoError(t, err)
+	copyID, err := database.CreatePDF("Infected Copy", "", "", "1_copy.pdf", "infected.pdf", user.ID)
+	require.NoError(t, err)
+	_, err = database.CreatePDF("Missing", "", "", "1_missing.pdf", "missing.pdf", user.ID)
+	require.NoError(t, err)
+
+	infected, err := libraryHandler.RescanFiles(ctx)
+	require.NoError(t, err)
+	require.Len(t, infected, 2)
+	var ids []int
+	for _, pdf := range infected {
+		ids = append(ids, pdf.PDF.ID)
+		assert.Equal(t, "Eicar-Test-Signature", pdf.Threat)
+	}
+	assert.ElementsMatch(t, []int{infectedID, copyID}, ids)
+	assert.NotContains(t, ids, cleanID)
+
+	clamd.mu.Lock()
+	assert.Len(t, clamd.scanned, 2, "shared files are scanned once")
+	clamd.mu.Unlock()
+
+	events, _, err := database.GetAuditEvents(db.AuditFilter{Action: models.AuditPDFInfected, TargetType: models.AuditTargetPDF, TargetID: &infectedID}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Nil(t, events[0].ActorID)
+	assert.Contains(t, string(events[0].After), `"threat":"Eicar-Test-Signature"`)
+}
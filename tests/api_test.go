@@ -0,0 +1,352 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type apiTestServer struct {
+	database       *db.Database
+	sessionManager *auth.SessionManager
+	mux            *http.ServeMux
+}
+
+func newAPITestServer(t *testing.T) *apiTestServer {
+	t.Helper()
+
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	api := handlers.NewAPIHandler(database, sessionManager)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/auth/login", api.Login)
+	mux.HandleFunc("/api/v1/auth/logout", api.AuthMiddleware(api.Logout))
+	mux.HandleFunc("/api/v1/pdfs", api.AuthMiddleware(api.PDFs))
+	mux.HandleFunc("/api/v1/pdfs/search", api.AuthMiddleware(api.SearchPDFs))
+	mux.HandleFunc("/api/v1/pdfs/", api.AuthMiddleware(api.PDF))
+	mux.HandleFunc("/api/v1/users", api.AuthMiddleware(api.Users))
+	mux.HandleFunc("/api/v1/users/me", api.AuthMiddleware(api.Me))
+	mux.HandleFunc("/api/v1/users/", api.AuthMiddleware(api.User))
+	mux.HandleFunc("/api/v1/roles", api.AuthMiddleware(api.Roles))
+	mux.HandleFunc("/api/v1/roles/", api.AuthMiddleware(api.Role))
+	mux.HandleFunc("/api/v1/permissions", api.AuthMiddleware(api.Permissions))
+	mux.HandleFunc("/api/v1/", api.NotFound)
+
+	return &apiTestServer{database: database, sessionManager: sessionManager, mux: mux}
+}
+
+// token creates a session for the user and returns its bearer token.
+func (s *apiTestServer) token(t *testing.T, user *models.User) string {
+	t.Helper()
+	token, err := s.sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	return token
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into a generic map.
+func (s *apiTestServer) do(t *testing.T, method, path, token string, body any) (int, map[string]any) {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+
+	var decoded map[string]any
+	if w.Body.Len() > 0 {
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &decoded))
+	}
+	return w.Code, decoded
+}
+
+func errorCode(response map[string]any) string {
+	envelope, _ := response["error"].(map[string]any)
+	code, _ := envelope["code"].(string)
+	return code
+}
+
+// TestAPIAuthentication tests logging in, bearer tokens and the error envelope for unauthenticated requests
+func TestAPIAuthentication(t *testing.T) {
+	server := newAPITestServer(t)
+
+	hash, err := auth.HashPassword("secret123")
+	require.NoError(t, err)
+	require.NoError(t, server.database.CreateUser("reader", "reader@example.com", hash))
+
+	status, body := server.do(t, "GET", "/api/v1/pdfs", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "unauthorized", errorCode(body))
+
+	status, body = server.do(t, "POST", "/api/v1/auth/login", "", map[string]string{"username": "reader", "password": "wrong"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "unauthorized", errorCode(body))
+
+	status, body = server.do(t, "POST", "/api/v1/auth/login", "", map[string]string{"username": "reader", "password": "secret123", "extra": "x"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "bad_request", errorCode(body))
+
+	status, body = server.do(t, "POST", "/api/v1/auth/login", "", map[string]string{"username": "reader", "password": "secret123"})
+	require.Equal(t, http.StatusOK, status)
+	data := body["data"].(map[string]any)
+	token := data["token"].(string)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, "reader", data["user"].(map[string]any)["username"])
+	assert.NotContains(t, data["user"], "password_hash")
+
+	status, body = server.do(t, "GET", "/api/v1/users/me", token, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "reader", body["data"].(map[string]any)["username"])
+
+	status, _ = server.do(t, "POST", "/api/v1/auth/logout", token, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+
+	status, body = server.do(t, "GET", "/api/v1/users/me", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "unauthorized", errorCode(body))
+
+	status, body = server.do(t, "GET", "/api/v1/unknown", "", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "not_found", errorCode(body))
+}
+
+// TestAPIPDFs tests listing, paginating, creating, updating and deleting PDFs through the API
+func TestAPIPDFs(t *testing.T) {
+	server := newAPITestServer(t)
+
+	admin := createUserWithRole(t, server.database, "admin", "admin")
+	reader := createUserWithRole(t, server.database, "reader", "user")
+	adminToken := server.token(t, admin)
+	readerToken := server.token(t, reader)
+
+	for i := 1; i <= 3; i++ {
+		_, err := server.database.CreatePDF(fmt.Sprintf("Book %d", i), "Author", "", "book.pdf", "book.pdf", admin.ID)
+		require.NoError(t, err)
+	}
+
+	t.Run("List is paginated", func(t *testing.T) {
+		status, body := server.do(t, "GET", "/api/v1/pdfs?per_page=2", readerToken, nil)
+		require.Equal(t, http.StatusOK, status)
+		assert.Len(t, body["data"], 2)
+		pagination := body["pagination"].(map[string]any)
+		assert.Equal(t, float64(1), pagination["page"])
+		assert.Equal(t, float64(3), pagination["total"])
+		assert.Equal(t, float64(2), pagination["total_pages"])
+
+		status, body = server.do(t, "GET", "/api/v1/pdfs?per_page=2&page=2", readerToken, nil)
+		require.Equal(t, http.StatusOK, status)
+		assert.Len(t, body["data"], 1)
+
+		status, body = server.do(t, "GET", "/api/v1/pdfs?page=3", readerToken, nil)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []any{}, body["data"])
+
+		status, body = server.do(t, "GET", "/api/v1/pdfs?per_page=1000", readerToken, nil)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "bad_request", errorCode(body))
+	})
+
+	pdfID, err := server.database.CreatePDF("Original", "Someone", "Old", "orig.pdf", "orig.pdf", admin.ID)
+	require.NoError(t, err)
+	pdf, err := server.database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	path := fmt.Sprintf("/api/v1/pdfs/%d", pdfID)
+
+	t.Run("Get", func(t *testing.T) {
+		status, body := server.do(t, "GET", path, readerToken, nil)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Original", body["data"].(map[string]any)["title"])
+
+		status, body = server.do(t, "GET", "/api/v1/pdfs/999999", readerToken, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+		assert.Equal(t, "not_found", errorCode(body))
+	})
+
+	t.Run("Update requires edit_pdf", func(t *testing.T) {
+		status, body := server.do(t, "PATCH", path, readerToken, map[string]any{"title": "Mine", "version": pdf.Version})
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, "forbidden", errorCode(body))
+	})
+
+	t.Run("Update changes only the given fields", func(t *testing.T) {
+		status, body := server.do(t, "PATCH", path, adminToken, map[string]any{"title": "Renamed", "version": pdf.Version})
+		require.Equal(t, http.StatusOK, status)
+		data := body["data"].(map[string]any)
+		assert.Equal(t, "Renamed", data["title"])
+		assert.Equal(t, "Someone", data["author"])
+
+		// The old version is now stale
+		status, body = server.do(t, "PATCH", path, adminToken, map[string]any{"title": "Again", "version": pdf.Version})
+		assert.Equal(t, http.StatusConflict, status)
+		assert.Equal(t, "conflict", errorCode(body))
+
+		status, body = server.do(t, "PATCH", path, adminToken, map[string]any{"title": "No Version"})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "bad_request", errorCode(body))
+	})
+
+	t.Run("Unsupported method", func(t *testing.T) {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		server.mux.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		assert.Contains(t, w.Header().Get("Allow"), "DELETE")
+	})
+
+	t.Run("Delete requires delete_pdf", func(t *testing.T) {
+		status, _ := server.do(t, "DELETE", path, readerToken, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		status, _ = server.do(t, "DELETE", path, adminToken, nil)
+		assert.Equal(t, http.StatusNoContent, status)
+
+		status, _ = server.do(t, "GET", path, adminToken, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
+
+// TestAPICreatePDF tests uploading a PDF through the API
+func TestAPICreatePDF(t *testing.T) {
+	t.Chdir(t.TempDir())
+	server := newAPITestServer(t)
+
+	admin := createUserWithRole(t, server.database, "admin", "admin")
+	guest := createUserWithRole(t, server.database, "guest", "")
+
+	upload := func(token string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		body.WriteString("--boundary\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nUploaded\r\n")
+		body.WriteString("--boundary\r\nContent-Disposition: form-data; name=\"file\"; filename=\"up.pdf\"\r\nContent-Type: application/pdf\r\n\r\n")
+		body.Write(testPDF("Uploaded"))
+		body.WriteString("\r\n")
+		body.WriteString("--boundary--\r\n")
+
+		req := httptest.NewRequest("POST", "/api/v1/pdfs", &body)
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := upload(server.token(t, guest))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = upload(server.token(t, admin))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var body struct {
+		Data models.PDF `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "Uploaded", body.Data.Title)
+	assert.Equal(t, fmt.Sprintf("/api/v1/pdfs/%d", body.Data.ID), w.Header().Get("Location"))
+	assert.True(t, strings.HasSuffix(body.Data.Filename, "up.pdf"))
+	assert.Len(t, body.Data.Checksum, 64)
+
+	// Uploading the same file again warns about the first upload
+	w = upload(server.token(t, admin))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var again struct {
+		Data     models.PDF `json:"data"`
+		Warnings []struct {
+			Code  string `json:"code"`
+			PDFID int    `json:"pdf_id"`
+		} `json:"warnings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &again))
+	assert.Equal(t, body.Data.StorageKey, again.Data.StorageKey)
+	require.Len(t, again.Warnings, 1)
+	assert.Equal(t, "duplicate", again.Warnings[0].Code)
+	assert.Equal(t, body.Data.ID, again.Warnings[0].PDFID)
+}
+
+// TestAPIUsersAndRoles tests the user, role and permission endpoints and role assignment
+func TestAPIUsersAndRoles(t *testing.T) {
+	server := newAPITestServer(t)
+
+	admin := createUserWithRole(t, server.database, "admin", "admin")
+	reader := createUserWithRole(t, server.database, "reader", "user")
+	adminToken := server.token(t, admin)
+	readerToken := server.token(t, reader)
+
+	for _, path := range []string{"/api/v1/users", "/api/v1/roles", "/api/v1/permissions", fmt.Sprintf("/api/v1/users/%d", admin.ID)} {
+		status, body := server.do(t, "GET", path, readerToken, nil)
+		assert.Equal(t, http.StatusForbidden, status, path)
+		assert.Equal(t, "forbidden", errorCode(body), path)
+	}
+
+	status, body := server.do(t, "GET", "/api/v1/users?per_page=1", adminToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Len(t, body["data"], 1)
+	assert.Equal(t, float64(2), body["pagination"].(map[string]any)["total"])
+
+	status, body = server.do(t, "GET", "/api/v1/permissions", adminToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, body["data"])
+
+	roles, err := server.database.GetAllRoles()
+	require.NoError(t, err)
+	var librarian models.Role
+	for _, role := range roles {
+		if role.Name == "librarian" {
+			librarian = role
+		}
+	}
+	require.NotZero(t, librarian.ID)
+
+	status, body = server.do(t, "GET", fmt.Sprintf("/api/v1/roles/%d", librarian.ID), adminToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "librarian", body["data"].(map[string]any)["name"])
+	assert.NotEmpty(t, body["data"].(map[string]any)["permissions"])
+
+	rolesPath := fmt.Sprintf("/api/v1/users/%d/roles", reader.ID)
+	status, body = server.do(t, "POST", rolesPath, adminToken, map[string]int{"role_id": 999999})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "bad_request", errorCode(body))
+
+	status, _ = server.do(t, "POST", rolesPath, adminToken, map[string]int{"role_id": librarian.ID})
+	require.Equal(t, http.StatusOK, status)
+	user, err := server.database.GetUserWithRoles(reader.ID)
+	require.NoError(t, err)
+	assert.Len(t, user.Roles, 2)
+
+	status, _ = server.do(t, "DELETE", fmt.Sprintf("%s/%d", rolesPath, librarian.ID), adminToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	user, err = server.database.GetUserWithRoles(reader.ID)
+	require.NoError(t, err)
+	assert.Len(t, user.Roles, 1)
+
+	status, _ = server.do(t, "GET", "/api/v1/users/999999", adminToken, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"database/sql"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAPITokens tests that API tokens authenticate requests and are limited to their scopes
+func TestAPITokens(t *testing.T) {
+	server := newAPITestServer(t)
+
+	admin := createUserWithRole(t, server.database, "admin", "admin")
+	reader := createUserWithRole(t, server.database, "reader", "user")
+
+	pdfID, err := server.database.CreatePDF("Book", "", "", "book.pdf", "book.pdf", admin.ID)
+	require.NoError(t, err)
+	pdf, err := server.database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	path := fmt.Sprintf("/api/v1/pdfs/%d", pdfID)
+
+	now := time.Now()
+
+	newToken := func(userID int, scopes []string, expiresAt *time.Time) string {
+		token := auth.GenerateAPIToken()
+		_, err := server.database.CreateAPIToken(userID, "test", auth.HashToken(token), scopes, expiresAt, now)
+		require.NoError(t, err)
+		return token
+	}
+
+	t.Run("Scopes must be permissions the user has", func(t *testing.T) {
+		_, err := server.database.CreateAPIToken(reader.ID, "test", auth.HashToken(auth.GenerateAPIToken()), []string{"edit_pdf"}, nil, now)
+		assert.ErrorIs(t, err, db.ErrInvalidScope)
+	})
+
+	t.Run("Token is limited to its scopes", func(t *testing.T) {
+		token := newToken(admin.ID, []string{"view_pdf"}, nil)
+
+		status, body := server.do(t, "GET", "/api/v1/users/me", token, nil)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "admin", body["data"].(map[string]any)["username"])
+
+		status, _ = server.do(t, "PATCH", path, token, map[string]any{"title": "Renamed", "version": pdf.Version})
+		assert.Equal(t, http.StatusForbidden, status)
+		status, _ = server.do(t, "GET", "/api/v1/users", token, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		tokens, err := server.database.GetUserAPITokens(admin.ID)
+		require.NoError(t, err)
+		require.NotEmpty(t, tokens)
+		assert.NotNil(t, tokens[0].LastUsedAt)
+	})
+
+	t.Run("Reading PDFs needs view_pdf", func(t *testing.T) {
+		paths := []string{"/api/v1/pdfs", "/api/v1/pdfs/search?q=book", path}
+
+		token := newToken(admin.ID, []string{"edit_pdf"}, nil)
+		for _, p := range paths {
+			status, _ := server.do(t, "GET", p, token, nil)
+			assert.Equal(t, http.StatusForbidden, status, "token without the view_pdf scope: GET %s", p)
+		}
+
+		guest := createUserWithRole(t, server.database, "guest", "")
+		roles, err := server.database.GetUserRoles(guest.ID)
+		require.NoError(t, err)
+		for _, role := range roles {
+			require.NoError(t, server.database.RemoveRole(guest.ID, role.ID))
+		}
+		session := server.token(t, guest)
+		for _, p := range paths {
+			status, _ := server.do(t, "GET", p, session, nil)
+			assert.Equal(t, http.StatusForbidden, status, "role without view_pdf: GET %s", p)
+		}
+
+		for _, p := range paths {
+			status, _ := server.do(t, "GET", p, server.token(t, reader), nil)
+			assert.Equal(t, http.StatusOK, status, "GET %s", p)
+		}
+	})
+
+	t.Run("Token loses permissions its owner loses", func(t *testing.T) {
+		editor := createUserWithRole(t, server.database, "editor", "admin")
+		token := newToken(editor.ID, []string{"edit_pdf"}, nil)
+
+		status, _ := server.do(t, "PATCH", path, token, map[string]any{"description": "Edited", "version": pdf.Version})
+		require.Equal(t, http.StatusOK, status)
+
+		roles, err := server.database.GetUserRoles(editor.ID)
+		require.NoError(t, err)
+		for _, role := range roles {
+			require.NoError(t, server.database.RemoveRole(editor.ID, role.ID))
+		}
+
+		pdf, err = server.database.GetPDFByID(pdfID)
+		require.NoError(t, err)
+		status, _ = server.do(t, "PATCH", path, token, map[string]any{"description": "Again", "version": pdf.Version})
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Expired and revoked tokens are rejected", func(t *testing.T) {
+		expiry := now.Add(-time.Minute)
+		expired := newToken(reader.ID, []string{"view_pdf"}, &expiry)
+		status, body := server.do(t, "GET", "/api/v1/users/me", expired, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "unauthorized", errorCode(body))
+
+		token := newToken(reader.ID, []string{"view_pdf"}, nil)
+		tokens, err := server.database.GetUserAPITokens(reader.ID)
+		require.NoError(t, err)
+		assert.ErrorIs(t, server.database.DeleteAPIToken(tokens[0].ID, admin.ID), sql.ErrNoRows)
+		require.NoError(t, server.database.DeleteAPIToken(tokens[0].ID, reader.ID))
+
+		status, _ = server.do(t, "GET", "/api/v1/users/me", token, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+}
+
+// TestTokensPage tests creating and revoking API tokens from the tokens page
+func TestTokensPage(t *testing.T) {
+	server := newAPITestServer(t)
+	authHandler := handlers.NewAuthHandler(server.database, server.sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+	tokens := authHandler.AuthMiddleware(authHandler.Tokens)
+	revoke := authHandler.AuthMiddleware(authHandler.RevokeToken)
+
+	user := createUserWithRole(t, server.database, "reader", "user")
+	session := server.token(t, user)
+
+	post := func(handler http.HandlerFunc, bearer string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/tokens", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(tokens, session, url.Values{"name": {"Too much"}, "expires_in_days": {"30"}, "scope": {"manage_roles"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post(tokens, session, url.Values{"name": {"Export"}, "expires_in_days": {"30"}, "scope": {"view_pdf"}})
+	require.Equal(t, http.StatusCreated, w.Code)
+	secret := regexp.MustCompile(regexp.QuoteMeta(auth.APITokenPrefix) + `[A-Za-z0-9_=-]+`).FindString(w.Body.String())
+	require.NotEmpty(t, secret)
+
+	created, err := server.database.GetUserAPITokens(user.ID)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	assert.Equal(t, "Export", created[0].Name)
+	assert.Equal(t, []string{"view_pdf"}, created[0].Scopes)
+	require.NotNil(t, created[0].ExpiresAt)
+
+	// A token can't be used to create more tokens
+	w = post(tokens, secret, url.Values{"name": {"Another"}, "expires_in_days": {"0"}, "scope": {"view_pdf"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = post(revoke, session, url.Values{"token_id": {fmt.Sprintf("%d", created[0].ID)}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	status, _ := server.do(t, "GET", "/api/v1/users/me", secret, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
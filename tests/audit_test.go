@@ -0,0 +1,349 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAuditLog tests that logins, role changes and PDF deletions are recorded in the append-only audit log
+func TestAuditLog(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "library.db")
+	database, err := db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+
+	hash, err := auth.HashPassword("correct1")
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", hash))
+	reader, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+	admin := createUserWithRole(t, database, "admin", "admin")
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	w := postForm(authHandler.Login, "/auth/login", url.Values{"username": {"Reader"}, "password": {"wrong"}}, "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = postForm(authHandler.Login, "/auth/login", url.Values{"username": {"reader"}, "password": {"correct1"}}, "")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+
+	librarian := findRole(t, database, "librarian")
+	form := url.Values{"user_id": {fmt.Sprint(reader.ID)}, "role_id": {fmt.Sprint(librarian.ID)}}
+	require.Equal(t, http.StatusSeeOther, postForm(adminHandler.AuthMiddleware(adminHandler.AssignRole), "/admin/assign-role", form, adminSession).Code)
+	require.Equal(t, http.StatusSeeOther, postForm(adminHandler.AuthMiddleware(adminHandler.RemoveRole), "/admin/remove-role", form, adminSession).Code)
+
+	pdfID, err := database.CreatePDF("Old Book", "", "", "1_old.pdf", "1_old.pdf", admin.ID)
+	require.NoError(t, err)
+	w = postForm(libraryHandler.AuthMiddleware(libraryHandler.DeletePDF), "/library/delete", url.Values{"pdf_id": {fmt.Sprint(pdfID)}}, adminSession)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+
+	t.Run("Logins", func(t *testing.T) {
+		events, total, err := database.GetAuditEvents(db.AuditFilter{Actor: "READER"}, 10, 0)
+		require.NoError(t, err)
+		require.Equal(t, 2, total)
+
+		// Newest first
+		assert.Equal(t, models.AuditLogin, events[0].Action)
+		require.NotNil(t, events[0].ActorID)
+		assert.Equal(t, reader.ID, *events[0].ActorID)
+		assert.Equal(t, "192.0.2.1", events[0].IPAddress)
+
+		assert.Equal(t, models.AuditLoginFailed, events[1].Action)
+		assert.Nil(t, events[1].ActorID, "failed logins only know the attempted username")
+		assert.Equal(t, "Reader", events[1].ActorName)
+	})
+
+	t.Run("Role changes", func(t *testing.T) {
+		events, _, err := database.GetAuditEvents(db.AuditFilter{TargetType: models.AuditTargetUser, TargetID: &reader.ID, Action: models.AuditRoleRemoved}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "admin", events[0].ActorName)
+		assert.JSONEq(t, fmt.Sprintf(`{"role_id": %d}`, librarian.ID), string(events[0].Before))
+		assert.Nil(t, events[0].After)
+	})
+
+	t.Run("PDF deletions", func(t *testing.T) {
+		events, _, err := database.GetAuditEvents(db.AuditFilter{Action: models.AuditPDFDeleted}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		var before models.PDF
+		require.NoError(t, json.Unmarshal(events[0].Before, &before))
+		assert.Equal(t, "Old Book", before.Title)
+	})
+
+	t.Run("Date filters", func(t *testing.T) {
+		_, total, err := database.GetAuditEvents(db.AuditFilter{Until: time.Now().Add(-time.Hour)}, 10, 0)
+		require.NoError(t, err)
+		assert.Zero(t, total)
+		_, total, err = database.GetAuditEvents(db.AuditFilter{Since: time.Now().Add(-time.Hour)}, 10, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 5, total)
+	})
+
+	t.Run("Append-only", func(t *testing.T) {
+		raw, err := sql.Open("sqlite3", dbPath)
+		require.NoError(t, err)
+		defer raw.Close()
+
+		_, err = raw.Exec(`UPDATE audit_events SET actor_name = 'someone else'`)
+		assert.ErrorContains(t, err, "append-only")
+		_, err = raw.Exec(`DELETE FROM audit_events`)
+		assert.ErrorContains(t, err, "append-only")
+	})
+}
+
+// TestAuditLogPage tests filtering, paging and exporting the audit log from the admin panel
+func TestAuditLogPage(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	audit := adminHandler.AuthMiddleware(adminHandler.Audit)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	reader := createUserWithRole(t, database, "reader", "user")
+
+	now := time.Now()
+	for i := 0; i < 60; i++ {
+		require.NoError(t, database.RecordAuditEvent(models.AuditEvent{
+			ActorID:   &admin.ID,
+			ActorName: admin.Username,
+			Action:    models.AuditUserApproved,
+			CreatedAt: now.Add(time.Duration(i) * time.Second),
+		}))
+	}
+	require.NoError(t, database.RecordAuditEvent(models.AuditEvent{ActorName: "mallory", Action: models.AuditLoginFailed, IPAddress: "198.51.100.7", CreatedAt: now}))
+
+	get := func(path string, user *models.User) *httptest.ResponseRecorder {
+		token, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		w := httptest.NewRecorder()
+		audit.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("/admin/audit", reader).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/admin/audit?action=nothing", admin).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/admin/audit?since=yesterday", admin).Code)
+
+	w := get("/admin/audit?action=user_approved&page=2", admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Page 2 of 2")
+	assert.NotContains(t, w.Body.String(), "mallory")
+
+	events, total, err := database.GetAuditEvents(db.AuditFilter{Action: models.AuditUserApproved}, 50, 50)
+	require.NoError(t, err)
+	assert.Equal(t, 60, total)
+	assert.Len(t, events, 10)
+
+	t.Run("CSV export", func(t *testing.T) {
+		w := get("/admin/audit?actor=mallory&format=csv", admin)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "audit-events.csv")
+		records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		assert.Equal(t, "actor_name", records[0][3])
+		assert.Equal(t, []string{"mallory", "login_failed"}, records[1][3:5])
+		assert.Equal(t, "198.51.100.7", records[1][9])
+	})
+
+	t.Run("JSON export", func(t *testing.T) {
+		w := get("/admin/audit?format=json", admin)
+		require.Equal(t, http.StatusOK, w.Code)
+		var exported []models.AuditEvent
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &exported))
+		assert.Len(t, exported, 61, "exports aren't paged")
+	})
+
+	t.Run("CSV export neutralises formulas", func(t *testing.T) {
+		for _, name := range []string{`=HYPERLINK("http://attacker.example","x")`, "+1", "-1", "@SUM(A1)"} {
+			require.NoError(t, database.RecordAuditEvent(models.AuditEvent{ActorName: name, Action: models.AuditLoginFailed, CreatedAt: now}))
+		}
+
+		w := get("/admin/audit?action=login_failed&format=csv", admin)
+		require.Equal(t, http.StatusOK, w.Code)
+		records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+		require.NoError(t, err)
+		var names []string
+		for _, record := range records[1:] {
+			names = append(names, record[3])
+		}
+		assert.ElementsMatch(t, []string{"mallory", `'=HYPERLINK("http://attacker.example","x")`, "'+1", "'-1", "'@SUM(A1)"}, names)
+	})
+}
+
+// TestAuditAdministrativeChanges tests that fine, invitation and group sync changes are recorded in the audit log
+func TestAuditAdministrativeChanges(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+	circulationHandler := handlers.NewCirculationHandler(database, sessionManager)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	borrower := createUserWithRole(t, database, "borrower", "")
+	session, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	// lastEvent returns the only event with an action
+	lastEvent := func(t *testing.T, action string) models.AuditEvent {
+		t.Helper()
+		events, _, err := database.GetAuditEvents(db.AuditFilter{Action: action}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		return events[0]
+	}
+
+	t.Run("Fine policy", func(t *testing.T) {
+		form := url.Values{"per_day": {"0.50"}, "grace_days": {"2"}, "max": {"20.00"}, "block_threshold": {"5.00"}}
+		w := postForm(circulationHandler.AuthMiddleware(circulationHandler.Fines), "/circulation/fines", form, session)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		event := lastEvent(t, models.AuditFinePolicy)
+		assert.Equal(t, "admin", event.ActorName)
+		assert.Contains(t, string(event.Before), `"per_day_cents":25`)
+		assert.Contains(t, string(event.After), `"per_day_cents":50`)
+		assert.Contains(t, string(event.After), `"max_cents":2000`)
+	})
+
+	t.Run("Role fine overrides", func(t *testing.T) {
+		roleID := roleIDByName(t, database, "librarian")
+		form := url.Values{"role_id": {fmt.Sprint(roleID)}, "per_day": {"0.10"}}
+		w := postForm(circulationHandler.AuthMiddleware(circulationHandler.Fines), "/circulation/fines", form, session)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		event := lastEvent(t, models.AuditFineOverride)
+		assert.Equal(t, models.AuditTargetRole, event.TargetType)
+		require.NotNil(t, event.TargetID)
+		assert.Equal(t, roleID, *event.TargetID)
+		assert.Contains(t, string(event.Before), `"per_day_cents":null`)
+		assert.Contains(t, string(event.After), `"per_day_cents":10`)
+		assert.Contains(t, string(event.After), `"role_name":"librarian"`)
+	})
+
+	t.Run("Payments and waivers", func(t *testing.T) {
+		itemID, err := database.CreateItem("Bleak House", "Charles Dickens", "", "")
+		require.NoError(t, err)
+		_, err = database.AddCopy(itemID, "B1", "")
+		require.NoError(t, err)
+		loan, err := database.CheckOut("B1", borrower.ID, admin.ID, time.Now().Add(-60*24*time.Hour))
+		require.NoError(t, err)
+		_, err = database.AssessFines(loan.DueAt.Add(12 * 24 * time.Hour))
+		require.NoError(t, err)
+		balance, err := database.GetBalance(borrower.ID)
+		require.NoError(t, err)
+		require.Equal(t, 500, balance)
+
+		path := fmt.Sprintf("/circulation/fines/%d", borrower.ID)
+		patronFines := circulationHandler.AuthMiddleware(circulationHandler.PatronFines)
+		w := postForm(patronFines, path, url.Values{"kind": {models.LedgerPayment}, "amount": {"2.00"}, "note": {"cash"}}, session)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = postForm(patronFines, path, url.Values{"kind": {models.LedgerWaiver}, "amount": {"1.00"}, "note": {"first time"}}, session)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		payment := lastEvent(t, models.AuditFinePayment)
+		assert.Equal(t, "admin", payment.ActorName)
+		assert.Equal(t, models.AuditTargetUser, payment.TargetType)
+		require.NotNil(t, payment.TargetID)
+		assert.Equal(t, borrower.ID, *payment.TargetID)
+		assert.JSONEq(t, `{"balance_cents": 500}`, string(payment.Before))
+		assert.JSONEq(t, `{"balance_cents": 300, "amount_cents": 200, "note": "cash"}`, string(payment.After))
+
+		waiver := lastEvent(t, models.AuditFineWaiver)
+		assert.JSONEq(t, `{"balance_cents": 300}`, string(waiver.Before))
+		assert.JSONEq(t, `{"balance_cents": 200, "amount_cents": 100, "note": "first time"}`, string(waiver.After))
+
+		// Rejected entries aren't recorded
+		w = postForm(patronFines, path, url.Values{"kind": {models.LedgerWaiver}, "amount": {"50.00"}}, session)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		lastEvent(t, models.AuditFineWaiver)
+	})
+
+	t.Run("Invitations", func(t *testing.T) {
+		w := postForm(authHandler.AuthMiddleware(authHandler.Invite), "/admin/invite", url.Values{"email": {"newcomer@example.com"}}, session)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+
+		event := lastEvent(t, models.AuditInvitationCreated)
+		assert.Equal(t, "admin", event.ActorName)
+		assert.JSONEq(t, `{"email": "newcomer@example.com"}`, string(event.After))
+	})
+
+	t.Run("Group sync", func(t *testing.T) {
+		const (
+			aliceDN = "uid=alice,ou=people,dc=example,dc=com"
+			staffDN = "cn=staff,ou=groups,dc=example,dc=com"
+		)
+		directory := newMockLDAPServer(t, map[string]mockLDAPEntry{
+			"cn=library,dc=example,dc=com": {password: "service"},
+			aliceDN:                        {password: "directory1", attributes: map[string][]string{"uid": {"alice"}, "mail": {"alice@example.com"}}},
+			staffDN:                        {attributes: map[string][]string{"cn": {"staff"}, "member": {aliceDN}}},
+		})
+		authenticator := handlers.NewLDAPAuthenticator(database, auth.NewLDAPDirectory(auth.LDAPConfig{
+			URL:          directory.URL(),
+			BindDN:       "cn=library,dc=example,dc=com",
+			BindPassword: "service",
+			BaseDN:       "ou=people,dc=example,dc=com",
+			GroupBaseDN:  "ou=groups,dc=example,dc=com",
+		}), map[string][]string{"staff": {"librarian"}}, handlers.AuthConfig{RegistrationMode: handlers.RegistrationOpen})
+
+		alice, err := authenticator.Authenticate(context.Background(), "alice", "directory1")
+		require.NoError(t, err)
+		assigned := lastEvent(t, models.AuditRoleAssigned)
+		assert.Nil(t, assigned.ActorID, "group sync has no actor")
+		require.NotNil(t, assigned.TargetID)
+		assert.Equal(t, alice.ID, *assigned.TargetID)
+		assert.Contains(t, string(assigned.After), `"role":"librarian"`)
+		assert.Contains(t, string(assigned.After), `"source":"`+directory.URL()+`"`)
+
+		directory.update(staffDN, "member")
+		_, err = authenticator.Authenticate(context.Background(), "alice", "directory1")
+		require.NoError(t, err)
+		removed := lastEvent(t, models.AuditRoleRemoved)
+		assert.Nil(t, removed.ActorID)
+		assert.Contains(t, string(removed.Before), `"role":"librarian"`)
+		assert.Nil(t, removed.After)
+	})
+}
+
+// roleIDByName returns the ID of the role with a name
+func roleIDByName(t *testing.T, database *db.Database, name string) int {
+	t.Helper()
+	roles, err := database.GetAllRoles()
+	require.NoError(t, err)
+	for _, role := range roles {
+		if role.Name == name {
+			return role.ID
+		}
+	}
+	t.Fatalf("role %q not found", name)
+	return 0
+}
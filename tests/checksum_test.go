@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/storage"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadPDF uploads a file through the upload form.
+func uploadPDF(t *testing.T, libraryHandler *handlers.LibraryHandler, session, title, filename, content string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("title", title)
+	part, err := form.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	part.Write([]byte(content))
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest("POST", "/library/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w := httptest.NewRecorder()
+	libraryHandler.AuthMiddleware(libraryHandler.UploadPDF).ServeHTTP(w, req)
+	return w
+}
+
+// TestUploadDeduplication tests that identical uploads share one stored file and warn about each other
+func TestUploadDeduplication(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	store := storage.NewLocalStore(filepath.Join(dir, "uploads"))
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(store)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	session, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	content := string(testPDF("The same book"))
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+
+	w := uploadPDF(t, libraryHandler, session, "First Copy", "book.pdf", content)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	assert.Equal(t, "/library", w.Header().Get("Location"))
+
+	// The same name with other content doesn't replace the first file
+	w = uploadPDF(t, libraryHandler, session, "Other Book", "book.pdf", string(testPDF("Another book")))
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/library", w.Header().Get("Location"))
+
+	w = uploadPDF(t, libraryHandler, session, "Second Copy", "copy.pdf", content)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+
+	copies, err := database.GetPDFsByChecksum(db.PDFVisibility{All: true}, checksum)
+	require.NoError(t, err)
+	require.Len(t, copies, 2)
+	first, second := copies[0], copies[1]
+	assert.Equal(t, "First Copy", first.Title)
+	assert.Equal(t, fmt.Sprintf("/library/view/%d?duplicate=1", second.ID), w.Header().Get("Location"))
+	assert.Equal(t, "sha256/"+checksum[:2]+"/"+checksum, first.StorageKey)
+	assert.Equal(t, first.StorageKey, second.StorageKey)
+	assert.Equal(t, int64(len(content)), first.SizeBytes)
+
+	blobs, err := store.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Len(t, blobs, 2, "identical files are stored once")
+
+	t.Run("Viewer warns about duplicates", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/library/view/%d?duplicate=1", second.ID), nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+		w := httptest.NewRecorder()
+		libraryHandler.AuthMiddleware(libraryHandler.ViewPDF).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "This file is identical to one already in the library")
+		assert.Contains(t, w.Body.String(), fmt.Sprintf(`href="/library/view/%d"`, first.ID))
+
+		// Users who can't see the first copy aren't told about it
+		require.NoError(t, database.SetPDFRestricted(first.ID, true))
+		reader := createUserWithRole(t, database, "reader", "user")
+		duplicates, err := database.GetPDFsByChecksum(db.PDFVisibility{UserID: reader.ID}, checksum)
+		require.NoError(t, err)
+		require.Len(t, duplicates, 1)
+		assert.Equal(t, second.ID, duplicates[0].ID)
+	})
+
+	t.Run("Shared files outlive all but the last PDF", func(t *testing.T) {
+		deletePDF := libraryHandler.AuthMiddleware(libraryHandler.DeletePDF)
+		w := postForm(deletePDF, "/library/delete", url.Values{"pdf_id": {fmt.Sprint(first.ID)}}, session)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		_, err := store.Stat(context.Background(), second.StorageKey)
+		assert.NoError(t, err)
+
+		w = postForm(deletePDF, "/library/delete", url.Values{"pdf_id": {fmt.Sprint(second.ID)}}, session)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		_, err = store.Stat(context.Background(), second.StorageKey)
+		assert.NoError(t, err, "released files wait for the scrub job")
+
+		_, err = libraryHandler.ScrubFiles(context.Background())
+		require.NoError(t, err)
+		_, err = store.Stat(context.Background(), second.StorageKey)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("Released files uploaded again are kept", func(t *testing.T) {
+		content := string(testPDF("Returned book"))
+		w := uploadPDF(t, libraryHandler, session, "Returned", "returned.pdf", content)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		pdfs, err := database.GetAllPDFs()
+		require.NoError(t, err)
+		var returned models.PDF
+		for _, pdf := range pdfs {
+			if pdf.Title == "Returned" {
+				returned = pdf
+			}
+		}
+
+		deletePDF := libraryHandler.AuthMiddleware(libraryHandler.DeletePDF)
+		w = postForm(deletePDF, "/library/delete", url.Values{"pdf_id": {fmt.Sprint(returned.ID)}}, session)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		w = uploadPDF(t, libraryHandler, session, "Returned Again", "returned.pdf", content)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+
+		_, err = libraryHandler.ScrubFiles(context.Background())
+		require.NoError(t, err)
+		_, err = store.Stat(context.Background(), returned.StorageKey)
+		assert.NoError(t, err)
+
+		// The mark was dropped, so the file stays after later scrubs too
+		_, err = libraryHandler.ScrubFiles(context.Background())
+		require.NoError(t, err)
+		_, err = store.Stat(context.Background(), returned.StorageKey)
+		assert.NoError(t, err)
+	})
+}
+
+// TestScrubFiles tests re-hashing stored files to find missing and corrupt ones
+func TestScrubFiles(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	ctx := context.Background()
+	store := storage.NewLocalStore(filepath.Join(dir, "uploads"))
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(store)
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	session, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	for _, title := range []string{"Intact", "Corrupt", "Missing"} {
+		w := uploadPDF(t, libraryHandler, session, title, strings.ToLower(title)+".pdf", string(testPDF(title)))
+		require.Equal(t, http.StatusSeeOther, w.Code)
+	}
+	// Uploaded before checksums were recorded
+	legacy := "%PDF-1.4\nlegacy\n%%EOF\n"
+	require.NoError(t, store.Put(ctx, "1_legacy.pdf", strings.NewReader(legacy), int64(len(legacy))))
+	legacyID, err := database.CreatePDF("Legacy", "", "", "1_legacy.pdf", "1_legacy.pdf", admin.ID)
+	require.NoError(t, err)
+
+	pdfs := map[string]models.PDF{}
+	all, err := database.GetAllPDFs()
+	require.NoError(t, err)
+	for _, pdf := range all {
+		pdfs[pdf.Title] = pdf
+	}
+	corrupted := "%PDF-1.4\nflipped bits\n%%EOF\n"
+	require.NoError(t, store.Put(ctx, pdfs["Corrupt"].StorageKey, strings.NewReader(corrupted), int64(len(corrupted))))
+	require.NoError(t, store.Delete(ctx, pdfs["Missing"].StorageKey))
+
+	damaged, err := libraryHandler.ScrubFiles(ctx)
+	require.NoError(t, err)
+	require.Len(t, damaged, 2)
+
+	status := func(id int) string {
+		pdf, err := database.GetPDFByID(id)
+		require.NoError(t, err)
+		require.NotNil(t, pdf.ScrubbedAt)
+		return pdf.ScrubStatus
+	}
+	assert.Equal(t, models.ScrubOK, status(pdfs["Intact"].ID))
+	assert.Equal(t, models.ScrubCorrupt, status(pdfs["Corrupt"].ID))
+	assert.Equal(t, models.ScrubMissing, status(pdfs["Missing"].ID))
+	assert.Equal(t, models.ScrubOK, status(legacyID))
+
+	legacyPDF, err := database.GetPDFByID(legacyID)
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte(legacy))
+	assert.Equal(t, hex.EncodeToString(sum[:]), legacyPDF.Checksum, "the first scrub records missing checksums")
+	assert.Equal(t, int64(len(legacy)), legacyPDF.SizeBytes)
+
+	t.Run("Admin panel lists damaged files", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+		w := httptest.NewRecorder()
+		adminHandler.AuthMiddleware(adminHandler.Index).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "File missing")
+		assert.Contains(t, w.Body.String(), "Checksum mismatch")
+		assert.NotContains(t, w.Body.String(), ">Intact<")
+	})
+
+	t.Run("Repaired files pass the next scrub", func(t *testing.T) {
+		original := string(testPDF("Corrupt"))
+		require.NoError(t, store.Put(ctx, pdfs["Corrupt"].StorageKey, strings.NewReader(original), int64(len(original))))
+
+		damaged, err := libraryHandler.ScrubFiles(ctx)
+		require.NoError(t, err)
+		require.Len(t, damaged, 1)
+		assert.Equal(t, "Missing", damaged[0].Title)
+
+		stored, err := database.GetDamagedPDFs()
+		require.NoError(t, err)
+		require.Len(t, stored, 1)
+		assert.Equal(t, pdfs["Missing"].ID, stored[0].ID)
+	})
+}
@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createUserWithRole creates a user and gives them an additional role
+func createUserWithRole(t *testing.T, database *db.Database, username, roleName string) *models.User {
+	t.Helper()
+
+	require.NoError(t, database.CreateUser(username, username+"@example.com", "hash"))
+	user, err := database.GetUserByUsername(username)
+	require.NoError(t, err)
+
+	if roleName != "" {
+		roles, err := database.GetAllRoles()
+		require.NoError(t, err)
+		for _, role := range roles {
+			if role.Name == roleName {
+				require.NoError(t, database.AssignRole(user.ID, role.ID, nil))
+				return user
+			}
+		}
+		t.Fatalf("role %s not found", roleName)
+	}
+
+	return user
+}
+
+// TestCirculation tests checking out, renewing and checking in copies
+func TestCirculation(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	// The first user becomes an admin on startup, so create them up front
+	createUserWithRole(t, database, "admin", "admin")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	patron := createUserWithRole(t, database, "patron", "")
+
+	itemID, err := database.CreateItem("Moby Dick", "Herman Melville", "9780142437247", "")
+	require.NoError(t, err)
+	for _, barcode := range []string{"B1", "B2", "B3", "B4", "B5", "B6"} {
+		_, err := database.AddCopy(itemID, barcode, "FIC MEL")
+		require.NoError(t, err)
+	}
+
+	_, err = database.AddCopy(itemID, "B1", "")
+	assert.ErrorIs(t, err, db.ErrDuplicateBarcode)
+
+	policy, err := database.GetLoanPolicy(patron.ID)
+	require.NoError(t, err)
+	assert.Equal(t, db.LoanPolicy{Limit: 5, PeriodDays: 21, MaxRenewals: 2}, policy)
+
+	now := time.Now()
+	loan, err := database.CheckOut("B1", patron.ID, librarian.ID, now)
+	require.NoError(t, err)
+	assert.Equal(t, "Moby Dick", loan.ItemTitle)
+	assert.Equal(t, "patron", loan.Username)
+	assert.WithinDuration(t, now.AddDate(0, 0, 21), loan.DueAt, time.Second)
+
+	t.Run("A copy can only be on one loan", func(t *testing.T) {
+		_, err := database.CheckOut("B1", librarian.ID, librarian.ID, now)
+		assert.ErrorIs(t, err, db.ErrCopyUnavailable)
+	})
+
+	t.Run("Loan limit is enforced", func(t *testing.T) {
+		for _, barcode := range []string{"B2", "B3", "B4", "B5"} {
+			_, err := database.CheckOut(barcode, patron.ID, librarian.ID, now)
+			require.NoError(t, err)
+		}
+		_, err := database.CheckOut("B6", patron.ID, librarian.ID, now)
+		assert.ErrorIs(t, err, db.ErrLoanLimitReached)
+
+		item, err := database.GetItemByID(itemID)
+		require.NoError(t, err)
+		assert.Equal(t, 6, item.TotalCopies)
+		assert.Equal(t, 1, item.AvailableCopies)
+	})
+
+	t.Run("Renewals are limited", func(t *testing.T) {
+		later := now.AddDate(0, 0, 10)
+		renewed, err := database.RenewLoan(loan.ID, later)
+		require.NoError(t, err)
+		assert.Equal(t, 1, renewed.Renewals)
+		assert.WithinDuration(t, later.AddDate(0, 0, 21), renewed.DueAt, time.Second)
+
+		_, err = database.RenewLoan(loan.ID, later)
+		require.NoError(t, err)
+		_, err = database.RenewLoan(loan.ID, later)
+		assert.ErrorIs(t, err, db.ErrRenewalLimitReached)
+	})
+
+	t.Run("Check in closes the loan", func(t *testing.T) {
+		returned, hold, err := database.CheckIn("B1", now)
+		require.NoError(t, err)
+		require.NotNil(t, returned.ReturnedAt)
+		assert.Nil(t, hold)
+
+		_, _, err = database.CheckIn("B1", now)
+		assert.ErrorIs(t, err, db.ErrNotCheckedOut)
+
+		// The patron is below their limit again
+		_, err = database.CheckOut("B6", patron.ID, librarian.ID, now)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Overdue loans are reported", func(t *testing.T) {
+		loans, err := database.GetUserLoans(patron.ID)
+		require.NoError(t, err)
+		require.Len(t, loans, 6)
+		assert.Nil(t, loans[0].ReturnedAt)
+		assert.NotNil(t, loans[5].ReturnedAt)
+		assert.True(t, loans[0].IsOverdue(now.AddDate(0, 1, 0)))
+		assert.False(t, loans[5].IsOverdue(now.AddDate(0, 1, 0)))
+	})
+}
+
+// TestCirculationDeskPermissions tests that only circulation staff can check items out
+func TestCirculationDeskPermissions(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	circulationHandler := handlers.NewCirculationHandler(database, sessionManager)
+	handler := circulationHandler.AuthMiddleware(circulationHandler.CheckOut)
+
+	createUserWithRole(t, database, "admin", "admin")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	patron := createUserWithRole(t, database, "patron", "")
+
+	itemID, err := database.CreateItem("Emma", "Jane Austen", "", "")
+	require.NoError(t, err)
+	_, err = database.AddCopy(itemID, "E1", "")
+	require.NoError(t, err)
+
+	checkOut := func(user *models.User) *httptest.ResponseRecorder {
+		token, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+
+		form := url.Values{"username": {"patron"}, "barcode": {"E1"}}
+		req := httptest.NewRequest("POST", "/circulation/checkout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := checkOut(patron)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = checkOut(librarian)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Checked out")
+
+	loans, err := database.GetUserLoans(patron.ID)
+	require.NoError(t, err)
+	require.Len(t, loans, 1)
+	assert.Equal(t, librarian.ID, loans[0].CheckedOutBy)
+
+	w = checkOut(librarian)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
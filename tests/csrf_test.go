@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCSRFProtection tests that state-changing requests need the CSRF token of the browser's session
+func TestCSRFProtection(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	api := handlers.NewAPIHandler(database, sessionManager)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", authHandler.Login)
+	mux.HandleFunc("/auth/login", authHandler.Login)
+	mux.HandleFunc("/admin/assign-role", adminHandler.AuthMiddleware(adminHandler.AssignRole))
+	mux.HandleFunc("/api/v1/auth/login", api.Login)
+	mux.HandleFunc("/api/v1/users/me", api.AuthMiddleware(api.Me))
+	handler := handlers.CSRFMiddleware(mux)
+
+	do := func(method, path string, body string, header http.Header, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if method == "POST" && header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	hash, err := auth.HashPassword("password1")
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", hash))
+
+	// Visitors get a token for the login form
+	w := do("GET", "/login", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	secret := responseCookie(w, "csrf_secret")
+	require.NotNil(t, secret)
+	token := auth.CSRFToken(secret.Value)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`name="csrf_token" value="%s"`, token))
+	assert.Contains(t, w.Body.String(), "X-CSRF-Token", "htmx requests send the token in a header")
+
+	credentials := url.Values{"username": {"reader"}, "password": {"password1"}}
+	w = do("POST", "/auth/login", credentials.Encode(), nil, secret)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "Request Rejected")
+	assert.Nil(t, responseCookie(w, "session_token"))
+
+	credentials.Set("csrf_token", auth.CSRFToken("another browser"))
+	w = do("POST", "/auth/login", credentials.Encode(), nil, secret)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	credentials.Set("csrf_token", token)
+	w = do("POST", "/auth/login", credentials.Encode(), nil, secret)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+
+	// Logged-in users' tokens come from their session
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	session := &http.Cookie{Name: "session_token", Value: adminSession}
+	roles, err := database.GetAllRoles()
+	require.NoError(t, err)
+	form := url.Values{"user_id": {fmt.Sprintf("%d", admin.ID)}, "role_id": {fmt.Sprintf("%d", roles[0].ID)}}
+
+	w = do("POST", "/admin/assign-role", form.Encode(), nil, session, secret)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = do("POST", "/admin/assign-role", form.Encode(), http.Header{"X-Csrf-Token": {token}}, session, secret)
+	assert.Equal(t, http.StatusForbidden, w.Code, "the visitor's token stops working after login")
+	w = do("POST", "/admin/assign-role", form.Encode(), http.Header{"X-Csrf-Token": {auth.CSRFToken(adminSession)}}, session)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	t.Run("API", func(t *testing.T) {
+		json := http.Header{"Content-Type": {"application/json"}}
+		w := do("POST", "/api/v1/auth/login", `{"username": "reader", "password": "password1"}`, json)
+		assert.Equal(t, http.StatusOK, w.Code, "header-authenticated API clients don't need a token")
+
+		w = do("POST", "/api/v1/auth/login", `{"username": "reader", "password": "password1"}`, json, session)
+		assert.Equal(t, http.StatusForbidden, w.Code, "cookie-authenticated API requests do")
+
+		w = do("GET", "/api/v1/users/me", "", nil, session)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
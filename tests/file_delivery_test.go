@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServeFile tests authenticated PDF delivery through /library/file/{id}
+func TestServeFile(t *testing.T) {
+	dir := t.TempDir()
+
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(storage.NewLocalStore(dir))
+	handler := libraryHandler.AuthMiddleware(libraryHandler.ServeFile)
+
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", "hash"))
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+
+	content := []byte("%PDF-1.4\n0123456789\n%%EOF\n")
+	filePath := filepath.Join(dir, "1_book.pdf")
+	require.NoError(t, os.WriteFile(filePath, content, 0644))
+	pdfID, err := database.CreatePDF("Book", "Author", "", "1_book.pdf", "1_book.pdf", user.ID)
+	require.NoError(t, err)
+	fileURL := fmt.Sprintf("/library/file/%d", pdfID)
+
+	token, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	newRequest := func(url string) *http.Request {
+		req := httptest.NewRequest("GET", url, nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		return req
+	}
+
+	t.Run("Unauthenticated request redirects to login", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", fileURL, nil))
+
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/login", w.Header().Get("Location"))
+	})
+
+	t.Run("Full file is served inline", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(fileURL))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+		assert.Equal(t, `inline; filename=1_book.pdf`, w.Header().Get("Content-Disposition"))
+		assert.NotEmpty(t, w.Header().Get("ETag"))
+		assert.Equal(t, content, w.Body.Bytes())
+	})
+
+	t.Run("Download is served as attachment", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(fileURL+"?download=1"))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `attachment; filename=1_book.pdf`, w.Header().Get("Content-Disposition"))
+	})
+
+	t.Run("Range request returns partial content", func(t *testing.T) {
+		req := newRequest(fileURL)
+		req.Header.Set("Range", "bytes=0-7")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "%PDF-1.4", w.Body.String())
+		assert.Equal(t, fmt.Sprintf("bytes 0-7/%d", len(content)), w.Header().Get("Content-Range"))
+	})
+
+	t.Run("Matching ETag returns not modified", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(fileURL))
+		etag := w.Header().Get("ETag")
+
+		req := newRequest(fileURL)
+		req.Header.Set("If-None-Match", etag)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("Unknown PDF returns not found", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("/library/file/9999"))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
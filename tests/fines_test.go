@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFineFor tests that fines start after the grace period and stop at the cap
+func TestFineFor(t *testing.T) {
+	policy := models.FinePolicy{PerDayCents: 25, GraceDays: 2, MaxCents: 100}
+	due := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	assert.Equal(t, 0, policy.FineFor(due, due.Add(-day)))
+	assert.Equal(t, 0, policy.FineFor(due, due.Add(2*day)))
+	assert.Equal(t, 0, policy.FineFor(due, due.Add(3*day-time.Minute)))
+	assert.Equal(t, 25, policy.FineFor(due, due.Add(3*day)))
+	assert.Equal(t, 75, policy.FineFor(due, due.Add(5*day)))
+	assert.Equal(t, 100, policy.FineFor(due, due.Add(30*day)))
+
+	policy.MaxCents = 0
+	assert.Equal(t, 700, policy.FineFor(due, due.Add(30*day)))
+}
+
+// TestFines tests assessing overdue fines, recording payments and waivers and blocking checkouts
+func TestFines(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	createUserWithRole(t, database, "admin", "admin")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	borrower := createUserWithRole(t, database, "borrower", "")
+
+	itemID, err := database.CreateItem("Bleak House", "Charles Dickens", "", "")
+	require.NoError(t, err)
+	_, err = database.AddCopy(itemID, "B1", "")
+	require.NoError(t, err)
+	_, err = database.AddCopy(itemID, "B2", "")
+	require.NoError(t, err)
+
+	policy, err := database.GetFinePolicy()
+	require.NoError(t, err)
+	assert.Equal(t, models.FinePolicy{PerDayCents: 25, GraceDays: 1, MaxCents: 1000, BlockThresholdCents: 500}, policy)
+
+	loan, err := database.CheckOut("B1", borrower.ID, librarian.ID, time.Now().Add(-60*24*time.Hour))
+	require.NoError(t, err)
+	day := 24 * time.Hour
+
+	t.Run("Assessment charges only what is new", func(t *testing.T) {
+		charges, err := database.AssessFines(loan.DueAt.Add(3 * day))
+		require.NoError(t, err)
+		assert.Equal(t, 1, charges)
+
+		charges, err = database.AssessFines(loan.DueAt.Add(3 * day))
+		require.NoError(t, err)
+		assert.Equal(t, 0, charges)
+
+		charges, err = database.AssessFines(loan.DueAt.Add(5 * day))
+		require.NoError(t, err)
+		assert.Equal(t, 1, charges)
+
+		balance, err := database.GetBalance(borrower.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 100, balance)
+	})
+
+	t.Run("Returned loans are settled", func(t *testing.T) {
+		_, _, err := database.CheckIn("B1", loan.DueAt.Add(6*day))
+		require.NoError(t, err)
+
+		charges, err := database.AssessFines(loan.DueAt.Add(10 * day))
+		require.NoError(t, err)
+		assert.Equal(t, 1, charges)
+
+		charges, err = database.AssessFines(loan.DueAt.Add(20 * day))
+		require.NoError(t, err)
+		assert.Equal(t, 0, charges)
+
+		balance, err := database.GetBalance(borrower.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 125, balance)
+
+		balances, err := database.GetOutstandingBalances()
+		require.NoError(t, err)
+		assert.Equal(t, []models.UserBalance{{UserID: borrower.ID, Username: "borrower", BalanceCents: 125}}, balances)
+	})
+
+	t.Run("Checkouts are blocked above the threshold", func(t *testing.T) {
+		policy.BlockThresholdCents = 100
+		require.NoError(t, database.UpdateFinePolicy(policy))
+
+		_, err := database.CheckOut("B2", borrower.ID, librarian.ID, time.Now())
+		assert.ErrorIs(t, err, db.ErrFinesOwed)
+	})
+
+	t.Run("Payments and waivers reduce the balance", func(t *testing.T) {
+		err := database.RecordPayment(borrower.ID, 0, "", librarian.ID, time.Now())
+		assert.ErrorIs(t, err, db.ErrInvalidAmount)
+		err = database.RecordPayment(borrower.ID, 200, "", librarian.ID, time.Now())
+		assert.ErrorIs(t, err, db.ErrExceedsBalance)
+
+		require.NoError(t, database.RecordPayment(borrower.ID, 100, "Cash", librarian.ID, time.Now()))
+		_, err = database.CheckOut("B2", borrower.ID, librarian.ID, time.Now())
+		require.NoError(t, err)
+
+		require.NoError(t, database.WaiveFines(borrower.ID, 25, "First offence", librarian.ID, time.Now().Add(time.Second)))
+
+		balance, err := database.GetBalance(borrower.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 0, balance)
+
+		entries, err := database.GetLedger(borrower.ID)
+		require.NoError(t, err)
+		require.Len(t, entries, 5)
+		assert.Equal(t, models.LedgerWaiver, entries[0].Kind)
+		assert.Equal(t, "First offence", entries[0].Description)
+		assert.Equal(t, "librarian", entries[0].RecordedByName)
+		require.NotNil(t, entries[0].RecordedBy)
+		assert.Equal(t, librarian.ID, *entries[0].RecordedBy)
+		assert.Equal(t, models.LedgerPayment, entries[1].Kind)
+		assert.Equal(t, models.LedgerCharge, entries[4].Kind)
+		assert.Nil(t, entries[4].RecordedBy)
+		require.NotNil(t, entries[4].LoanID)
+		assert.Equal(t, loan.ID, *entries[4].LoanID)
+	})
+}
+
+// TestFineOverrides tests that role overrides replace parts of the library-wide policy
+func TestFineOverrides(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	createUserWithRole(t, database, "admin", "admin")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	borrower := createUserWithRole(t, database, "borrower", "")
+
+	overrides, err := database.GetFineOverrides()
+	require.NoError(t, err)
+	var roleID int
+	for _, override := range overrides {
+		assert.Nil(t, override.PerDayCents)
+		if override.RoleName == "librarian" {
+			roleID = override.RoleID
+		}
+	}
+	require.NotZero(t, roleID)
+
+	negative := -1
+	err = database.SetFineOverride(models.FineOverride{RoleID: roleID, PerDayCents: &negative})
+	assert.ErrorIs(t, err, db.ErrInvalidPolicy)
+
+	perDay, maxCents := 10, 0
+	require.NoError(t, database.SetFineOverride(models.FineOverride{RoleID: roleID, PerDayCents: &perDay, MaxCents: &maxCents}))
+
+	// The librarian also has the user role, whose library-wide cap is more
+	// generous than no cap
+	policy, err := database.GetUserFinePolicy(librarian.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10, policy.PerDayCents)
+	assert.Equal(t, 1, policy.GraceDays)
+	assert.Equal(t, 1000, policy.MaxCents)
+
+	policy, err = database.GetUserFinePolicy(borrower.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 25, policy.PerDayCents)
+	assert.Equal(t, 1000, policy.MaxCents)
+}
+
+// TestFineOverridesMixedRoles tests that a harsh override of one role doesn't
+// apply to patrons with another role on the library-wide policy
+func TestFineOverridesMixedRoles(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	// Members of librarian also have the user role, which has no overrides
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	overrides, err := database.GetFineOverrides()
+	require.NoError(t, err)
+	var roleID int
+	for _, override := range overrides {
+		if override.RoleName == "librarian" {
+			roleID = override.RoleID
+		}
+	}
+	require.NotZero(t, roleID)
+
+	perDay, grace, maxCents := 100, 0, 5000
+	require.NoError(t, database.SetFineOverride(models.FineOverride{RoleID: roleID, PerDayCents: &perDay, GraceDays: &grace, MaxCents: &maxCents}))
+
+	policy, err := database.GetUserFinePolicy(librarian.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.FinePolicy{PerDayCents: 25, GraceDays: 1, MaxCents: 1000, BlockThresholdCents: 500}, policy)
+
+	// Without the user role, the overrides apply
+	roles, err := database.GetUserRoles(librarian.ID)
+	require.NoError(t, err)
+	for _, role := range roles {
+		if role.Name == "user" {
+			require.NoError(t, database.RemoveRole(librarian.ID, role.ID))
+		}
+	}
+	policy, err = database.GetUserFinePolicy(librarian.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.FinePolicy{PerDayCents: 100, GraceDays: 0, MaxCents: 5000, BlockThresholdCents: 500}, policy)
+}
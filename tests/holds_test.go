@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/models"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHoldQueue tests that holds are filled first come, first served and expire when not picked up
+func TestHoldQueue(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	createUserWithRole(t, database, "admin", "admin")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	borrower := createUserWithRole(t, database, "borrower", "")
+	first := createUserWithRole(t, database, "first", "")
+	second := createUserWithRole(t, database, "second", "")
+
+	itemID, err := database.CreateItem("Middlemarch", "George Eliot", "", "")
+	require.NoError(t, err)
+	_, err = database.AddCopy(itemID, "M1", "")
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// Holds are only accepted once every copy is out
+	_, err = database.PlaceHold(first.ID, itemID, now)
+	assert.ErrorIs(t, err, db.ErrCopiesAvailable)
+
+	_, err = database.CheckOut("M1", borrower.ID, librarian.ID, now)
+	require.NoError(t, err)
+
+	_, err = database.PlaceHold(borrower.ID, itemID, now)
+	assert.ErrorIs(t, err, db.ErrAlreadyBorrowed)
+
+	firstHold, err := database.PlaceHold(first.ID, itemID, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, firstHold.Position)
+	secondHold, err := database.PlaceHold(second.ID, itemID, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, secondHold.Position)
+
+	_, err = database.PlaceHold(first.ID, itemID, now)
+	assert.ErrorIs(t, err, db.ErrHoldExists)
+
+	// Renewing would keep the queue waiting
+	loans, err := database.GetUserLoans(borrower.ID)
+	require.NoError(t, err)
+	_, err = database.RenewLoan(loans[0].ID, now)
+	assert.ErrorIs(t, err, db.ErrHoldsWaiting)
+
+	t.Run("Returned copy is set aside for the first hold", func(t *testing.T) {
+		_, hold, err := database.CheckIn("M1", now)
+		require.NoError(t, err)
+		require.NotNil(t, hold)
+		assert.Equal(t, firstHold.ID, hold.ID)
+		assert.Equal(t, models.HoldReady, hold.Status)
+		assert.Equal(t, "M1", hold.Barcode)
+
+		secondHold, err = database.GetHoldByID(secondHold.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, secondHold.Position)
+
+		// Only the patron it was set aside for can borrow it
+		_, err = database.CheckOut("M1", second.ID, librarian.ID, now)
+		assert.ErrorIs(t, err, db.ErrCopyOnHold)
+
+		item, err := database.GetItemByID(itemID)
+		require.NoError(t, err)
+		assert.Equal(t, 0, item.AvailableCopies)
+	})
+
+	t.Run("Unclaimed holds expire and pass the copy on", func(t *testing.T) {
+		expired, err := database.ExpireHolds(now.Add(6 * 24 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 0, expired)
+
+		expired, err = database.ExpireHolds(now.Add(8 * 24 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, expired)
+
+		hold, err := database.GetHoldByID(firstHold.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.HoldExpired, hold.Status)
+
+		hold, err = database.GetHoldByID(secondHold.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.HoldReady, hold.Status)
+	})
+
+	t.Run("Borrowing fulfills the hold", func(t *testing.T) {
+		_, err := database.CheckOut("M1", second.ID, librarian.ID, now)
+		require.NoError(t, err)
+
+		hold, err := database.GetHoldByID(secondHold.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.HoldFulfilled, hold.Status)
+	})
+
+	t.Run("Cancelling a ready hold passes the copy on", func(t *testing.T) {
+		third, err := database.PlaceHold(first.ID, itemID, now)
+		require.NoError(t, err)
+		fourth, err := database.PlaceHold(borrower.ID, itemID, now)
+		require.NoError(t, err)
+
+		_, hold, err := database.CheckIn("M1", now)
+		require.NoError(t, err)
+		require.Equal(t, third.ID, hold.ID)
+
+		// Users can only cancel their own holds
+		assert.Error(t, database.CancelHold(third.ID, borrower.ID, now))
+
+		require.NoError(t, database.CancelHold(third.ID, first.ID, now))
+		assert.ErrorIs(t, database.CancelHold(third.ID, first.ID, now), db.ErrHoldNotActive)
+
+		hold, err = database.GetHoldByID(fourth.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.HoldReady, hold.Status)
+
+		holds, err := database.GetReadyHolds()
+		require.NoError(t, err)
+		require.Len(t, holds, 1)
+		assert.Equal(t, "borrower", holds[0].Username)
+	})
+}
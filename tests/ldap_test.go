@@ -0,0 +1,350 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockLDAPServer is an LDAP directory that answers simple binds and searches
+// with equality filters.
+type mockLDAPServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries map[string]mockLDAPEntry // By DN
+}
+
+type mockLDAPEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+func newMockLDAPServer(t *testing.T, entries map[string]mockLDAPEntry) *mockLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &mockLDAPServer{listener: listener, entries: entries}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *mockLDAPServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// update changes an entry's attributes while the server runs.
+func (s *mockLDAPServer) update(dn, attribute string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[dn].attributes[attribute] = values
+}
+
+func (s *mockLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		s.mu.Lock()
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if entry, ok := s.entries[dn]; (dn == "" && password == "") || (ok && password != "" && entry.password == password) {
+				code, bound = ldap.LDAPResultSuccess, dn
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			if bound == "" {
+				conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights).Bytes())
+				break
+			}
+			base := op.Children[0].Data.String()
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			attribute, value, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")"), "=")
+			var requested []string
+			for _, child := range op.Children[7].Children {
+				requested = append(requested, child.Data.String())
+			}
+
+			for dn, entry := range s.entries {
+				if strings.HasSuffix(dn, base) && slices.Contains(entry.attributes[attribute], value) {
+					conn.Write(ldapSearchEntry(id, dn, entry, requested).Bytes())
+				}
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationUnbindRequest:
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.NewSequence("LDAP Message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return ldapMessage(id, result)
+}
+
+func ldapSearchEntry(id int64, dn string, entry mockLDAPEntry, requested []string) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	attributes := ber.NewSequence("Attributes")
+	for _, name := range requested {
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range entry.attributes[name] {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	result.AppendChild(attributes)
+	return ldapMessage(id, result)
+}
+
+// TestLDAPLogin tests logging in against an LDAP directory, with group to role sync and local passwords as a fallback
+func TestLDAPLogin(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	const (
+		aliceDN = "uid=alice,ou=people,dc=example,dc=com"
+		bobDN   = "uid=bob,ou=people,dc=example,dc=com"
+		staffDN = "cn=staff,ou=groups,dc=example,dc=com"
+	)
+	directory := newMockLDAPServer(t, map[string]mockLDAPEntry{
+		"cn=library,dc=example,dc=com": {password: "service"},
+		aliceDN:                        {password: "directory1", attributes: map[string][]string{"uid": {"alice"}, "mail": {"alice@example.com"}}},
+		bobDN:                          {password: "directory2", attributes: map[string][]string{"uid": {"bob"}, "mail": {"bob@example.com"}}},
+		staffDN:                        {attributes: map[string][]string{"cn": {"staff"}, "member": {aliceDN, bobDN}}},
+	})
+	ldapConfig := auth.LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=library,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		GroupBaseDN:  "ou=groups,dc=example,dc=com",
+	}
+	roleMapping := map[string][]string{"staff": {"librarian"}}
+	authenticator := handlers.Authenticators{
+		handlers.NewLDAPAuthenticator(database, auth.NewLDAPDirectory(ldapConfig), roleMapping, handlers.AuthConfig{RegistrationMode: handlers.RegistrationOpen}),
+		handlers.NewPasswordAuthenticator(database),
+	}
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{
+		BaseURL:          "http://localhost",
+		RegistrationMode: handlers.RegistrationOpen,
+		Authenticator:    authenticator,
+	})
+	login := func(username, password string) *httptest.ResponseRecorder {
+		return postForm(authHandler.Login, "/auth/login", url.Values{"username": {username}, "password": {password}}, "")
+	}
+	hasRole := func(username, role string) bool {
+		user, err := database.GetUserByUsername(username)
+		require.NoError(t, err)
+		user, err = database.GetUserWithRoles(user.ID)
+		require.NoError(t, err)
+		for _, r := range user.Roles {
+			if r.Name == role {
+				return true
+			}
+		}
+		return false
+	}
+
+	hash, err := auth.HashPassword("password1")
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("local", "local@example.com", hash))
+	require.NoError(t, database.CreateUser("robert", "bob@example.com", hash))
+
+	// Directory users get a local user with the roles of their groups
+	w := login("alice", "directory1")
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	assert.NotNil(t, responseCookie(w, "session_token"))
+	alice, err := database.GetUserByUsername("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", alice.Email)
+	assert.Empty(t, alice.PasswordHash)
+	assert.True(t, hasRole("alice", "librarian"))
+
+	directory.update(staffDN, "member", bobDN)
+	w = login("alice", "directory1")
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	assert.False(t, hasRole("alice", "librarian"), "leaving a group removes its roles")
+	assert.True(t, hasRole("alice", "user"), "unmapped roles are left alone")
+
+	assert.Equal(t, http.StatusBadRequest, login("alice", "wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, login("*", "directory1").Code, "usernames are escaped in filters")
+
+	// Local passwords still work, and directory users can't take over
+	// local users by email address
+	assert.Equal(t, http.StatusSeeOther, login("local", "password1").Code)
+	assert.Equal(t, http.StatusBadRequest, login("bob", "directory2").Code)
+	assert.Equal(t, http.StatusSeeOther, login("robert", "password1").Code)
+
+	t.Run("API", func(t *testing.T) {
+		api := handlers.NewAPIHandler(database, sessionManager)
+		api.SetAuthenticator(authenticator)
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"username": "alice", "password": "directory1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		api.Login(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Unreachable directory", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closed := "ldap://" + listener.Addr().String()
+		listener.Close()
+
+		config := ldapConfig
+		config.URL = closed
+		authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{
+			BaseURL:          "http://localhost",
+			RegistrationMode: handlers.RegistrationOpen,
+			Authenticator: handlers.Authenticators{
+				handlers.NewLDAPAuthenticator(database, auth.NewLDAPDirectory(config), roleMapping, handlers.AuthConfig{RegistrationMode: handlers.RegistrationOpen}),
+				handlers.NewPasswordAuthenticator(database),
+			},
+		})
+
+		w := postForm(authHandler.Login, "/auth/login", url.Values{"username": {"local"}, "password": {"password1"}}, "")
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		w = postForm(authHandler.Login, "/auth/login", url.Values{"username": {"alice"}, "password": {"directory1"}}, "")
+		assert.Equal(t, http.StatusInternalServerError, w.Code, "an unreachable directory isn't a wrong password")
+	})
+
+	t.Run("Unresponsive directory", func(t *testing.T) {
+		// A directory that accepts connections and never answers
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		config := ldapConfig
+		config.URL = "ldap://" + listener.Addr().String()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = auth.NewLDAPDirectory(config).Authenticate(ctx, "alice", "directory1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second, "the bind gives up at the context's deadline")
+	})
+}
+
+// TestLDAPRegistrationModes tests that the registration mode decides which directory users get a local user
+func TestLDAPRegistrationModes(t *testing.T) {
+	const (
+		carolDN = "uid=carol,ou=people,dc=example,dc=com"
+		daveDN  = "uid=dave,ou=people,dc=example,dc=com"
+	)
+	directory := newMockLDAPServer(t, map[string]mockLDAPEntry{
+		"cn=library,dc=example,dc=com": {password: "service"},
+		carolDN:                        {password: "directory1", attributes: map[string][]string{"uid": {"carol"}, "mail": {"carol@example.com"}}},
+		daveDN:                         {password: "directory2", attributes: map[string][]string{"uid": {"dave"}, "mail": {"dave@elsewhere.org"}}},
+	})
+	ldapConfig := auth.LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=library,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=example,dc=com",
+	}
+	setup := func(t *testing.T, config handlers.AuthConfig) (*db.Database, *handlers.LDAPAuthenticator) {
+		database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { database.Close() })
+		return database, handlers.NewLDAPAuthenticator(database, auth.NewLDAPDirectory(ldapConfig), nil, config)
+	}
+	ctx := context.Background()
+
+	t.Run("Approval", func(t *testing.T) {
+		database, authenticator := setup(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationApproval})
+		user, err := authenticator.Authenticate(ctx, "carol", "directory1")
+		require.NoError(t, err)
+		assert.Equal(t, models.UserPending, user.Status)
+
+		stored, err := database.GetUserByUsername("carol")
+		require.NoError(t, err)
+		assert.Equal(t, models.UserPending, stored.Status)
+	})
+
+	t.Run("Invite", func(t *testing.T) {
+		database, authenticator := setup(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationInvite})
+		_, err := authenticator.Authenticate(ctx, "carol", "directory1")
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+		_, err = database.GetUserByUsername("carol")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Domain", func(t *testing.T) {
+		database, authenticator := setup(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationDomain, AllowedDomains: []string{"example.com"}})
+		user, err := authenticator.Authenticate(ctx, "carol", "directory1")
+		require.NoError(t, err)
+		assert.Equal(t, models.UserActive, user.Status)
+
+		_, err = authenticator.Authenticate(ctx, "dave", "directory2")
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+		_, err = database.GetUserByUsername("dave")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
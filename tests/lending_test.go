@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDigitalLending tests that concurrent loans of a PDF are limited and freed loans go to the hold queue
+func TestDigitalLending(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	first := createUserWithRole(t, database, "first", "user")
+	second := createUserWithRole(t, database, "second", "user")
+	third := createUserWithRole(t, database, "third", "user")
+
+	pdfID, err := database.CreatePDF("Licensed Book", "", "", "book.pdf", "book.pdf", admin.ID)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// Unrestricted PDFs are read without a loan
+	_, err = database.BorrowPDF(first.ID, pdfID, now)
+	assert.ErrorIs(t, err, db.ErrNotLendable)
+
+	pdf, err := database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	pdf.MaxConcurrentLoans = 1
+	require.NoError(t, database.UpdatePDF(pdf, pdf.Version))
+
+	loan, err := database.BorrowPDF(first.ID, pdfID, now)
+	require.NoError(t, err)
+	assert.True(t, loan.IsActive(now))
+	assert.Equal(t, "Licensed Book", loan.PDFTitle)
+
+	_, err = database.BorrowPDF(first.ID, pdfID, now)
+	assert.ErrorIs(t, err, db.ErrAlreadyBorrowed)
+	_, err = database.BorrowPDF(second.ID, pdfID, now)
+	assert.ErrorIs(t, err, db.ErrNoLoansAvailable)
+	_, err = database.PlacePDFHold(first.ID, pdfID, now)
+	assert.ErrorIs(t, err, db.ErrAlreadyBorrowed)
+
+	secondHold, err := database.PlacePDFHold(second.ID, pdfID, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, secondHold.Position)
+	require.NotNil(t, secondHold.PDFID)
+	assert.Nil(t, secondHold.ItemID)
+	thirdHold, err := database.PlacePDFHold(third.ID, pdfID, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, thirdHold.Position)
+
+	_, err = database.PlacePDFHold(second.ID, pdfID, now)
+	assert.ErrorIs(t, err, db.ErrHoldExists)
+
+	t.Run("Returned loan is set aside for the first hold", func(t *testing.T) {
+		require.NoError(t, database.ReturnPDF(first.ID, pdfID, now))
+		assert.ErrorIs(t, database.ReturnPDF(first.ID, pdfID, now), db.ErrNoDigitalLoan)
+
+		hold, err := database.GetHoldByID(secondHold.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.HoldReady, hold.Status)
+
+		_, err = database.BorrowPDF(third.ID, pdfID, now)
+		assert.ErrorIs(t, err, db.ErrNoLoansAvailable)
+
+		_, err = database.BorrowPDF(second.ID, pdfID, now)
+		require.NoError(t, err)
+		hold, err = database.GetHoldByID(secondHold.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.HoldFulfilled, hold.Status)
+	})
+
+	t.Run("Loans expire and pass to the next hold", func(t *testing.T) {
+		later := now.Add(15 * 24 * time.Hour)
+
+		onLoan, err := database.HasActiveDigitalLoan(second.ID, pdfID, later)
+		require.NoError(t, err)
+		assert.False(t, onLoan)
+
+		expired, err := database.ExpireDigitalLoans(later)
+		require.NoError(t, err)
+		assert.Equal(t, 1, expired)
+
+		lending, err := database.GetPDFLending(pdfID, third.ID, later)
+		require.NoError(t, err)
+		require.NotNil(t, lending.Hold)
+		assert.Equal(t, models.HoldReady, lending.Hold.Status)
+		assert.Nil(t, lending.Loan)
+		assert.Equal(t, 0, lending.Available)
+
+		// The reserved loan is released when the hold isn't used in time
+		expiredHolds, err := database.ExpireHolds(later.Add(3 * 24 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, expiredHolds)
+
+		lending, err = database.GetPDFLending(pdfID, first.ID, later.Add(3*24*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, lending.Available)
+	})
+}
+
+// TestServeLendingControlledFile tests that lending-controlled PDFs are only served to borrowers
+func TestServeLendingControlledFile(t *testing.T) {
+	dir := t.TempDir()
+
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(storage.NewLocalStore(dir))
+	handler := libraryHandler.AuthMiddleware(libraryHandler.ServeFile)
+
+	user := createUserWithRole(t, database, "reader", "user")
+
+	filePath := filepath.Join(dir, "1_book.pdf")
+	require.NoError(t, os.WriteFile(filePath, []byte("%PDF-1.4\n%%EOF\n"), 0644))
+	pdfID, err := database.CreatePDF("Book", "", "", "1_book.pdf", "1_book.pdf", user.ID)
+	require.NoError(t, err)
+	pdf, err := database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	pdf.MaxConcurrentLoans = 2
+	require.NoError(t, database.UpdatePDF(pdf, pdf.Version))
+
+	token, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/library/file/%d", pdfID), nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve())
+
+	_, err = database.BorrowPDF(user.ID, pdfID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve())
+
+	require.NoError(t, database.ReturnPDF(user.ID, pdfID, time.Now()))
+	assert.Equal(t, http.StatusForbidden, serve())
+}
@@ -0,0 +1,203 @@
+package tests
+
+import (
+	"database/sql"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoginFailureBackoff tests that failed logins are slowed down exponentially and then locked out
+func TestLoginFailureBackoff(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	now := time.Now()
+	admin := createUserWithRole(t, database, "admin", "admin")
+
+	// The first three failures are free
+	for i := 0; i < 3; i++ {
+		_, err := database.RecordLoginFailure("Reader", "192.0.2.1", now)
+		require.NoError(t, err)
+	}
+	until, err := database.LoginBlockedUntil("reader", "192.0.2.1", now)
+	require.NoError(t, err)
+	assert.True(t, until.IsZero())
+
+	// Then the wait doubles with each failure
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		_, err := database.RecordLoginFailure("reader", "192.0.2.1", now)
+		require.NoError(t, err)
+		until, err := database.LoginBlockedUntil("READER", "198.51.100.7", now)
+		require.NoError(t, err)
+		waits = append(waits, until.Sub(now).Round(time.Second))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}, waits)
+
+	lockouts, err := database.GetActiveLockouts(now)
+	require.NoError(t, err)
+	assert.Empty(t, lockouts)
+
+	// The tenth failure locks the username out
+	var started []models.Lockout
+	for i := 0; i < 2; i++ {
+		started, err = database.RecordLoginFailure("reader", "192.0.2.1", now)
+		require.NoError(t, err)
+	}
+	require.Len(t, started, 1)
+	assert.Equal(t, models.LockoutUsername, started[0].Kind)
+	assert.Equal(t, "reader", started[0].Subject)
+	assert.Equal(t, "192.0.2.1", started[0].IPAddress)
+	assert.Equal(t, 10, started[0].Failures)
+
+	until, err = database.LoginBlockedUntil("reader", "198.51.100.7", now)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, until.Sub(now).Round(time.Second))
+
+	lockouts, err = database.GetActiveLockouts(now)
+	require.NoError(t, err)
+	require.Len(t, lockouts, 1)
+
+	t.Run("Unlock", func(t *testing.T) {
+		unlocked, err := database.Unlock(lockouts[0].ID, admin.ID, now)
+		require.NoError(t, err)
+		assert.Equal(t, "admin", unlocked.UnlockedByName)
+		assert.False(t, unlocked.IsActive(now))
+
+		// The username is free again, but the IP address keeps its count
+		until, err := database.LoginBlockedUntil("reader", "198.51.100.7", now)
+		require.NoError(t, err)
+		assert.True(t, until.IsZero())
+		until, err = database.LoginBlockedUntil("someone", "192.0.2.1", now)
+		require.NoError(t, err)
+		assert.True(t, until.IsZero(), "ten failures are free per IP address")
+
+		_, err = database.Unlock(lockouts[0].ID, admin.ID, now)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Counters restart after an hour without failures", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			_, err := database.RecordLoginFailure("quiet", "203.0.113.5", now)
+			require.NoError(t, err)
+		}
+		later := now.Add(2 * time.Hour)
+		_, err := database.RecordLoginFailure("quiet", "203.0.113.5", later)
+		require.NoError(t, err)
+		until, err := database.LoginBlockedUntil("quiet", "203.0.113.5", later)
+		require.NoError(t, err)
+		assert.True(t, until.IsZero())
+
+		pruned, err := database.PruneLoginFailures(later.Add(2 * time.Hour))
+		require.NoError(t, err)
+		assert.Positive(t, pruned)
+	})
+}
+
+// TestLoginThrottling tests that the login handlers refuse attempts while failures block them
+func TestLoginThrottling(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+
+	// The clock only moves when the test moves it, so slow runs don't
+	// outlast the backoff
+	now := time.Now()
+	clock := func() time.Time { return now }
+	authHandler.SetClock(clock)
+
+	hash, err := auth.HashPassword("correct1")
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", hash))
+
+	login := func(password string) int {
+		return postForm(authHandler.Login, "/auth/login", url.Values{"username": {"reader"}, "password": {password}}, "").Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusBadRequest, login("wrong"))
+	}
+	assert.Equal(t, http.StatusSeeOther, login("correct1"), "success resets the count")
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusBadRequest, login("wrong"))
+	}
+	w := postForm(authHandler.Login, "/auth/login", url.Values{"username": {"reader"}, "password": {"correct1"}}, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the password isn't checked while blocked")
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	t.Run("API", func(t *testing.T) {
+		api := handlers.NewAPIHandler(database, sessionManager)
+		api.SetClock(clock)
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"username": "reader", "password": "correct1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		api.Login(w, req)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	})
+
+	t.Run("Logins are allowed once the backoff has passed", func(t *testing.T) {
+		now = now.Add(time.Second)
+		assert.Equal(t, http.StatusSeeOther, login("correct1"))
+	})
+}
+
+// TestAdminUnlock tests removing a lockout from the admin panel
+func TestAdminUnlock(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	unlock := adminHandler.AuthMiddleware(adminHandler.Unlock)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	reader := createUserWithRole(t, database, "reader", "user")
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	readerSession, err := sessionManager.CreateSession(reader.ID, reader.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := database.RecordLoginFailure("victim", "192.0.2.1", now)
+		require.NoError(t, err)
+	}
+	lockouts, err := database.GetActiveLockouts(now)
+	require.NoError(t, err)
+	require.Len(t, lockouts, 1)
+	form := url.Values{"lockout_id": {fmt.Sprintf("%d", lockouts[0].ID)}}
+
+	w := postForm(unlock, "/admin/unlock", form, readerSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = postForm(unlock, "/admin/unlock", form, adminSession)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	lockouts, err = database.GetActiveLockouts(time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, lockouts)
+
+	w = postForm(unlock, "/admin/unlock", form, adminSession)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
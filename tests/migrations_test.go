@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"database/sql"
+	"librarymanagementsystem/internal/db"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMigrations tests applying and reverting schema migrations
+func TestMigrations(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	version, err := database.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, db.LatestSchemaVersion(), version)
+
+	statuses, err := database.MigrationStatus()
+	require.NoError(t, err)
+	require.Len(t, statuses, db.LatestSchemaVersion())
+	for _, status := range statuses {
+		assert.True(t, status.Applied, "migration %d", status.Version)
+	}
+
+	// Migrations are recorded, so running them again is a no-op
+	require.NoError(t, database.Migrate())
+
+	// Revert everything, then apply it all again
+	require.NoError(t, database.MigrateDown(0))
+	version, err = database.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	statuses, err = database.MigrationStatus()
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.False(t, status.Applied, "migration %d", status.Version)
+	}
+
+	require.NoError(t, database.MigrateUp(2))
+	version, err = database.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	require.NoError(t, database.Migrate())
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", "hash"))
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+
+	hasPermission, err := database.HasPermission(user.ID, "view_pdf")
+	require.NoError(t, err)
+	assert.True(t, hasPermission)
+}
+
+// TestMigrateLegacyDatabase tests upgrading a database created before migrations existed
+func TestMigrateLegacyDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "library.db")
+
+	// Schema and data as written by the original createTables
+	legacy, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	statements := []string{
+		`CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			email TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE pdfs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT NOT NULL,
+			author TEXT,
+			description TEXT,
+			filename TEXT NOT NULL,
+			file_path TEXT NOT NULL,
+			uploaded_by INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`INSERT INTO users (username, email, password_hash) VALUES ('admin', 'admin@example.com', 'hash')`,
+		`INSERT INTO pdfs (title, author, description, filename, file_path, uploaded_by) VALUES ('Old Book', 'Author', '', 'old.pdf', 'uploads/old.pdf', 1)`,
+	}
+	for _, statement := range statements {
+		_, err := legacy.Exec(statement)
+		require.NoError(t, err)
+	}
+	require.NoError(t, legacy.Close())
+
+	database, err := db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	defer database.Close()
+
+	version, err := database.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, db.LatestSchemaVersion(), version)
+
+	// Existing rows survive and new columns are backfilled
+	pdfs, err := database.GetAllPDFs()
+	require.NoError(t, err)
+	require.Len(t, pdfs, 1)
+	assert.Equal(t, "Old Book", pdfs[0].Title)
+	assert.Equal(t, pdfs[0].CreatedAt, pdfs[0].UpdatedAt)
+	assert.Equal(t, "old.pdf", pdfs[0].StorageKey, "file paths become keys in the uploads store")
+
+	// The first user still becomes an admin
+	hasPermission, err := database.HasPermission(1, "manage_roles")
+	require.NoError(t, err)
+	assert.True(t, hasPermission)
+}
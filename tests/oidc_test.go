@@ -0,0 +1,380 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockOIDCProvider is an identity provider that issues ID tokens with the
+// claims a test gives it, checking PKCE like a real provider.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		authorization, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != authorization.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.sign(t, authorization.claims),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) sign(t *testing.T, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize plays the user logging in at the provider: it takes the URL the
+// library redirected to and returns the callback URL with a code for claims.
+func (p *mockOIDCProvider) authorize(t *testing.T, location string, claims map[string]any) string {
+	authURL, err := url.Parse(location)
+	require.NoError(t, err)
+	query := authURL.Query()
+	require.Equal(t, p.URL+"/authorize", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+
+	idClaims := map[string]any{
+		"iss":   p.URL,
+		"aud":   query.Get("client_id"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+
+	code := auth.GenerateToken()
+	p.mu.Lock()
+	p.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), claims: idClaims}
+	p.mu.Unlock()
+
+	return query.Get("redirect_uri") + "?" + url.Values{"state": {query.Get("state")}, "code": {code}}.Encode()
+}
+
+// ssoLogin goes through a login at the provider, starting from start, and
+// returns the response to the callback.
+func ssoLogin(t *testing.T, provider *mockOIDCProvider, oidcHandler *handlers.OIDCHandler, start *httptest.ResponseRecorder, claims map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	require.Equal(t, http.StatusSeeOther, start.Code)
+	state := responseCookie(start, "oidc_state")
+	require.NotNil(t, state)
+
+	req := httptest.NewRequest("GET", provider.authorize(t, start.Header().Get("Location"), claims), nil)
+	req.AddCookie(state)
+	w := httptest.NewRecorder()
+	oidcHandler.Callback(w, req)
+	return w
+}
+
+// TestOIDCLogin tests logging in through an identity provider, creating users, mapping groups to roles and linking accounts
+func TestOIDCLogin(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	provider := newMockOIDCProvider(t)
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{
+		BaseURL:          "https://library.example.com",
+		RegistrationMode: handlers.RegistrationOpen,
+		OIDC: handlers.OIDCConfig{
+			ProviderName: "Example ID",
+			IssuerURL:    provider.URL,
+			ClientID:     "library",
+			ClientSecret: "secret",
+			RoleMapping:  map[string][]string{"library-staff": {"librarian"}},
+		},
+	})
+	oidcHandler, err := handlers.NewOIDCHandler(context.Background(), authHandler)
+	require.NoError(t, err)
+
+	startLogin := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		oidcHandler.Login(w, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+		return w
+	}
+	hasRole := func(username, role string) bool {
+		user, err := database.GetUserByUsername(username)
+		require.NoError(t, err)
+		user, err = database.GetUserWithRoles(user.ID)
+		require.NoError(t, err)
+		for _, r := range user.Roles {
+			if r.Name == role {
+				return true
+			}
+		}
+		return false
+	}
+
+	req := httptest.NewRequest("GET", "/login", nil)
+	w := httptest.NewRecorder()
+	authHandler.Login(w, req)
+	assert.Contains(t, w.Body.String(), "Log in with Example ID")
+
+	// New users get an account with the roles of their groups
+	alice := map[string]any{"sub": "alice-id", "email": "alice@example.com", "email_verified": true, "preferred_username": "alice", "groups": []string{"library-staff", "everyone"}}
+	w = ssoLogin(t, provider, oidcHandler, startLogin(), alice)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	assert.Equal(t, "/library", w.Header().Get("Location"))
+	assert.NotNil(t, responseCookie(w, "session_token"))
+
+	user, err := database.GetUserByUsername("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", user.Email)
+	assert.Empty(t, user.PasswordHash)
+	assert.True(t, user.CanUseLibrary())
+	assert.True(t, hasRole("alice", "librarian"))
+
+	alice["groups"] = "everyone"
+	w = ssoLogin(t, provider, oidcHandler, startLogin(), alice)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	assert.False(t, hasRole("alice", "librarian"), "leaving a group removes its roles")
+	assert.True(t, hasRole("alice", "user"), "unmapped roles are left alone")
+
+	t.Run("Invalid logins", func(t *testing.T) {
+		start := startLogin()
+		location := provider.authorize(t, start.Header().Get("Location"), alice)
+
+		req := httptest.NewRequest("GET", location, nil)
+		w := httptest.NewRecorder()
+		oidcHandler.Callback(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "the state cookie is required")
+
+		req = httptest.NewRequest("GET", location, nil)
+		req.AddCookie(responseCookie(start, "oidc_state"))
+		w = httptest.NewRecorder()
+		oidcHandler.Callback(w, req)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+
+		req = httptest.NewRequest("GET", location, nil)
+		req.AddCookie(responseCookie(start, "oidc_state"))
+		w = httptest.NewRecorder()
+		oidcHandler.Callback(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "states can't be replayed")
+
+		// A code issued for another login's PKCE challenge doesn't work
+		start, other := startLogin(), startLogin()
+		location = provider.authorize(t, other.Header().Get("Location"), alice)
+		callback, err := url.Parse(location)
+		require.NoError(t, err)
+		query := callback.Query()
+		query.Set("state", responseCookie(start, "oidc_state").Value)
+		req = httptest.NewRequest("GET", callback.Path+"?"+query.Encode(), nil)
+		req.AddCookie(responseCookie(start, "oidc_state"))
+		w = httptest.NewRecorder()
+		oidcHandler.Callback(w, req)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("Existing accounts are linked, not taken over", func(t *testing.T) {
+		hash, err := auth.HashPassword("password1")
+		require.NoError(t, err)
+		require.NoError(t, database.CreateUser("bob", "bob@example.com", hash))
+		bobUser, err := database.GetUserByUsername("bob")
+		require.NoError(t, err)
+
+		bob := map[string]any{"sub": "bob-id", "email": "bob@example.com", "preferred_username": "bob"}
+		w := ssoLogin(t, provider, oidcHandler, startLogin(), bob)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), "link your Example ID account")
+		assert.Nil(t, responseCookie(w, "session_token"))
+
+		session, err := sessionManager.CreateSession(bobUser.ID, bobUser.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+		start := postForm(authHandler.AuthMiddleware(oidcHandler.Link), "/auth/oidc/link", url.Values{}, session)
+		w = ssoLogin(t, provider, oidcHandler, start, bob)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		assert.Equal(t, "/account/2fa", w.Header().Get("Location"))
+
+		events, _, err := database.GetAuditEvents(db.AuditFilter{Action: models.AuditIdentityLinked}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "bob", events[0].ActorName)
+		assert.Contains(t, string(events[0].After), `"subject":"bob-id"`)
+
+		w = ssoLogin(t, provider, oidcHandler, startLogin(), bob)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		cookie := responseCookie(w, "session_token")
+		require.NotNil(t, cookie)
+		loggedIn, err := sessionManager.ValidateSession(cookie.Value)
+		require.NoError(t, err)
+		assert.Equal(t, bobUser.ID, loggedIn.UserID)
+
+		start = postForm(authHandler.AuthMiddleware(oidcHandler.Link), "/auth/oidc/link", url.Values{}, session)
+		w = ssoLogin(t, provider, oidcHandler, start, alice)
+		assert.Equal(t, http.StatusConflict, w.Code, "identities belong to one user")
+
+		identities, err := database.GetUserIdentities(bobUser.ID)
+		require.NoError(t, err)
+		require.Len(t, identities, 1)
+		w = postForm(authHandler.AuthMiddleware(authHandler.UnlinkIdentity), "/account/sso/unlink", url.Values{"identity_id": {fmt.Sprintf("%d", identities[0].ID)}}, session)
+		assert.Equal(t, http.StatusOK, w.Code)
+		identities, err = database.GetUserIdentities(bobUser.ID)
+		require.NoError(t, err)
+		assert.Empty(t, identities)
+
+		events, _, err = database.GetAuditEvents(db.AuditFilter{Action: models.AuditIdentityUnlinked}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "bob", events[0].ActorName)
+	})
+
+	t.Run("Users without a password keep their last identity", func(t *testing.T) {
+		aliceUser, err := database.GetUserByUsername("alice")
+		require.NoError(t, err)
+		identities, err := database.GetUserIdentities(aliceUser.ID)
+		require.NoError(t, err)
+		require.Len(t, identities, 1)
+
+		session, err := sessionManager.CreateSession(aliceUser.ID, aliceUser.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+		w := postForm(authHandler.AuthMiddleware(authHandler.UnlinkIdentity), "/account/sso/unlink", url.Values{"identity_id": {fmt.Sprintf("%d", identities[0].ID)}}, session)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+// TestOIDCRegistrationModes tests that logins through an identity provider only create accounts the registration mode allows
+func TestOIDCRegistrationModes(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+
+	setup := func(t *testing.T, config handlers.AuthConfig) (*db.Database, *handlers.OIDCHandler) {
+		database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { database.Close() })
+
+		config.BaseURL = "https://library.example.com"
+		config.OIDC = handlers.OIDCConfig{ProviderName: "Example ID", IssuerURL: provider.URL, ClientID: "library", ClientSecret: "secret"}
+		sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+		authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), config)
+		oidcHandler, err := handlers.NewOIDCHandler(context.Background(), authHandler)
+		require.NoError(t, err)
+		return database, oidcHandler
+	}
+	login := func(t *testing.T, oidcHandler *handlers.OIDCHandler, claims map[string]any) *httptest.ResponseRecorder {
+		start := httptest.NewRecorder()
+		oidcHandler.Login(start, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+		return ssoLogin(t, provider, oidcHandler, start, claims)
+	}
+	carol := map[string]any{"sub": "carol-id", "email": "carol@example.com", "email_verified": true, "preferred_username": "carol"}
+
+	t.Run("Invite", func(t *testing.T) {
+		database, oidcHandler := setup(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationInvite})
+		w := login(t, oidcHandler, carol)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "by invitation only")
+		assert.Nil(t, responseCookie(w, "session_token"))
+		_, err := database.GetUserByUsername("carol")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("Domain", func(t *testing.T) {
+		database, oidcHandler := setup(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationDomain, AllowedDomains: []string{"library.example.com"}})
+		w := login(t, oidcHandler, carol)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "limited to addresses at library.example.com")
+		_, err := database.GetUserByUsername("carol")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		staff := map[string]any{"sub": "dave-id", "email": "dave@library.example.com", "email_verified": true, "preferred_username": "dave"}
+		w = login(t, oidcHandler, staff)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		user, err := database.GetUserByUsername("dave")
+		require.NoError(t, err)
+		assert.True(t, user.CanUseLibrary())
+	})
+
+	t.Run("Approval", func(t *testing.T) {
+		database, oidcHandler := setup(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationApproval})
+		w := login(t, oidcHandler, carol)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		user, err := database.GetUserByUsername("carol")
+		require.NoError(t, err)
+		assert.Equal(t, models.UserPending, user.Status)
+		assert.False(t, user.CanUseLibrary())
+	})
+}
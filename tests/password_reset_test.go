@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMailer keeps sent messages instead of delivering them.
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *recordingMailer) Send(msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *recordingMailer) sent() []mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mail.Message(nil), m.messages...)
+}
+
+func postForm(handler http.HandlerFunc, path string, form url.Values, cookie string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: cookie})
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestPasswordReset tests requesting a reset link by email and using it to choose a new password
+func TestPasswordReset(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	mailer := &recordingMailer{}
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mailer, handlers.AuthConfig{BaseURL: "https://library.example.com/", RegistrationMode: handlers.RegistrationOpen})
+
+	hash, err := auth.HashPassword("oldpassword")
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", hash))
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+
+	session, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	w := postForm(authHandler.ForgotPassword, "/forgot-password", url.Values{"email": {"nobody@example.com"}}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, mailer.sent())
+	unknownBody := w.Body.String()
+
+	w = postForm(authHandler.ForgotPassword, "/forgot-password", url.Values{"email": {"Reader@Example.com"}}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, unknownBody, w.Body.String(), "response must not reveal whether the account exists")
+
+	sent := mailer.sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "reader@example.com", sent[0].To)
+	link := regexp.MustCompile(`https://library\.example\.com/reset-password\?token=\S+`).FindString(sent[0].Body)
+	require.NotEmpty(t, link)
+	linkURL, err := url.Parse(link)
+	require.NoError(t, err)
+	token := linkURL.Query().Get("token")
+
+	getReset := func(token string) int {
+		req := httptest.NewRequest("GET", "/reset-password?token="+url.QueryEscape(token), nil)
+		w := httptest.NewRecorder()
+		authHandler.ResetPassword(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, getReset(token))
+	assert.Equal(t, http.StatusBadRequest, getReset("not-a-token"))
+
+	w = postForm(authHandler.ResetPassword, "/reset-password", url.Values{"token": {token}, "password": {"newpassword"}, "confirm-password": {"different"}}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postForm(authHandler.ResetPassword, "/reset-password", url.Values{"token": {token}, "password": {"newpassword"}, "confirm-password": {"newpassword"}}, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	user, err = database.GetUserByUsername("reader")
+	require.NoError(t, err)
+	assert.True(t, auth.CheckPassword("newpassword", user.PasswordHash))
+
+	_, err = sessionManager.ValidateSession(session)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "sessions must end after a reset")
+
+	t.Run("Tokens are single use", func(t *testing.T) {
+		w := postForm(authHandler.ResetPassword, "/reset-password", url.Values{"token": {token}, "password": {"another1"}, "confirm-password": {"another1"}}, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, http.StatusBadRequest, getReset(token))
+	})
+
+	t.Run("Tokens expire", func(t *testing.T) {
+		expired := auth.GenerateToken()
+		require.NoError(t, database.CreatePasswordReset(user.ID, auth.HashToken(expired), time.Now().Add(-2*time.Hour)))
+		assert.ErrorIs(t, database.CheckPasswordReset(auth.HashToken(expired), time.Now()), db.ErrInvalidResetToken)
+	})
+
+	t.Run("A new link replaces older ones", func(t *testing.T) {
+		first := auth.GenerateToken()
+		require.NoError(t, database.CreatePasswordReset(user.ID, auth.HashToken(first), time.Now()))
+		second := auth.GenerateToken()
+		require.NoError(t, database.CreatePasswordReset(user.ID, auth.HashToken(second), time.Now()))
+
+		assert.ErrorIs(t, database.CheckPasswordReset(auth.HashToken(first), time.Now()), db.ErrInvalidResetToken)
+		assert.NoError(t, database.CheckPasswordReset(auth.HashToken(second), time.Now()))
+	})
+}
+
+// TestAdminSetPassword tests that admins can set a user's password and that it ends the user's sessions
+func TestAdminSetPassword(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	setPassword := adminHandler.AuthMiddleware(adminHandler.SetPassword)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	reader := createUserWithRole(t, database, "reader", "user")
+
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	readerSession, err := sessionManager.CreateSession(reader.ID, reader.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	form := url.Values{"user_id": {fmt.Sprintf("%d", admin.ID)}, "password": {"takeover"}}
+	w := postForm(setPassword, "/admin/set-password", form, readerSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	form = url.Values{"user_id": {fmt.Sprintf("%d", reader.ID)}, "password": {"short"}}
+	w = postForm(setPassword, "/admin/set-password", form, adminSession)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	form = url.Values{"user_id": {fmt.Sprintf("%d", reader.ID)}, "password": {"temporary"}}
+	w = postForm(setPassword, "/admin/set-password", form, adminSession)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	updated, err := database.GetUserByID(reader.ID)
+	require.NoError(t, err)
+	assert.True(t, auth.CheckPassword("temporary", updated.PasswordHash))
+
+	_, err = sessionManager.ValidateSession(readerSession)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken)
+	_, err = sessionManager.ValidateSession(adminSession)
+	assert.NoError(t, err)
+}
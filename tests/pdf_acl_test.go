@@ -0,0 +1,357 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"librarymanagementsystem/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPDFAccessControlLists tests restricting PDFs and granting users and roles access to them
+func TestPDFAccessControlLists(t *testing.T) {
+	dir := t.TempDir()
+
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(storage.NewLocalStore(dir))
+	access := libraryHandler.AuthMiddleware(libraryHandler.PDFAccess)
+
+	owner := createUserWithRole(t, database, "owner", "user")
+	reader := createUserWithRole(t, database, "reader", "user")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	admin := createUserWithRole(t, database, "admin", "admin")
+
+	filePath := filepath.Join(dir, "1_diary.pdf")
+	require.NoError(t, os.WriteFile(filePath, []byte("%PDF-1.4\n%%EOF\n"), 0644))
+	pdfID, err := database.CreatePDF("Private Diary", "Owner", "", "1_diary.pdf", "1_diary.pdf", owner.ID)
+	require.NoError(t, err)
+	_, err = database.CreatePDF("Public Book", "Author", "", "2_book.pdf", "1_diary.pdf", librarian.ID)
+	require.NoError(t, err)
+
+	session := func(user *models.User) string {
+		token, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+		return token
+	}
+	ownerSession, readerSession, librarianSession := session(owner), session(reader), session(librarian)
+
+	get := func(handler http.HandlerFunc, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	view := libraryHandler.AuthMiddleware(libraryHandler.ViewPDF)
+	file := libraryHandler.AuthMiddleware(libraryHandler.ServeFile)
+	viewPath, filePathURL := fmt.Sprintf("/library/view/%d", pdfID), fmt.Sprintf("/library/file/%d", pdfID)
+
+	titles := func(v db.PDFVisibility) []string {
+		pdfs, err := database.GetVisiblePDFs(v)
+		require.NoError(t, err)
+		var titles []string
+		for _, pdf := range pdfs {
+			titles = append(titles, pdf.Title)
+		}
+		return titles
+	}
+
+	// Only the uploader and users with manage_pdf_access may restrict a PDF
+	w := postForm(access, "/library/access", url.Values{"action": {"restrict"}, "pdf_id": {fmt.Sprint(pdfID)}, "restricted": {"true"}}, readerSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = postForm(access, "/library/access", url.Values{"action": {"restrict"}, "pdf_id": {fmt.Sprint(pdfID)}, "restricted": {"true"}}, ownerSession)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+
+	t.Run("Restricted PDFs are hidden", func(t *testing.T) {
+		assert.Equal(t, []string{"Public Book"}, titles(db.PDFVisibility{UserID: reader.ID}))
+		assert.Equal(t, []string{"Public Book"}, titles(db.PDFVisibility{UserID: librarian.ID}), "role permissions don't reach restricted PDFs")
+		assert.ElementsMatch(t, []string{"Private Diary", "Public Book"}, titles(db.PDFVisibility{UserID: owner.ID}))
+		assert.ElementsMatch(t, []string{"Private Diary", "Public Book"}, titles(db.PDFVisibility{UserID: admin.ID, All: true}))
+
+		pdfs, _, err := database.SearchPDFs(db.PDFVisibility{UserID: reader.ID}, "Diary")
+		require.NoError(t, err)
+		assert.Empty(t, pdfs)
+
+		assert.Equal(t, http.StatusForbidden, get(view, viewPath, readerSession).Code)
+		assert.Equal(t, http.StatusForbidden, get(file, filePathURL, readerSession).Code)
+		assert.Equal(t, http.StatusOK, get(view, viewPath, ownerSession).Code)
+		assert.Equal(t, http.StatusOK, get(view, viewPath, session(admin)).Code)
+
+		w := postForm(libraryHandler.AuthMiddleware(libraryHandler.DeletePDF), "/library/delete", url.Values{"pdf_id": {fmt.Sprint(pdfID)}}, librarianSession)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("User entries", func(t *testing.T) {
+		w := postForm(access, "/library/access", url.Values{"action": {"grant"}, "pdf_id": {fmt.Sprint(pdfID)}, "username": {"nobody"}, "access": {"read"}}, ownerSession)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = postForm(access, "/library/access", url.Values{"action": {"grant"}, "pdf_id": {fmt.Sprint(pdfID)}, "username": {"reader"}, "access": {"own"}}, ownerSession)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = postForm(access, "/library/access", url.Values{"action": {"grant"}, "pdf_id": {fmt.Sprint(pdfID)}, "username": {"reader"}, "access": {"read"}}, ownerSession)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+		assert.ElementsMatch(t, []string{"Private Diary", "Public Book"}, titles(db.PDFVisibility{UserID: reader.ID}))
+		assert.Equal(t, http.StatusOK, get(file, filePathURL, readerSession).Code)
+
+		level, err := database.GetPDFAccess(pdfID, reader.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PDFAccessRead, level)
+
+		// Granting again replaces the entry, and edit access includes reading
+		require.NoError(t, database.SetPDFACLEntry(pdfID, &reader.ID, nil, models.PDFAccessEdit, owner.ID, time.Now()))
+		entries, err := database.GetPDFACL(pdfID)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "reader", entries[0].Username)
+		assert.Equal(t, models.PDFAccessEdit, entries[0].Access)
+		assert.Equal(t, http.StatusOK, get(libraryHandler.AuthMiddleware(libraryHandler.EditPDF), fmt.Sprintf("/library/edit/%d", pdfID), readerSession).Code)
+		w = postForm(libraryHandler.AuthMiddleware(libraryHandler.DeletePDF), "/library/delete", url.Values{"pdf_id": {fmt.Sprint(pdfID)}}, readerSession)
+		assert.Equal(t, http.StatusForbidden, w.Code, "edit access doesn't include deleting")
+
+		w = postForm(access, "/library/access", url.Values{"action": {"revoke"}, "pdf_id": {fmt.Sprint(pdfID)}, "entry_id": {fmt.Sprint(entries[0].ID)}}, ownerSession)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, http.StatusForbidden, get(view, viewPath, readerSession).Code)
+	})
+
+	t.Run("Role entries", func(t *testing.T) {
+		librarianRole := findRole(t, database, "librarian")
+		w := postForm(access, "/library/access", url.Values{"action": {"grant"}, "pdf_id": {fmt.Sprint(pdfID)}, "role_id": {fmt.Sprint(librarianRole.ID)}, "access": {"delete"}}, ownerSession)
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+
+		assert.ElementsMatch(t, []string{"Private Diary", "Public Book"}, titles(db.PDFVisibility{UserID: librarian.ID}))
+		assert.Equal(t, []string{"Public Book"}, titles(db.PDFVisibility{UserID: reader.ID}))
+		assert.Equal(t, http.StatusOK, get(view, viewPath, librarianSession).Code)
+
+		// Deleting a role removes its entries
+		archivists, err := database.CreateRole("archivists", "")
+		require.NoError(t, err)
+		require.NoError(t, database.SetPDFACLEntry(pdfID, nil, &archivists, models.PDFAccessRead, owner.ID, time.Now()))
+		require.NoError(t, database.DeleteRole(archivists))
+		entries, err := database.GetPDFACL(pdfID)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+
+		w = postForm(libraryHandler.AuthMiddleware(libraryHandler.DeletePDF), "/library/delete", url.Values{"pdf_id": {fmt.Sprint(pdfID)}}, librarianSession)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		_, err = database.GetPDFByID(pdfID)
+		assert.Error(t, err)
+	})
+}
+
+// TestCollectionAccessControlLists tests granting access to every PDF in a collection
+func TestCollectionAccessControlLists(t *testing.T) {
+	dir := t.TempDir()
+
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(storage.NewLocalStore(dir))
+	access := libraryHandler.AuthMiddleware(libraryHandler.PDFAccess)
+	collections := libraryHandler.AuthMiddleware(libraryHandler.Collections)
+
+	owner := createUserWithRole(t, database, "owner", "user")
+	reader := createUserWithRole(t, database, "reader", "user")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	admin := createUserWithRole(t, database, "admin", "admin")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1_diary.pdf"), []byte("%PDF-1.4\n%%EOF\n"), 0644))
+	diaryID, err := database.CreatePDF("Private Diary", "Owner", "", "1_diary.pdf", "1_diary.pdf", owner.ID)
+	require.NoError(t, err)
+	lettersID, err := database.CreatePDF("Private Letters", "Owner", "", "2_letters.pdf", "1_diary.pdf", owner.ID)
+	require.NoError(t, err)
+	require.NoError(t, database.SetPDFRestricted(diaryID, true))
+	require.NoError(t, database.SetPDFRestricted(lettersID, true))
+
+	session := func(user *models.User) string {
+		token, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+		return token
+	}
+	ownerSession, readerSession, librarianSession, adminSession := session(owner), session(reader), session(librarian), session(admin)
+
+	get := func(handler http.HandlerFunc, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	view := libraryHandler.AuthMiddleware(libraryHandler.ViewPDF)
+	file := libraryHandler.AuthMiddleware(libraryHandler.ServeFile)
+	viewPath := fmt.Sprintf("/library/view/%d", diaryID)
+
+	titles := func(v db.PDFVisibility) []string {
+		pdfs, err := database.GetVisiblePDFs(v)
+		require.NoError(t, err)
+		var titles []string
+		for _, pdf := range pdfs {
+			titles = append(titles, pdf.Title)
+		}
+		return titles
+	}
+
+	// Only users with manage_pdf_access manage collections
+	w := postForm(collections, "/library/collections", url.Values{"action": {"create"}, "name": {"Archive"}}, ownerSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = postForm(collections, "/library/collections", url.Values{"action": {"create"}, "name": {"Archive"}}, adminSession)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = postForm(collections, "/library/collections", url.Values{"action": {"create"}, "name": {"archive"}}, adminSession)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	all, err := database.GetAllCollections()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	collectionID := fmt.Sprint(all[0].ID)
+
+	// The uploader puts their PDF in the collection from the viewer
+	w = postForm(access, "/library/access", url.Values{"action": {"add_collection"}, "pdf_id": {fmt.Sprint(diaryID)}, "collection_id": {collectionID}}, readerSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = postForm(access, "/library/access", url.Values{"action": {"add_collection"}, "pdf_id": {fmt.Sprint(diaryID)}, "collection_id": {collectionID}}, ownerSession)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+	w = get(view, viewPath, ownerSession)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Archive")
+
+	t.Run("User entries", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, get(view, viewPath, readerSession).Code)
+
+		w := postForm(collections, "/library/collections", url.Values{"action": {"grant"}, "collection_id": {collectionID}, "username": {"nobody"}, "access": {"read"}}, adminSession)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = postForm(collections, "/library/collections", url.Values{"action": {"grant"}, "collection_id": {collectionID}, "username": {"reader"}, "access": {"read"}}, adminSession)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		assert.Equal(t, []string{"Private Diary"}, titles(db.PDFVisibility{UserID: reader.ID}), "only PDFs in the collection are shared")
+		pdfs, _, err := database.SearchPDFs(db.PDFVisibility{UserID: reader.ID}, "Diary")
+		require.NoError(t, err)
+		assert.Len(t, pdfs, 1)
+		assert.Equal(t, http.StatusOK, get(view, viewPath, readerSession).Code)
+		assert.Equal(t, http.StatusOK, get(file, fmt.Sprintf("/library/file/%d", diaryID), readerSession).Code)
+		assert.Equal(t, http.StatusForbidden, get(view, fmt.Sprintf("/library/view/%d", lettersID), readerSession).Code)
+
+		level, err := database.GetPDFAccess(diaryID, reader.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PDFAccessRead, level)
+		w = postForm(libraryHandler.AuthMiddleware(libraryHandler.DeletePDF), "/library/delete", url.Values{"pdf_id": {fmt.Sprint(diaryID)}}, readerSession)
+		assert.Equal(t, http.StatusForbidden, w.Code, "read access doesn't include deleting")
+
+		// A PDF entry and a collection entry give the higher of the two
+		require.NoError(t, database.SetPDFACLEntry(diaryID, &reader.ID, nil, models.PDFAccessEdit, owner.ID, time.Now()))
+		level, err = database.GetPDFAccess(diaryID, reader.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PDFAccessEdit, level)
+	})
+
+	t.Run("Role entries", func(t *testing.T) {
+		librarianRole := findRole(t, database, "librarian")
+		w := postForm(collections, "/library/collections", url.Values{"action": {"grant"}, "collection_id": {collectionID}, "role_id": {fmt.Sprint(librarianRole.ID)}, "access": {"edit"}}, adminSession)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		assert.Equal(t, []string{"Private Diary"}, titles(db.PDFVisibility{UserID: librarian.ID}))
+		assert.Equal(t, http.StatusOK, get(libraryHandler.AuthMiddleware(libraryHandler.EditPDF), fmt.Sprintf("/library/edit/%d", diaryID), librarianSession).Code)
+
+		w = get(collections, "/library/collections", adminSession)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "Private Diary")
+		assert.Contains(t, w.Body.String(), "reader")
+
+		entries, err := database.GetCollectionACL(all[0].ID)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, "reader", entries[0].Username)
+		assert.Equal(t, "librarian", entries[1].RoleName)
+		w = postForm(collections, "/library/collections", url.Values{"action": {"revoke"}, "collection_id": {collectionID}, "entry_id": {fmt.Sprint(entries[1].ID)}}, adminSession)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, titles(db.PDFVisibility{UserID: librarian.ID}))
+	})
+
+	t.Run("Leaving and deleting collections", func(t *testing.T) {
+		require.NoError(t, database.AddPDFToCollection(all[0].ID, lettersID))
+		assert.ElementsMatch(t, []string{"Private Diary", "Private Letters"}, titles(db.PDFVisibility{UserID: reader.ID}))
+
+		w := postForm(access, "/library/access", url.Values{"action": {"remove_collection"}, "pdf_id": {fmt.Sprint(lettersID)}, "collection_id": {collectionID}}, ownerSession)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, []string{"Private Diary"}, titles(db.PDFVisibility{UserID: reader.ID}), "the diary's own entry still applies")
+
+		require.NoError(t, database.AddPDFToCollection(all[0].ID, lettersID))
+		w = postForm(collections, "/library/collections", url.Values{"action": {"delete"}, "collection_id": {collectionID}}, adminSession)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []string{"Private Diary"}, titles(db.PDFVisibility{UserID: reader.ID}))
+		inCollections, err := database.GetPDFCollections(lettersID)
+		require.NoError(t, err)
+		assert.Empty(t, inCollections)
+
+		events, _, err := database.GetAuditEvents(db.AuditFilter{TargetType: models.AuditTargetCollection}, 10, 0)
+		require.NoError(t, err)
+		var actions []string
+		for _, event := range events {
+			actions = append(actions, event.Action)
+		}
+		assert.Contains(t, actions, models.AuditCollectionCreated)
+		assert.Contains(t, actions, models.AuditCollectionAccess)
+		assert.Contains(t, actions, models.AuditCollectionDeleted)
+	})
+}
+
+// TestAPIPDFAccessControlLists tests that the API hides restricted PDFs from users without access
+func TestAPIPDFAccessControlLists(t *testing.T) {
+	server := newAPITestServer(t)
+
+	owner := createUserWithRole(t, server.database, "owner", "librarian")
+	reader := createUserWithRole(t, server.database, "reader", "librarian")
+	pdfID, err := server.database.CreatePDF("Private Diary", "Owner", "", "1_diary.pdf", "1_diary.pdf", owner.ID)
+	require.NoError(t, err)
+	require.NoError(t, server.database.SetPDFRestricted(pdfID, true))
+	readerToken := server.token(t, reader)
+	pdfPath := fmt.Sprintf("/api/v1/pdfs/%d", pdfID)
+
+	status, body := server.do(t, "GET", "/api/v1/pdfs", readerToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Empty(t, body["data"])
+	status, _ = server.do(t, "GET", pdfPath, readerToken, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = server.do(t, "DELETE", pdfPath, readerToken, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, body = server.do(t, "GET", pdfPath, server.token(t, owner), nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, body["data"].(map[string]any)["restricted"])
+
+	require.NoError(t, server.database.SetPDFACLEntry(pdfID, &reader.ID, nil, models.PDFAccessRead, owner.ID, time.Now()))
+	status, body = server.do(t, "GET", "/api/v1/pdfs", readerToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	assert.Len(t, body["data"], 1)
+	status, _ = server.do(t, "DELETE", pdfPath, readerToken, nil)
+	assert.Equal(t, http.StatusForbidden, status, "read access doesn't include deleting")
+
+	// Unrestricted PDFs still need view_pdf, as in the UI
+	publicID, err := server.database.CreatePDF("Public Notes", "Owner", "", "1_notes.pdf", "1_notes.pdf", owner.ID)
+	require.NoError(t, err)
+	guest := createUserWithRole(t, server.database, "guest", "")
+	roles, err := server.database.GetUserRoles(guest.ID)
+	require.NoError(t, err)
+	for _, role := range roles {
+		require.NoError(t, server.database.RemoveRole(guest.ID, role.ID))
+	}
+	status, _ = server.do(t, "GET", fmt.Sprintf("/api/v1/pdfs/%d", publicID), server.token(t, guest), nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = server.do(t, "GET", fmt.Sprintf("/api/v1/pdfs/%d", publicID), readerToken, nil)
+	assert.Equal(t, http.StatusOK, status)
+}
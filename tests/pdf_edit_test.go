@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUpdatePDFOptimisticConcurrency tests that stale edits are rejected instead of overwriting newer changes
+func TestUpdatePDFOptimisticConcurrency(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	require.NoError(t, database.CreateUser("librarian", "librarian@example.com", "hash"))
+	user, err := database.GetUserByUsername("librarian")
+	require.NoError(t, err)
+	pdfID, err := database.CreatePDF("Original", "Author", "", "1_book.pdf", "1_book.pdf", user.ID)
+	require.NoError(t, err)
+
+	// Two librarians open the edit form at the same time
+	first, err := database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	second, err := database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+
+	first.Title = "First edit"
+	require.NoError(t, database.UpdatePDF(first, first.Version))
+
+	second.Title = "Second edit"
+	err = database.UpdatePDF(second, second.Version)
+	assert.ErrorIs(t, err, db.ErrConflict)
+
+	current, err := database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	assert.Equal(t, "First edit", current.Title)
+
+	// Editing again from the current version succeeds
+	current.Title = "Second edit"
+	require.NoError(t, database.UpdatePDF(current, current.Version))
+
+	current, err = database.GetPDFByID(pdfID)
+	require.NoError(t, err)
+	assert.Equal(t, "Second edit", current.Title)
+	assert.Equal(t, 3, current.Version, "every update increments the version")
+}
+
+// editPDF posts the edit form of a PDF as a multipart form, without a new file.
+func editPDF(t *testing.T, libraryHandler *handlers.LibraryHandler, session string, pdfID int, fields url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, values := range fields {
+		for _, value := range values {
+			form.WriteField(name, value)
+		}
+	}
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/library/edit/%d", pdfID), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w := httptest.NewRecorder()
+	libraryHandler.AuthMiddleware(libraryHandler.EditPDF).ServeHTTP(w, req)
+	return w
+}
+
+// TestEditPDF tests the edit form's permission check, version round trip, conflicts and validation
+func TestEditPDF(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	edit := libraryHandler.AuthMiddleware(libraryHandler.EditPDF)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	reader := createUserWithRole(t, database, "reader", "user")
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	readerSession, err := sessionManager.CreateSession(reader.ID, reader.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	pdfID, err := database.CreatePDF("Original", "Author", "", "1_book.pdf", "1_book.pdf", admin.ID)
+	require.NoError(t, err)
+	path := fmt.Sprintf("/library/edit/%d", pdfID)
+
+	get := func(handler http.HandlerFunc, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	versionField := regexp.MustCompile(`name="version" value="([0-9]+)"`)
+
+	// formVersion returns the version carried by the edit form
+	formVersion := func(body string) string {
+		t.Helper()
+		match := versionField.FindStringSubmatch(body)
+		require.NotNil(t, match, "the form carries the version")
+		return match[1]
+	}
+
+	t.Run("Editing needs edit_pdf", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, get(edit, path, readerSession).Code)
+		w := editPDF(t, libraryHandler, readerSession, pdfID, url.Values{"title": {"Mine"}, "version": {"1"}})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		pdf, err := database.GetPDFByID(pdfID)
+		require.NoError(t, err)
+		assert.Equal(t, "Original", pdf.Title)
+	})
+
+	t.Run("The form round-trips the version", func(t *testing.T) {
+		w := get(edit, path, adminSession)
+		require.Equal(t, http.StatusOK, w.Code)
+		version := formVersion(w.Body.String())
+		assert.Equal(t, "1", version)
+
+		w = editPDF(t, libraryHandler, adminSession, pdfID, url.Values{"title": {"Renamed"}, "author": {"Author"}, "version": {version}})
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+
+		pdf, err := database.GetPDFByID(pdfID)
+		require.NoError(t, err)
+		assert.Equal(t, "Renamed", pdf.Title)
+		assert.Equal(t, 2, pdf.Version)
+		assert.Equal(t, "2", formVersion(get(edit, path, adminSession).Body.String()))
+	})
+
+	t.Run("Stale edits are rejected with the current values", func(t *testing.T) {
+		w := editPDF(t, libraryHandler, adminSession, pdfID, url.Values{"title": {"Stale"}, "version": {"1"}})
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Contains(t, w.Body.String(), "changed by someone else")
+		assert.Contains(t, w.Body.String(), `value="Renamed"`)
+		assert.Equal(t, "2", formVersion(w.Body.String()))
+
+		pdf, err := database.GetPDFByID(pdfID)
+		require.NoError(t, err)
+		assert.Equal(t, "Renamed", pdf.Title)
+	})
+
+	t.Run("Invalid forms are rejected", func(t *testing.T) {
+		for name, form := range map[string]url.Values{
+			"missing title":   {"title": {""}, "version": {"2"}},
+			"missing version": {"title": {"No Version"}},
+			"invalid version": {"title": {"Bad Version"}, "version": {"two"}},
+			"negative loans":  {"title": {"Negative"}, "version": {"2"}, "max_concurrent_loans": {"-1"}},
+		} {
+			w := editPDF(t, libraryHandler, adminSession, pdfID, form)
+			assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		}
+
+		pdf, err := database.GetPDFByID(pdfID)
+		require.NoError(t, err)
+		assert.Equal(t, "Renamed", pdf.Title)
+		assert.Equal(t, 2, pdf.Version)
+	})
+}
@@ -0,0 +1,227 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRegistrationTest(t *testing.T, config handlers.AuthConfig) (*db.Database, *auth.SessionManager, *recordingMailer, *handlers.AuthHandler) {
+	t.Helper()
+
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	mailer := &recordingMailer{}
+	config.BaseURL = "https://library.example.com"
+	return database, sessionManager, mailer, handlers.NewAuthHandler(database, sessionManager, mailer, config)
+}
+
+func registrationForm(username, email string) url.Values {
+	return url.Values{
+		"username":         {username},
+		"email":            {email},
+		"password":         {"password1"},
+		"confirm-password": {"password1"},
+	}
+}
+
+// sessionCookie returns the session token set by a response.
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "session_token" {
+			return cookie.Value
+		}
+	}
+	t.Fatal("no session cookie set")
+	return ""
+}
+
+// emailedToken returns the token in the first link to path in a message body.
+func emailedToken(t *testing.T, body, path string) string {
+	t.Helper()
+	link := regexp.MustCompile(regexp.QuoteMeta("https://library.example.com"+path) + `\S+`).FindString(body)
+	require.NotEmpty(t, link)
+	linkURL, err := url.Parse(link)
+	require.NoError(t, err)
+	for _, values := range linkURL.Query() {
+		return values[0]
+	}
+	t.Fatal("link has no token")
+	return ""
+}
+
+// TestEmailVerification tests that new accounts can't use the library until their email address is verified
+func TestEmailVerification(t *testing.T) {
+	database, sessionManager, mailer, authHandler := newRegistrationTest(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationOpen})
+	library := handlers.NewLibraryHandler(database, sessionManager)
+	index := library.AuthMiddleware(library.Index)
+
+	w := postForm(authHandler.Register, "/auth/register", registrationForm("reader", "reader@example.com"), "")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/account/pending", w.Header().Get("Location"))
+	session := sessionCookie(t, w)
+
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+	assert.False(t, user.IsEmailVerified())
+	assert.Equal(t, models.UserActive, user.Status)
+
+	req := httptest.NewRequest("GET", "/library", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w = httptest.NewRecorder()
+	index(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/account/pending", w.Header().Get("Location"))
+
+	t.Run("API rejects unverified users", func(t *testing.T) {
+		api := handlers.NewAPIHandler(database, sessionManager)
+		req := httptest.NewRequest("GET", "/api/v1/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+session)
+		w := httptest.NewRecorder()
+		api.AuthMiddleware(api.Me)(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	w = postForm(authHandler.AccountPending, "/account/pending", nil, session)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	sent := mailer.sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "reader@example.com", sent[0].To)
+	first := emailedToken(t, sent[0].Body, "/verify-email")
+	second := emailedToken(t, sent[1].Body, "/verify-email")
+
+	verify := func(token string) int {
+		req := httptest.NewRequest("GET", "/verify-email?token="+url.QueryEscape(token), nil)
+		w := httptest.NewRecorder()
+		authHandler.VerifyEmail(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, verify("not-a-token"))
+	assert.Equal(t, http.StatusOK, verify(second))
+	assert.Equal(t, http.StatusBadRequest, verify(second), "links are single use")
+	assert.Equal(t, http.StatusBadRequest, verify(first), "sending a new link replaces older ones")
+
+	user, err = database.GetUserByUsername("reader")
+	require.NoError(t, err)
+	assert.True(t, user.CanUseLibrary())
+
+	req = httptest.NewRequest("GET", "/library", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w = httptest.NewRecorder()
+	index(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// TestRegistrationModes tests the restrictions each registration mode puts on who can register
+func TestRegistrationModes(t *testing.T) {
+	t.Run("Domain", func(t *testing.T) {
+		database, _, _, authHandler := newRegistrationTest(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationDomain, AllowedDomains: []string{"example.edu"}})
+
+		w := postForm(authHandler.Register, "/auth/register", registrationForm("outsider", "outsider@example.com"), "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		_, err := database.GetUserByUsername("outsider")
+		assert.Error(t, err)
+
+		w = postForm(authHandler.Register, "/auth/register", registrationForm("student", "student@Example.EDU"), "")
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+	})
+
+	t.Run("Approval", func(t *testing.T) {
+		database, sessionManager, mailer, authHandler := newRegistrationTest(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationApproval})
+		adminHandler := handlers.NewAdminHandler(database, sessionManager)
+		approve := adminHandler.AuthMiddleware(adminHandler.Approve)
+
+		w := postForm(authHandler.Register, "/auth/register", registrationForm("reader", "reader@example.com"), "")
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		sent := mailer.sent()
+		require.Len(t, sent, 1)
+		req := httptest.NewRequest("GET", "/verify-email?token="+url.QueryEscape(emailedToken(t, sent[0].Body, "/verify-email")), nil)
+		authHandler.VerifyEmail(httptest.NewRecorder(), req)
+
+		user, err := database.GetUserByUsername("reader")
+		require.NoError(t, err)
+		assert.True(t, user.IsEmailVerified())
+		assert.Equal(t, models.UserPending, user.Status)
+		assert.False(t, user.CanUseLibrary())
+
+		admin := createUserWithRole(t, database, "admin", "admin")
+		adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+
+		w = postForm(approve, "/admin/approve", url.Values{"user_id": {fmt.Sprintf("%d", user.ID)}}, adminSession)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+
+		user, err = database.GetUserByUsername("reader")
+		require.NoError(t, err)
+		assert.True(t, user.CanUseLibrary())
+	})
+
+	t.Run("Invite", func(t *testing.T) {
+		database, sessionManager, mailer, authHandler := newRegistrationTest(t, handlers.AuthConfig{RegistrationMode: handlers.RegistrationInvite})
+		invite := authHandler.AuthMiddleware(authHandler.Invite)
+
+		w := postForm(authHandler.Register, "/auth/register", registrationForm("reader", "reader@example.com"), "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		admin := createUserWithRole(t, database, "admin", "admin")
+		member := createUserWithRole(t, database, "member", "user")
+		adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+		memberSession, err := sessionManager.CreateSession(member.ID, member.Username, "127.0.0.1", "test")
+		require.NoError(t, err)
+
+		w = postForm(invite, "/admin/invite", url.Values{"email": {"reader@example.com"}}, memberSession)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = postForm(invite, "/admin/invite", url.Values{"email": {"reader@example.com"}}, adminSession)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		sent := mailer.sent()
+		require.Len(t, sent, 1)
+		assert.Equal(t, "reader@example.com", sent[0].To)
+		token := emailedToken(t, sent[0].Body, "/register")
+
+		invitations, err := database.GetOpenInvitations(time.Now())
+		require.NoError(t, err)
+		require.Len(t, invitations, 1)
+		assert.Equal(t, "admin", invitations[0].InviterName)
+
+		form := registrationForm("reader", "someone-else@example.com")
+		form.Set("invite", token)
+		w = postForm(authHandler.Register, "/auth/register", form, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		form = registrationForm("reader", "Reader@example.com")
+		form.Set("invite", token)
+		w = postForm(authHandler.Register, "/auth/register", form, "")
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/library", w.Header().Get("Location"))
+
+		user, err := database.GetUserByUsername("reader")
+		require.NoError(t, err)
+		assert.True(t, user.CanUseLibrary(), "invited users don't need to verify their address")
+		assert.Len(t, mailer.sent(), 1)
+
+		form = registrationForm("another", "reader@example.com")
+		form.Set("invite", token)
+		w = postForm(authHandler.Register, "/auth/register", form, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, "invitations are single use")
+	})
+}
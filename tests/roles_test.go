@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findRole returns the role with the given name.
+func findRole(t *testing.T, database *db.Database, name string) models.Role {
+	t.Helper()
+
+	roles, err := database.GetAllRoles()
+	require.NoError(t, err)
+	for _, role := range roles {
+		if role.Name == name {
+			return role
+		}
+	}
+	t.Fatalf("role %s not found", name)
+	return models.Role{}
+}
+
+// findPermission returns the permission with the given name.
+func findPermission(t *testing.T, database *db.Database, name string) models.Permission {
+	t.Helper()
+
+	permissions, err := database.GetAllPermissions()
+	require.NoError(t, err)
+	for _, permission := range permissions {
+		if permission.Name == name {
+			return permission
+		}
+	}
+	t.Fatalf("permission %s not found", name)
+	return models.Permission{}
+}
+
+// TestRoleManagement tests creating, renaming and deleting roles and editing the permission matrix from the admin panel
+func TestRoleManagement(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	roles := adminHandler.AuthMiddleware(adminHandler.Roles)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	reader := createUserWithRole(t, database, "reader", "user")
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	readerSession, err := sessionManager.CreateSession(reader.ID, reader.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	w := postForm(roles, "/admin/roles", url.Values{"action": {"create"}, "name": {"archivist"}}, readerSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Creating roles
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"create"}, "name": {"archivist"}, "description": {"Keeps the archive"}}, adminSession)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "Created role archivist")
+	archivist := findRole(t, database, "archivist")
+	assert.Equal(t, "Keeps the archive", archivist.Description)
+	assert.False(t, archivist.BuiltIn)
+
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"create"}, "name": {"archivist"}}, adminSession)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"create"}, "name": {"staff=admin"}}, adminSession)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "names can't contain role mapping separators")
+
+	// Built-in roles can't be renamed or deleted, but their descriptions can change
+	userRole := findRole(t, database, "user")
+	assert.True(t, userRole.BuiltIn)
+	roleID := fmt.Sprintf("%d", userRole.ID)
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"update"}, "role_id": {roleID}, "name": {"patron"}}, adminSession)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"update"}, "role_id": {roleID}, "name": {"user"}, "description": {"Library patron"}}, adminSession)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Library patron", findRole(t, database, "user").Description)
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"delete"}, "role_id": {roleID}}, adminSession)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"update"}, "role_id": {fmt.Sprintf("%d", archivist.ID)}, "name": {"archivists"}}, adminSession)
+	assert.Equal(t, http.StatusOK, w.Code)
+	archivist = findRole(t, database, "archivists")
+
+	// The permission matrix replaces the permissions of the roles it lists
+	require.NoError(t, database.AssignRole(reader.ID, archivist.ID, nil))
+	editPDF := findPermission(t, database, "edit_pdf")
+	viewPDF := findPermission(t, database, "view_pdf")
+	w = postForm(roles, "/admin/roles", url.Values{
+		"action":  {"permissions"},
+		"role_id": {fmt.Sprintf("%d", archivist.ID)},
+		"grant":   {fmt.Sprintf("%d:%d", archivist.ID, editPDF.ID), fmt.Sprintf("%d:%d", archivist.ID, viewPDF.ID)},
+	}, adminSession)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	hasPerm, err := database.HasPermission(reader.ID, "edit_pdf")
+	require.NoError(t, err)
+	assert.True(t, hasPerm)
+	permissions, err := database.GetRolePermissions(findRole(t, database, "admin").ID)
+	require.NoError(t, err)
+	assert.NotEmpty(t, permissions, "roles left out of the matrix keep their permissions")
+
+	w = postForm(roles, "/admin/roles", url.Values{
+		"action":  {"permissions"},
+		"role_id": {fmt.Sprintf("%d", archivist.ID)},
+		"grant":   {fmt.Sprintf("%d:%d", archivist.ID, 999999)},
+	}, adminSession)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = postForm(roles, "/admin/roles", url.Values{"action": {"delete"}, "role_id": {fmt.Sprintf("%d", archivist.ID)}}, adminSession)
+	require.Equal(t, http.StatusOK, w.Code)
+	hasPerm, err = database.HasPermission(reader.ID, "edit_pdf")
+	require.NoError(t, err)
+	assert.False(t, hasPerm, "deleting a role takes its permissions from its members")
+
+	t.Run("Last role manager", func(t *testing.T) {
+		adminRole := findRole(t, database, "admin")
+		manageRoles := findPermission(t, database, "manage_roles")
+
+		assert.ErrorIs(t, database.RemoveRole(admin.ID, adminRole.ID), db.ErrLastRoleManager)
+		assert.ErrorIs(t, database.SetRolePermissions(map[int][]int{adminRole.ID: {}}), db.ErrLastRoleManager)
+		permissions, err := database.GetRolePermissions(adminRole.ID)
+		require.NoError(t, err)
+		assert.NotEmpty(t, permissions, "a refused change is rolled back")
+
+		w := postForm(adminHandler.AuthMiddleware(adminHandler.RemoveRole), "/admin/remove-role", url.Values{
+			"user_id": {fmt.Sprintf("%d", admin.ID)},
+			"role_id": {fmt.Sprintf("%d", adminRole.ID)},
+		}, adminSession)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		// A custom role holding manage_roles can't be deleted while its
+		// members are the only ones who can manage roles
+		keyholders, err := database.CreateRole("keyholders", "")
+		require.NoError(t, err)
+		require.NoError(t, database.SetRolePermissions(map[int][]int{keyholders: {manageRoles.ID}}))
+		require.NoError(t, database.AssignRole(reader.ID, keyholders, nil))
+		require.NoError(t, database.RemoveRole(admin.ID, adminRole.ID), "someone else can still manage roles")
+		assert.ErrorIs(t, database.DeleteRole(keyholders), db.ErrLastRoleManager)
+
+		require.NoError(t, database.AssignRole(admin.ID, adminRole.ID, nil))
+		assert.NoError(t, database.DeleteRole(keyholders))
+	})
+}
+
+// TestAPIRoleManagement tests creating, updating and deleting roles and replacing their permissions through the API
+func TestAPIRoleManagement(t *testing.T) {
+	server := newAPITestServer(t)
+
+	admin := createUserWithRole(t, server.database, "admin", "admin")
+	adminToken := server.token(t, admin)
+	viewPDF := findPermission(t, server.database, "view_pdf")
+
+	status, body := server.do(t, "POST", "/api/v1/roles", adminToken, map[string]string{"name": "archivist", "description": "Keeps the archive"})
+	require.Equal(t, http.StatusCreated, status)
+	data := body["data"].(map[string]any)
+	assert.Equal(t, "archivist", data["name"])
+	assert.Equal(t, false, data["built_in"])
+	rolePath := fmt.Sprintf("/api/v1/roles/%d", int(data["id"].(float64)))
+
+	status, body = server.do(t, "POST", "/api/v1/roles", adminToken, map[string]string{"name": "archivist"})
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "conflict", errorCode(body))
+
+	status, body = server.do(t, "PATCH", rolePath, adminToken, map[string]string{"description": "Archive staff"})
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "archivist", body["data"].(map[string]any)["name"])
+	assert.Equal(t, "Archive staff", body["data"].(map[string]any)["description"])
+
+	status, body = server.do(t, "PUT", rolePath+"/permissions", adminToken, map[string][]int{"permission_ids": {viewPDF.ID}})
+	require.Equal(t, http.StatusOK, status)
+	assert.Len(t, body["data"].(map[string]any)["permissions"], 1)
+	status, _ = server.do(t, "PUT", rolePath+"/permissions", adminToken, map[string][]int{"permission_ids": {999999}})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	adminPath := fmt.Sprintf("/api/v1/roles/%d", findRole(t, server.database, "admin").ID)
+	status, _ = server.do(t, "PATCH", adminPath, adminToken, map[string]string{"name": "root"})
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = server.do(t, "DELETE", adminPath, adminToken, nil)
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = server.do(t, "PUT", adminPath+"/permissions", adminToken, map[string][]int{"permission_ids": {viewPDF.ID}})
+	assert.Equal(t, http.StatusConflict, status, "admins can't take away their own last way to manage roles")
+
+	status, _ = server.do(t, "DELETE", fmt.Sprintf("/api/v1/users/%d/roles/%d", admin.ID, findRole(t, server.database, "admin").ID), adminToken, nil)
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, _ = server.do(t, "DELETE", rolePath, adminToken, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = server.do(t, "GET", rolePath, adminToken, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+}
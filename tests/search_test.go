@@ -0,0 +1,241 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/pdftext"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestPDF writes a minimal PDF with one line of Helvetica text per page
+func writeTestPDF(t *testing.T, path string, pages []string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, testPDF(pages...), 0644))
+}
+
+// testPDF returns a minimal PDF with one line of Helvetica text per page
+func testPDF(pages ...string) []byte {
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	)
+	for i, text := range pages {
+		stream := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.Bytes()
+}
+
+// TestExtractPages tests that text is extracted per page, in page order
+func TestExtractPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "book.pdf")
+	writeTestPDF(t, path, []string{"Call me Ishmael", "The white whale"})
+
+	pages, err := pdftext.ExtractPages(path)
+	require.NoError(t, err)
+	require.Len(t, pages, 2)
+	assert.Contains(t, pages[0], "Ishmael")
+	assert.Contains(t, pages[1], "whale")
+
+	// Files that aren't PDFs are reported as errors, not panics
+	notPDF := filepath.Join(t.TempDir(), "notes.pdf")
+	require.NoError(t, os.WriteFile(notPDF, []byte("plain text"), 0644))
+	_, err = pdftext.ExtractPages(notPDF)
+	assert.Error(t, err)
+}
+
+// TestCreateSearchIndex tests that reindexing creates a missing search index
+func TestCreateSearchIndex(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "library.db")
+	database, err := db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	if !database.FullTextSearchEnabled() {
+		database.Close()
+		t.Skip("SQLite built without FTS5; run tests with -tags sqlite_fts5")
+	}
+	require.NoError(t, database.CreateUser("librarian", "librarian@example.com", "hash"))
+	user, err := database.GetUserByUsername("librarian")
+	require.NoError(t, err)
+	id, err := database.CreatePDF("Moby Dick", "Herman Melville", "", "moby.pdf", "moby.pdf", user.ID)
+	require.NoError(t, err)
+	database.Close()
+
+	// As if a build without FTS5 had migrated the database
+	raw, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	for _, statement := range []string{
+		`DROP TRIGGER pdfs_search_delete`, `DROP TRIGGER pdfs_search_update`, `DROP TRIGGER pdfs_search_insert`, `DROP TABLE pdf_search`,
+	} {
+		_, err := raw.Exec(statement)
+		require.NoError(t, err)
+	}
+	raw.Close()
+
+	database, err = db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	defer database.Close()
+	assert.False(t, database.FullTextSearchEnabled())
+	assert.Contains(t, database.SearchIndexWarning(), "run reindex")
+
+	require.NoError(t, database.CreateSearchIndex())
+	assert.True(t, database.FullTextSearchEnabled())
+	assert.Empty(t, database.SearchIndexWarning())
+
+	pdfs, _, err := database.SearchPDFs(db.PDFVisibility{All: true}, "Melville")
+	require.NoError(t, err)
+	require.Len(t, pdfs, 1)
+	assert.Equal(t, id, pdfs[0].ID, "existing PDFs are indexed")
+
+	version, err := database.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, db.LatestSchemaVersion(), version, "no migration is reverted")
+}
+
+// TestSearchPDFs tests metadata and full-text search, including page snippets
+func TestSearchPDFs(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	// Builds without FTS5 explain why search falls back to LIKE
+	assert.Equal(t, database.FullTextSearchEnabled(), database.SearchIndexWarning() == "")
+
+	require.NoError(t, database.CreateUser("librarian", "librarian@example.com", "hash"))
+	user, err := database.GetUserByUsername("librarian")
+	require.NoError(t, err)
+
+	mobyDick, err := database.CreatePDF("Moby Dick", "Herman Melville", "A whaling voyage", "1_moby.pdf", "1_moby.pdf", user.ID)
+	require.NoError(t, err)
+	emma, err := database.CreatePDF("Emma", "Jane Austen", "A comedy of manners", "2_emma.pdf", "2_emma.pdf", user.ID)
+	require.NoError(t, err)
+
+	t.Run("Metadata matches", func(t *testing.T) {
+		pdfs, _, err := database.SearchPDFs(db.PDFVisibility{All: true}, "Melville")
+		require.NoError(t, err)
+		require.Len(t, pdfs, 1)
+		assert.Equal(t, mobyDick, pdfs[0].ID)
+	})
+
+	if !database.FullTextSearchEnabled() {
+		t.Skip("SQLite built without FTS5; run tests with -tags sqlite_fts5")
+	}
+
+	require.NoError(t, database.IndexPDFPages(mobyDick, []string{"Call me Ishmael.", "", "Towards thee I roll, thou all-destroying but unconquering whale"}))
+	require.NoError(t, database.IndexPDFPages(emma, []string{"Emma Woodhouse, handsome, clever, and rich"}))
+
+	t.Run("Page text matches with snippets", func(t *testing.T) {
+		pdfs, matches, err := database.SearchPDFs(db.PDFVisibility{All: true}, "unconquering")
+		require.NoError(t, err)
+		require.Len(t, pdfs, 1)
+		assert.Equal(t, mobyDick, pdfs[0].ID)
+
+		require.Len(t, matches[mobyDick], 1)
+		match := matches[mobyDick][0]
+		assert.Equal(t, 3, match.Page)
+
+		var highlighted []string
+		for _, part := range match.Snippet {
+			if part.Highlight {
+				highlighted = append(highlighted, part.Text)
+			}
+		}
+		assert.Equal(t, []string{"unconquering"}, highlighted)
+	})
+
+	t.Run("Stemming and prefix matching", func(t *testing.T) {
+		pdfs, _, err := database.SearchPDFs(db.PDFVisibility{All: true}, "handsomely cle")
+		require.NoError(t, err)
+		require.Len(t, pdfs, 1)
+		assert.Equal(t, emma, pdfs[0].ID)
+	})
+
+	t.Run("Query syntax is treated as text", func(t *testing.T) {
+		_, _, err := database.SearchPDFs(db.PDFVisibility{All: true}, `"Ishmael AND (OR`)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Hidden matches don't crowd out visible ones", func(t *testing.T) {
+		require.NoError(t, database.CreateUser("patron", "patron@example.com", "hash"))
+		patron, err := database.GetUserByUsername("patron")
+		require.NoError(t, err)
+
+		// More matching rows than the search returns, all better matches
+		// than the one the patron can see
+		pages := make([]string, 10)
+		for i := range pages {
+			pages[i] = "The kraken rises"
+		}
+		for i := 0; i < 50; i++ {
+			id, err := database.CreatePDF(fmt.Sprintf("Kraken %d", i), "", "", "kraken.pdf", "kraken.pdf", user.ID)
+			require.NoError(t, err)
+			require.NoError(t, database.SetPDFRestricted(id, true))
+			require.NoError(t, database.IndexPDFPages(id, pages))
+		}
+		visible, err := database.CreatePDF("Sea Monsters", "", "", "sea.pdf", "sea.pdf", user.ID)
+		require.NoError(t, err)
+		require.NoError(t, database.IndexPDFPages(visible, []string{"Tales of the kraken"}))
+
+		pdfs, matches, err := database.SearchPDFs(db.PDFVisibility{UserID: patron.ID}, "kraken")
+		require.NoError(t, err)
+		require.Len(t, pdfs, 1)
+		assert.Equal(t, visible, pdfs[0].ID)
+		require.Len(t, matches[visible], 1)
+		assert.Equal(t, 1, matches[visible][0].Page)
+
+		pdfs, _, err = database.SearchPDFs(db.PDFVisibility{UserID: user.ID}, "kraken")
+		require.NoError(t, err)
+		assert.Len(t, pdfs, 51, "uploaders see their restricted PDFs")
+	})
+
+	t.Run("Edits update the index", func(t *testing.T) {
+		pdf, err := database.GetPDFByID(emma)
+		require.NoError(t, err)
+		pdf.Author = "J. Austen"
+		require.NoError(t, database.UpdatePDF(pdf, pdf.Version))
+
+		pdfs, _, err := database.SearchPDFs(db.PDFVisibility{All: true}, "Jane")
+		require.NoError(t, err)
+		assert.Empty(t, pdfs)
+	})
+
+	t.Run("Deleted PDFs are removed from the index", func(t *testing.T) {
+		require.NoError(t, database.DeletePDF(mobyDick))
+
+		pdfs, _, err := database.SearchPDFs(db.PDFVisibility{All: true}, "whale")
+		require.NoError(t, err)
+		assert.Empty(t, pdfs)
+	})
+}
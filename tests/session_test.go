@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSessionStores tests the session lifecycle against every store implementation
+func TestSessionStores(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", "hash"))
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+
+	stores := map[string]auth.SessionStore{
+		"memory": auth.NewMemorySessionStore(),
+		"sqlite": db.NewSessionStore(database),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			sm := auth.NewSessionManager(store)
+
+			token, err := sm.CreateSession(user.ID, user.Username, "10.0.0.1", "Test-Agent/1.0")
+			require.NoError(t, err)
+
+			session, err := sm.ValidateSession(token)
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, session.UserID)
+			assert.Equal(t, "10.0.0.1", session.IPAddress)
+			assert.Equal(t, "Test-Agent/1.0", session.UserAgent)
+
+			// Tokens are stored hashed, never in plain text
+			_, err = store.Get(token)
+			assert.Error(t, err)
+
+			sessions, err := sm.UserSessions(user.ID)
+			require.NoError(t, err)
+			assert.Len(t, sessions, 1)
+
+			// Concurrent validation and cleanup must not race
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					sm.ValidateSession(token)
+				}()
+				go func() {
+					defer wg.Done()
+					sm.CleanupExpiredSessions()
+				}()
+			}
+			wg.Wait()
+
+			sm.DestroySession(token)
+			_, err = sm.ValidateSession(token)
+			assert.ErrorIs(t, err, auth.ErrInvalidToken)
+		})
+	}
+}
+
+// TestSessionsSurviveRestart tests that SQLite sessions outlive the session manager and database handle
+func TestSessionsSurviveRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "library.db")
+
+	database, err := db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", "hash"))
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+
+	token, err := auth.NewSessionManager(db.NewSessionStore(database)).CreateSession(user.ID, user.Username, "10.0.0.1", "test")
+	require.NoError(t, err)
+	require.NoError(t, database.Close())
+
+	database, err = db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	defer database.Close()
+
+	session, err := auth.NewSessionManager(db.NewSessionStore(database)).ValidateSession(token)
+	require.NoError(t, err)
+	assert.Equal(t, "reader", session.Username)
+}
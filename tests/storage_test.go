@@ -0,0 +1,315 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-memory stand-in for an S3-compatible server such as MinIO.
+// It serves one bucket, pages object listings after pageSize keys and
+// rejects requests that aren't signed with Signature Version 4.
+type fakeS3 struct {
+	url      string
+	bucket   string
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	modTime map[string]time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *storage.S3Store) {
+	t.Helper()
+
+	fake := &fakeS3{bucket: "library", pageSize: 2, objects: map[string][]byte{}, modTime: map[string]time.Time{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+
+	store, err := storage.NewS3Store(storage.S3Config{
+		Endpoint:        server.URL,
+		Bucket:          fake.bucket,
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+	})
+	require.NoError(t, err)
+	return fake, store
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=test-key/") ||
+		!strings.Contains(authorization, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		s.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketPath := "/" + s.bucket
+	if r.URL.Path == bucketPath && r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+		s.list(w, r.URL.Query())
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, bucketPath+"/")
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			s.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = data
+		s.modTime[key] = time.Now().Truncate(time.Second)
+	case "GET", "HEAD":
+		data, ok := s.objects[key]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		// ServeContent handles Range and sets Last-Modified
+		http.ServeContent(w, r, "", s.modTime[key], bytes.NewReader(data))
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// object returns the content stored under key, or nil.
+func (s *fakeS3) object(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[key]
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	type object struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+
+	var keys []string
+	for key := range s.objects {
+		// Continuation tokens are the last key of the previous page
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if len(keys) > s.pageSize {
+		keys = keys[:s.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{Key: key, Size: len(s.objects[key]), LastModified: s.modTime[key].UTC().Format(time.RFC3339)})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// testBlobStore checks the behavior every BlobStore shares.
+func testBlobStore(t *testing.T, store storage.BlobStore) {
+	ctx := context.Background()
+	content := "%PDF-1.4\n0123456789\n%%EOF\n"
+	put := func(key, content string) {
+		t.Helper()
+		require.NoError(t, store.Put(ctx, key, strings.NewReader(content), int64(len(content))))
+	}
+	put("books/1_a.pdf", content)
+	put("books/2_b.pdf", "old")
+	put("books/2_b.pdf", "new")
+	put("covers/1.png", "png")
+	put("empty", "")
+
+	t.Run("Get streams and seeks", func(t *testing.T) {
+		blob, info, err := store.Get(ctx, "books/1_a.pdf")
+		require.NoError(t, err)
+		defer blob.Close()
+		assert.Equal(t, int64(len(content)), info.Size)
+		assert.WithinDuration(t, time.Now(), info.ModTime, time.Minute)
+
+		_, err = blob.Seek(9, io.SeekStart)
+		require.NoError(t, err)
+		buf := make([]byte, 10)
+		_, err = io.ReadFull(blob, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "0123456789", string(buf))
+
+		_, err = blob.Seek(-6, io.SeekEnd)
+		require.NoError(t, err)
+		rest, err := io.ReadAll(blob)
+		require.NoError(t, err)
+		assert.Equal(t, "%%EOF\n", string(rest))
+
+		_, err = blob.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		all, err := io.ReadAll(blob)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(all))
+	})
+
+	t.Run("Put replaces blobs", func(t *testing.T) {
+		blob, _, err := store.Get(ctx, "books/2_b.pdf")
+		require.NoError(t, err)
+		defer blob.Close()
+		data, err := io.ReadAll(blob)
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(data))
+
+		info, err := store.Stat(ctx, "empty")
+		require.NoError(t, err)
+		assert.Zero(t, info.Size)
+	})
+
+	t.Run("List filters by prefix", func(t *testing.T) {
+		blobs, err := store.List(ctx, "books/")
+		require.NoError(t, err)
+		require.Len(t, blobs, 2)
+		assert.Equal(t, "books/1_a.pdf", blobs[0].Key)
+		assert.Equal(t, int64(len(content)), blobs[0].Size)
+		assert.Equal(t, "books/2_b.pdf", blobs[1].Key)
+
+		blobs, err = store.List(ctx, "")
+		require.NoError(t, err)
+		var keys []string
+		for _, blob := range blobs {
+			keys = append(keys, blob.Key)
+		}
+		assert.Equal(t, []string{"books/1_a.pdf", "books/2_b.pdf", "covers/1.png", "empty"}, keys)
+	})
+
+	t.Run("Missing and invalid keys", func(t *testing.T) {
+		_, err := store.Stat(ctx, "books/missing.pdf")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		_, _, err = store.Get(ctx, "books/missing.pdf")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		assert.NoError(t, store.Delete(ctx, "books/missing.pdf"))
+
+		for _, key := range []string{"", "../escape.pdf", "/etc/passwd", "books/../../escape.pdf", `books\a.pdf`} {
+			assert.ErrorIs(t, store.Put(ctx, key, strings.NewReader("x"), 1), storage.ErrInvalidKey, key)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, store.Delete(ctx, "covers/1.png"))
+		_, err := store.Stat(ctx, "covers/1.png")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+}
+
+// TestLocalStore tests storing blobs in a directory
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewLocalStore(filepath.Join(dir, "uploads"))
+
+	blobs, err := store.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Empty(t, blobs, "a store nothing was written to is empty")
+
+	testBlobStore(t, store)
+	assert.NoFileExists(t, filepath.Join(dir, "escape.pdf"))
+}
+
+// TestS3Store tests storing blobs in an S3-compatible bucket
+func TestS3Store(t *testing.T) {
+	fake, store := newFakeS3(t)
+	testBlobStore(t, store)
+
+	t.Run("Requests must be signed", func(t *testing.T) {
+		stranger, err := storage.NewS3Store(storage.S3Config{Endpoint: fake.url, Bucket: fake.bucket, AccessKeyID: "stranger"})
+		require.NoError(t, err)
+		err = stranger.Put(context.Background(), "x", strings.NewReader("x"), 1)
+		assert.ErrorContains(t, err, "AccessDenied")
+	})
+
+	_, err := storage.NewS3Store(storage.S3Config{Endpoint: "localhost:9000", Bucket: "library"})
+	assert.Error(t, err, "endpoints need a scheme")
+	_, err = storage.NewS3Store(storage.S3Config{Endpoint: "http://localhost:9000"})
+	assert.Error(t, err, "a bucket is required")
+}
+
+// TestUploadToS3 tests uploading, serving and deleting PDFs kept in an S3-compatible bucket
+func TestUploadToS3(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	fake, store := newFakeS3(t)
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(store)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	session, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	content := string(testPDF("Stored remotely"))
+	w := uploadPDF(t, libraryHandler, session, "Stored Remotely", "remote.pdf", content)
+	require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+
+	pdfs, err := database.GetAllPDFs()
+	require.NoError(t, err)
+	require.Len(t, pdfs, 1)
+	pdf := pdfs[0]
+	assert.Equal(t, fmt.Sprintf("%d_remote.pdf", admin.ID), pdf.Filename)
+	assert.True(t, strings.HasPrefix(pdf.StorageKey, "sha256/"))
+	assert.Equal(t, content, string(fake.object(pdf.StorageKey)))
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/library/file/%d", pdf.ID), nil)
+	req.Header.Set("Range", "bytes=9-18")
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w = httptest.NewRecorder()
+	libraryHandler.AuthMiddleware(libraryHandler.ServeFile).ServeHTTP(w, req)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, content[9:19], w.Body.String())
+	assert.Equal(t, fmt.Sprintf("bytes 9-18/%d", len(content)), w.Header().Get("Content-Range"))
+
+	w = postForm(libraryHandler.AuthMiddleware(libraryHandler.DeletePDF), "/library/delete", url.Values{"pdf_id": {fmt.Sprint(pdf.ID)}}, session)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	_, err = libraryHandler.ScrubFiles(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, fake.object(pdf.StorageKey))
+}
@@ -0,0 +1,288 @@
+package tests
+
+import (
+	"database/sql"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/mail"
+	"librarymanagementsystem/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postWithCookies(handler http.HandlerFunc, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// setTestSecretBox gives a test database a key to encrypt TOTP secrets with
+func setTestSecretBox(t *testing.T, database *db.Database) {
+	t.Helper()
+	box, err := auth.NewSecretBox(make([]byte, auth.SecretKeySize))
+	require.NoError(t, err)
+	database.SetSecretBox(box)
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name && cookie.MaxAge >= 0 {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// TestTwoFactorLogin tests setting up TOTP and logging in with a code or a recovery code
+func TestTwoFactorLogin(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "library.db")
+	database, err := db.NewDatabase(dbPath)
+	require.NoError(t, err)
+	defer database.Close()
+	setTestSecretBox(t, database)
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+
+	hash, err := auth.HashPassword("password1")
+	require.NoError(t, err)
+	require.NoError(t, database.CreateUser("reader", "reader@example.com", hash))
+	user, err := database.GetUserByUsername("reader")
+	require.NoError(t, err)
+	session, err := sessionManager.CreateSession(user.ID, user.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	// Set up
+	w := postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"setup"}}, session)
+	require.Equal(t, http.StatusOK, w.Code)
+	secret, err := database.GetTOTPSecret(user.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, secret)
+	assert.Contains(t, w.Body.String(), secret)
+
+	req := httptest.NewRequest("GET", "/account/2fa/qr", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	w = httptest.NewRecorder()
+	authHandler.TwoFactorQRCode(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+
+	w = postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"enable"}, "code": {"000000"}}, session)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	now := time.Now()
+	code, err := totp.GenerateCode(secret, now)
+	require.NoError(t, err)
+	w = postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"enable"}, "code": {code}}, session)
+	require.Equal(t, http.StatusOK, w.Code)
+	var recoveryCodes []string
+	for _, match := range regexp.MustCompile(`<code>([a-z2-7]{5}-[a-z2-7]{5})</code>`).FindAllStringSubmatch(w.Body.String(), -1) {
+		recoveryCodes = append(recoveryCodes, match[1])
+	}
+	require.Len(t, recoveryCodes, auth.RecoveryCodeCount)
+
+	user, err = database.GetUserByUsername("reader")
+	require.NoError(t, err)
+	assert.True(t, user.HasTwoFactor())
+
+	// The password alone no longer starts a session
+	login := func() *http.Cookie {
+		t.Helper()
+		w := postForm(authHandler.Login, "/auth/login", url.Values{"username": {"reader"}, "password": {"password1"}}, "")
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "/login/2fa", w.Header().Get("Location"))
+		assert.Nil(t, responseCookie(w, "session_token"))
+		challenge := responseCookie(w, "login_challenge")
+		require.NotNil(t, challenge)
+		return challenge
+	}
+
+	challenge := login()
+	w = postWithCookies(authHandler.LoginTwoFactor, "/login/2fa", url.Values{"code": {code}}, challenge)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "a code can't be used twice")
+
+	next, err := totp.GenerateCode(secret, now.Add(30*time.Second))
+	require.NoError(t, err)
+	w = postWithCookies(authHandler.LoginTwoFactor, "/login/2fa", url.Values{"code": {next}}, challenge)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	assert.NotNil(t, responseCookie(w, "session_token"))
+
+	w = postWithCookies(authHandler.LoginTwoFactor, "/login/2fa", url.Values{"code": {next}}, challenge)
+	assert.Equal(t, "/login", w.Header().Get("Location"), "challenges end with the login")
+
+	t.Run("Recovery codes", func(t *testing.T) {
+		challenge := login()
+		w := postWithCookies(authHandler.LoginTwoFactor, "/login/2fa", url.Values{"code": {strings.ToUpper(recoveryCodes[0])}}, challenge)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+
+		challenge = login()
+		w = postWithCookies(authHandler.LoginTwoFactor, "/login/2fa", url.Values{"code": {recoveryCodes[0]}}, challenge)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "recovery codes are single use")
+
+		remaining, err := database.CountRecoveryCodes(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, auth.RecoveryCodeCount-1, remaining)
+	})
+
+	t.Run("Secrets are encrypted", func(t *testing.T) {
+		raw, err := sql.Open("sqlite3", dbPath)
+		require.NoError(t, err)
+		defer raw.Close()
+		var stored string
+		require.NoError(t, raw.QueryRow(`SELECT totp_secret FROM users WHERE id = ?`, user.ID).Scan(&stored))
+		assert.NotContains(t, stored, secret)
+		assert.True(t, auth.IsSealed(stored))
+
+		other, err := auth.NewSecretBox([]byte(strings.Repeat("k", auth.SecretKeySize)))
+		require.NoError(t, err)
+		_, err = other.Open(stored)
+		assert.ErrorIs(t, err, auth.ErrSecretUndecryptable, "other keys can't decrypt it")
+
+		// Secrets stored in plaintext before encryption are encrypted in place
+		_, err = raw.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, secret, user.ID)
+		require.NoError(t, err)
+		count, err := database.EncryptTOTPSecrets()
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		require.NoError(t, raw.QueryRow(`SELECT totp_secret FROM users WHERE id = ?`, user.ID).Scan(&stored))
+		assert.True(t, auth.IsSealed(stored))
+		decrypted, err := database.GetTOTPSecret(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, secret, decrypted)
+	})
+
+	t.Run("Challenges allow a few attempts", func(t *testing.T) {
+		token := auth.GenerateToken()
+		require.NoError(t, database.CreateLoginChallenge(user.ID, auth.HashToken(token), now))
+		for i := 0; i < 5; i++ {
+			_, err := database.GetLoginChallenge(auth.HashToken(token), now)
+			require.NoError(t, err)
+			require.NoError(t, database.FailLoginChallenge(auth.HashToken(token)))
+		}
+		_, err := database.GetLoginChallenge(auth.HashToken(token), now)
+		assert.ErrorIs(t, err, db.ErrInvalidLoginChallenge)
+
+		require.NoError(t, database.CreateLoginChallenge(user.ID, auth.HashToken(token+"2"), now.Add(-10*time.Minute)))
+		_, err = database.GetLoginChallenge(auth.HashToken(token+"2"), now)
+		assert.ErrorIs(t, err, db.ErrInvalidLoginChallenge, "challenges expire")
+	})
+
+	t.Run("API", func(t *testing.T) {
+		api := handlers.NewAPIHandler(database, sessionManager)
+		apiLogin := func(body string) int {
+			req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			api.Login(w, req)
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusUnauthorized, apiLogin(`{"username": "reader", "password": "password1"}`))
+		assert.Equal(t, http.StatusOK, apiLogin(fmt.Sprintf(`{"username": "reader", "password": "password1", "code": %q}`, recoveryCodes[2])))
+	})
+
+	t.Run("Regenerating recovery codes is audited", func(t *testing.T) {
+		w := postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"recovery-codes"}, "code": {recoveryCodes[3]}}, session)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "Your old recovery codes no longer work.")
+
+		events, _, err := database.GetAuditEvents(db.AuditFilter{Action: models.AuditRecoveryCodes}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "reader", events[0].ActorName)
+		require.NotNil(t, events[0].TargetID)
+		assert.Equal(t, user.ID, *events[0].TargetID)
+
+		remaining, err := database.CountRecoveryCodes(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, auth.RecoveryCodeCount, remaining)
+	})
+}
+
+// TestRoleRequiresTwoFactor tests that members of a role requiring 2FA must set it up before using the library
+func TestRoleRequiresTwoFactor(t *testing.T) {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+	setTestSecretBox(t, database)
+
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	authHandler := handlers.NewAuthHandler(database, sessionManager, mail.NewFileMailer(t.TempDir(), "library@localhost"), handlers.AuthConfig{BaseURL: "http://localhost", RegistrationMode: handlers.RegistrationOpen})
+	adminHandler := handlers.NewAdminHandler(database, sessionManager)
+	library := handlers.NewLibraryHandler(database, sessionManager)
+	api := handlers.NewAPIHandler(database, sessionManager)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	librarian := createUserWithRole(t, database, "librarian", "librarian")
+	adminSession, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+	librarianSession, err := sessionManager.CreateSession(librarian.ID, librarian.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	roles, err := database.GetAllRoles()
+	require.NoError(t, err)
+	roleID := 0
+	for _, role := range roles {
+		if role.Name == "librarian" {
+			roleID = role.ID
+		}
+	}
+	require.NotZero(t, roleID)
+	form := url.Values{"role_id": {fmt.Sprintf("%d", roleID)}, "require_2fa": {"true"}}
+
+	w := postForm(adminHandler.AuthMiddleware(adminHandler.SetRoleTwoFactor), "/admin/roles/2fa", form, librarianSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = postForm(adminHandler.AuthMiddleware(adminHandler.SetRoleTwoFactor), "/admin/roles/2fa", form, adminSession)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+
+	req := httptest.NewRequest("GET", "/library", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: librarianSession})
+	w = httptest.NewRecorder()
+	library.AuthMiddleware(library.Index)(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/account/2fa", w.Header().Get("Location"))
+
+	req = httptest.NewRequest("GET", "/api/v1/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+librarianSession)
+	w = httptest.NewRecorder()
+	api.AuthMiddleware(api.Me)(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Setting it up restores access, and it can't be turned off again
+	w = postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"setup"}}, librarianSession)
+	require.Equal(t, http.StatusOK, w.Code)
+	secret, err := database.GetTOTPSecret(librarian.ID)
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	w = postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"enable"}, "code": {code}}, librarianSession)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", "/library", nil)
+	req.AddCookie(&http.Cookie{Name: "session_token", Value: librarianSession})
+	w = httptest.NewRecorder()
+	library.AuthMiddleware(library.Index)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	next, err := totp.GenerateCode(secret, time.Now().Add(30*time.Second))
+	require.NoError(t, err)
+	w = postForm(authHandler.TwoFactor, "/account/2fa", url.Values{"action": {"disable"}, "code": {next}}, librarianSession)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
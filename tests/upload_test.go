@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"librarymanagementsystem/internal/auth"
+	"librarymanagementsystem/internal/db"
+	"librarymanagementsystem/internal/handlers"
+	"librarymanagementsystem/internal/pdftext"
+	"librarymanagementsystem/internal/storage"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encryptedTestPDF returns a test PDF whose trailer declares it encrypted
+// with the given /Encrypt dictionary
+func encryptedTestPDF(encrypt string) []byte {
+	id := strings.Repeat("ab", 16)
+	trailer := fmt.Sprintf("/Root 1 0 R /ID [<%s> <%s>] /Encrypt %s >>", id, id, encrypt)
+	return bytes.Replace(testPDF("Secret"), []byte("/Root 1 0 R >>"), []byte(trailer), 1)
+}
+
+// TestValidatePDF tests telling readable PDFs apart from other, encrypted and damaged files
+func TestValidatePDF(t *testing.T) {
+	validate := func(content []byte) error {
+		return pdftext.Validate(bytes.NewReader(content), int64(len(content)))
+	}
+	hash := strings.Repeat("cd", 32)
+
+	assert.NoError(t, validate(testPDF("One page")))
+	assert.NoError(t, validate(testPDF("First page", "Second page")))
+
+	assert.ErrorIs(t, validate([]byte("plain text")), pdftext.ErrNotPDF)
+	assert.ErrorIs(t, validate(nil), pdftext.ErrNotPDF)
+
+	assert.ErrorIs(t, validate(encryptedTestPDF(fmt.Sprintf("<< /Filter /Standard /V 2 /R 3 /Length 128 /O <%s> /U <%s> /P -4 >>", hash, hash))), pdftext.ErrEncrypted)
+	assert.ErrorIs(t, validate(encryptedTestPDF("<< /Filter /Standard /V 5 /R 6 /Length 256 >>")), pdftext.ErrEncrypted, "unsupported encryption is still encryption")
+
+	valid := testPDF("Truncated")
+	assert.ErrorIs(t, validate(valid[:len(valid)/2]), pdftext.ErrMalformed)
+	assert.ErrorIs(t, validate(bytes.Replace(valid, []byte("xref"), []byte("xxxx"), 1)), pdftext.ErrMalformed)
+	assert.ErrorIs(t, validate(testPDF()), pdftext.ErrMalformed, "PDFs need at least one page")
+}
+
+// TestUploadValidation tests that uploads are streamed into quarantine and only stored once they pass the checks
+func TestUploadValidation(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.NewDatabase(filepath.Join(dir, "library.db"))
+	require.NoError(t, err)
+	defer database.Close()
+
+	quarantine := filepath.Join(dir, "quarantine")
+	store := storage.NewLocalStore(filepath.Join(dir, "uploads"))
+	sessionManager := auth.NewSessionManager(auth.NewMemorySessionStore())
+	libraryHandler := handlers.NewLibraryHandler(database, sessionManager)
+	libraryHandler.SetBlobStore(store)
+	libraryHandler.SetUploadConfig(handlers.UploadConfig{MaxSize: 4 << 10, QuarantineDir: quarantine})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/library/upload", libraryHandler.AuthMiddleware(libraryHandler.UploadPDF))
+	handler := handlers.CSRFMiddleware(mux)
+
+	admin := createUserWithRole(t, database, "admin", "admin")
+	session, err := sessionManager.CreateSession(admin.ID, admin.Username, "127.0.0.1", "test")
+	require.NoError(t, err)
+
+	// upload posts the upload form the way a browser does, CSRF token first
+	upload := func(token, filename string, content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("csrf_token", token)
+		form.WriteField("title", "Uploaded")
+		part, err := form.CreateFormFile("file", filename)
+		require.NoError(t, err)
+		part.Write(content)
+		require.NoError(t, form.Close())
+
+		req := httptest.NewRequest("POST", "/library/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	token := auth.CSRFToken(session)
+
+	// assertNothingStored checks that a rejected upload left no file behind
+	assertNothingStored := func(t *testing.T) {
+		pdfs, err := database.GetAllPDFs()
+		require.NoError(t, err)
+		assert.Empty(t, pdfs)
+		quarantined, err := os.ReadDir(quarantine)
+		if err == nil {
+			assert.Empty(t, quarantined)
+		}
+		_, err = os.Stat(filepath.Join(dir, "uploads"))
+		assert.True(t, os.IsNotExist(err), "rejected files never reach the blob store")
+	}
+
+	t.Run("Forged uploads are rejected", func(t *testing.T) {
+		w := upload(auth.CSRFToken("another session"), "book.pdf", testPDF("Forged"))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assertNothingStored(t)
+	})
+
+	t.Run("Files that aren't PDFs are rejected", func(t *testing.T) {
+		w := upload(token, "notes.pdf", []byte("plain text"))
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		assert.Contains(t, w.Body.String(), "Only PDF files are allowed")
+		assertNothingStored(t)
+	})
+
+	t.Run("Encrypted PDFs are rejected", func(t *testing.T) {
+		w := upload(token, "secret.pdf", encryptedTestPDF("<< /Filter /Standard /V 5 /R 6 /Length 256 >>"))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "Encrypted or password-protected PDFs can't be uploaded")
+		assertNothingStored(t)
+	})
+
+	t.Run("Damaged PDFs are rejected", func(t *testing.T) {
+		valid := testPDF("Damaged")
+		w := upload(token, "damaged.pdf", valid[:len(valid)-40])
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "The PDF is damaged and can't be read")
+		assertNothingStored(t)
+	})
+
+	t.Run("Files over the size limit are rejected", func(t *testing.T) {
+		pages := make([]string, 40)
+		for i := range pages {
+			pages[i] = fmt.Sprintf("Page %d", i+1)
+		}
+		w := upload(token, "long.pdf", testPDF(pages...))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), "The file is larger than the upload limit of 4 KB")
+		assertNothingStored(t)
+	})
+
+	t.Run("File names are sanitized", func(t *testing.T) {
+		w := upload(token, `..\..\My "Best" Book<script>.PDF`, testPDF("Sanitized"))
+		require.Equal(t, http.StatusSeeOther, w.Code, w.Body.String())
+
+		pdfs, err := database.GetAllPDFs()
+		require.NoError(t, err)
+		require.Len(t, pdfs, 1)
+		assert.Equal(t, fmt.Sprintf("%d_My_Best_Book_script.pdf", admin.ID), pdfs[0].Filename)
+
+		quarantined, err := os.ReadDir(quarantine)
+		require.NoError(t, err)
+		assert.Empty(t, quarantined, "accepted files leave quarantine")
+		_, err = os.Stat(filepath.Join(dir, "uploads", filepath.FromSlash(pdfs[0].StorageKey)))
+		assert.NoError(t, err)
+	})
+}